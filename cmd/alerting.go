@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/michaelprice232/eks-env-scaledown/internal/notify"
+	"github.com/michaelprice232/eks-env-scaledown/internal/report"
+	"github.com/michaelprice232/eks-env-scaledown/internal/service"
+	"github.com/michaelprice232/eks-env-scaledown/internal/state"
+	"github.com/michaelprice232/eks-env-scaledown/internal/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// alerting holds the clients for the alerting integrations which are muted whilst the environment is
+// scaled down. A nil client means the integration is not configured.
+type alerting struct {
+	cloudwatch   *notify.CloudwatchClient
+	newRelic     *notify.NewRelicClient
+	pagerDuty    *notify.PagerDutyClient
+	alertmanager *notify.AlertmanagerClient
+	grafana      *notify.AlertmanagerClient
+	datadog      *notify.DatadogClient
+
+	// store carries silence, downtime and maintenance window IDs, and the alarms which were already
+	// disabled, from the scale down to the scale up
+	store *state.Store
+}
+
+// newAlerting creates the client for each alerting integration configured through envars.
+func newAlerting(ctx context.Context) (*alerting, error) {
+	var (
+		a   alerting
+		err error
+	)
+
+	if a.cloudwatch, err = notify.NewCloudwatchClient(ctx); err != nil {
+		return nil, fmt.Errorf("creating Cloudwatch client: %w", err)
+	}
+
+	if a.newRelic, err = notify.NewNewRelicClient(); err != nil {
+		return nil, fmt.Errorf("creating New Relic client: %w", err)
+	}
+
+	if a.pagerDuty, err = notify.NewPagerDutyClient(); err != nil {
+		return nil, fmt.Errorf("creating PagerDuty client: %w", err)
+	}
+
+	if a.alertmanager, err = notify.NewAlertmanagerClient(); err != nil {
+		return nil, fmt.Errorf("creating Alertmanager client: %w", err)
+	}
+
+	if a.grafana, err = notify.NewGrafanaClient(); err != nil {
+		return nil, fmt.Errorf("creating Grafana client: %w", err)
+	}
+
+	if a.datadog, err = notify.NewDatadogClient(); err != nil {
+		return nil, fmt.Errorf("creating Datadog client: %w", err)
+	}
+
+	return &a, nil
+}
+
+// update mutes (ScaleDown) or unmutes (ScaleUp) every configured integration, stopping at the first failure.
+func (a *alerting) update(ctx context.Context, rep *report.Report, s *service.Service, action notify.ScaleAction) error {
+	cloudwatchAction, cloudwatchVerb := "disable", "disabling"
+	if action == notify.ScaleUp {
+		cloudwatchAction, cloudwatchVerb = "enable", "enabling"
+	}
+
+	if err := updateCloudwatchAlarms(ctx, rep, a.cloudwatch, a.store, cloudwatchAction); err != nil {
+		return fmt.Errorf("%s Cloudwatch alarms: %w", cloudwatchVerb, err)
+	}
+
+	if err := updateNewRelicAlertPolicy(ctx, rep, a.newRelic, a.store, action); err != nil {
+		return fmt.Errorf("updating New Relic: %w", err)
+	}
+
+	if err := updatePagerDutyMaintenanceWindow(ctx, rep, a.pagerDuty, a.store, action); err != nil {
+		return fmt.Errorf("updating PagerDuty: %w", err)
+	}
+
+	if err := updateAlertmanagerSilences(ctx, rep, a.alertmanager, a.store, s, action); err != nil {
+		return fmt.Errorf("updating Alertmanager: %w", err)
+	}
+
+	if err := updateAlertmanagerSilences(ctx, rep, a.grafana, a.store, s, action); err != nil {
+		return fmt.Errorf("updating Grafana: %w", err)
+	}
+
+	if err := updateDatadogDowntime(ctx, rep, a.datadog, a.store, action); err != nil {
+		return fmt.Errorf("updating Datadog: %w", err)
+	}
+
+	return nil
+}
+
+// updateCloudwatchAlarms enables or disables the Cloudwatch alarms, recording the updated alarms in rep along
+// with those left alone because their actions were disabled before the scale down. Every batch of alarms is
+// attempted in every region and account, with the alarms which could not be updated returned in the error.
+func updateCloudwatchAlarms(ctx context.Context, rep *report.Report, cwClient *notify.CloudwatchClient, store *state.Store, action string) error {
+	ctx, span := tracing.Start(ctx, "update Cloudwatch alarms", attribute.String("action", action))
+	results, err := notify.UpdateCloudwatchAlarms(ctx, cwClient, store, action)
+
+	updated := notify.AlarmsWithStatus(results, notify.AlarmUpdated)
+	skipped := notify.AlarmsWithStatus(results, notify.AlarmSkipped)
+	failed := notify.AlarmsWithStatus(results, notify.AlarmFailed)
+	if len(failed) > 0 {
+		err = errors.Join(err, fmt.Errorf("unable to %s %d alarm(s): %s", action, len(failed), strings.Join(failed, ", ")))
+	}
+
+	span.SetAttributes(attribute.Int("alarms", len(updated)), attribute.Int("skipped", len(skipped)), attribute.Int("failed", len(failed)))
+	tracing.End(span, err)
+	if len(updated) > 0 {
+		rep.AddAlerting(report.AlertingAction{Integration: "cloudwatch", Action: action, Targets: updated})
+	}
+	for _, name := range skipped {
+		rep.AddSkipped(report.Skipped{Kind: "cloudwatch-alarm", Name: name, Reason: "actions disabled before the scale down"})
+	}
+
+	return err
+}
+
+// updateNewRelicAlertPolicy mutes or unmutes the New Relic alert policies and synthetic monitors, recording
+// the policies (and the muting rule's tags) and the monitors in rep.
+func updateNewRelicAlertPolicy(ctx context.Context, rep *report.Report, nrClient *notify.NewRelicClient, store *state.Store, action notify.ScaleAction) error {
+	ctx, span := tracing.Start(ctx, "update New Relic alert policies", attribute.String("action", string(action)))
+	result, err := notify.UpdateNewRelicAlertPolicy(ctx, nrClient, store, action)
+	span.SetAttributes(attribute.Int("policies", len(result.PolicyIDs)), attribute.Int("monitors", len(result.Monitors)))
+	tracing.End(span, err)
+	if err != nil {
+		return err
+	}
+
+	if nrClient != nil {
+		targets := make([]string, 0, len(result.PolicyIDs)+len(nrClient.MutingTags))
+		for _, id := range result.PolicyIDs {
+			targets = append(targets, strconv.Itoa(id))
+		}
+		for _, key := range slices.Sorted(maps.Keys(nrClient.MutingTags)) {
+			targets = append(targets, key+"="+nrClient.MutingTags[key])
+		}
+		rep.AddAlerting(report.AlertingAction{Integration: "newrelic", Action: string(action), Targets: targets})
+	}
+
+	if len(result.Monitors) > 0 {
+		rep.AddAlerting(report.AlertingAction{Integration: "newrelic-synthetics", Action: string(action), Targets: result.Monitors})
+	}
+
+	return nil
+}
+
+// updatePagerDutyMaintenanceWindow opens or ends the PagerDuty maintenance window, recording the covered services in rep.
+func updatePagerDutyMaintenanceWindow(ctx context.Context, rep *report.Report, pdClient *notify.PagerDutyClient, store *state.Store, action notify.ScaleAction) error {
+	ctx, span := tracing.Start(ctx, "update PagerDuty maintenance window", attribute.String("action", string(action)))
+	err := notify.UpdatePagerDutyMaintenanceWindow(ctx, pdClient, store, action)
+	tracing.End(span, err)
+	if err != nil {
+		return err
+	}
+
+	if pdClient != nil {
+		rep.AddAlerting(report.AlertingAction{Integration: "pagerduty", Action: string(action), Targets: pdClient.ServiceIDs})
+	}
+
+	return nil
+}
+
+// updateAlertmanagerSilences creates or expires the silences in Alertmanager (or an Alertmanager-compatible
+// API such as Grafana's), recording their matchers in rep.
+// When no matchers are configured the scale down silences the namespaces of the workloads s scales.
+func updateAlertmanagerSilences(ctx context.Context, rep *report.Report, amClient *notify.AlertmanagerClient, store *state.Store, s *service.Service, action notify.ScaleAction) error {
+	if amClient == nil {
+		return nil
+	}
+
+	ctx, span := tracing.Start(ctx, fmt.Sprintf("update %s silences", amClient.Name()), attribute.String("action", string(action)))
+	var err error
+	defer func() { tracing.End(span, err) }()
+
+	var namespaces []string
+	if action == notify.ScaleDown && len(amClient.Silences) == 0 {
+		if namespaces, err = s.TargetNamespaces(ctx); err != nil {
+			return fmt.Errorf("finding the namespaces to silence: %w", err)
+		}
+	}
+
+	if err = notify.UpdateAlertmanagerSilences(ctx, amClient, store, action, namespaces); err != nil {
+		return err
+	}
+
+	targets := namespaces
+	for _, matchers := range amClient.Silences {
+		targets = append(targets, fmt.Sprint(matchers))
+	}
+	rep.AddAlerting(report.AlertingAction{Integration: strings.ToLower(amClient.Name()), Action: string(action), Targets: targets})
+
+	return nil
+}
+
+// updateDatadogDowntime schedules or cancels the Datadog downtime, recording its scope in rep.
+func updateDatadogDowntime(ctx context.Context, rep *report.Report, ddClient *notify.DatadogClient, store *state.Store, action notify.ScaleAction) error {
+	ctx, span := tracing.Start(ctx, "update Datadog downtime", attribute.String("action", string(action)))
+	err := notify.UpdateDatadogDowntime(ctx, ddClient, store, action)
+	tracing.End(span, err)
+	if err != nil {
+		return err
+	}
+
+	if ddClient != nil {
+		rep.AddAlerting(report.AlertingAction{Integration: "datadog", Action: string(action), Targets: []string{ddClient.Scope}})
+	}
+
+	return nil
+}
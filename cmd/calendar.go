@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	log "log/slog"
+	"time"
+
+	"github.com/michaelprice232/eks-env-scaledown/config"
+	"github.com/michaelprice232/eks-env-scaledown/internal/calendar"
+	"github.com/michaelprice232/eks-env-scaledown/internal/report"
+)
+
+// consultCalendar decides from the calendar of dated overrides whether the run goes ahead, recording the decision in
+// rep. A deferred run doesn't go ahead, leaving a later scheduled run after its time to act, as a keep-alive does. A
+// calendar which can't be read is logged and the run goes ahead, so an unavailable calendar doesn't stop the
+// environment being scaled.
+func consultCalendar(ctx context.Context, c config.Config, rep *report.Report) (proceed bool, err error) {
+	cal, err := calendar.New(ctx, c.K8sClient, c.Namespace)
+	if err != nil {
+		log.Warn("Problem reading the calendar. Continuing with the run", "error", err)
+		return true, nil
+	}
+	if cal == nil {
+		return true, nil
+	}
+
+	decision := cal.Decide(c.Action, time.Now())
+	rep.SetCalendar(decision.Decision, decision.Reason, decision.Until)
+
+	switch decision.Decision {
+	case calendar.DecisionSkip:
+		log.Info("Skipping the run as the calendar says so", "action", c.Action, "reason", decision.Reason)
+		return false, nil
+
+	case calendar.DecisionDefer:
+		log.Info("Deferring the run as the calendar says so. A later run will go ahead", "action", c.Action, "reason", decision.Reason, "until", decision.Until)
+		return false, nil
+
+	default:
+		log.Info("No calendar override applies. Continuing with the run", "action", c.Action, "overrides", len(cal.Overrides))
+	}
+
+	return true, nil
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/michaelprice232/eks-env-scaledown/config"
+	"github.com/michaelprice232/eks-env-scaledown/internal/controller"
+)
+
+// runController scales the environment on its schedules until ctx is cancelled, calling scaleFn for each run.
+func runController(ctx context.Context, scaleFn controller.RunFunc) error {
+	conf, err := controller.NewConfig()
+	if err != nil {
+		return fmt.Errorf("creating controller config: %w", err)
+	}
+
+	client, err := config.NewK8sClient()
+	if err != nil {
+		return fmt.Errorf("creating k8s client: %w", err)
+	}
+
+	return controller.New(conf, client, scaleFn).Run(ctx)
+}
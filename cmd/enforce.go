@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	log "log/slog"
+	"time"
+
+	"github.com/michaelprice232/eks-env-scaledown/config"
+	"github.com/michaelprice232/eks-env-scaledown/internal/report"
+	"github.com/michaelprice232/eks-env-scaledown/internal/service"
+	"github.com/michaelprice232/eks-env-scaledown/internal/state"
+)
+
+// environmentStateKey is set in the state whilst the environment is scaled down, holding when it was. Enforce runs
+// only act whilst it is set, so they never fight a scale up.
+const environmentStateKey = "environment-scaled-down"
+
+// markScaledDown records in the state that the environment is scaled down. A failure is logged rather than failing
+// the scale down, leaving the enforce runs idle until the next one.
+func markScaledDown(ctx context.Context, store *state.Store) {
+	if err := store.Set(ctx, environmentStateKey, time.Now().UTC().Format(time.RFC3339)); err != nil {
+		log.Warn("Problem recording that the environment is scaled down. Its scale down won't be enforced", "error", err)
+	}
+}
+
+// markScaledUp clears the record that the environment is scaled down, before anything is scaled up.
+func markScaledUp(ctx context.Context, store *state.Store) error {
+	if err := store.Delete(ctx, environmentStateKey); err != nil {
+		return fmt.Errorf("clearing the environment's scaled down state: %w", err)
+	}
+
+	return nil
+}
+
+// enforce re-applies the scale down to the workloads which have drifted back up, recording each one in rep. Nothing
+// is done unless the environment is scaled down, or whilst the whole environment is kept alive.
+func enforce(ctx context.Context, c config.Config, rep *report.Report, store *state.Store) error {
+	since, found, err := store.Get(ctx, environmentStateKey)
+	if err != nil {
+		return fmt.Errorf("getting the environment's scaled down state: %w", err)
+	}
+	if !found {
+		log.Info("The environment isn't scaled down. Nothing to enforce")
+		return nil
+	}
+
+	s, err := service.NewService(c, rep)
+	if err != nil {
+		return fmt.Errorf("creating service: %w", err)
+	}
+
+	until, err := s.EnvironmentKeptAlive(ctx)
+	if err != nil {
+		return fmt.Errorf("checking the cluster-wide keep-alive: %w", err)
+	}
+	if !until.IsZero() {
+		log.Info("The environment is kept alive. Not enforcing its scale down", "until", until)
+		return nil
+	}
+
+	log.Info("Enforcing the scale down of the environment", "scaledDownAt", since)
+	start := time.Now()
+	err = s.Run(ctx)
+	rep.AddPhase("enforce", time.Since(start))
+	if err != nil {
+		return fmt.Errorf("running: %w", err)
+	}
+
+	return nil
+}
+
+// quietRun reports whether the outcome of a successful run is left unnotified, as enforce runs are frequent and
+// usually find nothing. An enforce run which found drift is still notified.
+func quietRun(rep *report.Report) bool {
+	return rep.Action == string(config.Enforce) && len(rep.Drift) == 0
+}
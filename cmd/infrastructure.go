@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/michaelprice232/eks-env-scaledown/config"
+	"github.com/michaelprice232/eks-env-scaledown/internal/cloud"
+	"github.com/michaelprice232/eks-env-scaledown/internal/report"
+	"github.com/michaelprice232/eks-env-scaledown/internal/service"
+	"github.com/michaelprice232/eks-env-scaledown/internal/state"
+	"github.com/michaelprice232/eks-env-scaledown/internal/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// stopDatabases stops the tagged RDS databases once the workloads using them are down, recording each one in rep.
+func stopDatabases(ctx context.Context, rep *report.Report, rdsClient *cloud.RDSClient, store *state.Store) (err error) {
+	if rdsClient == nil {
+		return nil
+	}
+
+	ctx, span := tracing.Start(ctx, "stop databases")
+	defer func() { tracing.End(span, err) }()
+
+	start := time.Now()
+	changes, err := rdsClient.StopDatabases(ctx, store)
+	recordDatabaseChanges(rep, changes)
+	span.SetAttributes(attribute.Int("databases", len(changes)))
+	rep.AddPhase("stop-databases", time.Since(start))
+
+	return err
+}
+
+// startDatabases starts the RDS databases stopped by the scale down and waits for them to become available, so they
+// are ready before the first startup group is scaled up.
+func startDatabases(ctx context.Context, rep *report.Report, rdsClient *cloud.RDSClient, store *state.Store) (err error) {
+	if rdsClient == nil {
+		return nil
+	}
+
+	ctx, span := tracing.Start(ctx, "start databases")
+	defer func() { tracing.End(span, err) }()
+
+	start := time.Now()
+	changes, err := rdsClient.StartDatabases(ctx, store)
+	recordDatabaseChanges(rep, changes)
+	span.SetAttributes(attribute.Int("databases", len(changes)))
+	rep.AddPhase("start-databases", time.Since(start))
+
+	return err
+}
+
+func recordDatabaseChanges(rep *report.Report, changes []cloud.DatabaseChange) {
+	for _, c := range changes {
+		if c.Change == "skipped" {
+			rep.AddSkipped(report.Skipped{Kind: c.Kind, Name: c.ID, Reason: c.Reason})
+			continue
+		}
+		rep.AddInfrastructure(c.Kind, c.ID, c.Change)
+	}
+}
+
+// scaleDownNodeGroups scales the selected node groups to zero once every pod has been terminated, recording each
+// one in rep. The node groups running the pods s left up, such as those of reduced workloads, are skipped.
+func scaleDownNodeGroups(ctx context.Context, rep *report.Report, nodeGroups *cloud.NodeGroupClient, store *state.Store, s *service.Service) (err error) {
+	if nodeGroups == nil {
+		return nil
+	}
+
+	ctx, span := tracing.Start(ctx, "scale down node groups")
+	defer func() { tracing.End(span, err) }()
+
+	inUse, err := s.NodesInUse(ctx)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	changes, err := nodeGroups.ScaleDownNodeGroups(ctx, store, inUse)
+	recordNodeGroupChanges(rep, changes)
+	span.SetAttributes(attribute.Int("nodeGroups", len(changes)))
+	rep.AddPhase("scale-down-node-groups", time.Since(start))
+
+	return err
+}
+
+// restoreNodeGroups restores the node groups scaled to zero by the scale down and waits for their nodes to be Ready,
+// so the first startup group has somewhere to run.
+func restoreNodeGroups(ctx context.Context, rep *report.Report, nodeGroups *cloud.NodeGroupClient, store *state.Store) (err error) {
+	if nodeGroups == nil {
+		return nil
+	}
+
+	ctx, span := tracing.Start(ctx, "restore node groups")
+	defer func() { tracing.End(span, err) }()
+
+	start := time.Now()
+	changes, err := nodeGroups.RestoreNodeGroups(ctx, store)
+	recordNodeGroupChanges(rep, changes)
+	span.SetAttributes(attribute.Int("nodeGroups", len(changes)))
+	rep.AddPhase("restore-node-groups", time.Since(start))
+
+	return err
+}
+
+func recordNodeGroupChanges(rep *report.Report, changes []cloud.NodeGroupChange) {
+	for _, c := range changes {
+		if c.Change == "skipped" {
+			rep.AddSkipped(report.Skipped{Kind: c.Kind, Name: c.Name, Reason: c.Reason})
+			continue
+		}
+		rep.AddInfrastructure(c.Kind, c.Name, fmt.Sprintf("%s (min %d, desired %d)", c.Change, c.MinSize, c.Desired))
+	}
+}
+
+// registerExternalResources stops and starts the external resources plugins around the startup group each one
+// belongs to, recording the changes in rep.
+func registerExternalResources(s *service.Service, rep *report.Report, external *cloud.ExternalResources) {
+	if external == nil {
+		return
+	}
+
+	s.AfterScaleDownGroup(func(ctx context.Context, group int) error {
+		changes, err := external.StopAfterGroup(ctx, group, s.KeptAliveGroups())
+		recordResourceChanges(rep, changes)
+		return err
+	})
+	s.BeforeScaleUpGroup(func(ctx context.Context, group int) error {
+		changes, err := external.StartBeforeGroup(ctx, group)
+		recordResourceChanges(rep, changes)
+		return err
+	})
+}
+
+// finishExternalResources stops (ScaleDown) or starts (ScaleUp) the external resources which weren't handled around
+// a startup group, such as those outside the startup groups when stopping, or belonging to a group after the last.
+func finishExternalResources(ctx context.Context, rep *report.Report, external *cloud.ExternalResources, action config.ScaleAction) (err error) {
+	if external == nil {
+		return nil
+	}
+
+	ctx, span := tracing.Start(ctx, "update external resources", attribute.String("action", string(action)))
+	defer func() { tracing.End(span, err) }()
+
+	var changes []cloud.ResourceChange
+	if action == config.ScaleDown {
+		changes, err = external.StopRemaining(ctx)
+	} else {
+		changes, err = external.StartRemaining(ctx)
+	}
+	recordResourceChanges(rep, changes)
+	span.SetAttributes(attribute.Int("resources", len(changes)))
+
+	return err
+}
+
+func recordResourceChanges(rep *report.Report, changes []cloud.ResourceChange) {
+	for _, c := range changes {
+		if c.Change == "skipped" {
+			rep.AddSkipped(report.Skipped{Kind: c.Kind, Name: c.ID, Reason: c.Reason})
+			continue
+		}
+		rep.AddInfrastructure(c.Kind, c.ID, c.Change)
+	}
+}
@@ -3,78 +3,301 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	log "log/slog"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/michaelprice232/eks-env-scaledown/config"
+	"github.com/michaelprice232/eks-env-scaledown/internal/cloud"
+	"github.com/michaelprice232/eks-env-scaledown/internal/metrics"
 	"github.com/michaelprice232/eks-env-scaledown/internal/notify"
+	"github.com/michaelprice232/eks-env-scaledown/internal/report"
 	"github.com/michaelprice232/eks-env-scaledown/internal/service"
+	"github.com/michaelprice232/eks-env-scaledown/internal/state"
+	"github.com/michaelprice232/eks-env-scaledown/internal/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// The RUN_MODE values which run a long-running mode instead of a single scale run.
+const (
+	runModeWaker      = "waker"
+	runModeController = "controller"
 )
 
 func main() {
 	config.SetupLogging()
 
-	slackClient := notify.NewSlackClient()
+	mode := os.Getenv("RUN_MODE")
+	if mode == runModeWaker {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		if err := runWaker(ctx); err != nil {
+			log.Error("running the waker", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	notifier, err := notify.NewDispatcher()
+	if err != nil {
+		log.Warn("Problem configuring notifications. Continuing with the remaining notifiers", "error", err)
+	}
+	pusher := metrics.NewPusher()
+
+	ctx := context.Background()
+	shutdownTracing, err := tracing.Setup(ctx)
+	if err != nil {
+		log.Warn("Unable to set up tracing. Continuing without it", "error", err)
+		shutdownTracing = func(context.Context) error { return nil }
+	}
+
+	if mode == runModeController {
+		signalCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+		err = runController(signalCtx, func(ctx context.Context, action config.ScaleAction) error {
+			return scale(ctx, notifier, pusher, string(action))
+		})
+		stop()
+		if err != nil {
+			log.Error("running the controller", "error", err)
+		}
+	} else {
+		err = scale(ctx, notifier, pusher, os.Getenv("SCALE_ACTION"))
+	}
+
+	// Flush the spans before exiting the process
+	if shutdownErr := shutdownTracing(ctx); shutdownErr != nil {
+		log.Warn("Problem flushing traces", "error", shutdownErr)
+	}
+
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+// scale runs a single scale up or down, notifying of its start, the completion of each group and its outcome.
+// Enforce runs are only notified of their outcome, when they found drift or failed.
+func scale(ctx context.Context, notifier *notify.Dispatcher, pusher *metrics.Pusher, action string) error {
+	rep := report.New(action)
+	if config.ScaleAction(action) != config.Enforce {
+		notifier.Started(ctx, rep)
+	}
+	rep.OnGroup(func(g report.Group) { notifier.GroupCompleted(ctx, rep, g) })
+
+	if err := run(ctx, rep, pusher); err != nil {
+		reportError(ctx, notifier, rep, err)
+		return err
+	}
 
-	if err := run(); err != nil {
-		reportError(slackClient, err)
+	if !quietRun(rep) {
+		notifier.Finished(ctx, rep, nil)
 	}
+	return nil
 }
 
 // run performs the full scale up/down workflow, returning a wrapped error on the
 // first failure. Keeping the logic out of main() makes it testable and confines
-// the os.Exit to a single place.
-func run() error {
-	nrClient, err := notify.NewNewRelicClient()
+// the os.Exit to a single place. The outcome is recorded in rep, which is published
+// (along with the metrics, if a Pushgateway is configured) before returning on every path.
+func run(ctx context.Context, rep *report.Report, pusher *metrics.Pusher) (err error) {
+	var c config.Config
+
+	ctx, span := tracing.Start(ctx, "run", attribute.String("run.id", rep.RunID), attribute.String("action", rep.Action))
+	defer func() {
+		tracing.End(span, err)
+		publishReport(c, rep, pusher, err)
+	}()
+
+	alerts, err := newAlerting(ctx)
+	if err != nil {
+		return err
+	}
+
+	rdsClient, err := cloud.NewRDSClient(ctx)
 	if err != nil {
-		return fmt.Errorf("creating New Relic client: %w", err)
+		return fmt.Errorf("creating RDS client: %w", err)
 	}
 
-	c, err := config.NewConfig()
+	c, err = config.NewConfigFor(config.ScaleAction(rep.Action))
 	if err != nil {
 		return fmt.Errorf("creating config: %w", err)
 	}
+	store := state.New(c.K8sClient, c.Namespace)
+	alerts.store = store
 
-	if c.Action == config.ScaleDown {
-		if err = notify.UpdateCloudwatchAlarms("disable"); err != nil {
-			return fmt.Errorf("disabling Cloudwatch alarms: %w", err)
-		}
+	// Enforce runs leave the calendar, alerting and infrastructure alone, only scaling down the drifted workloads
+	if c.Action == config.Enforce {
+		return enforce(ctx, c, rep, store)
+	}
+
+	proceed, err := consultCalendar(ctx, c, rep)
+	if err != nil || !proceed {
+		return err
+	}
 
-		if err = notify.UpdateNewRelicAlertPolicy(nrClient, notify.ScaleDown); err != nil {
-			return fmt.Errorf("updating New Relic: %w", err)
+	// Save the report as the run starts and as each group completes, so the waker can show the run's progress
+	saveProgress := func() {
+		if err := rep.Save(c.K8sClient, c.Namespace, c.ReportHistoryLimit); err != nil {
+			log.Warn("Problem saving the run's progress to the history ConfigMap", "error", err)
 		}
 	}
+	saveProgress()
+	rep.OnGroup(func(report.Group) { saveProgress() })
+
+	nodeGroups, err := cloud.NewNodeGroupClient(ctx, c.K8sClient)
+	if err != nil {
+		return fmt.Errorf("creating node group client: %w", err)
+	}
+
+	external, err := cloud.NewExternalResources(ctx, store)
+	if err != nil {
+		return fmt.Errorf("creating external resources: %w", err)
+	}
 
-	s, err := service.NewService(c)
+	s, err := service.NewService(c, rep)
 	if err != nil {
 		return fmt.Errorf("creating service: %w", err)
 	}
+	registerExternalResources(s, rep, external)
+
+	// A cluster-wide keep-alive postpones the whole scale down, until a later scheduled run after it has expired
+	if c.Action == config.ScaleDown {
+		until, err := s.EnvironmentKeptAlive(ctx)
+		if err != nil {
+			return fmt.Errorf("checking the cluster-wide keep-alive: %w", err)
+		}
+		if !until.IsZero() {
+			log.Info("The environment is kept alive. Postponing the scale down until a later run", "until", until)
+			return nil
+		}
+	}
+
+	if c.Action == config.ScaleDown {
+		start := time.Now()
+		if err = alerts.update(ctx, rep, s, notify.ScaleDown); err != nil {
+			return err
+		}
+		rep.AddPhase("disable-alerts", time.Since(start))
+	}
+
+	// The nodes and databases are back before the first startup group, so the workloads can run and connect as they come up
+	if c.Action == config.ScaleUp {
+		if err = markScaledUp(ctx, store); err != nil {
+			return err
+		}
+		if err = restoreNodeGroups(ctx, rep, nodeGroups, store); err != nil {
+			return fmt.Errorf("restoring node groups: %w", err)
+		}
+		if err = startDatabases(ctx, rep, rdsClient, store); err != nil {
+			return fmt.Errorf("starting databases: %w", err)
+		}
+	}
+
+	// In continue-on-error mode a partial failure still completes the alerting steps below,
+	// with the collected failures returned once the run has finished
+	start := time.Now()
+	runErr := s.Run(ctx)
+	rep.AddPhase("scale", time.Since(start))
+	var failures *service.FailuresError
+	if runErr != nil && !errors.As(runErr, &failures) {
+		return fmt.Errorf("running: %w", runErr)
+	}
+
+	if c.Action == config.ScaleDown {
+		markScaledDown(ctx, store)
 
-	if err = s.Run(); err != nil {
-		return fmt.Errorf("running: %w", err)
+		// Workloads which failed to scale down may still be using the external resources, databases and nodes
+		if runErr != nil {
+			log.Warn("Leaving the remaining external resources, databases and node groups running as not every workload was scaled down")
+		} else if until := s.KeptAliveUntil(); !until.IsZero() {
+			log.Info("Leaving the external resources, databases and node groups running as some workloads are kept alive. A later run will scale them down", "until", until)
+		} else {
+			if err = finishExternalResources(ctx, rep, external, c.Action); err != nil {
+				return fmt.Errorf("stopping external resources: %w", err)
+			}
+			if err = stopDatabases(ctx, rep, rdsClient, store); err != nil {
+				return fmt.Errorf("stopping databases: %w", err)
+			}
+			if err = scaleDownNodeGroups(ctx, rep, nodeGroups, store, s); err != nil {
+				return fmt.Errorf("scaling down node groups: %w", err)
+			}
+		}
 	}
 
 	if c.Action == config.ScaleUp {
+		if err = finishExternalResources(ctx, rep, external, c.Action); err != nil {
+			return fmt.Errorf("starting external resources: %w", err)
+		}
+
 		// Delay re-enabling alerts to allow the services to stabilize first
 		log.Info("Waiting for services to stabilize before enabling alerts", "delay", c.AlertStabilizationDelay)
-		time.Sleep(c.AlertStabilizationDelay)
-
-		if err = notify.UpdateCloudwatchAlarms("enable"); err != nil {
-			return fmt.Errorf("enabling Cloudwatch alarms: %w", err)
+		// A controller which loses its leadership, or is stopped, cancels ctx so the alerts aren't re-enabled alongside the new leader
+		_, sleepSpan := tracing.Start(ctx, "alert stabilization delay", attribute.String("delay", c.AlertStabilizationDelay.String()))
+		select {
+		case <-ctx.Done():
+			sleepSpan.End()
+			return fmt.Errorf("waiting for services to stabilize: %w", ctx.Err())
+		case <-time.After(c.AlertStabilizationDelay):
 		}
+		sleepSpan.End()
+		rep.AddPhase("stabilization", c.AlertStabilizationDelay)
 
-		if err = notify.UpdateNewRelicAlertPolicy(nrClient, notify.ScaleUp); err != nil {
-			return fmt.Errorf("updating New Relic: %w", err)
+		start = time.Now()
+		if err = alerts.update(ctx, rep, s, notify.ScaleUp); err != nil {
+			return err
 		}
+		rep.AddPhase("enable-alerts", time.Since(start))
+	}
+
+	if runErr != nil {
+		return fmt.Errorf("running: %w", runErr)
 	}
 
 	return nil
 }
 
-func reportError(slackClient *notify.SlackClient, err error) {
-	log.Error("scaling the environment failed", "error", err)
-	notify.Slack(slackClient, fmt.Sprintf("error whilst scaling the environment: %v", err))
-	os.Exit(1)
+// publishReport finalises rep with the outcome of the run, writes it to stdout as JSON, stores it
+// in the in-cluster history and pushes the run metrics. Failures to publish are logged rather than
+// failing the run.
+func publishReport(c config.Config, rep *report.Report, pusher *metrics.Pusher, runErr error) {
+	// Failures collected in continue-on-error mode have already been recorded individually
+	var failures *service.FailuresError
+	if runErr != nil && !errors.As(runErr, &failures) {
+		rep.AddError(runErr.Error())
+	}
+	rep.Finish()
+
+	if err := rep.WriteJSON(os.Stdout); err != nil {
+		log.Error("writing run report", "error", err)
+	}
+
+	if err := metrics.Push(pusher, rep); err != nil {
+		log.Error("pushing run metrics", "error", err)
+	}
+
+	if c.K8sClient == nil {
+		return
+	}
+
+	if err := rep.Save(c.K8sClient, c.Namespace, c.ReportHistoryLimit); err != nil {
+		log.Error("saving run report to the history ConfigMap", "error", err, "namespace", c.Namespace, "configMap", report.HistoryConfigMapName)
+	}
+}
+
+// reportError logs the failed run and sends the failure notifications.
+func reportError(ctx context.Context, notifier *notify.Dispatcher, rep *report.Report, err error) {
+	var failures *service.FailuresError
+	if errors.As(err, &failures) {
+		log.Error("scaling the environment failed", "error", err, "failures", failures.Failures)
+	} else {
+		log.Error("scaling the environment failed", "error", err)
+	}
+
+	notifier.Finished(ctx, rep, fmt.Errorf("error whilst scaling the environment: %w", err))
 }
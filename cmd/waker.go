@@ -0,0 +1,24 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/michaelprice232/eks-env-scaledown/config"
+	"github.com/michaelprice232/eks-env-scaledown/internal/waker"
+)
+
+// runWaker serves the environment asleep page until ctx is cancelled, waking the environment when asked to.
+func runWaker(ctx context.Context) error {
+	conf, err := waker.NewConfig()
+	if err != nil {
+		return fmt.Errorf("creating waker config: %w", err)
+	}
+
+	client, err := config.NewK8sClient()
+	if err != nil {
+		return fmt.Errorf("creating k8s client: %w", err)
+	}
+
+	return waker.New(conf, client).ListenAndServe(ctx)
+}
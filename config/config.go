@@ -10,8 +10,12 @@ import (
 	"strings"
 	"time"
 
+	"net/http"
 	"path/filepath"
 
+	"github.com/michaelprice232/eks-env-scaledown/internal/tracing"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
@@ -19,7 +23,7 @@ import (
 	"k8s.io/client-go/util/homedir"
 )
 
-// ScaleAction defines whether the environment should be scaled up or down.
+// ScaleAction defines whether the environment should be scaled up or down, or kept down.
 type ScaleAction string
 
 const (
@@ -27,12 +31,26 @@ const (
 	ScaleUp ScaleAction = "ScaleUp"
 	// ScaleDown scales workloads to zero replicas.
 	ScaleDown ScaleAction = "ScaleDown"
+	// Enforce re-applies the scale down to workloads which have drifted back up whilst the environment is down.
+	Enforce ScaleAction = "Enforce"
 )
 
 // defaultAlertStabilizationDelay is how long scale-up waits for workloads to settle
 // before re-enabling alerts, when ALERT_STABILIZATION_DELAY is not set.
 const defaultAlertStabilizationDelay = 10 * time.Minute
 
+// defaultNamespace is the namespace this app is deployed into, when POD_NAMESPACE is not set.
+const defaultNamespace = "eks-env-scaledown"
+
+// defaultReportHistoryLimit is how many run reports are retained in-cluster, when REPORT_HISTORY_LIMIT is not set.
+const defaultReportHistoryLimit = 14
+
+// defaultKeepAliveMax is the furthest ahead a keep-alive can postpone the scale down, when KEEP_ALIVE_MAX is not set.
+const defaultKeepAliveMax = 12 * time.Hour
+
+// defaultKeepAliveConfigMap holds the cluster-wide keep-alive, when KEEP_ALIVE_CONFIGMAP is not set.
+const defaultKeepAliveConfigMap = "eks-env-scaledown-keep-alive"
+
 // Config holds the runtime configuration and Kubernetes clients for the application.
 type Config struct {
 	K8sClient        kubernetes.Interface
@@ -41,17 +59,44 @@ type Config struct {
 	SuspendCronJob   bool
 	SuspendKeda      bool
 
+	// ContinueOnError collects per-resource failures and carries on with the remaining startup
+	// groups instead of aborting on the first failure. Workloads annotated as critical still abort the run.
+	ContinueOnError bool
+
 	// AlertStabilizationDelay is how long scale-up waits after restoring workloads
 	// before re-enabling alerts, giving the services time to settle.
 	AlertStabilizationDelay time.Duration
+
+	// Namespace is where this app runs and stores its in-cluster state, such as the run report history.
+	Namespace string
+
+	// ReportHistoryLimit is how many run reports are retained in the history ConfigMap. Zero disables it.
+	ReportHistoryLimit int
+
+	// MaintenancePageService is the "name:port" Service, in each selected Ingress's namespace, serving the
+	// environment asleep page. The Ingresses are re-pointed to it during the scale down. Empty disables it.
+	MaintenancePageService string
+
+	// MaintenancePageWakeTime is when the environment is scheduled to wake, shown on the maintenance page e.g. "07:00 UTC"
+	MaintenancePageWakeTime string
+
+	// KeepAliveMax is the furthest ahead of the run a keep-alive can postpone the scale down. Later keep-alives are ignored
+	KeepAliveMax time.Duration
+
+	// KeepAliveConfigMap is the ConfigMap, in Namespace, whose keep-alive annotation postpones the whole scale down
+	KeepAliveConfigMap string
+
+	// ScaleDownReplicas are the replica counts the workloads in each namespace are scaled down to, rather than zero.
+	// A workload's own annotation takes precedence
+	ScaleDownReplicas map[string]int32
 }
 
 func (c Config) validateAction() error {
 	switch c.Action {
-	case ScaleUp, ScaleDown:
+	case ScaleUp, ScaleDown, Enforce:
 		return nil
 	default:
-		return fmt.Errorf("invalid Action: must be 'ScaleUp' or 'ScaleDown'. Ensure SCALE_ACTION envar is set correctly")
+		return fmt.Errorf("invalid Action: must be 'ScaleUp', 'ScaleDown' or 'Enforce'. Ensure SCALE_ACTION envar is set correctly")
 	}
 }
 
@@ -89,11 +134,58 @@ func parseDurationEnv(key string, def time.Duration) time.Duration {
 	return parsed
 }
 
+// parseIntEnv reads an integer environment variable, returning def when the variable
+// is unset or cannot be parsed as an integer.
+func parseIntEnv(key string, def int) int {
+	val := os.Getenv(key)
+	if val == "" {
+		return def
+	}
+
+	parsed, err := strconv.Atoi(val)
+	if err != nil {
+		log.Warn("Problem parsing integer env var. Using default", "key", key, "value", val, "default", def)
+		return def
+	}
+
+	return parsed
+}
+
+// parseReplicasEnv reads a comma-separated list of namespace=replicas pairs, e.g. "auth=1,payments=1".
+func parseReplicasEnv(key string) (map[string]int32, error) {
+	val := os.Getenv(key)
+	if val == "" {
+		return nil, nil
+	}
+
+	replicas := make(map[string]int32)
+	for _, pair := range strings.Split(val, ",") {
+		namespace, count, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if !found || namespace == "" {
+			return nil, fmt.Errorf("invalid %s entry %q: must be in the format namespace=replicas", key, pair)
+		}
+
+		parsed, err := strconv.ParseInt(count, 10, 32)
+		if err != nil || parsed < 0 {
+			return nil, fmt.Errorf("invalid %s entry %q: replicas must be a number from 0", key, pair)
+		}
+		replicas[namespace] = int32(parsed)
+	}
+
+	return replicas, nil
+}
+
 // NewConfig builds a Config from environment variables and initialises the Kubernetes clients.
 func NewConfig() (Config, error) {
+	return NewConfigFor(ScaleAction(os.Getenv("SCALE_ACTION")))
+}
+
+// NewConfigFor builds a Config for action, rather than SCALE_ACTION, such as for a run started by the controller's
+// schedule. The rest of the Config is read from environment variables.
+func NewConfigFor(action ScaleAction) (Config, error) {
 	var conf Config
 
-	conf.Action = ScaleAction(os.Getenv("SCALE_ACTION"))
+	conf.Action = action
 	err := conf.validateAction()
 	if err != nil {
 		return conf, fmt.Errorf("validating ScaleAction: %w", err)
@@ -105,9 +197,41 @@ func NewConfig() (Config, error) {
 	// Whether to disable Keda ScaledObjects during the scaledown. Default to disabled
 	conf.SuspendKeda = parseBoolEnv("SUSPEND_KEDA_SCALED_OBJECTS", false)
 
+	// Whether to carry on scaling the remaining resources when one fails. Default to disabled
+	conf.ContinueOnError = parseBoolEnv("CONTINUE_ON_ERROR", false)
+
 	// How long scale-up waits for workloads to stabilize before re-enabling alerts. Default to 10m
 	conf.AlertStabilizationDelay = parseDurationEnv("ALERT_STABILIZATION_DELAY", defaultAlertStabilizationDelay)
 
+	// The namespace this app runs in, normally injected via the downward API
+	conf.Namespace = os.Getenv("POD_NAMESPACE")
+	if conf.Namespace == "" {
+		conf.Namespace = defaultNamespace
+	}
+
+	// How many run reports to retain in-cluster. Default to 14
+	conf.ReportHistoryLimit = parseIntEnv("REPORT_HISTORY_LIMIT", defaultReportHistoryLimit)
+
+	// Re-point the selected Ingresses to an environment asleep page during the scale down. Default to disabled
+	conf.MaintenancePageService = os.Getenv("MAINTENANCE_PAGE_SERVICE")
+	if conf.MaintenancePageService != "" && !strings.Contains(conf.MaintenancePageService, ":") {
+		return conf, fmt.Errorf("invalid MAINTENANCE_PAGE_SERVICE %q: must be in the format name:port", conf.MaintenancePageService)
+	}
+	conf.MaintenancePageWakeTime = os.Getenv("MAINTENANCE_PAGE_WAKE_TIME")
+
+	// How far ahead a keep-alive can postpone the scale down, and where the cluster-wide keep-alive is. Default to 12h
+	conf.KeepAliveMax = parseDurationEnv("KEEP_ALIVE_MAX", defaultKeepAliveMax)
+	conf.KeepAliveConfigMap = os.Getenv("KEEP_ALIVE_CONFIGMAP")
+	if conf.KeepAliveConfigMap == "" {
+		conf.KeepAliveConfigMap = defaultKeepAliveConfigMap
+	}
+
+	// Scale the workloads in these namespaces down to a reduced replica count rather than zero. Default to none
+	conf.ScaleDownReplicas, err = parseReplicasEnv("SCALEDOWN_REPLICAS")
+	if err != nil {
+		return conf, err
+	}
+
 	kc, dc, err := newK8sClients()
 	if err != nil {
 		return conf, fmt.Errorf("creating k8s clients: %w", err)
@@ -141,6 +265,13 @@ func SetupLogging() {
 	log.SetDefault(log.New(handler))
 }
 
+// NewK8sClient returns the Kubernetes client for the long-running modes, such as the waker, which don't scale the
+// environment themselves and so don't need the rest of the Config.
+func NewK8sClient() (kubernetes.Interface, error) {
+	client, _, err := newK8sClients()
+	return client, err
+}
+
 func newK8sClients() (*kubernetes.Clientset, *dynamic.DynamicClient, error) {
 	var client *kubernetes.Clientset
 	var config *rest.Config
@@ -177,6 +308,15 @@ func newK8sClients() (*kubernetes.Clientset, *dynamic.DynamicClient, error) {
 	config.QPS = 50
 	config.Burst = 100
 
+	// Trace every Kubernetes API request, and any time spent queued in the local rate limiter,
+	// as children of the operation which made them. Both are no-ops unless tracing is enabled
+	config.RateLimiter = tracing.NewRateLimiter(config.QPS, config.Burst)
+	config.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+		return otelhttp.NewTransport(rt, otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return "k8s " + r.Method
+		}))
+	})
+
 	client, err = kubernetes.NewForConfig(config)
 	if err != nil {
 		return nil, nil, fmt.Errorf("creating K8s client: %w", err)
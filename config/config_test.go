@@ -15,6 +15,7 @@ func TestValidateAction(t *testing.T) {
 	}{
 		{name: "ScaleUp is valid", action: ScaleUp, wantErr: false},
 		{name: "ScaleDown is valid", action: ScaleDown, wantErr: false},
+		{name: "Enforce is valid", action: Enforce, wantErr: false},
 		{name: "empty is invalid", action: "", wantErr: true},
 		{name: "unknown is invalid", action: "Sideways", wantErr: true},
 	}
@@ -88,3 +89,62 @@ func TestParseDurationEnv(t *testing.T) {
 		})
 	}
 }
+
+func TestParseIntEnv(t *testing.T) {
+	const key = "TEST_PARSE_INT_ENV"
+
+	tests := []struct {
+		name     string
+		set      bool
+		value    string
+		def      int
+		expected int
+	}{
+		{name: "unset returns default", set: false, def: 14, expected: 14},
+		{name: "valid integer overrides default", set: true, value: "3", def: 14, expected: 3},
+		{name: "zero is honoured", set: true, value: "0", def: 14, expected: 0},
+		{name: "unparseable falls back to default", set: true, value: "lots", def: 14, expected: 14},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.set {
+				t.Setenv(key, tc.value)
+			}
+
+			assert.Equal(t, tc.expected, parseIntEnv(key, tc.def))
+		})
+	}
+}
+
+func TestParseReplicasEnv(t *testing.T) {
+	const key = "TEST_PARSE_REPLICAS_ENV"
+
+	tests := []struct {
+		name     string
+		value    string
+		wantErr  bool
+		expected map[string]int32
+	}{
+		{name: "unset", expected: nil},
+		{name: "several namespaces", value: "auth=1, payments=2", expected: map[string]int32{"auth": 1, "payments": 2}},
+		{name: "zero is honoured", value: "auth=0", expected: map[string]int32{"auth": 0}},
+		{name: "missing replicas", value: "auth", wantErr: true},
+		{name: "missing namespace", value: "=1", wantErr: true},
+		{name: "negative replicas", value: "auth=-1", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv(key, tc.value)
+
+			replicas, err := parseReplicasEnv(key)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, replicas)
+		})
+	}
+}
@@ -0,0 +1,186 @@
+// Package calendar reads dated overrides of the scaling schedule, such as bank holidays and release rehearsals, from
+// an iCalendar (ICS) file or a ConfigMap, and decides whether a run goes ahead.
+package calendar
+
+import (
+	"context"
+	"fmt"
+	"io"
+	log "log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/michaelprice232/eks-env-scaledown/config"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const fetchTimeout = 30 * time.Second
+
+// Mode is what an override does to the runs on the days it covers.
+type Mode string
+
+const (
+	// StayDown skips the scale ups, keeping the environment down all day
+	StayDown Mode = "stay-down"
+
+	// StayUpUntil defers the scale downs until the override's Until time
+	StayUpUntil Mode = "stay-up-until"
+
+	// Skip skips every run
+	Skip Mode = "skip"
+)
+
+// Override applies Mode to the runs from Start up to, but not including, End.
+type Override struct {
+	Start  time.Time
+	End    time.Time
+	Mode   Mode
+	Until  time.Time
+	Reason string
+}
+
+// The outcomes of Decide.
+const (
+	DecisionRun   = "run"
+	DecisionSkip  = "skip"
+	DecisionDefer = "defer"
+)
+
+// Decision is whether a run goes ahead, and why. Until is set when the run is deferred.
+type Decision struct {
+	Decision string
+	Reason   string
+	Until    time.Time
+}
+
+// Calendar holds the overrides read from the configured sources.
+type Calendar struct {
+	Overrides []Override
+}
+
+// New reads the overrides from the ICS file or URL in CALENDAR_ICS and the ConfigMap named by CALENDAR_CONFIGMAP in
+// namespace. Dates without a timezone are read in SCHEDULE_TIMEZONE. Nil is returned if neither is set, or
+// IGNORE_CALENDAR is true, as it is for the runs started by the waker.
+func New(ctx context.Context, client kubernetes.Interface, namespace string) (*Calendar, error) {
+	if ignore, _ := strconv.ParseBool(os.Getenv("IGNORE_CALENDAR")); ignore {
+		return nil, nil
+	}
+
+	ics, configMap := os.Getenv("CALENDAR_ICS"), os.Getenv("CALENDAR_CONFIGMAP")
+	if ics == "" && configMap == "" {
+		return nil, nil
+	}
+
+	tz := os.Getenv("SCHEDULE_TIMEZONE")
+	if tz == "" {
+		tz = "UTC"
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, fmt.Errorf("loading SCHEDULE_TIMEZONE: %w", err)
+	}
+
+	var cal Calendar
+	if ics != "" {
+		raw, err := readICS(ctx, ics)
+		if err != nil {
+			return nil, fmt.Errorf("reading CALENDAR_ICS: %w", err)
+		}
+		overrides, err := ParseICS(raw, loc)
+		if err != nil {
+			return nil, fmt.Errorf("parsing CALENDAR_ICS: %w", err)
+		}
+		cal.Overrides = append(cal.Overrides, overrides...)
+	}
+
+	if configMap != "" {
+		cm, err := client.CoreV1().ConfigMaps(namespace).Get(ctx, configMap, metav1.GetOptions{})
+		if k8serrors.IsNotFound(err) {
+			log.Warn("Calendar ConfigMap not found. Continuing without its overrides", "configMap", configMap, "namespace", namespace)
+		} else if err != nil {
+			return nil, fmt.Errorf("getting calendar ConfigMap %s: %w", configMap, err)
+		}
+
+		if cm != nil {
+			for _, key := range slices.Sorted(maps.Keys(cm.Data)) {
+				overrides, err := ParseOverrides(cm.Data[key], loc)
+				if err != nil {
+					return nil, fmt.Errorf("parsing calendar ConfigMap %s key %s: %w", configMap, key, err)
+				}
+				cal.Overrides = append(cal.Overrides, overrides...)
+			}
+		}
+	}
+
+	return &cal, nil
+}
+
+// readICS reads the ICS file at source, which is either an http(s) URL or a path such as a mounted ConfigMap.
+func readICS(ctx context.Context, source string) (string, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		raw, err := os.ReadFile(source)
+		return string(raw), err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, fetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	raw, err := io.ReadAll(resp.Body)
+
+	return string(raw), err
+}
+
+// Decide returns whether a run of action at now goes ahead. A nil *Calendar always runs.
+//
+// A skip override skips every run, a stay-down override skips the scale ups, and a stay-up-until override defers the
+// scale downs until its time. Where several stay-up-until overrides apply, the latest time wins.
+func (c *Calendar) Decide(action config.ScaleAction, now time.Time) Decision {
+	if c == nil {
+		return Decision{Decision: DecisionRun}
+	}
+
+	var deferred *Override
+	for i, o := range c.Overrides {
+		if now.Before(o.Start) || !now.Before(o.End) {
+			continue
+		}
+
+		switch {
+		case o.Mode == Skip:
+			return Decision{Decision: DecisionSkip, Reason: o.Reason}
+		case o.Mode == StayDown && action == config.ScaleUp:
+			return Decision{Decision: DecisionSkip, Reason: o.Reason}
+		case o.Mode == StayUpUntil && action == config.ScaleDown && now.Before(o.Until):
+			if deferred == nil || o.Until.After(deferred.Until) {
+				deferred = &c.Overrides[i]
+			}
+		}
+	}
+
+	if deferred != nil {
+		return Decision{Decision: DecisionDefer, Reason: deferred.Reason, Until: deferred.Until}
+	}
+
+	return Decision{Decision: DecisionRun}
+}
@@ -0,0 +1,209 @@
+package calendar
+
+import (
+	"io"
+	log "log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/michaelprice232/eks-env-scaledown/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const testICS = "BEGIN:VCALENDAR\r\n" +
+	"VERSION:2.0\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"DTSTART;VALUE=DATE:20261225\r\n" +
+	"DTEND;VALUE=DATE:20261227\r\n" +
+	"SUMMARY:Christmas Day and Boxing\r\n" +
+	"  Day\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"DTSTART;TZID=Europe/London:20260312T180000\r\n" +
+	"DTEND;TZID=Europe/London:20260312T230000\r\n" +
+	"SUMMARY:Release rehearsal\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"DTSTART;VALUE=DATE:20260319\r\n" +
+	"SUMMARY:Skip tonight\\, load test\r\n" +
+	"END:VEVENT\r\n" +
+	"END:VCALENDAR\r\n"
+
+func mustLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	require.NoError(t, err)
+	return loc
+}
+
+func TestParseICS(t *testing.T) {
+	london := mustLocation(t, "Europe/London")
+
+	overrides, err := ParseICS(testICS, london)
+	require.NoError(t, err)
+	require.Len(t, overrides, 3)
+
+	assert.Equal(t, Override{
+		Start:  time.Date(2026, 12, 25, 0, 0, 0, 0, london),
+		End:    time.Date(2026, 12, 27, 0, 0, 0, 0, london),
+		Mode:   StayDown,
+		Reason: "Christmas Day and Boxing Day",
+	}, overrides[0])
+
+	assert.Equal(t, StayUpUntil, overrides[1].Mode)
+	assert.True(t, time.Date(2026, 3, 12, 0, 0, 0, 0, london).Equal(overrides[1].Start))
+	assert.True(t, time.Date(2026, 3, 12, 23, 0, 0, 0, london).Equal(overrides[1].Until))
+
+	assert.Equal(t, Skip, overrides[2].Mode)
+	assert.Equal(t, "Skip tonight, load test", overrides[2].Reason)
+	assert.True(t, time.Date(2026, 3, 20, 0, 0, 0, 0, london).Equal(overrides[2].End), "Expected an event without an end to cover a single day")
+
+	_, err = ParseICS("BEGIN:VEVENT\nSUMMARY:No start\nEND:VEVENT\n", london)
+	assert.Error(t, err)
+}
+
+func TestParseOverrides(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		wantErr  bool
+		expected []Override
+	}{
+		{
+			name: "every mode",
+			raw: `# Dated overrides
+2026-12-24..2026-12-31 stay-down Christmas week
+
+2026-03-12 stay-up-until 23:00 Release rehearsal
+2026-03-19 skip`,
+			expected: []Override{
+				{Start: time.Date(2026, 12, 24, 0, 0, 0, 0, time.UTC), End: time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC), Mode: StayDown, Reason: "Christmas week"},
+				{Start: time.Date(2026, 3, 12, 0, 0, 0, 0, time.UTC), End: time.Date(2026, 3, 13, 0, 0, 0, 0, time.UTC), Mode: StayUpUntil, Until: time.Date(2026, 3, 12, 23, 0, 0, 0, time.UTC), Reason: "Release rehearsal"},
+				{Start: time.Date(2026, 3, 19, 0, 0, 0, 0, time.UTC), End: time.Date(2026, 3, 20, 0, 0, 0, 0, time.UTC), Mode: Skip, Reason: "skip on 2026-03-19"},
+			},
+		},
+		{name: "unknown mode", raw: "2026-03-19 stay-sideways", wantErr: true},
+		{name: "invalid date", raw: "2026-02-30 skip", wantErr: true},
+		{name: "range ends before it starts", raw: "2026-12-31..2026-12-24 stay-down", wantErr: true},
+		{name: "missing time", raw: "2026-03-12 stay-up-until", wantErr: true},
+		{name: "stay up over a range", raw: "2026-03-12..2026-03-13 stay-up-until 23:00", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			overrides, err := ParseOverrides(tc.raw, time.UTC)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, overrides)
+		})
+	}
+}
+
+func TestDecide(t *testing.T) {
+	overrides, err := ParseOverrides(`2026-12-24..2026-12-31 stay-down Christmas week
+2026-03-12 stay-up-until 21:00 Release rehearsal
+2026-03-12 stay-up-until 23:00 Release rehearsal overrun
+2026-03-19 skip Load test`, time.UTC)
+	require.NoError(t, err)
+	cal := &Calendar{Overrides: overrides}
+
+	tests := []struct {
+		name     string
+		cal      *Calendar
+		action   config.ScaleAction
+		now      time.Time
+		expected Decision
+	}{
+		{name: "no calendar", action: config.ScaleUp, now: time.Date(2026, 12, 25, 7, 0, 0, 0, time.UTC), expected: Decision{Decision: DecisionRun}},
+		{name: "no override applies", cal: cal, action: config.ScaleUp, now: time.Date(2026, 1, 5, 7, 0, 0, 0, time.UTC), expected: Decision{Decision: DecisionRun}},
+		{name: "stay down skips the scale up", cal: cal, action: config.ScaleUp, now: time.Date(2026, 12, 31, 7, 0, 0, 0, time.UTC), expected: Decision{Decision: DecisionSkip, Reason: "Christmas week"}},
+		{name: "stay down lets the scale down run", cal: cal, action: config.ScaleDown, now: time.Date(2026, 12, 24, 19, 0, 0, 0, time.UTC), expected: Decision{Decision: DecisionRun}},
+		{name: "stay down ends after its last day", cal: cal, action: config.ScaleUp, now: time.Date(2027, 1, 1, 7, 0, 0, 0, time.UTC), expected: Decision{Decision: DecisionRun}},
+		{
+			name:     "stay up defers the scale down to the latest time",
+			cal:      cal,
+			action:   config.ScaleDown,
+			now:      time.Date(2026, 3, 12, 19, 0, 0, 0, time.UTC),
+			expected: Decision{Decision: DecisionDefer, Reason: "Release rehearsal overrun", Until: time.Date(2026, 3, 12, 23, 0, 0, 0, time.UTC)},
+		},
+		{name: "stay up has passed", cal: cal, action: config.ScaleDown, now: time.Date(2026, 3, 12, 23, 30, 0, 0, time.UTC), expected: Decision{Decision: DecisionRun}},
+		{name: "skip skips the scale down", cal: cal, action: config.ScaleDown, now: time.Date(2026, 3, 19, 19, 0, 0, 0, time.UTC), expected: Decision{Decision: DecisionSkip, Reason: "Load test"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, tc.cal.Decide(tc.action, tc.now))
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	log.SetDefault(log.New(log.NewJSONHandler(io.Discard, nil)))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, testICS)
+	}))
+	defer srv.Close()
+
+	client := fake.NewClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "calendar", Namespace: "eks-env-scaledown"},
+		Data:       map[string]string{"releases": "2026-03-12 stay-up-until 23:00 Release rehearsal", "holidays": "2026-05-04 stay-down Bank holiday"},
+	})
+
+	t.Run("not configured", func(t *testing.T) {
+		t.Setenv("CALENDAR_ICS", "")
+		t.Setenv("CALENDAR_CONFIGMAP", "")
+
+		cal, err := New(t.Context(), client, "eks-env-scaledown")
+		require.NoError(t, err)
+		assert.Nil(t, cal)
+	})
+
+	t.Run("ignored", func(t *testing.T) {
+		t.Setenv("CALENDAR_ICS", srv.URL)
+		t.Setenv("IGNORE_CALENDAR", "true")
+
+		cal, err := New(t.Context(), client, "eks-env-scaledown")
+		require.NoError(t, err)
+		assert.Nil(t, cal)
+	})
+
+	t.Run("ICS URL and ConfigMap", func(t *testing.T) {
+		t.Setenv("CALENDAR_ICS", srv.URL)
+		t.Setenv("CALENDAR_CONFIGMAP", "calendar")
+		t.Setenv("SCHEDULE_TIMEZONE", "Europe/London")
+
+		cal, err := New(t.Context(), client, "eks-env-scaledown")
+		require.NoError(t, err)
+		require.Len(t, cal.Overrides, 5)
+		assert.Equal(t, "Bank holiday", cal.Overrides[3].Reason, "Expected the ConfigMap keys to be read in order")
+		assert.Equal(t, "Europe/London", cal.Overrides[4].Start.Location().String())
+	})
+
+	t.Run("missing ConfigMap", func(t *testing.T) {
+		t.Setenv("CALENDAR_ICS", "")
+		t.Setenv("CALENDAR_CONFIGMAP", "missing")
+
+		cal, err := New(t.Context(), client, "eks-env-scaledown")
+		require.NoError(t, err)
+		assert.Empty(t, cal.Overrides)
+	})
+
+	t.Run("unreadable ICS file", func(t *testing.T) {
+		t.Setenv("CALENDAR_ICS", "/does/not/exist.ics")
+		t.Setenv("CALENDAR_CONFIGMAP", "")
+
+		_, err := New(t.Context(), client, "eks-env-scaledown")
+		assert.Error(t, err)
+	})
+}
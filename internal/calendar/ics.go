@@ -0,0 +1,154 @@
+package calendar
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ParseICS parses the events in an iCalendar (ICS) file as overrides, reading dates without a timezone in loc.
+// Recurring events are not expanded, so each occurrence must be listed, as published holiday calendars do.
+//
+//   - An event whose summary starts with "skip" skips every run on the days it covers.
+//   - An all-day event, such as a bank holiday, keeps the environment down.
+//   - Any other event keeps the environment up until it ends on the day it starts.
+func ParseICS(raw string, loc *time.Location) ([]Override, error) {
+	var (
+		overrides []Override
+		event     map[string]property
+	)
+
+	for n, line := range unfold(raw) {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		name, params, _ := strings.Cut(name, ";")
+		name = strings.ToUpper(name)
+
+		switch {
+		case name == "BEGIN" && strings.EqualFold(value, "VEVENT"):
+			event = map[string]property{}
+		case name == "END" && strings.EqualFold(value, "VEVENT"):
+			if event == nil {
+				return nil, fmt.Errorf("line %d: END:VEVENT without BEGIN:VEVENT", n+1)
+			}
+			o, err := eventOverride(event, loc)
+			if err != nil {
+				return nil, fmt.Errorf("event ending on line %d: %w", n+1, err)
+			}
+			overrides = append(overrides, o)
+			event = nil
+		case event != nil:
+			if _, seen := event[name]; !seen {
+				event[name] = property{params: params, value: value}
+			}
+		}
+	}
+
+	return overrides, nil
+}
+
+type property struct {
+	params string
+	value  string
+}
+
+// unfold splits raw into lines, joining the continuation lines which start with a space or tab.
+func unfold(raw string) []string {
+	var lines []string
+	for _, line := range strings.Split(strings.ReplaceAll(raw, "\r\n", "\n"), "\n") {
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	return lines
+}
+
+func eventOverride(event map[string]property, loc *time.Location) (Override, error) {
+	var o Override
+
+	summary := strings.NewReplacer(`\,`, ",", `\;`, ";", `\n`, " ", `\N`, " ", `\\`, `\`).Replace(event["SUMMARY"].value)
+	o.Reason = strings.TrimSpace(summary)
+
+	dtstart, ok := event["DTSTART"]
+	if !ok {
+		return o, fmt.Errorf("missing DTSTART in %q", o.Reason)
+	}
+	start, allDay, err := parseICSTime(dtstart, loc)
+	if err != nil {
+		return o, fmt.Errorf("parsing DTSTART of %q: %w", o.Reason, err)
+	}
+	start = start.In(loc)
+	day := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, loc)
+
+	end := start
+	if dtend, ok := event["DTEND"]; ok {
+		if end, _, err = parseICSTime(dtend, loc); err != nil {
+			return o, fmt.Errorf("parsing DTEND of %q: %w", o.Reason, err)
+		}
+		end = end.In(loc)
+	}
+
+	switch {
+	case strings.HasPrefix(strings.ToLower(o.Reason), "skip"):
+		o.Mode, o.Start, o.End = Skip, day, dayAfter(end, loc)
+		if !o.End.After(day) {
+			o.End = day.AddDate(0, 0, 1)
+		}
+	case allDay:
+		// The end of an all-day event is exclusive, and a missing one means a single day
+		o.Mode, o.Start, o.End = StayDown, start, end
+		if !end.After(start) {
+			o.End = start.AddDate(0, 0, 1)
+		}
+	default:
+		o.Mode, o.Start, o.End, o.Until = StayUpUntil, day, day.AddDate(0, 0, 1), end
+	}
+
+	if o.Reason == "" {
+		o.Reason = fmt.Sprintf("%s on %s", o.Mode, day.Format(dateLayout))
+	}
+
+	return o, nil
+}
+
+// dayAfter returns midnight after t, or t itself if it is already midnight.
+func dayAfter(t time.Time, loc *time.Location) time.Time {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	if day.Equal(t) {
+		return day
+	}
+
+	return day.AddDate(0, 0, 1)
+}
+
+// parseICSTime parses a DATE or DATE-TIME value, reporting whether it was a DATE. A DATE-TIME is read in its TZID
+// parameter, in UTC if it ends with Z, or otherwise in loc.
+func parseICSTime(p property, loc *time.Location) (time.Time, bool, error) {
+	for _, param := range strings.Split(p.params, ";") {
+		key, value, _ := strings.Cut(param, "=")
+		if strings.EqualFold(key, "TZID") {
+			tz, err := time.LoadLocation(strings.Trim(value, `"`))
+			if err != nil {
+				return time.Time{}, false, err
+			}
+			loc = tz
+		}
+	}
+
+	switch {
+	case len(p.value) == len("20060102"):
+		t, err := time.ParseInLocation("20060102", p.value, loc)
+		return t, true, err
+	case strings.HasSuffix(p.value, "Z"):
+		t, err := time.Parse("20060102T150405Z", p.value)
+		return t, false, err
+	default:
+		t, err := time.ParseInLocation("20060102T150405", p.value, loc)
+		return t, false, err
+	}
+}
@@ -0,0 +1,90 @@
+package calendar
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const dateLayout = "2006-01-02"
+
+// ParseOverrides parses the overrides in raw, one per line, in loc. Blank lines and lines starting with # are
+// ignored. Each line is a date or inclusive date range, a mode and an optional reason:
+//
+//	2026-12-24..2026-12-31 stay-down Christmas week
+//	2026-03-12 stay-up-until 23:00 Release rehearsal
+//	2026-03-19 skip Skip tonight's scale down
+func ParseOverrides(raw string, loc *time.Location) ([]Override, error) {
+	var overrides []Override
+
+	scanner := bufio.NewScanner(strings.NewReader(raw))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		o, err := parseOverride(line, loc)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		overrides = append(overrides, o)
+	}
+
+	return overrides, scanner.Err()
+}
+
+func parseOverride(line string, loc *time.Location) (Override, error) {
+	var o Override
+
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return o, fmt.Errorf("expected a date and a mode in %q", line)
+	}
+
+	from, to, _ := strings.Cut(fields[0], "..")
+	if to == "" {
+		to = from
+	}
+	start, err := time.ParseInLocation(dateLayout, from, loc)
+	if err != nil {
+		return o, fmt.Errorf("parsing date %q: %w", from, err)
+	}
+	last, err := time.ParseInLocation(dateLayout, to, loc)
+	if err != nil {
+		return o, fmt.Errorf("parsing date %q: %w", to, err)
+	}
+	if last.Before(start) {
+		return o, fmt.Errorf("date range %q ends before it starts", fields[0])
+	}
+	o.Start, o.End = start, last.AddDate(0, 0, 1)
+
+	o.Mode = Mode(fields[1])
+	rest := fields[2:]
+	switch o.Mode {
+	case Skip, StayDown:
+	case StayUpUntil:
+		if len(rest) == 0 {
+			return o, fmt.Errorf("expected a time after %s", StayUpUntil)
+		}
+		until, err := time.Parse("15:04", rest[0])
+		if err != nil {
+			return o, fmt.Errorf("parsing time %q: %w", rest[0], err)
+		}
+		if !last.Equal(start) {
+			return o, fmt.Errorf("%s applies to a single date", StayUpUntil)
+		}
+		o.Until = time.Date(start.Year(), start.Month(), start.Day(), until.Hour(), until.Minute(), 0, 0, loc)
+		rest = rest[1:]
+	default:
+		return o, fmt.Errorf("unknown mode %q. Expected one of %s, %s or %s", o.Mode, StayDown, StayUpUntil, Skip)
+	}
+
+	o.Reason = strings.Join(rest, " ")
+	if o.Reason == "" {
+		o.Reason = fmt.Sprintf("%s on %s", o.Mode, fields[0])
+	}
+
+	return o, nil
+}
@@ -0,0 +1,154 @@
+package cloud
+
+import (
+	"context"
+	"fmt"
+	log "log/slog"
+	"slices"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// asgInstanceTag is set by EC2 Auto Scaling on the instances it launches.
+const asgInstanceTag = "aws:autoscaling:groupName"
+
+// defaultPluginTimeout is how long a plugin waits for a resource to start, when its timeout envar is not set.
+const defaultPluginTimeout = 10 * time.Minute
+
+// pluginPollInterval is how often a plugin checks a resource whilst waiting for it to start.
+var pluginPollInterval = 10 * time.Second
+
+// EC2API is the subset of the EC2 client used to stop and start instances.
+type EC2API interface {
+	ec2.DescribeInstancesAPIClient
+	StopInstances(ctx context.Context, params *ec2.StopInstancesInput, optFns ...func(*ec2.Options)) (*ec2.StopInstancesOutput, error)
+	StartInstances(ctx context.Context, params *ec2.StartInstancesInput, optFns ...func(*ec2.Options)) (*ec2.StartInstancesOutput, error)
+}
+
+// EC2Instances is an ExternalResource plugin which stops the EC2 instances, such as bastions, carrying every tag
+// in Tags.
+type EC2Instances struct {
+	API     EC2API
+	Tags    map[string]string
+	Timeout time.Duration
+}
+
+// NewEC2Instances returns the plugin for the instances tagged with EC2_TAGS. Nil is returned if EC2_TAGS is not set.
+func NewEC2Instances(ctx context.Context) (*EC2Instances, error) {
+	tags, err := parseTags("EC2_TAGS")
+	if err != nil {
+		return nil, err
+	}
+	if len(tags) == 0 {
+		return nil, nil
+	}
+
+	timeout, err := parseTimeout("EC2_TIMEOUT", defaultPluginTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("loading aws config: %w", err)
+	}
+
+	return &EC2Instances{API: ec2.NewFromConfig(cfg), Tags: tags, Timeout: timeout}, nil
+}
+
+// Name implements ExternalResource.
+func (e *EC2Instances) Name() string {
+	return "ec2-instance"
+}
+
+// Status implements ExternalResource. Instances launched by an Auto Scaling group are left out, as the group would
+// replace them once stopped.
+func (e *EC2Instances) Status(ctx context.Context) ([]ResourceStatus, error) {
+	filters := []ec2types.Filter{{Name: aws.String("instance-state-name"), Values: []string{"pending", "running", "stopping", "stopped"}}}
+	for k, v := range e.Tags {
+		filters = append(filters, ec2types.Filter{Name: aws.String("tag:" + k), Values: []string{v}})
+	}
+
+	var statuses []ResourceStatus
+	pages := ec2.NewDescribeInstancesPaginator(e.API, &ec2.DescribeInstancesInput{Filters: filters})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("describing EC2 instances: %w", err)
+		}
+
+		for _, r := range page.Reservations {
+			for _, i := range r.Instances {
+				id := aws.ToString(i.InstanceId)
+				if slices.ContainsFunc(i.Tags, func(t ec2types.Tag) bool { return aws.ToString(t.Key) == asgInstanceTag }) {
+					log.Warn("Skipping EC2 instance launched by an Auto Scaling group", "id", id)
+					continue
+				}
+
+				state := instanceState(i)
+				statuses = append(statuses, ResourceStatus{
+					ID:      id,
+					State:   string(state),
+					Stopped: state == ec2types.InstanceStateNameStopped || state == ec2types.InstanceStateNameStopping,
+				})
+			}
+		}
+	}
+
+	return statuses, nil
+}
+
+// Stop implements ExternalResource.
+func (e *EC2Instances) Stop(ctx context.Context, id string) error {
+	_, err := e.API.StopInstances(ctx, &ec2.StopInstancesInput{InstanceIds: []string{id}})
+	return err
+}
+
+// Start implements ExternalResource, waiting for the instance to be running. An instance which is still stopping is
+// waited on first, as it can't be started until it has stopped.
+func (e *EC2Instances) Start(ctx context.Context, id, _ string) error {
+	ctx, cancel := context.WithTimeout(ctx, e.Timeout)
+	defer cancel()
+
+	started := false
+	for {
+		out, err := e.API.DescribeInstances(ctx, &ec2.DescribeInstancesInput{InstanceIds: []string{id}})
+		if err != nil {
+			return fmt.Errorf("describing EC2 instance: %w", err)
+		}
+		if len(out.Reservations) == 0 || len(out.Reservations[0].Instances) == 0 {
+			return fmt.Errorf("EC2 instance %s no longer exists", id)
+		}
+
+		state := instanceState(out.Reservations[0].Instances[0])
+		switch {
+		case state == ec2types.InstanceStateNameRunning:
+			return nil
+		case state == ec2types.InstanceStateNameStopped && !started:
+			if _, err = e.API.StartInstances(ctx, &ec2.StartInstancesInput{InstanceIds: []string{id}}); err != nil {
+				return err
+			}
+			started = true
+		case state == ec2types.InstanceStateNameTerminated || state == ec2types.InstanceStateNameShuttingDown:
+			return fmt.Errorf("EC2 instance %s has been terminated", id)
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for EC2 instance %s to be running, last state %q", id, state)
+		case <-time.After(pluginPollInterval):
+		}
+	}
+}
+
+func instanceState(i ec2types.Instance) ec2types.InstanceStateName {
+	if i.State == nil {
+		return ""
+	}
+
+	return i.State.Name
+}
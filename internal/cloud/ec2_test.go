@@ -0,0 +1,80 @@
+package cloud
+
+import (
+	"context"
+	"io"
+	log "log/slog"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeEC2 holds each instance by ID. Started instances go through pending before becoming running.
+type fakeEC2 struct {
+	instances map[string]*ec2types.Instance
+}
+
+func (f *fakeEC2) DescribeInstances(_ context.Context, in *ec2.DescribeInstancesInput, _ ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+	var out ec2.DescribeInstancesOutput
+	for id, i := range f.instances {
+		if len(in.InstanceIds) > 0 && in.InstanceIds[0] != id {
+			continue
+		}
+		out.Reservations = append(out.Reservations, ec2types.Reservation{Instances: []ec2types.Instance{*i}})
+		if i.State.Name == ec2types.InstanceStateNamePending {
+			i.State = &ec2types.InstanceState{Name: ec2types.InstanceStateNameRunning}
+		}
+	}
+	return &out, nil
+}
+
+func (f *fakeEC2) StopInstances(_ context.Context, in *ec2.StopInstancesInput, _ ...func(*ec2.Options)) (*ec2.StopInstancesOutput, error) {
+	f.instances[in.InstanceIds[0]].State = &ec2types.InstanceState{Name: ec2types.InstanceStateNameStopped}
+	return &ec2.StopInstancesOutput{}, nil
+}
+
+func (f *fakeEC2) StartInstances(_ context.Context, in *ec2.StartInstancesInput, _ ...func(*ec2.Options)) (*ec2.StartInstancesOutput, error) {
+	f.instances[in.InstanceIds[0]].State = &ec2types.InstanceState{Name: ec2types.InstanceStateNamePending}
+	return &ec2.StartInstancesOutput{}, nil
+}
+
+func instance(id string, state ec2types.InstanceStateName, tags ...string) *ec2types.Instance {
+	i := &ec2types.Instance{InstanceId: aws.String(id), State: &ec2types.InstanceState{Name: state}}
+	for _, k := range tags {
+		i.Tags = append(i.Tags, ec2types.Tag{Key: aws.String(k), Value: aws.String("x")})
+	}
+	return i
+}
+
+func TestEC2Instances(t *testing.T) {
+	log.SetDefault(log.New(log.NewJSONHandler(io.Discard, nil)))
+	pluginPollInterval = time.Millisecond
+
+	api := &fakeEC2{instances: map[string]*ec2types.Instance{
+		"i-bastion": instance("i-bastion", ec2types.InstanceStateNameRunning),
+		"i-stopped": instance("i-stopped", ec2types.InstanceStateNameStopped),
+		"i-asg":     instance("i-asg", ec2types.InstanceStateNameRunning, asgInstanceTag),
+	}}
+	e := &EC2Instances{API: api, Tags: map[string]string{"environment": "staging"}, Timeout: time.Second}
+
+	statuses, err := e.Status(t.Context())
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []ResourceStatus{
+		{ID: "i-bastion", State: "running"},
+		{ID: "i-stopped", State: "stopped", Stopped: true},
+	}, statuses, "Expected the Auto Scaling group instance to be left out")
+
+	require.NoError(t, e.Stop(t.Context(), "i-bastion"))
+	assert.Equal(t, ec2types.InstanceStateNameStopped, api.instances["i-bastion"].State.Name)
+
+	require.NoError(t, e.Start(t.Context(), "i-bastion", "running"))
+	assert.Equal(t, ec2types.InstanceStateNameRunning, api.instances["i-bastion"].State.Name)
+
+	api.instances["i-bastion"].State.Name = ec2types.InstanceStateNameTerminated
+	assert.ErrorContains(t, e.Start(t.Context(), "i-bastion", "running"), "terminated")
+}
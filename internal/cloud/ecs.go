@@ -0,0 +1,149 @@
+package cloud
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+)
+
+// ecsMaxDescribeServices is the most services a single DescribeServices call accepts.
+const ecsMaxDescribeServices = 10
+
+// ECSAPI is the subset of the ECS client used to scale services.
+type ECSAPI interface {
+	ecs.ListServicesAPIClient
+	DescribeServices(ctx context.Context, params *ecs.DescribeServicesInput, optFns ...func(*ecs.Options)) (*ecs.DescribeServicesOutput, error)
+	UpdateService(ctx context.Context, params *ecs.UpdateServiceInput, optFns ...func(*ecs.Options)) (*ecs.UpdateServiceOutput, error)
+}
+
+// ECSServices is an ExternalResource plugin which scales ECS services to a desired count of zero, restoring their
+// original desired count at scale up.
+type ECSServices struct {
+	API     ECSAPI
+	Cluster string
+
+	// Services are the services to scale. "*" selects every service in the cluster
+	Services []string
+
+	Timeout time.Duration
+}
+
+// NewECSServices returns the plugin for the ECS_SERVICES in the ECS_CLUSTER cluster. Nil is returned if ECS_CLUSTER
+// is not set.
+func NewECSServices(ctx context.Context) (*ECSServices, error) {
+	cluster := os.Getenv("ECS_CLUSTER")
+	if cluster == "" {
+		return nil, nil
+	}
+
+	services := splitList(os.Getenv("ECS_SERVICES"))
+	if len(services) == 0 {
+		return nil, fmt.Errorf("ECS_SERVICES is required when ECS_CLUSTER is set")
+	}
+
+	timeout, err := parseTimeout("ECS_TIMEOUT", defaultPluginTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("loading aws config: %w", err)
+	}
+
+	return &ECSServices{API: ecs.NewFromConfig(cfg), Cluster: cluster, Services: services, Timeout: timeout}, nil
+}
+
+// Name implements ExternalResource.
+func (e *ECSServices) Name() string {
+	return "ecs-service"
+}
+
+// Status implements ExternalResource. The state of each service is its desired count.
+func (e *ECSServices) Status(ctx context.Context) ([]ResourceStatus, error) {
+	names := e.Services
+	if slices.Contains(names, "*") {
+		names = nil
+		pages := ecs.NewListServicesPaginator(e.API, &ecs.ListServicesInput{Cluster: aws.String(e.Cluster)})
+		for pages.HasMorePages() {
+			page, err := pages.NextPage(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("listing ECS services in cluster %s: %w", e.Cluster, err)
+			}
+			names = append(names, page.ServiceArns...)
+		}
+	}
+
+	var statuses []ResourceStatus
+	for batch := range slices.Chunk(names, ecsMaxDescribeServices) {
+		out, err := e.API.DescribeServices(ctx, &ecs.DescribeServicesInput{Cluster: aws.String(e.Cluster), Services: batch})
+		if err != nil {
+			return nil, fmt.Errorf("describing ECS services: %w", err)
+		}
+		if len(out.Failures) > 0 {
+			return nil, fmt.Errorf("describing ECS service %s: %s", aws.ToString(out.Failures[0].Arn), aws.ToString(out.Failures[0].Reason))
+		}
+
+		for _, s := range out.Services {
+			if aws.ToString(s.Status) != "ACTIVE" {
+				continue
+			}
+			statuses = append(statuses, ResourceStatus{
+				ID:      aws.ToString(s.ServiceName),
+				State:   strconv.Itoa(int(s.DesiredCount)),
+				Stopped: s.DesiredCount == 0,
+			})
+		}
+	}
+
+	return statuses, nil
+}
+
+// Stop implements ExternalResource.
+func (e *ECSServices) Stop(ctx context.Context, id string) error {
+	_, err := e.API.UpdateService(ctx, &ecs.UpdateServiceInput{Cluster: aws.String(e.Cluster), Service: aws.String(id), DesiredCount: aws.Int32(0)})
+	return err
+}
+
+// Start implements ExternalResource, restoring the desired count and waiting for the tasks to be running.
+func (e *ECSServices) Start(ctx context.Context, id, prior string) error {
+	desired, err := strconv.ParseInt(prior, 10, 32)
+	if err != nil {
+		return fmt.Errorf("parsing recorded desired count %q: %w", prior, err)
+	}
+
+	if _, err = e.API.UpdateService(ctx, &ecs.UpdateServiceInput{Cluster: aws.String(e.Cluster), Service: aws.String(id), DesiredCount: aws.Int32(int32(desired))}); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, e.Timeout)
+	defer cancel()
+
+	for {
+		out, err := e.API.DescribeServices(ctx, &ecs.DescribeServicesInput{Cluster: aws.String(e.Cluster), Services: []string{id}})
+		if err != nil {
+			return fmt.Errorf("describing ECS service: %w", err)
+		}
+		if len(out.Services) == 0 {
+			return fmt.Errorf("ECS service %s no longer exists", id)
+		}
+
+		running := out.Services[0].RunningCount
+		if running >= int32(desired) {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for ECS service %s to have %d running task(s), %d running", id, desired, running)
+		case <-time.After(pluginPollInterval):
+		}
+	}
+}
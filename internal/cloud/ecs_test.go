@@ -0,0 +1,79 @@
+package cloud
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeECS holds each service by name. Its running count catches up with the desired count when next described.
+type fakeECS struct {
+	services map[string]*ecstypes.Service
+}
+
+func (f *fakeECS) ListServices(context.Context, *ecs.ListServicesInput, ...func(*ecs.Options)) (*ecs.ListServicesOutput, error) {
+	var out ecs.ListServicesOutput
+	for name := range f.services {
+		out.ServiceArns = append(out.ServiceArns, name)
+	}
+	return &out, nil
+}
+
+func (f *fakeECS) DescribeServices(_ context.Context, in *ecs.DescribeServicesInput, _ ...func(*ecs.Options)) (*ecs.DescribeServicesOutput, error) {
+	var out ecs.DescribeServicesOutput
+	for _, name := range in.Services {
+		s, ok := f.services[name]
+		if !ok {
+			out.Failures = append(out.Failures, ecstypes.Failure{Arn: aws.String(name), Reason: aws.String("MISSING")})
+			continue
+		}
+		out.Services = append(out.Services, *s)
+		s.RunningCount = s.DesiredCount
+	}
+	return &out, nil
+}
+
+func (f *fakeECS) UpdateService(_ context.Context, in *ecs.UpdateServiceInput, _ ...func(*ecs.Options)) (*ecs.UpdateServiceOutput, error) {
+	f.services[*in.Service].DesiredCount = *in.DesiredCount
+	return &ecs.UpdateServiceOutput{}, nil
+}
+
+func ecsService(name, status string, desired int32) *ecstypes.Service {
+	return &ecstypes.Service{ServiceName: aws.String(name), Status: aws.String(status), DesiredCount: desired, RunningCount: desired}
+}
+
+func TestECSServices(t *testing.T) {
+	pluginPollInterval = time.Millisecond
+
+	api := &fakeECS{services: map[string]*ecstypes.Service{
+		"api":      ecsService("api", "ACTIVE", 3),
+		"worker":   ecsService("worker", "ACTIVE", 0),
+		"previous": ecsService("previous", "INACTIVE", 1),
+	}}
+	e := &ECSServices{API: api, Cluster: "staging", Services: []string{"*"}, Timeout: time.Second}
+
+	statuses, err := e.Status(t.Context())
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []ResourceStatus{
+		{ID: "api", State: "3"},
+		{ID: "worker", State: "0", Stopped: true},
+	}, statuses)
+
+	require.NoError(t, e.Stop(t.Context(), "api"))
+	assert.Equal(t, int32(0), api.services["api"].DesiredCount)
+
+	require.NoError(t, e.Start(t.Context(), "api", "3"))
+	assert.Equal(t, int32(3), api.services["api"].DesiredCount)
+	assert.Equal(t, int32(3), api.services["api"].RunningCount)
+
+	assert.Error(t, e.Start(t.Context(), "api", "three"))
+
+	_, err = (&ECSServices{API: api, Cluster: "staging", Services: []string{"missing"}}).Status(t.Context())
+	assert.ErrorContains(t, err, "MISSING")
+}
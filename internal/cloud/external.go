@@ -0,0 +1,280 @@
+package cloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "log/slog"
+	"maps"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/michaelprice232/eks-env-scaledown/internal/state"
+)
+
+// externalStateKeyPrefix prefixes the state key holding the prior state of each resource stopped by a plugin, as
+// id=state. Resources which were already stopped are not recorded, so stay stopped at scale up.
+const externalStateKeyPrefix = "external-"
+
+// DefaultGroup positions a plugin's resources outside the startup groups: they are stopped after every group has been
+// scaled down, and started before the first group is scaled up.
+const DefaultGroup = math.MinInt
+
+// ExternalResource is a plugin which stops and starts a type of AWS resource tied to the environment, such as its EC2
+// bastions or ECS services. The prior state of each resource is persisted between the scale down and the scale up
+// by ExternalResources, so the plugins themselves are stateless.
+type ExternalResource interface {
+	// Name identifies the plugin in logs, the run report and the state, e.g. "ec2-instance"
+	Name() string
+
+	// Status returns the current state of every resource the plugin manages
+	Status(ctx context.Context) ([]ResourceStatus, error)
+
+	// Stop stops a single running resource
+	Stop(ctx context.Context, id string) error
+
+	// Start restores a single resource to the state it was in before Stop, waiting for it to be ready
+	Start(ctx context.Context, id, prior string) error
+}
+
+// ResourceStatus is the state of a single resource managed by an ExternalResource plugin. State is what the
+// plugin needs to restore the resource, such as the desired count of an ECS service.
+type ResourceStatus struct {
+	ID      string
+	State   string
+	Stopped bool
+}
+
+// ResourceChange records what happened to a single resource. Reason is set when Change is "skipped".
+type ResourceChange struct {
+	Kind   string
+	ID     string
+	Change string
+	Reason string
+}
+
+// Plugin is an ExternalResource along with the startup group its resources belong to. They are stopped once the group
+// has been scaled down, and started before it is scaled up, so workloads in later groups can depend on them.
+type Plugin struct {
+	ExternalResource
+	Group int
+}
+
+// ExternalResources stops and starts the resources of each plugin at their point in the run.
+type ExternalResources struct {
+	Plugins []Plugin
+	store   *state.Store
+
+	// done holds the plugins which have already run, as the remaining ones are run at the end
+	done map[string]bool
+}
+
+// NewExternalResources returns the plugins configured through envars, persisting their prior state in store. Nil is
+// returned if no plugins are configured.
+func NewExternalResources(ctx context.Context, store *state.Store) (*ExternalResources, error) {
+	var plugins []Plugin
+
+	ec2Plugin, err := NewEC2Instances(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("creating EC2 plugin: %w", err)
+	}
+	if ec2Plugin != nil {
+		plugins = append(plugins, Plugin{ExternalResource: ec2Plugin})
+	}
+
+	ecsPlugin, err := NewECSServices(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("creating ECS plugin: %w", err)
+	}
+	if ecsPlugin != nil {
+		plugins = append(plugins, Plugin{ExternalResource: ecsPlugin})
+	}
+
+	if len(plugins) == 0 {
+		return nil, nil
+	}
+
+	for i, p := range plugins {
+		if plugins[i].Group, err = pluginGroup(p.Name()); err != nil {
+			return nil, err
+		}
+	}
+
+	return &ExternalResources{Plugins: plugins, store: store}, nil
+}
+
+// pluginGroup reads the startup group of a plugin from <NAME>_STARTUP_GROUP, e.g. EC2_INSTANCE_STARTUP_GROUP.
+func pluginGroup(name string) (int, error) {
+	key := strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_STARTUP_GROUP"
+	raw := os.Getenv(key)
+	if raw == "" {
+		return DefaultGroup, nil
+	}
+
+	group, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, fmt.Errorf("parsing %s: %w", key, err)
+	}
+
+	return group, nil
+}
+
+// StopAfterGroup stops the plugins belonging to group, or a later group, once group has been scaled down. The plugins
+// of the keptAlive groups are left running, as their kept alive workloads may still be using them. A nil
+// *ExternalResources is a no-op.
+func (e *ExternalResources) StopAfterGroup(ctx context.Context, group int, keptAlive map[int]bool) ([]ResourceChange, error) {
+	return e.run(ctx, true, func(p Plugin) bool { return p.Group != DefaultGroup && p.Group >= group && !keptAlive[p.Group] })
+}
+
+// StartBeforeGroup starts the plugins belonging to group, or an earlier group, before group is scaled up. A nil
+// *ExternalResources is a no-op.
+func (e *ExternalResources) StartBeforeGroup(ctx context.Context, group int) ([]ResourceChange, error) {
+	return e.run(ctx, false, func(p Plugin) bool { return p.Group <= group })
+}
+
+// StopRemaining stops the plugins which haven't already run, such as those outside the startup groups.
+func (e *ExternalResources) StopRemaining(ctx context.Context) ([]ResourceChange, error) {
+	return e.run(ctx, true, func(Plugin) bool { return true })
+}
+
+// StartRemaining starts the plugins which haven't already run, such as those belonging to a group after the last.
+func (e *ExternalResources) StartRemaining(ctx context.Context) ([]ResourceChange, error) {
+	return e.run(ctx, false, func(Plugin) bool { return true })
+}
+
+// run stops or starts each plugin matching include which hasn't already run. Every plugin is attempted, with the
+// failures returned together.
+func (e *ExternalResources) run(ctx context.Context, stop bool, include func(Plugin) bool) ([]ResourceChange, error) {
+	if e == nil {
+		return nil, nil
+	}
+	if e.done == nil {
+		e.done = make(map[string]bool)
+	}
+
+	var (
+		changes []ResourceChange
+		errs    []error
+	)
+	for _, p := range e.Plugins {
+		if e.done[p.Name()] || !include(p) {
+			continue
+		}
+		e.done[p.Name()] = true
+
+		var (
+			pluginChanges []ResourceChange
+			err           error
+		)
+		if stop {
+			pluginChanges, err = stopResources(ctx, e.store, p)
+		} else {
+			pluginChanges, err = startResources(ctx, e.store, p)
+		}
+		changes = append(changes, pluginChanges...)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", p.Name(), err))
+		}
+	}
+
+	return changes, errors.Join(errs...)
+}
+
+// stopResources records the prior state of each running resource and stops it. A resource which an earlier scale
+// down already recorded keeps its original record.
+func stopResources(ctx context.Context, store *state.Store, p ExternalResource) ([]ResourceChange, error) {
+	key := externalStateKeyPrefix + p.Name()
+	raw, _, err := store.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	recorded := decodePriorState(raw)
+
+	statuses, err := p.Status(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getting status: %w", err)
+	}
+
+	var (
+		changes []ResourceChange
+		errs    []error
+	)
+	for _, s := range statuses {
+		_, wasRecorded := recorded[s.ID]
+		if s.Stopped {
+			if !wasRecorded {
+				log.Info("Skipping resource which was already stopped", "kind", p.Name(), "id", s.ID)
+				changes = append(changes, ResourceChange{Kind: p.Name(), ID: s.ID, Change: "skipped", Reason: "stopped before the scale down"})
+			}
+			continue
+		}
+
+		// Record the prior state first, so the resource is started again even if this run fails part way through
+		if !wasRecorded {
+			recorded[s.ID] = s.State
+			if err = store.Set(ctx, key, encodePriorState(recorded)); err != nil {
+				return changes, fmt.Errorf("recording %s: %w", s.ID, err)
+			}
+		}
+
+		log.Info("Stopping resource", "kind", p.Name(), "id", s.ID, "state", s.State)
+		if err = p.Stop(ctx, s.ID); err != nil {
+			errs = append(errs, fmt.Errorf("stopping %s: %w", s.ID, err))
+			continue
+		}
+		changes = append(changes, ResourceChange{Kind: p.Name(), ID: s.ID, Change: "stopped"})
+	}
+
+	return changes, errors.Join(errs...)
+}
+
+// startResources restores each resource recorded by stopResources. The record is removed once every one has started.
+func startResources(ctx context.Context, store *state.Store, p ExternalResource) ([]ResourceChange, error) {
+	key := externalStateKeyPrefix + p.Name()
+	raw, _, err := store.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	recorded := decodePriorState(raw)
+
+	var (
+		changes []ResourceChange
+		errs    []error
+	)
+	for _, id := range slices.Sorted(maps.Keys(recorded)) {
+		log.Info("Starting resource", "kind", p.Name(), "id", id, "state", recorded[id])
+		if err = p.Start(ctx, id, recorded[id]); err != nil {
+			errs = append(errs, fmt.Errorf("starting %s: %w", id, err))
+			continue
+		}
+		changes = append(changes, ResourceChange{Kind: p.Name(), ID: id, Change: "started"})
+	}
+
+	if len(errs) > 0 {
+		return changes, errors.Join(errs...)
+	}
+
+	return changes, store.Delete(ctx, key)
+}
+
+func decodePriorState(raw string) map[string]string {
+	recorded := make(map[string]string)
+	for _, entry := range splitList(raw) {
+		id, prior, _ := strings.Cut(entry, "=")
+		recorded[id] = prior
+	}
+
+	return recorded
+}
+
+func encodePriorState(recorded map[string]string) string {
+	entries := make([]string, 0, len(recorded))
+	for _, id := range slices.Sorted(maps.Keys(recorded)) {
+		entries = append(entries, id+"="+recorded[id])
+	}
+
+	return strings.Join(entries, ",")
+}
@@ -0,0 +1,199 @@
+package cloud
+
+import (
+	"context"
+	"fmt"
+	"io"
+	log "log/slog"
+	"testing"
+
+	"github.com/michaelprice232/eks-env-scaledown/internal/state"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// fakePlugin holds the state of each resource, recording the order it was stopped and started in on calls.
+type fakePlugin struct {
+	name      string
+	resources map[string]string
+	stopped   map[string]bool
+	failStart bool
+	calls     *[]string
+}
+
+func (f *fakePlugin) Name() string {
+	return f.name
+}
+
+func (f *fakePlugin) Status(context.Context) ([]ResourceStatus, error) {
+	var statuses []ResourceStatus
+	for id, s := range f.resources {
+		statuses = append(statuses, ResourceStatus{ID: id, State: s, Stopped: f.stopped[id]})
+	}
+	return statuses, nil
+}
+
+func (f *fakePlugin) Stop(_ context.Context, id string) error {
+	*f.calls = append(*f.calls, "stop "+f.name+"/"+id)
+	f.stopped[id] = true
+	return nil
+}
+
+func (f *fakePlugin) Start(_ context.Context, id, prior string) error {
+	if f.failStart {
+		return fmt.Errorf("failed to start")
+	}
+	*f.calls = append(*f.calls, "start "+f.name+"/"+id)
+	f.stopped[id] = false
+	f.resources[id] = prior
+	return nil
+}
+
+func newFakePlugin(name string, calls *[]string) *fakePlugin {
+	return &fakePlugin{name: name, resources: map[string]string{"a": "2"}, stopped: map[string]bool{}, calls: calls}
+}
+
+func TestPluginGroup(t *testing.T) {
+	t.Run("defaults to outside the startup groups", func(t *testing.T) {
+		t.Setenv("EC2_INSTANCE_STARTUP_GROUP", "")
+
+		group, err := pluginGroup("ec2-instance")
+		assert.NoError(t, err)
+		assert.Equal(t, DefaultGroup, group)
+	})
+
+	t.Run("reads the group from the plugin's envar", func(t *testing.T) {
+		t.Setenv("ECS_SERVICE_STARTUP_GROUP", "2")
+
+		group, err := pluginGroup("ecs-service")
+		assert.NoError(t, err)
+		assert.Equal(t, 2, group)
+	})
+
+	t.Run("invalid group", func(t *testing.T) {
+		t.Setenv("ECS_SERVICE_STARTUP_GROUP", "two")
+
+		_, err := pluginGroup("ecs-service")
+		assert.Error(t, err)
+	})
+}
+
+func TestExternalResources(t *testing.T) {
+	log.SetDefault(log.New(log.NewJSONHandler(io.Discard, nil)))
+
+	t.Run("nil is a no-op", func(t *testing.T) {
+		var e *ExternalResources
+
+		changes, err := e.StopAfterGroup(t.Context(), 1, nil)
+		assert.NoError(t, err)
+		assert.Empty(t, changes)
+
+		changes, err = e.StartRemaining(t.Context())
+		assert.NoError(t, err)
+		assert.Empty(t, changes)
+	})
+
+	t.Run("plugins run around their startup group", func(t *testing.T) {
+		var calls []string
+		store := state.New(fake.NewClientset(), "eks-env-scaledown")
+		newRun := func() *ExternalResources {
+			return &ExternalResources{store: store, Plugins: []Plugin{
+				{ExternalResource: newFakePlugin("default", &calls), Group: DefaultGroup},
+				{ExternalResource: newFakePlugin("group-1", &calls), Group: 1},
+				{ExternalResource: newFakePlugin("group-3", &calls), Group: 3},
+			}}
+		}
+
+		// Scaling down groups 2 then 1: group-3 is stopped after group 2 as it belongs to a later group
+		down := newRun()
+		for _, g := range []int{2, 1} {
+			_, err := down.StopAfterGroup(t.Context(), g, nil)
+			require.NoError(t, err)
+			calls = append(calls, fmt.Sprintf("group %d", g))
+		}
+		_, err := down.StopRemaining(t.Context())
+		require.NoError(t, err)
+		assert.Equal(t, []string{"stop group-3/a", "group 2", "stop group-1/a", "group 1", "stop default/a"}, calls)
+
+		// Scaling up groups 1 then 2: group-3 is started at the end as there is no group 3
+		calls = nil
+		up := newRun()
+		for _, g := range []int{1, 2} {
+			_, err = up.StartBeforeGroup(t.Context(), g)
+			require.NoError(t, err)
+			calls = append(calls, fmt.Sprintf("group %d", g))
+		}
+		_, err = up.StartRemaining(t.Context())
+		require.NoError(t, err)
+		assert.Equal(t, []string{"start default/a", "start group-1/a", "group 1", "group 2", "start group-3/a"}, calls)
+	})
+
+	t.Run("plugins of kept alive groups are left running", func(t *testing.T) {
+		var calls []string
+		e := &ExternalResources{store: state.New(fake.NewClientset(), "eks-env-scaledown"), Plugins: []Plugin{
+			{ExternalResource: newFakePlugin("group-1", &calls), Group: 1},
+			{ExternalResource: newFakePlugin("group-5", &calls), Group: 5},
+		}}
+
+		// Scaling down group 5, whose hook is skipped as it has a kept alive workload, then group 1
+		_, err := e.StopAfterGroup(t.Context(), 1, map[int]bool{5: true})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"stop group-1/a"}, calls)
+	})
+
+	t.Run("resources are stopped and restored to their prior state", func(t *testing.T) {
+		var calls []string
+		plugin := newFakePlugin("ecs-service", &calls)
+		plugin.resources["already-stopped"] = "0"
+		plugin.stopped["already-stopped"] = true
+		store := state.New(fake.NewClientset(), "eks-env-scaledown")
+		e := &ExternalResources{store: store, Plugins: []Plugin{{ExternalResource: plugin, Group: DefaultGroup}}}
+
+		changes, err := e.StopRemaining(t.Context())
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []ResourceChange{
+			{Kind: "ecs-service", ID: "a", Change: "stopped"},
+			{Kind: "ecs-service", ID: "already-stopped", Change: "skipped", Reason: "stopped before the scale down"},
+		}, changes)
+
+		recorded, _, err := store.Get(t.Context(), "external-ecs-service")
+		require.NoError(t, err)
+		assert.Equal(t, "a=2", recorded)
+
+		// A repeated scale down keeps the original record
+		plugin.resources["a"] = "0"
+		_, err = (&ExternalResources{store: store, Plugins: e.Plugins}).StopRemaining(t.Context())
+		require.NoError(t, err)
+		recorded, _, err = store.Get(t.Context(), "external-ecs-service")
+		require.NoError(t, err)
+		assert.Equal(t, "a=2", recorded)
+
+		changes, err = (&ExternalResources{store: store, Plugins: e.Plugins}).StartRemaining(t.Context())
+		require.NoError(t, err)
+		assert.Equal(t, []ResourceChange{{Kind: "ecs-service", ID: "a", Change: "started"}}, changes)
+		assert.Equal(t, "2", plugin.resources["a"])
+		assert.True(t, plugin.stopped["already-stopped"], "Expected the resource stopped before the scale down to stay stopped")
+
+		_, found, err := store.Get(t.Context(), "external-ecs-service")
+		require.NoError(t, err)
+		assert.False(t, found)
+	})
+
+	t.Run("the record is kept when a resource fails to start", func(t *testing.T) {
+		var calls []string
+		plugin := newFakePlugin("ec2-instance", &calls)
+		plugin.failStart = true
+		store := state.New(fake.NewClientset(), "eks-env-scaledown")
+		require.NoError(t, store.Set(t.Context(), "external-ec2-instance", "a=running"))
+		e := &ExternalResources{store: store, Plugins: []Plugin{{ExternalResource: plugin, Group: DefaultGroup}}}
+
+		_, err := e.StartRemaining(t.Context())
+		assert.ErrorContains(t, err, "ec2-instance: starting a")
+
+		_, found, err := store.Get(t.Context(), "external-ec2-instance")
+		require.NoError(t, err)
+		assert.True(t, found, "Expected the record to be kept for the next scale up")
+	})
+}
@@ -0,0 +1,506 @@
+package cloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "log/slog"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/michaelprice232/eks-env-scaledown/internal/state"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	asgtypes "github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	"github.com/aws/aws-sdk-go-v2/service/eks"
+	ekstypes "github.com/aws/aws-sdk-go-v2/service/eks/types"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// nodeGroupsStateKey is the state key holding the capacity of each node group before the scale down, as
+// kind:name=min/desired. Node groups which were already scaled to zero are not recorded, so stay at zero at scale up.
+const nodeGroupsStateKey = "node-group-capacity"
+
+// defaultNodeGroupTimeout is how long to wait for the nodes to be Ready, when NODE_GROUP_TIMEOUT is not set.
+const defaultNodeGroupTimeout = 15 * time.Minute
+
+// The kinds of node group which can be scaled.
+const (
+	NodeGroupManaged     = "eks-nodegroup"
+	NodeGroupAutoScaling = "autoscaling-group"
+)
+
+// nodeGroupLabel is set by EKS on the nodes in a managed node group, and nodeGroupTag on its Auto Scaling group.
+const (
+	nodeGroupLabel = "eks.amazonaws.com/nodegroup"
+	nodeGroupTag   = "eks:nodegroup-name"
+)
+
+// nodePollInterval is how often the nodes are listed whilst waiting for them to be Ready.
+var nodePollInterval = 10 * time.Second
+
+// EKSAPI is the subset of the EKS client used to scale managed node groups.
+type EKSAPI interface {
+	eks.ListNodegroupsAPIClient
+	DescribeNodegroup(ctx context.Context, params *eks.DescribeNodegroupInput, optFns ...func(*eks.Options)) (*eks.DescribeNodegroupOutput, error)
+	UpdateNodegroupConfig(ctx context.Context, params *eks.UpdateNodegroupConfigInput, optFns ...func(*eks.Options)) (*eks.UpdateNodegroupConfigOutput, error)
+}
+
+// AutoScalingAPI is the subset of the Auto Scaling client used to scale self-managed node groups.
+type AutoScalingAPI interface {
+	autoscaling.DescribeAutoScalingGroupsAPIClient
+	UpdateAutoScalingGroup(ctx context.Context, params *autoscaling.UpdateAutoScalingGroupInput, optFns ...func(*autoscaling.Options)) (*autoscaling.UpdateAutoScalingGroupOutput, error)
+}
+
+// NodeGroupClient scales the selected EKS managed node groups and self-managed Auto Scaling groups to zero whilst
+// the environment is scaled down, for clusters which don't use Karpenter.
+type NodeGroupClient struct {
+	EKS         EKSAPI
+	AutoScaling AutoScalingAPI
+	K8s         kubernetes.Interface
+
+	// Cluster is the EKS cluster whose managed node groups are scaled
+	Cluster string
+
+	// NodeGroups are the managed node groups to scale. "*" selects every node group in the cluster
+	NodeGroups []string
+
+	// AutoScalingTags select the self-managed Auto Scaling groups carrying every tag
+	AutoScalingTags map[string]string
+
+	// Exclude lists the node groups and Auto Scaling groups which are never scaled, such as the system node group
+	// running this app
+	Exclude []string
+
+	// Timeout is how long to wait for the restored nodes to be Ready
+	Timeout time.Duration
+}
+
+// NodeGroup is an EKS managed node group or self-managed Auto Scaling group, along with its capacity.
+type NodeGroup struct {
+	Kind    string
+	Name    string
+	MinSize int32
+	Desired int32
+}
+
+// key identifies the node group in the state.
+func (g NodeGroup) key() string {
+	return g.Kind + ":" + g.Name
+}
+
+// NodeGroupChange records what happened to a single node group. Reason is set when Change is "skipped".
+type NodeGroupChange struct {
+	NodeGroup
+	Change string
+	Reason string
+}
+
+// NewNodeGroupClient returns a client for the node groups listed in NODE_GROUPS (in the EKS_CLUSTER_NAME cluster)
+// and the Auto Scaling groups tagged with AUTOSCALING_GROUP_TAGS. Nil is returned if neither is set, so the node
+// groups are left alone.
+func NewNodeGroupClient(ctx context.Context, k8s kubernetes.Interface) (*NodeGroupClient, error) {
+	asgTags, err := parseTags("AUTOSCALING_GROUP_TAGS")
+	if err != nil {
+		return nil, err
+	}
+
+	c := &NodeGroupClient{
+		K8s:             k8s,
+		Cluster:         os.Getenv("EKS_CLUSTER_NAME"),
+		NodeGroups:      splitList(os.Getenv("NODE_GROUPS")),
+		AutoScalingTags: asgTags,
+		Exclude:         splitList(os.Getenv("SYSTEM_NODE_GROUPS")),
+	}
+	if len(c.NodeGroups) == 0 && len(c.AutoScalingTags) == 0 {
+		log.Warn("NODE_GROUPS and AUTOSCALING_GROUP_TAGS envars not set. Node groups will not be scaled")
+		return nil, nil
+	}
+	if len(c.NodeGroups) > 0 && c.Cluster == "" {
+		return nil, fmt.Errorf("EKS_CLUSTER_NAME is required when NODE_GROUPS is set")
+	}
+
+	if c.Timeout, err = parseTimeout("NODE_GROUP_TIMEOUT", defaultNodeGroupTimeout); err != nil {
+		return nil, err
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("loading aws config: %w", err)
+	}
+	c.EKS = eks.NewFromConfig(cfg)
+	c.AutoScaling = autoscaling.NewFromConfig(cfg)
+
+	return c, nil
+}
+
+// listNodeGroups returns the selected node groups with their current capacity, leaving out those excluded.
+func (c *NodeGroupClient) listNodeGroups(ctx context.Context) ([]NodeGroup, error) {
+	var groups []NodeGroup
+
+	names := c.NodeGroups
+	if slices.Contains(names, "*") {
+		names = nil
+		pages := eks.NewListNodegroupsPaginator(c.EKS, &eks.ListNodegroupsInput{ClusterName: aws.String(c.Cluster)})
+		for pages.HasMorePages() {
+			page, err := pages.NextPage(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("listing node groups in cluster %s: %w", c.Cluster, err)
+			}
+			names = append(names, page.Nodegroups...)
+		}
+	}
+
+	for _, name := range names {
+		if slices.Contains(c.Exclude, name) {
+			continue
+		}
+
+		scaling, err := c.describeNodeGroup(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, NodeGroup{Kind: NodeGroupManaged, Name: name, MinSize: aws.ToInt32(scaling.MinSize), Desired: aws.ToInt32(scaling.DesiredSize)})
+	}
+
+	if len(c.AutoScalingTags) == 0 {
+		return groups, nil
+	}
+
+	pages := autoscaling.NewDescribeAutoScalingGroupsPaginator(c.AutoScaling, &autoscaling.DescribeAutoScalingGroupsInput{Filters: c.autoScalingFilters()})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("describing Auto Scaling groups: %w", err)
+		}
+		for _, asg := range page.AutoScalingGroups {
+			name := aws.ToString(asg.AutoScalingGroupName)
+			// The Auto Scaling groups behind managed node groups are scaled through EKS
+			managed := slices.ContainsFunc(asg.Tags, func(t asgtypes.TagDescription) bool { return aws.ToString(t.Key) == nodeGroupTag })
+			if managed || slices.Contains(c.Exclude, name) {
+				continue
+			}
+			groups = append(groups, NodeGroup{Kind: NodeGroupAutoScaling, Name: name, MinSize: aws.ToInt32(asg.MinSize), Desired: aws.ToInt32(asg.DesiredCapacity)})
+		}
+	}
+
+	return groups, nil
+}
+
+// autoScalingFilters select the Auto Scaling groups carrying every tag in AutoScalingTags.
+func (c *NodeGroupClient) autoScalingFilters() []asgtypes.Filter {
+	var filters []asgtypes.Filter
+	for k, v := range c.AutoScalingTags {
+		filters = append(filters, asgtypes.Filter{Name: aws.String("tag:" + k), Values: []string{v}})
+	}
+
+	return filters
+}
+
+// nodeGroupsHosting returns the keys of the node groups running any of the nodes. Managed node groups label their
+// nodes, whereas the nodes of an Auto Scaling group are matched to its instances through their provider ID.
+func (c *NodeGroupClient) nodeGroupsHosting(ctx context.Context, nodes []string) (map[string]bool, error) {
+	hosting := make(map[string]bool)
+	var instances []string
+	for _, name := range nodes {
+		node, err := c.K8s.CoreV1().Nodes().Get(ctx, name, metav1.GetOptions{})
+		if k8serrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("getting node %s: %w", name, err)
+		}
+
+		if group, found := node.Labels[nodeGroupLabel]; found {
+			hosting[NodeGroup{Kind: NodeGroupManaged, Name: group}.key()] = true
+			continue
+		}
+		// The provider ID is in the format aws:///<zone>/<instance ID>
+		instances = append(instances, node.Spec.ProviderID[strings.LastIndex(node.Spec.ProviderID, "/")+1:])
+	}
+
+	if len(instances) == 0 || len(c.AutoScalingTags) == 0 {
+		return hosting, nil
+	}
+
+	pages := autoscaling.NewDescribeAutoScalingGroupsPaginator(c.AutoScaling, &autoscaling.DescribeAutoScalingGroupsInput{Filters: c.autoScalingFilters()})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("describing Auto Scaling groups: %w", err)
+		}
+		for _, asg := range page.AutoScalingGroups {
+			if slices.ContainsFunc(asg.Instances, func(i asgtypes.Instance) bool { return slices.Contains(instances, aws.ToString(i.InstanceId)) }) {
+				hosting[NodeGroup{Kind: NodeGroupAutoScaling, Name: aws.ToString(asg.AutoScalingGroupName)}.key()] = true
+			}
+		}
+	}
+
+	return hosting, nil
+}
+
+func (c *NodeGroupClient) describeNodeGroup(ctx context.Context, name string) (*ekstypes.NodegroupScalingConfig, error) {
+	out, err := c.EKS.DescribeNodegroup(ctx, &eks.DescribeNodegroupInput{ClusterName: aws.String(c.Cluster), NodegroupName: aws.String(name)})
+	if err != nil {
+		return nil, fmt.Errorf("describing node group %s: %w", name, err)
+	}
+	if out.Nodegroup == nil || out.Nodegroup.ScalingConfig == nil {
+		return nil, fmt.Errorf("node group %s has no scaling config", name)
+	}
+
+	return out.Nodegroup.ScalingConfig, nil
+}
+
+// resize sets the minimum and desired capacity of g. The maximum of a managed node group is raised if needed, as
+// EKS requires it to be at least the desired size.
+func (c *NodeGroupClient) resize(ctx context.Context, g NodeGroup) error {
+	if g.Kind == NodeGroupAutoScaling {
+		_, err := c.AutoScaling.UpdateAutoScalingGroup(ctx, &autoscaling.UpdateAutoScalingGroupInput{
+			AutoScalingGroupName: aws.String(g.Name),
+			MinSize:              aws.Int32(g.MinSize),
+			DesiredCapacity:      aws.Int32(g.Desired),
+		})
+		return err
+	}
+
+	scaling, err := c.describeNodeGroup(ctx, g.Name)
+	if err != nil {
+		return err
+	}
+	_, err = c.EKS.UpdateNodegroupConfig(ctx, &eks.UpdateNodegroupConfigInput{
+		ClusterName:   aws.String(c.Cluster),
+		NodegroupName: aws.String(g.Name),
+		ScalingConfig: &ekstypes.NodegroupScalingConfig{
+			MinSize:     aws.Int32(g.MinSize),
+			DesiredSize: aws.Int32(g.Desired),
+			MaxSize:     aws.Int32(max(aws.ToInt32(scaling.MaxSize), g.Desired, 1)),
+		},
+	})
+	return err
+}
+
+// recordedNodeGroups decodes the node group capacities recorded by an earlier scale down, keyed by kind:name.
+func recordedNodeGroups(raw string) (map[string]NodeGroup, error) {
+	groups := make(map[string]NodeGroup)
+	for _, entry := range splitList(raw) {
+		key, capacity, _ := strings.Cut(entry, "=")
+		kind, name, _ := strings.Cut(key, ":")
+		minRaw, desiredRaw, _ := strings.Cut(capacity, "/")
+
+		minSize, err := strconv.ParseInt(minRaw, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("parsing recorded node group %q: %w", entry, err)
+		}
+		desired, err := strconv.ParseInt(desiredRaw, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("parsing recorded node group %q: %w", entry, err)
+		}
+		groups[key] = NodeGroup{Kind: kind, Name: name, MinSize: int32(minSize), Desired: int32(desired)}
+	}
+
+	return groups, nil
+}
+
+func encodeNodeGroups(groups map[string]NodeGroup) string {
+	entries := make([]string, 0, len(groups))
+	for key, g := range groups {
+		entries = append(entries, fmt.Sprintf("%s=%d/%d", key, g.MinSize, g.Desired))
+	}
+	slices.Sort(entries)
+
+	return strings.Join(entries, ",")
+}
+
+// ScaleDownNodeGroups records the capacity of each selected node group and scales it to zero. A node group which an
+// earlier scale down already recorded keeps its original record. Node groups which were already at zero, or which run
+// any of the inUse nodes hosting the pods left running by the scale down, are skipped. Every node group is attempted,
+// with the failures returned together. A nil client is a no-op.
+func (c *NodeGroupClient) ScaleDownNodeGroups(ctx context.Context, store *state.Store, inUse []string) ([]NodeGroupChange, error) {
+	if c == nil {
+		return nil, nil
+	}
+
+	raw, _, err := store.Get(ctx, nodeGroupsStateKey)
+	if err != nil {
+		return nil, err
+	}
+	recorded, err := recordedNodeGroups(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	groups, err := c.listNodeGroups(ctx)
+	if err != nil {
+		return nil, err
+	}
+	hosting, err := c.nodeGroupsHosting(ctx, inUse)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		changes []NodeGroupChange
+		errs    []error
+	)
+	for _, g := range groups {
+		if hosting[g.key()] {
+			log.Info("Skipping node group which runs pods left running by the scale down", "kind", g.Kind, "name", g.Name)
+			changes = append(changes, NodeGroupChange{NodeGroup: g, Change: "skipped", Reason: "runs pods left running by the scale down"})
+			continue
+		}
+
+		_, wasRecorded := recorded[g.key()]
+		if g.MinSize == 0 && g.Desired == 0 {
+			if !wasRecorded {
+				log.Info("Skipping node group which was already scaled to zero", "kind", g.Kind, "name", g.Name)
+				changes = append(changes, NodeGroupChange{NodeGroup: g, Change: "skipped", Reason: "scaled to zero before the scale down"})
+			}
+			continue
+		}
+
+		// Record the capacity first, so it is restored even if this run fails part way through
+		if !wasRecorded {
+			recorded[g.key()] = g
+			if err = store.Set(ctx, nodeGroupsStateKey, encodeNodeGroups(recorded)); err != nil {
+				return changes, fmt.Errorf("recording %s %s: %w", g.Kind, g.Name, err)
+			}
+		}
+
+		log.Info("Scaling node group to zero", "kind", g.Kind, "name", g.Name, "minSize", g.MinSize, "desired", g.Desired)
+		if err = c.resize(ctx, NodeGroup{Kind: g.Kind, Name: g.Name}); err != nil {
+			errs = append(errs, fmt.Errorf("scaling %s %s to zero: %w", g.Kind, g.Name, err))
+			continue
+		}
+		changes = append(changes, NodeGroupChange{NodeGroup: g, Change: "scaled to zero"})
+	}
+
+	return changes, errors.Join(errs...)
+}
+
+// RestoreNodeGroups restores the capacity recorded by ScaleDownNodeGroups and waits for the nodes to be Ready, so the
+// first startup group has somewhere to run. The record is removed once every node group is back. A nil client is a no-op.
+func (c *NodeGroupClient) RestoreNodeGroups(ctx context.Context, store *state.Store) ([]NodeGroupChange, error) {
+	if c == nil {
+		return nil, nil
+	}
+
+	raw, _, err := store.Get(ctx, nodeGroupsStateKey)
+	if err != nil {
+		return nil, err
+	}
+	recorded, err := recordedNodeGroups(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		restored []NodeGroup
+		errs     []error
+	)
+	for _, key := range slices.Sorted(maps.Keys(recorded)) {
+		g := recorded[key]
+		log.Info("Restoring node group", "kind", g.Kind, "name", g.Name, "minSize", g.MinSize, "desired", g.Desired)
+		if err = c.resize(ctx, g); err != nil {
+			errs = append(errs, fmt.Errorf("restoring %s %s: %w", g.Kind, g.Name, err))
+			continue
+		}
+		restored = append(restored, g)
+	}
+
+	var changes []NodeGroupChange
+	for _, g := range restored {
+		if err = c.waitForNodes(ctx, g); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		changes = append(changes, NodeGroupChange{NodeGroup: g, Change: "restored"})
+	}
+
+	if len(errs) > 0 {
+		return changes, errors.Join(errs...)
+	}
+
+	return changes, store.Delete(ctx, nodeGroupsStateKey)
+}
+
+// waitForNodes waits until g has at least its desired number of Ready nodes.
+func (c *NodeGroupClient) waitForNodes(ctx context.Context, g NodeGroup) error {
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	log.Info("Waiting for node group nodes to be Ready", "kind", g.Kind, "name", g.Name, "desired", g.Desired)
+	for {
+		ready, err := c.readyNodes(ctx, g)
+		if err != nil {
+			return fmt.Errorf("counting Ready nodes in %s %s: %w", g.Kind, g.Name, err)
+		}
+		if ready >= int(g.Desired) {
+			return nil
+		}
+
+		log.Debug("Waiting for nodes", "kind", g.Kind, "name", g.Name, "ready", ready, "desired", g.Desired)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for %s %s to have %d Ready node(s), %d Ready", g.Kind, g.Name, g.Desired, ready)
+		case <-time.After(nodePollInterval):
+		}
+	}
+}
+
+// readyNodes counts the Ready nodes in g. Managed node groups label their nodes, whereas the nodes of an Auto Scaling
+// group are matched to its instances through their provider ID.
+func (c *NodeGroupClient) readyNodes(ctx context.Context, g NodeGroup) (int, error) {
+	if g.Kind == NodeGroupManaged {
+		nodes, err := c.K8s.CoreV1().Nodes().List(ctx, metav1.ListOptions{LabelSelector: nodeGroupLabel + "=" + g.Name})
+		if err != nil {
+			return 0, err
+		}
+		return countReady(nodes.Items, func(corev1.Node) bool { return true }), nil
+	}
+
+	out, err := c.AutoScaling.DescribeAutoScalingGroups(ctx, &autoscaling.DescribeAutoScalingGroupsInput{AutoScalingGroupNames: []string{g.Name}})
+	if err != nil {
+		return 0, err
+	}
+	var instances []string
+	for _, asg := range out.AutoScalingGroups {
+		for _, i := range asg.Instances {
+			instances = append(instances, aws.ToString(i.InstanceId))
+		}
+	}
+
+	nodes, err := c.K8s.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return 0, err
+	}
+
+	// The provider ID is in the format aws:///<zone>/<instance ID>
+	return countReady(nodes.Items, func(n corev1.Node) bool {
+		return slices.Contains(instances, n.Spec.ProviderID[strings.LastIndex(n.Spec.ProviderID, "/")+1:])
+	}), nil
+}
+
+func countReady(nodes []corev1.Node, include func(corev1.Node) bool) int {
+	var ready int
+	for _, n := range nodes {
+		if !include(n) {
+			continue
+		}
+		if slices.ContainsFunc(n.Status.Conditions, func(c corev1.NodeCondition) bool {
+			return c.Type == corev1.NodeReady && c.Status == corev1.ConditionTrue
+		}) {
+			ready++
+		}
+	}
+
+	return ready
+}
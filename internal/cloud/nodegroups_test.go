@@ -0,0 +1,220 @@
+package cloud
+
+import (
+	"context"
+	"fmt"
+	"io"
+	log "log/slog"
+	"testing"
+	"time"
+
+	"github.com/michaelprice232/eks-env-scaledown/internal/state"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	asgtypes "github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	"github.com/aws/aws-sdk-go-v2/service/eks"
+	ekstypes "github.com/aws/aws-sdk-go-v2/service/eks/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// fakeEKS holds the scaling config of each managed node group.
+type fakeEKS struct {
+	nodeGroups map[string]*ekstypes.NodegroupScalingConfig
+}
+
+func (f *fakeEKS) ListNodegroups(context.Context, *eks.ListNodegroupsInput, ...func(*eks.Options)) (*eks.ListNodegroupsOutput, error) {
+	var out eks.ListNodegroupsOutput
+	for name := range f.nodeGroups {
+		out.Nodegroups = append(out.Nodegroups, name)
+	}
+	return &out, nil
+}
+
+func (f *fakeEKS) DescribeNodegroup(_ context.Context, in *eks.DescribeNodegroupInput, _ ...func(*eks.Options)) (*eks.DescribeNodegroupOutput, error) {
+	scaling, ok := f.nodeGroups[*in.NodegroupName]
+	if !ok {
+		return nil, fmt.Errorf("node group %s not found", *in.NodegroupName)
+	}
+	copied := *scaling
+	return &eks.DescribeNodegroupOutput{Nodegroup: &ekstypes.Nodegroup{ScalingConfig: &copied}}, nil
+}
+
+func (f *fakeEKS) UpdateNodegroupConfig(_ context.Context, in *eks.UpdateNodegroupConfigInput, _ ...func(*eks.Options)) (*eks.UpdateNodegroupConfigOutput, error) {
+	f.nodeGroups[*in.NodegroupName] = in.ScalingConfig
+	return &eks.UpdateNodegroupConfigOutput{}, nil
+}
+
+// fakeAutoScaling holds the Auto Scaling groups by name.
+type fakeAutoScaling struct {
+	groups map[string]*asgtypes.AutoScalingGroup
+}
+
+func (f *fakeAutoScaling) DescribeAutoScalingGroups(_ context.Context, in *autoscaling.DescribeAutoScalingGroupsInput, _ ...func(*autoscaling.Options)) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
+	var out autoscaling.DescribeAutoScalingGroupsOutput
+	for name, g := range f.groups {
+		if len(in.AutoScalingGroupNames) > 0 && in.AutoScalingGroupNames[0] != name {
+			continue
+		}
+		out.AutoScalingGroups = append(out.AutoScalingGroups, *g)
+	}
+	return &out, nil
+}
+
+func (f *fakeAutoScaling) UpdateAutoScalingGroup(_ context.Context, in *autoscaling.UpdateAutoScalingGroupInput, _ ...func(*autoscaling.Options)) (*autoscaling.UpdateAutoScalingGroupOutput, error) {
+	g := f.groups[*in.AutoScalingGroupName]
+	g.MinSize, g.DesiredCapacity = in.MinSize, in.DesiredCapacity
+	return &autoscaling.UpdateAutoScalingGroupOutput{}, nil
+}
+
+func scalingConfig(minSize, desired, maxSize int32) *ekstypes.NodegroupScalingConfig {
+	return &ekstypes.NodegroupScalingConfig{MinSize: aws.Int32(minSize), DesiredSize: aws.Int32(desired), MaxSize: aws.Int32(maxSize)}
+}
+
+func readyNode(name string, labels map[string]string, providerID string) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels},
+		Spec:       corev1.NodeSpec{ProviderID: providerID},
+		Status:     corev1.NodeStatus{Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionTrue}}},
+	}
+}
+
+func newTestNodeGroupClient() (*NodeGroupClient, *fakeEKS, *fakeAutoScaling) {
+	eksAPI := &fakeEKS{nodeGroups: map[string]*ekstypes.NodegroupScalingConfig{
+		"apps":   scalingConfig(2, 3, 5),
+		"batch":  scalingConfig(0, 0, 5),
+		"system": scalingConfig(2, 2, 2),
+	}}
+	asgAPI := &fakeAutoScaling{groups: map[string]*asgtypes.AutoScalingGroup{
+		"legacy": {
+			AutoScalingGroupName: aws.String("legacy"), MinSize: aws.Int32(1), DesiredCapacity: aws.Int32(1),
+			Instances: []asgtypes.Instance{{InstanceId: aws.String("i-0123")}},
+		},
+		"eks-apps": {
+			AutoScalingGroupName: aws.String("eks-apps"), MinSize: aws.Int32(2), DesiredCapacity: aws.Int32(3),
+			Tags: []asgtypes.TagDescription{{Key: aws.String(nodeGroupTag), Value: aws.String("apps")}},
+		},
+	}}
+	k8s := fake.NewClientset(
+		readyNode("apps-1", map[string]string{nodeGroupLabel: "apps"}, ""),
+		readyNode("apps-2", map[string]string{nodeGroupLabel: "apps"}, ""),
+		readyNode("apps-3", map[string]string{nodeGroupLabel: "apps"}, ""),
+		readyNode("legacy-1", nil, "aws:///eu-west-1a/i-0123"),
+	)
+
+	return &NodeGroupClient{
+		EKS:             eksAPI,
+		AutoScaling:     asgAPI,
+		K8s:             k8s,
+		Cluster:         "staging",
+		NodeGroups:      []string{"*"},
+		AutoScalingTags: map[string]string{"environment": "staging"},
+		Exclude:         []string{"system"},
+		Timeout:         time.Second,
+	}, eksAPI, asgAPI
+}
+
+func TestNewNodeGroupClient(t *testing.T) {
+	t.Run("returns nil when no node groups are selected", func(t *testing.T) {
+		t.Setenv("NODE_GROUPS", "")
+		t.Setenv("AUTOSCALING_GROUP_TAGS", "")
+
+		client, err := NewNodeGroupClient(t.Context(), fake.NewClientset())
+		assert.NoError(t, err)
+		assert.Nil(t, client)
+	})
+
+	t.Run("node groups require the cluster name", func(t *testing.T) {
+		t.Setenv("NODE_GROUPS", "apps")
+		t.Setenv("EKS_CLUSTER_NAME", "")
+
+		_, err := NewNodeGroupClient(t.Context(), fake.NewClientset())
+		assert.Error(t, err)
+	})
+}
+
+func TestScaleDownAndRestoreNodeGroups(t *testing.T) {
+	log.SetDefault(log.New(log.NewJSONHandler(io.Discard, nil)))
+	nodePollInterval = time.Millisecond
+
+	t.Run("nil client is a no-op", func(t *testing.T) {
+		var c *NodeGroupClient
+
+		changes, err := c.ScaleDownNodeGroups(t.Context(), nil, nil)
+		assert.NoError(t, err)
+		assert.Empty(t, changes)
+
+		changes, err = c.RestoreNodeGroups(t.Context(), nil)
+		assert.NoError(t, err)
+		assert.Empty(t, changes)
+	})
+
+	t.Run("node groups are scaled to zero and restored", func(t *testing.T) {
+		c, eksAPI, asgAPI := newTestNodeGroupClient()
+		store := state.New(fake.NewClientset(), "eks-env-scaledown")
+
+		changes, err := c.ScaleDownNodeGroups(t.Context(), store, nil)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []NodeGroupChange{
+			{NodeGroup: NodeGroup{Kind: NodeGroupManaged, Name: "apps", MinSize: 2, Desired: 3}, Change: "scaled to zero"},
+			{NodeGroup: NodeGroup{Kind: NodeGroupManaged, Name: "batch"}, Change: "skipped", Reason: "scaled to zero before the scale down"},
+			{NodeGroup: NodeGroup{Kind: NodeGroupAutoScaling, Name: "legacy", MinSize: 1, Desired: 1}, Change: "scaled to zero"},
+		}, changes)
+		assert.Equal(t, scalingConfig(0, 0, 5), eksAPI.nodeGroups["apps"])
+		assert.Equal(t, scalingConfig(2, 2, 2), eksAPI.nodeGroups["system"], "Expected the system node group to be left alone")
+		assert.Equal(t, int32(0), aws.ToInt32(asgAPI.groups["legacy"].DesiredCapacity))
+		assert.Equal(t, int32(3), aws.ToInt32(asgAPI.groups["eks-apps"].DesiredCapacity), "Expected the managed node group's ASG to be left to EKS")
+
+		// A repeated scale down keeps the original capacity
+		_, err = c.ScaleDownNodeGroups(t.Context(), store, nil)
+		require.NoError(t, err)
+
+		changes, err = c.RestoreNodeGroups(t.Context(), store)
+		require.NoError(t, err)
+		assert.Len(t, changes, 2)
+		assert.Equal(t, scalingConfig(2, 3, 5), eksAPI.nodeGroups["apps"])
+		assert.Equal(t, scalingConfig(0, 0, 5), eksAPI.nodeGroups["batch"])
+		assert.Equal(t, int32(1), aws.ToInt32(asgAPI.groups["legacy"].DesiredCapacity))
+
+		_, found, err := store.Get(t.Context(), nodeGroupsStateKey)
+		require.NoError(t, err)
+		assert.False(t, found)
+	})
+
+	t.Run("node groups running pods left up by the scale down are skipped", func(t *testing.T) {
+		c, eksAPI, asgAPI := newTestNodeGroupClient()
+		store := state.New(fake.NewClientset(), "eks-env-scaledown")
+
+		changes, err := c.ScaleDownNodeGroups(t.Context(), store, []string{"apps-2", "legacy-1", "deleted-1"})
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []NodeGroupChange{
+			{NodeGroup: NodeGroup{Kind: NodeGroupManaged, Name: "apps", MinSize: 2, Desired: 3}, Change: "skipped", Reason: "runs pods left running by the scale down"},
+			{NodeGroup: NodeGroup{Kind: NodeGroupManaged, Name: "batch"}, Change: "skipped", Reason: "scaled to zero before the scale down"},
+			{NodeGroup: NodeGroup{Kind: NodeGroupAutoScaling, Name: "legacy", MinSize: 1, Desired: 1}, Change: "skipped", Reason: "runs pods left running by the scale down"},
+		}, changes)
+		assert.Equal(t, scalingConfig(2, 3, 5), eksAPI.nodeGroups["apps"])
+		assert.Equal(t, int32(1), aws.ToInt32(asgAPI.groups["legacy"].DesiredCapacity))
+
+		_, found, err := store.Get(t.Context(), nodeGroupsStateKey)
+		require.NoError(t, err)
+		assert.False(t, found, "Expected the skipped node groups not to be recorded")
+	})
+
+	t.Run("restoring times out when the nodes aren't Ready", func(t *testing.T) {
+		c, _, _ := newTestNodeGroupClient()
+		c.Timeout = 10 * time.Millisecond
+		store := state.New(fake.NewClientset(), "eks-env-scaledown")
+		require.NoError(t, store.Set(t.Context(), nodeGroupsStateKey, "eks-nodegroup:apps=2/4"))
+
+		_, err := c.RestoreNodeGroups(t.Context(), store)
+		assert.ErrorContains(t, err, "timed out")
+
+		_, found, err := store.Get(t.Context(), nodeGroupsStateKey)
+		require.NoError(t, err)
+		assert.True(t, found, "Expected the record to be kept for the next scale up")
+	})
+}
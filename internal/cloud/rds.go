@@ -0,0 +1,416 @@
+// Package cloud stops and starts the AWS resources which run alongside the Kubernetes workloads, such as the
+// environment's databases, so they don't cost anything whilst the environment is scaled down.
+package cloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "log/slog"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/michaelprice232/eks-env-scaledown/internal/state"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/rds"
+	"github.com/aws/aws-sdk-go-v2/service/rds/types"
+)
+
+// rdsStateKey is the state key holding the databases stopped by the scale down, as kind:identifier. Databases
+// which were already stopped are not recorded, so stay stopped at scale up.
+const rdsStateKey = "rds-stopped-databases"
+
+// defaultRDSTimeout is how long to wait for a database to become available, when RDS_TIMEOUT is not set.
+const defaultRDSTimeout = 30 * time.Minute
+
+// The kinds of database which can be stopped. Aurora clusters are stopped as a whole, along with their instances.
+const (
+	DatabaseInstance = "rds-instance"
+	DatabaseCluster  = "rds-cluster"
+)
+
+const (
+	rdsStatusAvailable = "available"
+	rdsStatusStopped   = "stopped"
+	rdsStatusStarting  = "starting"
+	rdsStatusStopping  = "stopping"
+)
+
+// rdsPollInterval is how often a database is described whilst waiting for its status to change.
+var rdsPollInterval = 15 * time.Second
+
+// RDSAPI is the subset of the RDS client used to stop and start databases.
+type RDSAPI interface {
+	rds.DescribeDBInstancesAPIClient
+	rds.DescribeDBClustersAPIClient
+	StopDBInstance(ctx context.Context, params *rds.StopDBInstanceInput, optFns ...func(*rds.Options)) (*rds.StopDBInstanceOutput, error)
+	StartDBInstance(ctx context.Context, params *rds.StartDBInstanceInput, optFns ...func(*rds.Options)) (*rds.StartDBInstanceOutput, error)
+	StopDBCluster(ctx context.Context, params *rds.StopDBClusterInput, optFns ...func(*rds.Options)) (*rds.StopDBClusterOutput, error)
+	StartDBCluster(ctx context.Context, params *rds.StartDBClusterInput, optFns ...func(*rds.Options)) (*rds.StartDBClusterOutput, error)
+}
+
+// RDSClient stops and starts the RDS instances and Aurora clusters carrying every tag in Tags.
+type RDSClient struct {
+	API  RDSAPI
+	Tags map[string]string
+
+	// Timeout is how long to wait for a database to finish stopping or starting
+	Timeout time.Duration
+}
+
+// Database is an RDS instance or Aurora cluster.
+type Database struct {
+	Kind   string
+	ID     string
+	Status string
+}
+
+// key identifies the database in the state.
+func (d Database) key() string {
+	return d.Kind + ":" + d.ID
+}
+
+// DatabaseChange records what happened to a single database. Reason is set when Change is "skipped".
+type DatabaseChange struct {
+	Database
+	Change string
+	Reason string
+}
+
+// NewRDSClient returns a client for the databases tagged with RDS_TAGS. Nil is returned if RDS_TAGS is not set,
+// so the databases are left alone.
+func NewRDSClient(ctx context.Context) (*RDSClient, error) {
+	tags, err := parseTags("RDS_TAGS")
+	if err != nil {
+		return nil, err
+	}
+	if len(tags) == 0 {
+		log.Warn("RDS_TAGS envar not set. Databases will not be stopped")
+		return nil, nil
+	}
+
+	timeout, err := parseTimeout("RDS_TIMEOUT", defaultRDSTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("loading aws config: %w", err)
+	}
+
+	return &RDSClient{API: rds.NewFromConfig(cfg), Tags: tags, Timeout: timeout}, nil
+}
+
+// parseTags reads a comma-separated list of key=value tags from the envar key.
+func parseTags(key string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, entry := range strings.Split(os.Getenv(key), ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+
+		k, v, ok := strings.Cut(entry, "=")
+		if !ok || strings.TrimSpace(k) == "" {
+			return nil, fmt.Errorf("parsing %s: %q is not in the format key=value", key, entry)
+		}
+		tags[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+
+	return tags, nil
+}
+
+// parseTimeout reads a duration from the envar key, returning def when it is not set.
+func parseTimeout(key string, def time.Duration) (time.Duration, error) {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return def, nil
+	}
+
+	timeout, err := time.ParseDuration(raw)
+	if err != nil {
+		return 0, fmt.Errorf("parsing %s: %w", key, err)
+	}
+
+	return timeout, nil
+}
+
+// matchesTags reports whether tags include every tag in want.
+func matchesTags(tags []types.Tag, want map[string]string) bool {
+	for k, v := range want {
+		if !slices.ContainsFunc(tags, func(t types.Tag) bool { return aws.ToString(t.Key) == k && aws.ToString(t.Value) == v }) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// listDatabases returns the tagged RDS instances and Aurora clusters. Instances which belong to a cluster are
+// left out, as they are stopped along with the cluster.
+func (c *RDSClient) listDatabases(ctx context.Context) ([]Database, error) {
+	var databases []Database
+
+	instances := rds.NewDescribeDBInstancesPaginator(c.API, &rds.DescribeDBInstancesInput{})
+	for instances.HasMorePages() {
+		page, err := instances.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("describing RDS instances: %w", err)
+		}
+		for _, i := range page.DBInstances {
+			if i.DBClusterIdentifier != nil || !matchesTags(i.TagList, c.Tags) {
+				continue
+			}
+			databases = append(databases, Database{Kind: DatabaseInstance, ID: aws.ToString(i.DBInstanceIdentifier), Status: aws.ToString(i.DBInstanceStatus)})
+		}
+	}
+
+	clusters := rds.NewDescribeDBClustersPaginator(c.API, &rds.DescribeDBClustersInput{})
+	for clusters.HasMorePages() {
+		page, err := clusters.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("describing RDS clusters: %w", err)
+		}
+		for _, cl := range page.DBClusters {
+			if !matchesTags(cl.TagList, c.Tags) {
+				continue
+			}
+			if aws.ToString(cl.EngineMode) == "serverless" {
+				log.Warn("Skipping Aurora Serverless v1 cluster which cannot be stopped", "cluster", aws.ToString(cl.DBClusterIdentifier))
+				continue
+			}
+			databases = append(databases, Database{Kind: DatabaseCluster, ID: aws.ToString(cl.DBClusterIdentifier), Status: aws.ToString(cl.Status)})
+		}
+	}
+
+	return databases, nil
+}
+
+// describe returns the current status of db. A database which no longer exists is returned with an empty status.
+func (c *RDSClient) describe(ctx context.Context, db Database) (Database, error) {
+	switch db.Kind {
+	case DatabaseInstance:
+		out, err := c.API.DescribeDBInstances(ctx, &rds.DescribeDBInstancesInput{DBInstanceIdentifier: aws.String(db.ID)})
+		var notFound *types.DBInstanceNotFoundFault
+		if errors.As(err, &notFound) || (err == nil && len(out.DBInstances) == 0) {
+			db.Status = ""
+			return db, nil
+		}
+		if err != nil {
+			return db, err
+		}
+		db.Status = aws.ToString(out.DBInstances[0].DBInstanceStatus)
+
+	case DatabaseCluster:
+		out, err := c.API.DescribeDBClusters(ctx, &rds.DescribeDBClustersInput{DBClusterIdentifier: aws.String(db.ID)})
+		var notFound *types.DBClusterNotFoundFault
+		if errors.As(err, &notFound) || (err == nil && len(out.DBClusters) == 0) {
+			db.Status = ""
+			return db, nil
+		}
+		if err != nil {
+			return db, err
+		}
+		db.Status = aws.ToString(out.DBClusters[0].Status)
+
+	default:
+		return db, fmt.Errorf("unknown database kind %q", db.Kind)
+	}
+
+	return db, nil
+}
+
+// waitForStatus polls db until it reaches one of statuses, returning the database with its final status.
+// Gives up after Timeout, or if the database is deleted.
+func (c *RDSClient) waitForStatus(ctx context.Context, db Database, statuses ...string) (Database, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	for {
+		if slices.Contains(statuses, db.Status) {
+			return db, nil
+		}
+		if db.Status == "" {
+			return db, fmt.Errorf("%s %s no longer exists", db.Kind, db.ID)
+		}
+
+		log.Debug("Waiting for database status", "kind", db.Kind, "id", db.ID, "status", db.Status, "want", statuses)
+		select {
+		case <-ctx.Done():
+			return db, fmt.Errorf("timed out waiting for %s %s to be %s, last status %q", db.Kind, db.ID, strings.Join(statuses, " or "), db.Status)
+		case <-time.After(rdsPollInterval):
+		}
+
+		var err error
+		if db, err = c.describe(ctx, db); err != nil {
+			return db, fmt.Errorf("describing %s %s: %w", db.Kind, db.ID, err)
+		}
+	}
+}
+
+func (c *RDSClient) stop(ctx context.Context, db Database) error {
+	if db.Kind == DatabaseCluster {
+		_, err := c.API.StopDBCluster(ctx, &rds.StopDBClusterInput{DBClusterIdentifier: aws.String(db.ID)})
+		return err
+	}
+
+	_, err := c.API.StopDBInstance(ctx, &rds.StopDBInstanceInput{DBInstanceIdentifier: aws.String(db.ID)})
+	return err
+}
+
+func (c *RDSClient) start(ctx context.Context, db Database) error {
+	if db.Kind == DatabaseCluster {
+		_, err := c.API.StartDBCluster(ctx, &rds.StartDBClusterInput{DBClusterIdentifier: aws.String(db.ID)})
+		return err
+	}
+
+	_, err := c.API.StartDBInstance(ctx, &rds.StartDBInstanceInput{DBInstanceIdentifier: aws.String(db.ID)})
+	return err
+}
+
+// StopDatabases stops the tagged databases which are running, recording each one so only those are started again
+// by StartDatabases. Databases which were already stopped are skipped, unless they were stopped by an earlier scale
+// down. Recorded databases which AWS has automatically started again after 7 days are stopped again. Every database
+// is attempted, with the failures returned together. A nil client is a no-op.
+func (c *RDSClient) StopDatabases(ctx context.Context, store *state.Store) ([]DatabaseChange, error) {
+	if c == nil {
+		return nil, nil
+	}
+
+	raw, _, err := store.Get(ctx, rdsStateKey)
+	if err != nil {
+		return nil, err
+	}
+	recorded := splitList(raw)
+
+	databases, err := c.listDatabases(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		changes []DatabaseChange
+		errs    []error
+	)
+	for _, db := range databases {
+		wasRecorded := slices.Contains(recorded, db.key())
+
+		// Wait out a database which is still stopping, or being automatically started again after being stopped by
+		// an earlier run. Any other status, such as modifying, is left for the next run rather than holding this one up
+		if db.Status == rdsStatusStarting || db.Status == rdsStatusStopping {
+			if db, err = c.waitForStatus(ctx, db, rdsStatusAvailable, rdsStatusStopped); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+		}
+		if db.Status != rdsStatusAvailable && db.Status != rdsStatusStopped {
+			log.Warn("Skipping database which is neither available nor stopped", "kind", db.Kind, "id", db.ID, "status", db.Status)
+			changes = append(changes, DatabaseChange{Database: db, Change: "skipped", Reason: "status " + db.Status})
+			continue
+		}
+
+		if db.Status == rdsStatusStopped {
+			if !wasRecorded {
+				log.Info("Skipping database which was already stopped", "kind", db.Kind, "id", db.ID)
+				changes = append(changes, DatabaseChange{Database: db, Change: "skipped", Reason: "stopped before the scale down"})
+			}
+			continue
+		}
+
+		// Record the database first, so it is started again even if this run fails part way through
+		if !wasRecorded {
+			recorded = append(recorded, db.key())
+			if err = store.Set(ctx, rdsStateKey, strings.Join(recorded, ",")); err != nil {
+				return changes, fmt.Errorf("recording %s %s: %w", db.Kind, db.ID, err)
+			}
+		}
+
+		log.Info("Stopping database", "kind", db.Kind, "id", db.ID, "restarted", wasRecorded)
+		if err = c.stop(ctx, db); err != nil {
+			errs = append(errs, fmt.Errorf("stopping %s %s: %w", db.Kind, db.ID, err))
+			continue
+		}
+		changes = append(changes, DatabaseChange{Database: db, Change: "stopped"})
+	}
+
+	return changes, errors.Join(errs...)
+}
+
+// StartDatabases starts the databases recorded by StopDatabases and waits for them to become available, so they
+// are ready before the first startup group is scaled up. The record is removed once every database is available.
+// A nil client is a no-op.
+func (c *RDSClient) StartDatabases(ctx context.Context, store *state.Store) ([]DatabaseChange, error) {
+	if c == nil {
+		return nil, nil
+	}
+
+	raw, _, err := store.Get(ctx, rdsStateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		changes []DatabaseChange
+		started []Database
+		errs    []error
+	)
+	for _, key := range splitList(raw) {
+		kind, id, _ := strings.Cut(key, ":")
+		db, err := c.describe(ctx, Database{Kind: kind, ID: id})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("describing %s %s: %w", kind, id, err))
+			continue
+		}
+		if db.Status == "" {
+			log.Warn("Skipping database which no longer exists", "kind", kind, "id", id)
+			changes = append(changes, DatabaseChange{Database: db, Change: "skipped", Reason: "no longer exists"})
+			continue
+		}
+
+		// A database can't be started until it has finished stopping. One which AWS has already started is left to finish
+		if db, err = c.waitForStatus(ctx, db, rdsStatusAvailable, rdsStatusStopped, rdsStatusStarting); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if db.Status == rdsStatusStopped {
+			log.Info("Starting database", "kind", db.Kind, "id", db.ID)
+			if err = c.start(ctx, db); err != nil {
+				errs = append(errs, fmt.Errorf("starting %s %s: %w", db.Kind, db.ID, err))
+				continue
+			}
+		}
+		started = append(started, db)
+	}
+
+	// Start every database before waiting, so they come up in parallel
+	for _, db := range started {
+		log.Info("Waiting for database to become available", "kind", db.Kind, "id", db.ID)
+		if _, err = c.waitForStatus(ctx, db, rdsStatusAvailable); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		changes = append(changes, DatabaseChange{Database: db, Change: "started"})
+	}
+
+	if len(errs) > 0 {
+		return changes, errors.Join(errs...)
+	}
+
+	return changes, store.Delete(ctx, rdsStateKey)
+}
+
+// splitList splits a comma-separated value, dropping empty entries.
+func splitList(raw string) []string {
+	var items []string
+	for _, item := range strings.Split(raw, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
@@ -0,0 +1,220 @@
+package cloud
+
+import (
+	"context"
+	"io"
+	log "log/slog"
+	"testing"
+	"time"
+
+	"github.com/michaelprice232/eks-env-scaledown/internal/state"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/rds"
+	"github.com/aws/aws-sdk-go-v2/service/rds/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// fakeRDS holds instances and clusters by identifier. Transitional statuses move on each time the database is
+// described, as if the change completed between polls.
+type fakeRDS struct {
+	instances map[string]*types.DBInstance
+	clusters  map[string]*types.DBCluster
+	calls     []string
+}
+
+var transitions = map[string]string{"stopping": "stopped", "starting": "available"}
+
+func (f *fakeRDS) DescribeDBInstances(_ context.Context, in *rds.DescribeDBInstancesInput, _ ...func(*rds.Options)) (*rds.DescribeDBInstancesOutput, error) {
+	if in.DBInstanceIdentifier == nil {
+		var out rds.DescribeDBInstancesOutput
+		for _, i := range f.instances {
+			out.DBInstances = append(out.DBInstances, *i)
+		}
+		return &out, nil
+	}
+
+	i, ok := f.instances[*in.DBInstanceIdentifier]
+	if !ok {
+		return nil, &types.DBInstanceNotFoundFault{}
+	}
+	if next, ok := transitions[aws.ToString(i.DBInstanceStatus)]; ok {
+		i.DBInstanceStatus = aws.String(next)
+	}
+	return &rds.DescribeDBInstancesOutput{DBInstances: []types.DBInstance{*i}}, nil
+}
+
+func (f *fakeRDS) DescribeDBClusters(_ context.Context, in *rds.DescribeDBClustersInput, _ ...func(*rds.Options)) (*rds.DescribeDBClustersOutput, error) {
+	if in.DBClusterIdentifier == nil {
+		var out rds.DescribeDBClustersOutput
+		for _, c := range f.clusters {
+			out.DBClusters = append(out.DBClusters, *c)
+		}
+		return &out, nil
+	}
+
+	c, ok := f.clusters[*in.DBClusterIdentifier]
+	if !ok {
+		return nil, &types.DBClusterNotFoundFault{}
+	}
+	if next, ok := transitions[aws.ToString(c.Status)]; ok {
+		c.Status = aws.String(next)
+	}
+	return &rds.DescribeDBClustersOutput{DBClusters: []types.DBCluster{*c}}, nil
+}
+
+func (f *fakeRDS) StopDBInstance(_ context.Context, in *rds.StopDBInstanceInput, _ ...func(*rds.Options)) (*rds.StopDBInstanceOutput, error) {
+	f.calls = append(f.calls, "stop "+*in.DBInstanceIdentifier)
+	f.instances[*in.DBInstanceIdentifier].DBInstanceStatus = aws.String("stopping")
+	return &rds.StopDBInstanceOutput{}, nil
+}
+
+func (f *fakeRDS) StartDBInstance(_ context.Context, in *rds.StartDBInstanceInput, _ ...func(*rds.Options)) (*rds.StartDBInstanceOutput, error) {
+	f.calls = append(f.calls, "start "+*in.DBInstanceIdentifier)
+	f.instances[*in.DBInstanceIdentifier].DBInstanceStatus = aws.String("starting")
+	return &rds.StartDBInstanceOutput{}, nil
+}
+
+func (f *fakeRDS) StopDBCluster(_ context.Context, in *rds.StopDBClusterInput, _ ...func(*rds.Options)) (*rds.StopDBClusterOutput, error) {
+	f.calls = append(f.calls, "stop "+*in.DBClusterIdentifier)
+	f.clusters[*in.DBClusterIdentifier].Status = aws.String("stopping")
+	return &rds.StopDBClusterOutput{}, nil
+}
+
+func (f *fakeRDS) StartDBCluster(_ context.Context, in *rds.StartDBClusterInput, _ ...func(*rds.Options)) (*rds.StartDBClusterOutput, error) {
+	f.calls = append(f.calls, "start "+*in.DBClusterIdentifier)
+	f.clusters[*in.DBClusterIdentifier].Status = aws.String("starting")
+	return &rds.StartDBClusterOutput{}, nil
+}
+
+func (f *fakeRDS) instanceStatus(id string) string {
+	return aws.ToString(f.instances[id].DBInstanceStatus)
+}
+
+var stagingTags = []types.Tag{{Key: aws.String("environment"), Value: aws.String("staging")}}
+
+func newFakeRDS() *fakeRDS {
+	return &fakeRDS{
+		instances: map[string]*types.DBInstance{
+			"orders":    {DBInstanceIdentifier: aws.String("orders"), DBInstanceStatus: aws.String("available"), TagList: stagingTags},
+			"reporting": {DBInstanceIdentifier: aws.String("reporting"), DBInstanceStatus: aws.String("stopped"), TagList: stagingTags},
+			"payments":  {DBInstanceIdentifier: aws.String("payments"), DBInstanceStatus: aws.String("available")},
+			// Aurora instances are stopped along with their cluster
+			"users-1": {DBInstanceIdentifier: aws.String("users-1"), DBInstanceStatus: aws.String("available"), DBClusterIdentifier: aws.String("users"), TagList: stagingTags},
+		},
+		clusters: map[string]*types.DBCluster{
+			"users":  {DBClusterIdentifier: aws.String("users"), Status: aws.String("available"), TagList: stagingTags},
+			"legacy": {DBClusterIdentifier: aws.String("legacy"), Status: aws.String("available"), EngineMode: aws.String("serverless"), TagList: stagingTags},
+		},
+	}
+}
+
+func newTestRDSClient(api *fakeRDS) *RDSClient {
+	return &RDSClient{API: api, Tags: map[string]string{"environment": "staging"}, Timeout: time.Second}
+}
+
+func TestNewRDSClient(t *testing.T) {
+	t.Run("returns nil when RDS_TAGS is unset", func(t *testing.T) {
+		t.Setenv("RDS_TAGS", "")
+
+		client, err := NewRDSClient(t.Context())
+		assert.NoError(t, err)
+		assert.Nil(t, client)
+	})
+
+	t.Run("errors on a tag without a value", func(t *testing.T) {
+		t.Setenv("RDS_TAGS", "environment")
+
+		_, err := NewRDSClient(t.Context())
+		assert.Error(t, err)
+	})
+
+	t.Run("errors on an invalid timeout", func(t *testing.T) {
+		t.Setenv("RDS_TAGS", "environment=staging")
+		t.Setenv("RDS_TIMEOUT", "soon")
+
+		_, err := NewRDSClient(t.Context())
+		assert.Error(t, err)
+	})
+}
+
+func TestStopAndStartDatabases(t *testing.T) {
+	log.SetDefault(log.New(log.NewJSONHandler(io.Discard, nil)))
+	rdsPollInterval = time.Millisecond
+
+	t.Run("nil client is a no-op", func(t *testing.T) {
+		var c *RDSClient
+
+		changes, err := c.StopDatabases(t.Context(), nil)
+		assert.NoError(t, err)
+		assert.Empty(t, changes)
+
+		changes, err = c.StartDatabases(t.Context(), nil)
+		assert.NoError(t, err)
+		assert.Empty(t, changes)
+	})
+
+	t.Run("only the databases stopped by the scale down are started", func(t *testing.T) {
+		api := newFakeRDS()
+		c := newTestRDSClient(api)
+		store := state.New(fake.NewClientset(), "eks-env-scaledown")
+
+		changes, err := c.StopDatabases(t.Context(), store)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []DatabaseChange{
+			{Database: Database{Kind: DatabaseInstance, ID: "orders", Status: "available"}, Change: "stopped"},
+			{Database: Database{Kind: DatabaseInstance, ID: "reporting", Status: "stopped"}, Change: "skipped", Reason: "stopped before the scale down"},
+			{Database: Database{Kind: DatabaseCluster, ID: "users", Status: "available"}, Change: "stopped"},
+		}, changes)
+		assert.ElementsMatch(t, []string{"stop orders", "stop users"}, api.calls)
+
+		changes, err = c.StartDatabases(t.Context(), store)
+		require.NoError(t, err)
+		assert.Len(t, changes, 2)
+		assert.Equal(t, "available", api.instanceStatus("orders"))
+		assert.Equal(t, "available", aws.ToString(api.clusters["users"].Status))
+		assert.Equal(t, "stopped", api.instanceStatus("reporting"))
+
+		_, found, err := store.Get(t.Context(), rdsStateKey)
+		require.NoError(t, err)
+		assert.False(t, found)
+	})
+
+	t.Run("a repeated scale down stops databases which AWS started again", func(t *testing.T) {
+		api := newFakeRDS()
+		c := newTestRDSClient(api)
+		store := state.New(fake.NewClientset(), "eks-env-scaledown")
+
+		_, err := c.StopDatabases(t.Context(), store)
+		require.NoError(t, err)
+
+		// Seven days later AWS starts the instance again
+		api.instances["orders"].DBInstanceStatus = aws.String("starting")
+		api.calls = nil
+
+		changes, err := c.StopDatabases(t.Context(), store)
+		require.NoError(t, err)
+		assert.Contains(t, changes, DatabaseChange{Database: Database{Kind: DatabaseInstance, ID: "orders", Status: "available"}, Change: "stopped"})
+		assert.Len(t, changes, 2, "Expected the cluster stopped by the earlier run to stay recorded rather than be skipped")
+		assert.Equal(t, []string{"stop orders"}, api.calls)
+
+		_, err = c.StartDatabases(t.Context(), store)
+		require.NoError(t, err)
+		assert.Equal(t, "available", aws.ToString(api.clusters["users"].Status))
+	})
+
+	t.Run("a database which is still stopping is started once stopped", func(t *testing.T) {
+		api := newFakeRDS()
+		c := newTestRDSClient(api)
+		store := state.New(fake.NewClientset(), "eks-env-scaledown")
+		require.NoError(t, store.Set(t.Context(), rdsStateKey, "rds-instance:orders,rds-instance:deleted"))
+		api.instances["orders"].DBInstanceStatus = aws.String("stopping")
+
+		changes, err := c.StartDatabases(t.Context(), store)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"start orders"}, api.calls)
+		assert.Contains(t, changes, DatabaseChange{Database: Database{Kind: DatabaseInstance, ID: "deleted"}, Change: "skipped", Reason: "no longer exists"})
+	})
+}
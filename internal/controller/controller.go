@@ -0,0 +1,316 @@
+// Package controller implements the long-running controller mode, which scales the environment up and down on its
+// own schedules rather than from CronJobs, electing a leader so it can run with more than one replica.
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/michaelprice232/eks-env-scaledown/config"
+
+	"github.com/robfig/cron/v3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const (
+	defaultHealthAddr = ":8081"
+	defaultLeaseName  = "eks-env-scaledown"
+	defaultNamespace  = "eks-env-scaledown"
+
+	leaseDuration = 15 * time.Second
+	renewDeadline = 10 * time.Second
+	retryPeriod   = 2 * time.Second
+
+	shutdownTimeout = 10 * time.Second
+)
+
+// parser accepts standard 5 field cron expressions, along with descriptors such as @daily.
+var parser = cron.NewParser(cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+// Schedule is a cron expression at which the environment is scaled up or down, or its scale down enforced.
+type Schedule struct {
+	Action config.ScaleAction
+	Spec   string
+
+	schedule cron.Schedule
+}
+
+// Config holds the controller's settings.
+type Config struct {
+	// Schedules are when the environment is scaled. Several per action allow e.g. different weekday and weekend times
+	Schedules []Schedule
+
+	// Location is the timezone the schedules are evaluated in, so they follow daylight saving time
+	Location *time.Location
+
+	// HealthAddr is the address the health endpoints are served on
+	HealthAddr string
+
+	// LeaseName is the Lease used to elect the replica which runs the schedules
+	LeaseName string
+
+	// Namespace is where this app runs, holding the Lease
+	Namespace string
+
+	// Identity identifies this replica in the Lease, normally its pod name
+	Identity string
+}
+
+// NewConfig builds the controller's Config from environment variables.
+func NewConfig() (Config, error) {
+	var conf Config
+
+	tz := os.Getenv("SCHEDULE_TIMEZONE")
+	if tz == "" {
+		tz = "UTC"
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return conf, fmt.Errorf("loading SCHEDULE_TIMEZONE: %w", err)
+	}
+	conf.Location = loc
+
+	for _, env := range []struct {
+		key    string
+		action config.ScaleAction
+	}{{"SCALE_DOWN_SCHEDULE", config.ScaleDown}, {"SCALE_UP_SCHEDULE", config.ScaleUp}, {"ENFORCE_SCHEDULE", config.Enforce}} {
+		schedules, err := parseSchedules(env.action, os.Getenv(env.key))
+		if err != nil {
+			return conf, fmt.Errorf("parsing %s: %w", env.key, err)
+		}
+		conf.Schedules = append(conf.Schedules, schedules...)
+	}
+	// ENFORCE_SCHEDULE alone is rejected, as the controller would never scale the environment down for it to enforce
+	if !slices.ContainsFunc(conf.Schedules, func(s Schedule) bool { return s.Action != config.Enforce }) {
+		return conf, fmt.Errorf("at least one of SCALE_DOWN_SCHEDULE or SCALE_UP_SCHEDULE is required, alongside any ENFORCE_SCHEDULE")
+	}
+
+	conf.HealthAddr = envOrDefault("HEALTH_ADDR", defaultHealthAddr)
+	conf.LeaseName = envOrDefault("LEADER_ELECTION_LEASE", defaultLeaseName)
+	conf.Namespace = envOrDefault("POD_NAMESPACE", defaultNamespace)
+
+	conf.Identity = os.Getenv("POD_NAME")
+	if conf.Identity == "" {
+		if conf.Identity, err = os.Hostname(); err != nil {
+			return conf, fmt.Errorf("getting hostname for the leader election identity: %w", err)
+		}
+	}
+
+	return conf, nil
+}
+
+// parseSchedules parses the ;-separated cron expressions in raw, e.g. "0 19 * * 1-5; 0 16 * * 5".
+func parseSchedules(action config.ScaleAction, raw string) ([]Schedule, error) {
+	var schedules []Schedule
+	for _, spec := range strings.Split(raw, ";") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		s, err := parser.Parse(spec)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %q: %w", spec, err)
+		}
+		schedules = append(schedules, Schedule{Action: action, Spec: spec, schedule: s})
+	}
+
+	return schedules, nil
+}
+
+func envOrDefault(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+
+	return def
+}
+
+// RunFunc scales the environment for a single scheduled run.
+type RunFunc func(ctx context.Context, action config.ScaleAction) error
+
+// Controller runs RunFunc on the configured schedules whilst it is the leader.
+type Controller struct {
+	conf   Config
+	client kubernetes.Interface
+	run    RunFunc
+	now    func() time.Time
+
+	mu      sync.Mutex
+	leader  bool
+	running config.ScaleAction
+	next    *Schedule
+	nextAt  time.Time
+}
+
+// New returns a Controller which calls run at each scheduled time, using client for leader election.
+func New(conf Config, client kubernetes.Interface, run RunFunc) *Controller {
+	return &Controller{conf: conf, client: client, run: run, now: time.Now}
+}
+
+// Run serves the health endpoints and takes part in the leader election until ctx is cancelled. The leader runs the
+// schedules, and a replica which loses the leadership stands for election again.
+func (c *Controller) Run(ctx context.Context) error {
+	srv := &http.Server{Addr: c.conf.HealthAddr, Handler: c.Handler(), ReadHeaderTimeout: shutdownTimeout}
+	go func() {
+		log.Info("Serving health endpoints", "addr", c.conf.HealthAddr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error("Serving health endpoints", "error", err)
+		}
+	}()
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Warn("Problem shutting down the health endpoints", "error", err)
+		}
+	}()
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Name: c.conf.LeaseName, Namespace: c.conf.Namespace},
+		Client:     c.client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: c.conf.Identity},
+	}
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   leaseDuration,
+		RenewDeadline:   renewDeadline,
+		RetryPeriod:     retryPeriod,
+		ReleaseOnCancel: true,
+		Name:            c.conf.LeaseName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				log.Info("Elected leader. Running the schedules", "identity", c.conf.Identity)
+				c.setLeader(true)
+				c.loop(ctx)
+			},
+			OnStoppedLeading: func() {
+				log.Info("No longer the leader", "identity", c.conf.Identity)
+				c.setLeader(false)
+			},
+			OnNewLeader: func(identity string) {
+				log.Info("Leader elected", "leader", identity)
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("creating leader elector: %w", err)
+	}
+
+	for ctx.Err() == nil {
+		elector.Run(ctx)
+	}
+
+	return nil
+}
+
+// loop calls run at each scheduled time until ctx is cancelled. Runs never overlap: a schedule which passes whilst
+// a run is in progress is skipped.
+func (c *Controller) loop(ctx context.Context) {
+	for {
+		next, at := c.nextRun(c.now())
+		c.setNext(next, at)
+		log.Info("Waiting for the next scheduled run", "action", next.Action, "schedule", next.Spec, "at", at)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(at.Sub(c.now())):
+		}
+
+		c.setRunning(next.Action)
+		log.Info("Starting scheduled run", "action", next.Action, "schedule", next.Spec)
+		if err := c.run(ctx, next.Action); err != nil {
+			log.Error("Scheduled run failed", "action", next.Action, "error", err)
+		}
+		c.setRunning("")
+	}
+}
+
+// nextRun returns the schedule which fires soonest after now, and when, evaluated in the configured timezone.
+func (c *Controller) nextRun(now time.Time) (Schedule, time.Time) {
+	var (
+		next Schedule
+		at   time.Time
+	)
+	for _, s := range c.conf.Schedules {
+		t := s.schedule.Next(now.In(c.conf.Location))
+		if at.IsZero() || t.Before(at) {
+			next, at = s, t
+		}
+	}
+
+	return next, at
+}
+
+// Handler returns the health endpoints. /healthz reports the process is alive, and /readyz its state as JSON.
+func (c *Controller) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(c.status()); err != nil {
+			log.Error("Writing the controller status", "error", err)
+		}
+	})
+
+	return mux
+}
+
+// Status is the state of a controller replica, served on /readyz.
+type Status struct {
+	Identity   string     `json:"identity"`
+	Leader     bool       `json:"leader"`
+	Running    string     `json:"running,omitempty"`
+	NextAction string     `json:"nextAction,omitempty"`
+	NextRunAt  *time.Time `json:"nextRunAt,omitempty"`
+}
+
+func (c *Controller) status() Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := Status{Identity: c.conf.Identity, Leader: c.leader, Running: string(c.running)}
+	if c.leader && c.next != nil {
+		at := c.nextAt
+		s.NextAction = string(c.next.Action)
+		s.NextRunAt = &at
+	}
+
+	return s
+}
+
+func (c *Controller) setLeader(leader bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.leader = leader
+	if !leader {
+		c.next = nil
+	}
+}
+
+func (c *Controller) setNext(next Schedule, at time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.next, c.nextAt = &next, at
+}
+
+func (c *Controller) setRunning(action config.ScaleAction) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.running = action
+}
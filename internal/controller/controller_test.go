@@ -0,0 +1,185 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	log "log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/michaelprice232/eks-env-scaledown/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// everySchedule fires at a fixed interval, for schedules more frequent than cron allows.
+type everySchedule time.Duration
+
+func (e everySchedule) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(e))
+}
+
+func mustSchedules(t *testing.T, action config.ScaleAction, raw string) []Schedule {
+	t.Helper()
+	schedules, err := parseSchedules(action, raw)
+	require.NoError(t, err)
+	return schedules
+}
+
+func TestNewConfig(t *testing.T) {
+	tests := []struct {
+		name          string
+		timezone      string
+		down          string
+		up            string
+		enforce       string
+		wantErr       bool
+		wantSchedules int
+	}{
+		{name: "weekday and weekend schedules", timezone: "Europe/London", down: "0 19 * * 1-5; 0 16 * * 5", up: "0 7 * * 1-5", wantSchedules: 3},
+		{name: "defaults to UTC", down: "@daily", wantSchedules: 1},
+		{name: "hourly enforcement", down: "0 19 * * 1-5", up: "0 7 * * 1-5", enforce: "30 * * * *", wantSchedules: 3},
+		{name: "only an enforce schedule", enforce: "30 * * * *", wantErr: true},
+		{name: "invalid enforce expression", down: "0 19 * * *", enforce: "hourly", wantErr: true},
+		{name: "invalid timezone", timezone: "Mars/Olympus_Mons", down: "0 19 * * *", wantErr: true},
+		{name: "invalid expression", down: "0 25 * * *", wantErr: true},
+		{name: "no schedules", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("SCHEDULE_TIMEZONE", tc.timezone)
+			t.Setenv("SCALE_DOWN_SCHEDULE", tc.down)
+			t.Setenv("SCALE_UP_SCHEDULE", tc.up)
+			t.Setenv("ENFORCE_SCHEDULE", tc.enforce)
+			t.Setenv("POD_NAME", "controller-0")
+
+			conf, err := NewConfig()
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Len(t, conf.Schedules, tc.wantSchedules)
+			assert.Equal(t, "controller-0", conf.Identity)
+			assert.Equal(t, defaultLeaseName, conf.LeaseName)
+		})
+	}
+}
+
+func TestNextRun(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	require.NoError(t, err)
+
+	schedules := append(mustSchedules(t, config.ScaleDown, "0 19 * * 1-5"), mustSchedules(t, config.ScaleUp, "0 7 * * 1-5")...)
+	c := New(Config{Schedules: schedules, Location: london}, nil, nil)
+
+	tests := []struct {
+		name       string
+		now        time.Time
+		wantAction config.ScaleAction
+		wantAt     time.Time
+	}{
+		{
+			name:       "weekday evening scales down",
+			now:        time.Date(2026, 1, 14, 12, 0, 0, 0, time.UTC),
+			wantAction: config.ScaleDown,
+			wantAt:     time.Date(2026, 1, 14, 19, 0, 0, 0, time.UTC),
+		},
+		{
+			name:       "weekend is skipped until Monday morning",
+			now:        time.Date(2026, 1, 16, 20, 0, 0, 0, time.UTC),
+			wantAction: config.ScaleUp,
+			wantAt:     time.Date(2026, 1, 19, 7, 0, 0, 0, time.UTC),
+		},
+		{
+			name:       "follows daylight saving time",
+			now:        time.Date(2026, 3, 29, 12, 0, 0, 0, time.UTC),
+			wantAction: config.ScaleUp,
+			wantAt:     time.Date(2026, 3, 30, 6, 0, 0, 0, time.UTC),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			next, at := c.nextRun(tc.now)
+			assert.Equal(t, tc.wantAction, next.Action)
+			assert.True(t, tc.wantAt.Equal(at), "Expected %s, got %s", tc.wantAt, at)
+		})
+	}
+}
+
+func TestRun(t *testing.T) {
+	log.SetDefault(log.New(log.NewJSONHandler(io.Discard, nil)))
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	var runs atomic.Int32
+	run := func(_ context.Context, action config.ScaleAction) error {
+		assert.Equal(t, config.ScaleUp, action)
+		if runs.Add(1) == 2 {
+			cancel()
+		}
+		return nil
+	}
+
+	client := fake.NewClientset()
+	conf := Config{
+		Schedules:  []Schedule{{Action: config.ScaleUp, Spec: "every 10ms", schedule: everySchedule(10 * time.Millisecond)}},
+		Location:   time.UTC,
+		HealthAddr: "127.0.0.1:0",
+		LeaseName:  defaultLeaseName,
+		Namespace:  defaultNamespace,
+		Identity:   "controller-0",
+	}
+	c := New(conf, client, run)
+
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("Expected the controller to stop once its context was cancelled")
+	}
+	assert.Equal(t, int32(2), runs.Load(), "Expected runs not to overlap or continue after cancelling")
+
+	lease, err := client.CoordinationV1().Leases(defaultNamespace).Get(t.Context(), defaultLeaseName, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.NotNil(t, lease.Spec.LeaseDurationSeconds)
+}
+
+func TestHandler(t *testing.T) {
+	c := New(Config{Identity: "controller-0", Schedules: mustSchedules(t, config.ScaleDown, "0 19 * * *"), Location: time.UTC}, nil, nil)
+
+	rec := httptest.NewRecorder()
+	c.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var status Status
+	rec = httptest.NewRecorder()
+	c.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+	assert.Equal(t, Status{Identity: "controller-0"}, status)
+
+	c.setLeader(true)
+	next, at := c.nextRun(time.Date(2026, 1, 14, 12, 0, 0, 0, time.UTC))
+	c.setNext(next, at)
+
+	rec = httptest.NewRecorder()
+	c.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+	assert.True(t, status.Leader)
+	assert.Equal(t, "ScaleDown", status.NextAction)
+	require.NotNil(t, status.NextRunAt)
+	assert.True(t, at.Equal(*status.NextRunAt))
+}
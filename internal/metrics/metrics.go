@@ -0,0 +1,150 @@
+// Package metrics pushes Prometheus metrics describing a scale run to a Pushgateway.
+// The tool runs as a short-lived CronJob so the metrics cannot be scraped directly.
+package metrics
+
+import (
+	"fmt"
+	log "log/slog"
+	"os"
+	"strconv"
+
+	"github.com/michaelprice232/eks-env-scaledown/internal/report"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+const (
+	namespace      = "eks_env_scaledown"
+	defaultJobName = "eks-env-scaledown"
+)
+
+// Pusher holds the Pushgateway location and the labels used to group the pushed metrics.
+type Pusher struct {
+	URL         string
+	Job         string
+	Environment string
+}
+
+// NewPusher returns Pusher, which can be used for pushing run metrics to a Pushgateway.
+// Returns nil if PUSHGATEWAY_URL is not set.
+func NewPusher() *Pusher {
+	url := os.Getenv("PUSHGATEWAY_URL")
+	if url == "" {
+		log.Debug("PUSHGATEWAY_URL envar not set. Metrics will not be pushed")
+		return nil
+	}
+
+	job := os.Getenv("PUSHGATEWAY_JOB")
+	if job == "" {
+		job = defaultJobName
+	}
+
+	return &Pusher{
+		URL:         url,
+		Job:         job,
+		Environment: os.Getenv("ENVIRONMENT"),
+	}
+}
+
+// newRegistry builds the metrics for rep in a fresh registry. The last success timestamp is
+// only included for successful runs so a failed push leaves the previous value in place.
+func newRegistry(rep *report.Report) *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+
+	success := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_run_success",
+		Help:      "Whether the last run completed without errors (1) or not (0).",
+	})
+	lastRun := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_run_timestamp_seconds",
+		Help:      "Unix time at which the last run finished.",
+	})
+	runDuration := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "run_duration_seconds",
+		Help:      "How long the last run took.",
+	})
+	phaseDuration := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "phase_duration_seconds",
+		Help:      "How long each phase of the last run took.",
+	}, []string{"phase"})
+	groupDuration := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "group_duration_seconds",
+		Help:      "How long each startup group took to scale in the last run.",
+	}, []string{"group"})
+	resourcesScaled := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "resources_scaled",
+		Help:      "Number of Deployments and StatefulSets scaled in the last run.",
+	})
+	podsTerminated := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "pods_terminated",
+		Help:      "Number of standalone pods terminated in the last run.",
+	})
+	alertsToggled := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "alerts_toggled",
+		Help:      "Number of alerts enabled or disabled in the last run, per integration.",
+	}, []string{"integration"})
+
+	reg.MustRegister(success, lastRun, runDuration, phaseDuration, groupDuration, resourcesScaled, podsTerminated, alertsToggled)
+
+	if rep.Success {
+		success.Set(1)
+
+		lastSuccess := prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "last_success_timestamp_seconds",
+			Help:      "Unix time at which the last successful run finished.",
+		})
+		lastSuccess.Set(float64(rep.FinishedAt.Unix()))
+		reg.MustRegister(lastSuccess)
+	}
+
+	lastRun.Set(float64(rep.FinishedAt.Unix()))
+	runDuration.Set(rep.Duration().Seconds())
+	for _, p := range rep.Phases {
+		phaseDuration.WithLabelValues(p.Name).Set(p.DurationSeconds)
+	}
+	for _, g := range rep.Groups {
+		groupDuration.WithLabelValues(strconv.Itoa(g.Number)).Set(g.DurationSeconds)
+	}
+	resourcesScaled.Set(float64(len(rep.Resources)))
+	podsTerminated.Set(float64(len(rep.Pods)))
+	for _, a := range rep.Alerting {
+		alertsToggled.WithLabelValues(a.Integration).Add(float64(len(a.Targets)))
+	}
+
+	return reg
+}
+
+// Push sends the metrics for the finished run rep to the Pushgateway. The metrics are grouped by
+// action (and environment, if set) so scale up and scale down runs do not overwrite each other.
+func Push(p *Pusher, rep *report.Report) error {
+	if p == nil || rep == nil {
+		return nil
+	}
+
+	pusher := push.New(p.URL, p.Job).
+		Gatherer(newRegistry(rep)).
+		Grouping("action", rep.Action)
+	if p.Environment != "" {
+		pusher = pusher.Grouping("environment", p.Environment)
+	}
+
+	// Add (HTTP POST) only replaces metrics with the same names, keeping the last success
+	// timestamp from a previous run when this run failed
+	if err := pusher.Add(); err != nil {
+		return fmt.Errorf("pushing metrics to %s: %w", p.URL, err)
+	}
+
+	log.Info("Pushed run metrics", "pushgateway", p.URL, "job", p.Job)
+
+	return nil
+}
@@ -0,0 +1,91 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/michaelprice232/eks-env-scaledown/internal/report"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewPusher(t *testing.T) {
+	t.Run("returns nil when the Pushgateway URL is unset", func(t *testing.T) {
+		t.Setenv("PUSHGATEWAY_URL", "")
+		assert.Nil(t, NewPusher())
+	})
+
+	t.Run("defaults the job name", func(t *testing.T) {
+		t.Setenv("PUSHGATEWAY_URL", "http://pushgateway:9091")
+		t.Setenv("PUSHGATEWAY_JOB", "")
+		t.Setenv("ENVIRONMENT", "staging")
+
+		p := NewPusher()
+		require.NotNil(t, p)
+		assert.Equal(t, defaultJobName, p.Job)
+		assert.Equal(t, "staging", p.Environment)
+	})
+}
+
+func gatheredNames(t *testing.T, rep *report.Report) map[string]bool {
+	t.Helper()
+
+	families, err := newRegistry(rep).Gather()
+	require.NoError(t, err)
+
+	names := make(map[string]bool, len(families))
+	for _, f := range families {
+		names[f.GetName()] = true
+	}
+
+	return names
+}
+
+func TestNewRegistry(t *testing.T) {
+	t.Run("successful run includes the last success timestamp", func(t *testing.T) {
+		rep := report.New("ScaleUp")
+		rep.AddPhase("scale", time.Minute)
+		rep.AddGroup(1, 30*time.Second, 2)
+		rep.Finish()
+
+		names := gatheredNames(t, rep)
+		assert.True(t, names["eks_env_scaledown_last_success_timestamp_seconds"])
+		assert.True(t, names["eks_env_scaledown_phase_duration_seconds"])
+		assert.True(t, names["eks_env_scaledown_group_duration_seconds"])
+	})
+
+	t.Run("failed run omits the last success timestamp", func(t *testing.T) {
+		rep := report.New("ScaleDown")
+		rep.AddError("boom")
+		rep.Finish()
+
+		names := gatheredNames(t, rep)
+		assert.False(t, names["eks_env_scaledown_last_success_timestamp_seconds"])
+		assert.True(t, names["eks_env_scaledown_last_run_success"])
+	})
+}
+
+func TestPush(t *testing.T) {
+	t.Run("no-op when pusher is nil", func(t *testing.T) {
+		assert.NoError(t, Push(nil, report.New("ScaleUp")))
+	})
+
+	t.Run("pushes to the job grouped by action and environment", func(t *testing.T) {
+		var method, path string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			method, path = r.Method, r.URL.Path
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		rep := report.New("ScaleDown")
+		rep.Finish()
+
+		require.NoError(t, Push(&Pusher{URL: server.URL, Job: defaultJobName, Environment: "staging"}, rep))
+		assert.Equal(t, http.MethodPost, method)
+		assert.Equal(t, "/metrics/job/eks-env-scaledown/action/ScaleDown/environment/staging", path)
+	})
+}
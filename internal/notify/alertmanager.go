@@ -0,0 +1,387 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	log "log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/michaelprice232/eks-env-scaledown/internal/state"
+)
+
+const (
+	// alertmanagerStateKey is the state key holding the comma-separated IDs of the open silences.
+	alertmanagerStateKey = "alertmanager-silences"
+
+	// defaultSilenceDuration covers a weekend. Silences are expired early at scale up, so this only
+	// matters if the scale up never runs.
+	defaultSilenceDuration = 72 * time.Hour
+)
+
+// Matcher is a single Alertmanager label matcher.
+type Matcher struct {
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	IsRegex bool   `json:"isRegex"`
+	IsEqual bool   `json:"isEqual"`
+}
+
+// String returns the matcher in PromQL-style notation, e.g. namespace=~"web|api".
+func (m Matcher) String() string {
+	op := "="
+	switch {
+	case m.IsRegex && m.IsEqual:
+		op = "=~"
+	case m.IsRegex:
+		op = "!~"
+	case !m.IsEqual:
+		op = "!="
+	}
+
+	return fmt.Sprintf("%s%s%q", m.Name, op, m.Value)
+}
+
+// AlertmanagerClient manages silences through the Alertmanager v2 API whilst the environment is
+// scaled down. Each entry in Silences becomes one silence. If none are configured a single silence
+// matching the namespaces of the scaled workloads is created instead.
+type AlertmanagerClient struct {
+	Client      *http.Client
+	BaseURL     string
+	BearerToken string
+	Username    string
+	Password    string
+	Silences    [][]Matcher
+	Duration    time.Duration
+	Environment string
+
+	// name and stateKey distinguish Alertmanager-compatible APIs which share this client, such as Grafana's
+	name     string
+	stateKey string
+}
+
+// NewAlertmanagerClient returns AlertmanagerClient, which can be used for creating and expiring
+// Alertmanager silences. nil is returned if ALERTMANAGER_URL is not set.
+func NewAlertmanagerClient() (*AlertmanagerClient, error) {
+	baseURL := os.Getenv("ALERTMANAGER_URL")
+	if baseURL == "" {
+		log.Warn("ALERTMANAGER_URL not set. Will not create any Alertmanager silences")
+		return nil, nil
+	}
+
+	if u, err := url.Parse(baseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("ALERTMANAGER_URL %q is not a valid http(s) URL", baseURL)
+	}
+
+	silences, err := ParseSilences(os.Getenv("ALERTMANAGER_MATCHERS"))
+	if err != nil {
+		return nil, fmt.Errorf("parsing ALERTMANAGER_MATCHERS: %w", err)
+	}
+
+	duration := defaultSilenceDuration
+	if raw := os.Getenv("ALERTMANAGER_SILENCE_DURATION"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("unable to parse ALERTMANAGER_SILENCE_DURATION %q into a positive duration", raw)
+		}
+		duration = d
+	}
+
+	return &AlertmanagerClient{
+		Client:      &http.Client{Timeout: httpTimeout},
+		BaseURL:     baseURL,
+		BearerToken: os.Getenv("ALERTMANAGER_BEARER_TOKEN"),
+		Username:    os.Getenv("ALERTMANAGER_USERNAME"),
+		Password:    os.Getenv("ALERTMANAGER_PASSWORD"),
+		Silences:    silences,
+		Duration:    duration,
+		Environment: os.Getenv("ENVIRONMENT"),
+	}, nil
+}
+
+// Name identifies the integration in logs and errors.
+func (am *AlertmanagerClient) Name() string {
+	if am.name == "" {
+		return "Alertmanager"
+	}
+
+	return am.name
+}
+
+func (am *AlertmanagerClient) key() string {
+	if am.stateKey == "" {
+		return alertmanagerStateKey
+	}
+
+	return am.stateKey
+}
+
+var matcherRegex = regexp.MustCompile(`^\s*([a-zA-Z_][a-zA-Z0-9_]*)\s*(=~|!~|!=|=)\s*(.*?)\s*$`)
+
+// ParseSilences parses silences separated by ";", each made up of matchers separated by ",", e.g.
+// `namespace=~"web|api",severity!="info";alertname="TargetDown"`. Values may be quoted.
+func ParseSilences(raw string) ([][]Matcher, error) {
+	var silences [][]Matcher
+
+	for _, group := range strings.Split(raw, ";") {
+		if strings.TrimSpace(group) == "" {
+			continue
+		}
+
+		var matchers []Matcher
+		for _, expr := range strings.Split(group, ",") {
+			if strings.TrimSpace(expr) == "" {
+				continue
+			}
+
+			parts := matcherRegex.FindStringSubmatch(expr)
+			if parts == nil {
+				return nil, fmt.Errorf("invalid matcher %q: must be of the form name=value, name!=value, name=~regex or name!~regex", strings.TrimSpace(expr))
+			}
+
+			value := parts[3]
+			if len(value) >= 2 && strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) {
+				value = value[1 : len(value)-1]
+			}
+
+			matchers = append(matchers, Matcher{
+				Name:    parts[1],
+				Value:   value,
+				IsRegex: parts[2] == "=~" || parts[2] == "!~",
+				IsEqual: parts[2] == "=" || parts[2] == "=~",
+			})
+		}
+
+		if len(matchers) > 0 {
+			silences = append(silences, matchers)
+		}
+	}
+
+	return silences, nil
+}
+
+// namespaceSilence returns a silence matching every alert from namespaces.
+func namespaceSilence(namespaces []string) []Matcher {
+	quoted := make([]string, 0, len(namespaces))
+	for _, ns := range namespaces {
+		quoted = append(quoted, regexp.QuoteMeta(ns))
+	}
+
+	return []Matcher{{Name: "namespace", Value: strings.Join(quoted, "|"), IsRegex: true, IsEqual: true}}
+}
+
+// UpdateAlertmanagerSilences creates the configured silences at scale down and expires them at scale
+// up. namespaces is only used at scale down when no matchers are configured. The silence IDs are
+// kept in store between the runs, so a scale up which fails before reaching this step leaves them
+// recorded for the next scale up to expire.
+func UpdateAlertmanagerSilences(ctx context.Context, am *AlertmanagerClient, store *state.Store, action ScaleAction, namespaces []string) error {
+	if am == nil {
+		return nil
+	}
+
+	if err := action.validateAction(); err != nil {
+		return err
+	}
+
+	raw, found, err := store.Get(ctx, am.key())
+	if err != nil {
+		return err
+	}
+	existing := splitList(raw)
+
+	switch action {
+	case ScaleDown:
+		// Silences left over from a scale down which was never followed by a scale up are replaced
+		if found {
+			for _, id := range existing {
+				if err = am.expireSilence(ctx, id); err != nil {
+					log.Warn("Unable to expire previous silence. It will expire on its own", "integration", am.Name(), "silenceID", id, "error", err)
+				}
+			}
+		}
+
+		silences := am.Silences
+		if len(silences) == 0 {
+			if len(namespaces) == 0 {
+				log.Info("No matchers configured and no target namespaces found. Not creating any silences", "integration", am.Name())
+				return store.Delete(ctx, am.key())
+			}
+			silences = [][]Matcher{namespaceSilence(namespaces)}
+		}
+
+		ids := make([]string, 0, len(silences))
+		for _, matchers := range silences {
+			id, err := am.createSilence(ctx, matchers)
+			if err != nil {
+				// Record the silences created so far (replacing any previous ones) so the scale up still expires them
+				if setErr := store.Set(ctx, am.key(), strings.Join(ids, ",")); setErr != nil {
+					log.Error("recording silences", "integration", am.Name(), "silenceIDs", ids, "error", setErr)
+				}
+				return fmt.Errorf("creating silence %v: %w", matchers, err)
+			}
+			log.Info("Created silence", "integration", am.Name(), "silenceID", id, "matchers", fmt.Sprint(matchers), "duration", am.Duration)
+			ids = append(ids, id)
+		}
+
+		if err = store.Set(ctx, am.key(), strings.Join(ids, ",")); err != nil {
+			return fmt.Errorf("recording silences %v, which will expire after %s: %w", ids, am.Duration, err)
+		}
+
+	case ScaleUp:
+		if !found {
+			log.Info("No silences recorded. Nothing to expire", "integration", am.Name())
+			return nil
+		}
+
+		for _, id := range existing {
+			log.Info("Expiring silence", "integration", am.Name(), "silenceID", id)
+			if err = am.expireSilence(ctx, id); err != nil {
+				return fmt.Errorf("expiring silence %s: %w", id, err)
+			}
+		}
+
+		if err = store.Delete(ctx, am.key()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type postableSilence struct {
+	Matchers  []Matcher `json:"matchers"`
+	StartsAt  time.Time `json:"startsAt"`
+	EndsAt    time.Time `json:"endsAt"`
+	CreatedBy string    `json:"createdBy"`
+	Comment   string    `json:"comment"`
+}
+
+// createSilence creates a silence starting now and returns its ID.
+func (am *AlertmanagerClient) createSilence(ctx context.Context, matchers []Matcher) (string, error) {
+	now := time.Now().UTC()
+
+	body, err := json.Marshal(postableSilence{
+		Matchers:  matchers,
+		StartsAt:  now,
+		EndsAt:    now.Add(am.Duration),
+		CreatedBy: "eks-env-scaledown",
+		Comment:   strings.TrimSpace(fmt.Sprintf("eks-env-scaledown: %s scaled down", am.Environment)),
+	})
+	if err != nil {
+		return "", fmt.Errorf("encoding silence: %w", err)
+	}
+
+	resp, err := am.do(ctx, http.MethodPost, "/api/v2/silences", body)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", am.responseError(resp)
+	}
+
+	var created struct {
+		SilenceID string `json:"silenceID"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		return "", fmt.Errorf("decoding silence: %w", err)
+	}
+	if created.SilenceID == "" {
+		return "", errors.New("silence created without an ID")
+	}
+
+	return created.SilenceID, nil
+}
+
+// expireSilence expires a silence. A silence which no longer exists, or has already expired, is
+// not an error.
+func (am *AlertmanagerClient) expireSilence(ctx context.Context, id string) error {
+	resp, err := am.do(ctx, http.MethodDelete, "/api/v2/silence/"+url.PathEscape(id), nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode == http.StatusNotFound {
+		log.Info("Silence no longer exists", "integration", am.Name(), "silenceID", id)
+		return nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		// Alertmanager refuses to expire a silence which has already expired
+		if expired, stateErr := am.silenceExpired(ctx, id); stateErr == nil && expired {
+			log.Info("Silence has already expired", "integration", am.Name(), "silenceID", id)
+			return nil
+		}
+		return am.responseError(resp)
+	}
+
+	return nil
+}
+
+// silenceExpired reports whether the silence id is in the expired state.
+func (am *AlertmanagerClient) silenceExpired(ctx context.Context, id string) (bool, error) {
+	resp, err := am.do(ctx, http.MethodGet, "/api/v2/silence/"+url.PathEscape(id), nil)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return false, am.responseError(resp)
+	}
+
+	var silence struct {
+		Status struct {
+			State string `json:"state"`
+		} `json:"status"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&silence); err != nil {
+		return false, fmt.Errorf("decoding silence: %w", err)
+	}
+
+	return silence.Status.State == "expired", nil
+}
+
+func (am *AlertmanagerClient) do(ctx context.Context, method, path string, body []byte) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(am.BaseURL, "/")+path, reader)
+	if err != nil {
+		return nil, fmt.Errorf("building request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	switch {
+	case am.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+am.BearerToken)
+	case am.Username != "":
+		req.SetBasicAuth(am.Username, am.Password)
+	}
+
+	resp, err := am.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("sending request to %s: %w", am.Name(), err)
+	}
+
+	return resp, nil
+}
+
+func (am *AlertmanagerClient) responseError(resp *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("unexpected response from %s %s: %s", am.Name(), resp.Status, strings.TrimSpace(string(msg)))
+}
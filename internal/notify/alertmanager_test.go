@@ -0,0 +1,218 @@
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	log "log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/michaelprice232/eks-env-scaledown/internal/state"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// fakeAlertmanager is a stand-in for the Alertmanager v2 silences API.
+type fakeAlertmanager struct {
+	mu       sync.Mutex
+	silences map[string]postableSilence
+	expired  map[string]bool
+	nextID   int
+}
+
+func (f *fakeAlertmanager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer am-token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/api/v2/silences":
+		var body postableSilence
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.nextID++
+		id := fmt.Sprintf("silence-%d", f.nextID)
+		f.silences[id] = body
+		_ = json.NewEncoder(w).Encode(map[string]string{"silenceID": id})
+
+	case strings.HasPrefix(r.URL.Path, "/api/v2/silence/"):
+		id := strings.TrimPrefix(r.URL.Path, "/api/v2/silence/")
+		if _, ok := f.silences[id]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if r.Method == http.MethodGet {
+			state := "active"
+			if f.expired[id] {
+				state = "expired"
+			}
+			_ = json.NewEncoder(w).Encode(map[string]any{"id": id, "status": map[string]string{"state": state}})
+			return
+		}
+
+		if f.expired[id] {
+			http.Error(w, fmt.Sprintf("silence %s already expired", id), http.StatusInternalServerError)
+			return
+		}
+		f.expired[id] = true
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeAlertmanager) active() []string {
+	var ids []string
+	for id := range f.silences {
+		if !f.expired[id] {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+}
+
+func newAlertmanagerTestClient(t *testing.T, silences [][]Matcher) (*AlertmanagerClient, *fakeAlertmanager) {
+	t.Helper()
+
+	fakeAM := &fakeAlertmanager{silences: make(map[string]postableSilence), expired: make(map[string]bool)}
+	srv := httptest.NewServer(fakeAM)
+	t.Cleanup(srv.Close)
+
+	return &AlertmanagerClient{
+		Client:      srv.Client(),
+		BaseURL:     srv.URL,
+		BearerToken: "am-token",
+		Silences:    silences,
+		Duration:    12 * time.Hour,
+		Environment: "staging",
+	}, fakeAM
+}
+
+func TestUpdateAlertmanagerSilences(t *testing.T) {
+	log.SetDefault(log.New(log.NewJSONHandler(io.Discard, nil)))
+
+	t.Run("defaults to the target namespaces", func(t *testing.T) {
+		am, fakeAM := newAlertmanagerTestClient(t, nil)
+		store := state.New(fake.NewClientset(), "eks-env-scaledown")
+
+		require.NoError(t, UpdateAlertmanagerSilences(t.Context(), am, store, ScaleDown, []string{"data", "web"}))
+		require.Len(t, fakeAM.active(), 1)
+
+		silence := fakeAM.silences[fakeAM.active()[0]]
+		assert.Equal(t, []Matcher{{Name: "namespace", Value: "data|web", IsRegex: true, IsEqual: true}}, silence.Matchers)
+		assert.Equal(t, 12*time.Hour, silence.EndsAt.Sub(silence.StartsAt))
+		assert.Equal(t, "eks-env-scaledown", silence.CreatedBy)
+
+		require.NoError(t, UpdateAlertmanagerSilences(t.Context(), am, store, ScaleUp, nil))
+		assert.Empty(t, fakeAM.active())
+
+		_, found, err := store.Get(t.Context(), alertmanagerStateKey)
+		require.NoError(t, err)
+		assert.False(t, found, "Expected the silence IDs to be cleared once expired")
+	})
+
+	t.Run("one silence per configured matcher set", func(t *testing.T) {
+		silences, err := ParseSilences(`namespace=~"web|api",severity!="info";alertname="TargetDown"`)
+		require.NoError(t, err)
+		am, fakeAM := newAlertmanagerTestClient(t, silences)
+		store := state.New(fake.NewClientset(), "eks-env-scaledown")
+
+		require.NoError(t, UpdateAlertmanagerSilences(t.Context(), am, store, ScaleDown, []string{"ignored"}))
+		assert.Len(t, fakeAM.active(), 2)
+
+		ids, _, err := store.Get(t.Context(), alertmanagerStateKey)
+		require.NoError(t, err)
+		assert.Equal(t, "silence-1,silence-2", ids)
+	})
+
+	t.Run("leftover silences are replaced at scale down", func(t *testing.T) {
+		am, fakeAM := newAlertmanagerTestClient(t, nil)
+		store := state.New(fake.NewClientset(), "eks-env-scaledown")
+
+		require.NoError(t, UpdateAlertmanagerSilences(t.Context(), am, store, ScaleDown, []string{"web"}))
+		require.NoError(t, UpdateAlertmanagerSilences(t.Context(), am, store, ScaleDown, []string{"web"}))
+
+		assert.Equal(t, []string{"silence-2"}, fakeAM.active())
+	})
+
+	t.Run("already expired silences are not an error", func(t *testing.T) {
+		am, fakeAM := newAlertmanagerTestClient(t, nil)
+		store := state.New(fake.NewClientset(), "eks-env-scaledown")
+
+		require.NoError(t, UpdateAlertmanagerSilences(t.Context(), am, store, ScaleDown, []string{"web"}))
+		fakeAM.expired["silence-1"] = true
+
+		require.NoError(t, UpdateAlertmanagerSilences(t.Context(), am, store, ScaleUp, nil))
+	})
+
+	t.Run("scale up without recorded silences is a no-op", func(t *testing.T) {
+		am, fakeAM := newAlertmanagerTestClient(t, nil)
+
+		require.NoError(t, UpdateAlertmanagerSilences(t.Context(), am, state.New(fake.NewClientset(), "eks-env-scaledown"), ScaleUp, nil))
+		assert.Empty(t, fakeAM.expired)
+	})
+
+	t.Run("nil client is a no-op", func(t *testing.T) {
+		assert.NoError(t, UpdateAlertmanagerSilences(t.Context(), nil, nil, ScaleDown, nil))
+	})
+}
+
+func TestParseSilences(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		expected [][]Matcher
+		wantErr  bool
+	}{
+		{name: "empty", raw: "", expected: nil},
+		{
+			name: "all operators",
+			raw:  `a=1, b!="2", c=~"x|y", d!~z`,
+			expected: [][]Matcher{{
+				{Name: "a", Value: "1", IsEqual: true},
+				{Name: "b", Value: "2"},
+				{Name: "c", Value: "x|y", IsRegex: true, IsEqual: true},
+				{Name: "d", Value: "z", IsRegex: true},
+			}},
+		},
+		{
+			name:     "multiple silences",
+			raw:      `namespace="web"; alertname="TargetDown";`,
+			expected: [][]Matcher{{{Name: "namespace", Value: "web", IsEqual: true}}, {{Name: "alertname", Value: "TargetDown", IsEqual: true}}},
+		},
+		{name: "missing operator", raw: `namespace`, wantErr: true},
+		{name: "invalid label name", raw: `1namespace="web"`, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			silences, err := ParseSilences(tc.raw)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, silences)
+		})
+	}
+}
+
+func TestMatcherString(t *testing.T) {
+	assert.Equal(t, `namespace=~"web|api"`, Matcher{Name: "namespace", Value: "web|api", IsRegex: true, IsEqual: true}.String())
+	assert.Equal(t, `severity!="info"`, Matcher{Name: "severity", Value: "info"}.String())
+}
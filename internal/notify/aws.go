@@ -4,72 +4,448 @@ package notify
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	log "log/slog"
 	"os"
+	"slices"
+	"strings"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+
+	"github.com/michaelprice232/eks-env-scaledown/internal/state"
 )
 
-// UpdateCloudwatchAlarms either enables or disables all the actions for all the Cloudwatch alerts in the target AWS account.
-// This includes both metric and composite alarms.
-func UpdateCloudwatchAlarms(action string) error {
-	if action != "enable" && action != "disable" {
-		return fmt.Errorf("invalid action: must be 'enable' or 'disable'")
+// CloudwatchFilter restricts which alarms are toggled, for accounts shared with other environments.
+// An alarm must pass every configured filter. An empty filter matches every alarm.
+type CloudwatchFilter struct {
+	// Prefixes matches alarms whose name starts with any of the prefixes.
+	Prefixes []string
+	// Tags matches alarms which have every tag. An empty value matches any value for that key.
+	Tags map[string]string
+	// Allow matches only the listed alarm names or ARNs.
+	Allow []string
+	// Deny excludes the listed alarm names or ARNs, taking precedence over the other filters.
+	Deny []string
+}
+
+// NewCloudwatchFilter returns the CloudwatchFilter configured through envars.
+func NewCloudwatchFilter() (CloudwatchFilter, error) {
+	f := CloudwatchFilter{
+		Prefixes: splitList(os.Getenv("CLOUDWATCH_ALARM_PREFIXES")),
+		Allow:    splitList(os.Getenv("CLOUDWATCH_ALARM_ALLOW")),
+		Deny:     splitList(os.Getenv("CLOUDWATCH_ALARM_DENY")),
+	}
+
+	for _, tag := range splitList(os.Getenv("CLOUDWATCH_ALARM_TAGS")) {
+		key, value, _ := strings.Cut(tag, "=")
+		key = strings.TrimSpace(key)
+		if key == "" {
+			return CloudwatchFilter{}, fmt.Errorf("invalid CLOUDWATCH_ALARM_TAGS entry %q: must be of the form key=value or key", tag)
+		}
+		if f.Tags == nil {
+			f.Tags = make(map[string]string)
+		}
+		f.Tags[key] = strings.TrimSpace(value)
+	}
+
+	return f, nil
+}
+
+// matchesAlarm applies the name based filters to an alarm.
+func (f CloudwatchFilter) matchesAlarm(name, arn string) bool {
+	if slices.Contains(f.Deny, name) || slices.Contains(f.Deny, arn) {
+		return false
+	}
+
+	if len(f.Allow) > 0 && !slices.Contains(f.Allow, name) && !slices.Contains(f.Allow, arn) {
+		return false
+	}
+
+	if len(f.Prefixes) > 0 && !slices.ContainsFunc(f.Prefixes, func(p string) bool { return strings.HasPrefix(name, p) }) {
+		return false
+	}
+
+	return true
+}
+
+// matchesTags applies the tag filter to an alarm's tags.
+func (f CloudwatchFilter) matchesTags(tags []types.Tag) bool {
+	for key, value := range f.Tags {
+		found := slices.ContainsFunc(tags, func(t types.Tag) bool {
+			return aws.ToString(t.Key) == key && (value == "" || aws.ToString(t.Value) == value)
+		})
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// cloudwatchAlarm is the subset of a metric or composite alarm needed for filtering.
+type cloudwatchAlarm struct {
+	name           string
+	arn            string
+	actionsEnabled bool
+}
+
+const (
+	// cloudwatchStateKey is the state key holding the names of the alarms whose actions were already disabled
+	// before the scale down, one per line. Alarm names cannot contain control characters.
+	cloudwatchStateKey = "cloudwatch-disabled-alarms"
+
+	// cloudwatchMaxAlarmNames is the most alarm names DisableAlarmActions and EnableAlarmActions accept per request.
+	cloudwatchMaxAlarmNames = 100
+
+	// cloudwatchMaxAttempts is the number of attempts made for each request, with throttled requests also
+	// slowing down the rate of the following ones.
+	cloudwatchMaxAttempts = 8
+)
+
+// CloudwatchAPI is the subset of the Cloudwatch API used for managing alarms, allowing it to be faked in tests.
+type CloudwatchAPI interface {
+	cloudwatch.DescribeAlarmsAPIClient
+	ListTagsForResource(ctx context.Context, params *cloudwatch.ListTagsForResourceInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.ListTagsForResourceOutput, error)
+	DisableAlarmActions(ctx context.Context, params *cloudwatch.DisableAlarmActionsInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.DisableAlarmActionsOutput, error)
+	EnableAlarmActions(ctx context.Context, params *cloudwatch.EnableAlarmActionsInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.EnableAlarmActionsOutput, error)
+}
+
+// CloudwatchTarget is a region and/or account whose alarms are managed. RoleARN is assumed through STS to
+// reach another account, and an empty Region uses the default from the AWS config.
+type CloudwatchTarget struct {
+	Region  string
+	RoleARN string
+	API     CloudwatchAPI
+}
+
+// Name identifies the target in results and logs, or is empty for the default region and account.
+func (t CloudwatchTarget) Name() string {
+	if t.RoleARN == "" {
+		return t.Region
 	}
 
-	manageCloudwatchAlarms := os.Getenv("MANAGE_CLOUDWATCH_ALARMS")
-	if manageCloudwatchAlarms == "" {
+	// Validated by ParseCloudwatchTargets
+	roleARN, _ := arn.Parse(t.RoleARN)
+	if t.Region == "" {
+		return roleARN.AccountID
+	}
+	return roleARN.AccountID + "/" + t.Region
+}
+
+// stateKey is the state key holding the target's alarms which were already disabled before the scale down.
+func (t CloudwatchTarget) stateKey() string {
+	if name := t.Name(); name != "" {
+		return cloudwatchStateKey + "." + strings.ReplaceAll(name, "/", ".")
+	}
+
+	return cloudwatchStateKey
+}
+
+// ParseCloudwatchTargets parses targets of the form region or region=role-arn, separated by ";".
+func ParseCloudwatchTargets(raw string) ([]CloudwatchTarget, error) {
+	var targets []CloudwatchTarget
+	for _, entry := range strings.Split(raw, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		// Role names may contain "=", but regions never do
+		region, roleARN, _ := strings.Cut(entry, "=")
+		t := CloudwatchTarget{Region: strings.TrimSpace(region), RoleARN: strings.TrimSpace(roleARN)}
+		if t.Region == "" {
+			return nil, fmt.Errorf("invalid Cloudwatch target %q: must be of the form region or region=role-arn", entry)
+		}
+		if t.RoleARN != "" {
+			parsed, err := arn.Parse(t.RoleARN)
+			if err != nil || parsed.Service != "iam" || !strings.HasPrefix(parsed.Resource, "role/") {
+				return nil, fmt.Errorf("invalid Cloudwatch target %q: %q is not an IAM role ARN", entry, t.RoleARN)
+			}
+		}
+		targets = append(targets, t)
+	}
+
+	return targets, nil
+}
+
+// CloudwatchClient enables and disables the actions of the Cloudwatch alarms matching Filter in each target.
+type CloudwatchClient struct {
+	Targets []CloudwatchTarget
+	Filter  CloudwatchFilter
+}
+
+// NewCloudwatchClient returns CloudwatchClient, using the default AWS credential chain. Throttled requests are
+// retried with the SDK's adaptive retry mode. The regions and accounts to manage are set through
+// CLOUDWATCH_TARGETS, defaulting to those of the AWS config. nil is returned if MANAGE_CLOUDWATCH_ALARMS is not set.
+func NewCloudwatchClient(ctx context.Context) (*CloudwatchClient, error) {
+	if os.Getenv("MANAGE_CLOUDWATCH_ALARMS") == "" {
 		log.Warn("MANAGE_CLOUDWATCH_ALARMS envar not set. Alarms will not be managed")
-		return nil
+		return nil, nil
+	}
+
+	filter, err := NewCloudwatchFilter()
+	if err != nil {
+		return nil, err
+	}
+
+	targets, err := ParseCloudwatchTargets(os.Getenv("CLOUDWATCH_TARGETS"))
+	if err != nil {
+		return nil, err
+	}
+	if len(targets) == 0 {
+		targets = []CloudwatchTarget{{}}
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRetryer(func() aws.Retryer {
+		return retry.NewAdaptiveMode(func(o *retry.AdaptiveModeOptions) {
+			o.StandardOptions = append(o.StandardOptions, func(so *retry.StandardOptions) { so.MaxAttempts = cloudwatchMaxAttempts })
+		})
+	}))
+	if err != nil {
+		return nil, fmt.Errorf("loading aws config: %w", err)
+	}
+
+	for i, t := range targets {
+		targetCfg := cfg.Copy()
+		if t.Region != "" {
+			targetCfg.Region = t.Region
+		}
+		if t.RoleARN != "" {
+			provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(targetCfg), t.RoleARN, func(o *stscreds.AssumeRoleOptions) {
+				o.RoleSessionName = "eks-env-scaledown"
+			})
+			targetCfg.Credentials = aws.NewCredentialsCache(provider)
+		}
+		targets[i].API = cloudwatch.NewFromConfig(targetCfg)
+	}
+
+	return &CloudwatchClient{Targets: targets, Filter: filter}, nil
+}
+
+// AlarmStatus is the outcome of updating a single alarm.
+type AlarmStatus string
+
+const (
+	AlarmUpdated AlarmStatus = "updated"
+	AlarmSkipped AlarmStatus = "skipped"
+	AlarmFailed  AlarmStatus = "failed"
+)
+
+// AlarmResult records the outcome of updating a single alarm. Err is set when Status is AlarmFailed.
+type AlarmResult struct {
+	Target string
+	Name   string
+	Status AlarmStatus
+	Err    error
+}
+
+// String returns the alarm name, qualified by its target if it isn't in the default region and account.
+func (r AlarmResult) String() string {
+	if r.Target == "" {
+		return r.Name
+	}
+
+	return r.Target + "/" + r.Name
+}
+
+// AlarmsWithStatus returns the qualified names of the alarms in results with status.
+func AlarmsWithStatus(results []AlarmResult, status AlarmStatus) []string {
+	var names []string
+	for _, r := range results {
+		if r.Status == status {
+			names = append(names, r.String())
+		}
+	}
+
+	return names
+}
+
+// UpdateCloudwatchAlarms either enables or disables the actions for the Cloudwatch alarms which match the
+// client's filter in each of its targets. This includes both metric and composite alarms. Requests are batched
+// within the API limits, and a failed batch or target doesn't stop the remaining ones: the outcome for each
+// alarm is returned, with the error only reporting the targets where the alarms or the state couldn't be read.
+//
+// Alarms whose actions were already disabled at scale down are recorded in store and left disabled at scale
+// up, in the same way as CronJobs which were suspended before the scale down.
+func UpdateCloudwatchAlarms(ctx context.Context, cw *CloudwatchClient, store *state.Store, action string) ([]AlarmResult, error) {
+	if action != "enable" && action != "disable" {
+		return nil, fmt.Errorf("invalid action: must be 'enable' or 'disable'")
+	}
+
+	if cw == nil {
+		return nil, nil
 	}
 
-	cfg, err := config.LoadDefaultConfig(context.Background())
+	var (
+		results []AlarmResult
+		errs    []error
+	)
+	for _, t := range cw.Targets {
+		targetResults, err := updateCloudwatchTarget(ctx, t, cw.Filter, store, action)
+		results = append(results, targetResults...)
+		if err != nil {
+			if t.Name() != "" {
+				err = fmt.Errorf("%s: %w", t.Name(), err)
+			}
+			errs = append(errs, err)
+		}
+	}
+
+	return results, errors.Join(errs...)
+}
+
+// updateCloudwatchTarget enables or disables the matching alarms in a single target.
+func updateCloudwatchTarget(ctx context.Context, t CloudwatchTarget, filter CloudwatchFilter, store *state.Store, action string) ([]AlarmResult, error) {
+	matched, err := findCloudwatchAlarms(ctx, t.API, filter)
 	if err != nil {
-		return fmt.Errorf("loading aws config: %w", err)
+		return nil, err
+	}
+
+	recorded, found, err := store.Get(ctx, t.stateKey())
+	if err != nil {
+		return nil, err
+	}
+
+	alarms, skipped := alarmsToUpdate(action, matched, decodeAlarmNames(recorded), found)
+	if len(skipped) > 0 {
+		log.Info("Skipping Cloudwatch alarms whose actions were disabled before the scale down", "target", t.Name(), "alarms", skipped)
+	}
+
+	if action == "disable" {
+		// A record left by a scale down which was never followed by a scale up is kept, as by now
+		// it is this app which has disabled the alarms
+		if found {
+			log.Info("Keeping the Cloudwatch alarms recorded as disabled by a previous scale down", "target", t.Name())
+		} else if err = store.Set(ctx, t.stateKey(), strings.Join(skipped, "\n")); err != nil {
+			return nil, fmt.Errorf("recording the alarms which are already disabled: %w", err)
+		}
+	}
+
+	results := make([]AlarmResult, 0, len(matched))
+	for _, name := range skipped {
+		results = append(results, AlarmResult{Target: t.Name(), Name: name, Status: AlarmSkipped})
 	}
 
-	cwClient := cloudwatch.NewFromConfig(cfg)
+	failed := 0
+	for batch := range slices.Chunk(alarms, cloudwatchMaxAlarmNames) {
+		if action == "disable" {
+			_, err = t.API.DisableAlarmActions(ctx, &cloudwatch.DisableAlarmActionsInput{AlarmNames: batch})
+		} else {
+			_, err = t.API.EnableAlarmActions(ctx, &cloudwatch.EnableAlarmActionsInput{AlarmNames: batch})
+		}
+
+		if err != nil {
+			log.Error("Unable to update Cloudwatch alarms", "target", t.Name(), "action", action, "count", len(batch), "error", err)
+			failed += len(batch)
+			for _, name := range batch {
+				results = append(results, AlarmResult{Target: t.Name(), Name: name, Status: AlarmFailed, Err: fmt.Errorf("%s alarm actions: %w", action, err)})
+			}
+			continue
+		}
+
+		for _, name := range batch {
+			results = append(results, AlarmResult{Target: t.Name(), Name: name, Status: AlarmUpdated})
+		}
+	}
+
+	// The record is kept until every alarm has been re-enabled, so a retried scale up still skips them
+	if action == "enable" && failed == 0 {
+		if err = store.Delete(ctx, t.stateKey()); err != nil {
+			return results, err
+		}
+	}
+
+	log.Info("Updated Cloudwatch alarms", "target", t.Name(), "action", action, "updated", len(alarms)-failed, "skipped", len(skipped), "failed", failed)
 
+	return results, nil
+}
+
+// findCloudwatchAlarms returns every metric and composite alarm which matches filter.
+func findCloudwatchAlarms(ctx context.Context, cwClient CloudwatchAPI, filter CloudwatchFilter) ([]cloudwatchAlarm, error) {
 	// Only metric alarms are returned by default
-	alarmsPaginator := cloudwatch.NewDescribeAlarmsPaginator(cwClient, &cloudwatch.DescribeAlarmsInput{
+	input := &cloudwatch.DescribeAlarmsInput{
 		AlarmTypes: []types.AlarmType{
 			types.AlarmTypeCompositeAlarm,
 			types.AlarmTypeMetricAlarm,
 		},
-	})
+	}
+	// A single prefix can be filtered server side
+	if len(filter.Prefixes) == 1 {
+		input.AlarmNamePrefix = aws.String(filter.Prefixes[0])
+	}
+	alarmsPaginator := cloudwatch.NewDescribeAlarmsPaginator(cwClient, input)
 
+	var matched []cloudwatchAlarm
 	for alarmsPaginator.HasMorePages() {
-		alarmResults, err := alarmsPaginator.NextPage(context.Background())
+		alarmResults, err := alarmsPaginator.NextPage(ctx)
 		if err != nil {
-			return fmt.Errorf("describing cloudwatch alarms: %w", err)
+			return nil, fmt.Errorf("describing cloudwatch alarms: %w", err)
 		}
 
-		alarms := make([]string, 0, len(alarmResults.MetricAlarms)+len(alarmResults.CompositeAlarms))
-
-		for _, metricAlarm := range alarmResults.MetricAlarms {
-			alarms = append(alarms, *metricAlarm.AlarmName)
+		found := make([]cloudwatchAlarm, 0, len(alarmResults.MetricAlarms)+len(alarmResults.CompositeAlarms))
+		for _, a := range alarmResults.MetricAlarms {
+			found = append(found, cloudwatchAlarm{name: aws.ToString(a.AlarmName), arn: aws.ToString(a.AlarmArn), actionsEnabled: aws.ToBool(a.ActionsEnabled)})
 		}
-		for _, compositeAlarm := range alarmResults.CompositeAlarms {
-			alarms = append(alarms, *compositeAlarm.AlarmName)
+		for _, a := range alarmResults.CompositeAlarms {
+			found = append(found, cloudwatchAlarm{name: aws.ToString(a.AlarmName), arn: aws.ToString(a.AlarmArn), actionsEnabled: aws.ToBool(a.ActionsEnabled)})
 		}
 
-		log.Debug("Found alarms", "alarms", alarms)
-
-		if action == "disable" {
-			if _, err = cwClient.DisableAlarmActions(context.Background(), &cloudwatch.DisableAlarmActionsInput{AlarmNames: alarms}); err != nil {
-				return fmt.Errorf("disabling alarm actions: %w", err)
+		for _, alarm := range found {
+			if !filter.matchesAlarm(alarm.name, alarm.arn) {
+				continue
 			}
-			log.Info("Disabled Cloudwatch alarms")
-		} else {
-			if _, err = cwClient.EnableAlarmActions(context.Background(), &cloudwatch.EnableAlarmActionsInput{AlarmNames: alarms}); err != nil {
-				return fmt.Errorf("enabling alarm actions: %w", err)
+
+			if len(filter.Tags) > 0 {
+				tags, err := cwClient.ListTagsForResource(ctx, &cloudwatch.ListTagsForResourceInput{ResourceARN: aws.String(alarm.arn)})
+				if err != nil {
+					return nil, fmt.Errorf("listing tags for alarm %s: %w", alarm.name, err)
+				}
+				if !filter.matchesTags(tags.Tags) {
+					continue
+				}
 			}
-			log.Info("Enabled Cloudwatch alarms")
+
+			matched = append(matched, alarm)
+		}
+	}
+
+	log.Debug("Found alarms", "matched", len(matched))
+
+	return matched, nil
+}
+
+// alarmsToUpdate returns the names of the alarms to toggle. At scale down alarms whose actions are already
+// disabled are skipped, and at scale up those recorded as such are. Once a record was found, a repeated scale down
+// only skips the recorded alarms, disabling again those this app disabled before.
+func alarmsToUpdate(action string, alarms []cloudwatchAlarm, recorded []string, found bool) (update, skipped []string) {
+	for _, alarm := range alarms {
+		disabledBefore := !alarm.actionsEnabled && (!found || slices.Contains(recorded, alarm.name))
+		if (action == "disable" && disabledBefore) || (action == "enable" && slices.Contains(recorded, alarm.name)) {
+			skipped = append(skipped, alarm.name)
+			continue
+		}
+		update = append(update, alarm.name)
+	}
+
+	return update, skipped
+}
+
+// decodeAlarmNames splits the alarm names recorded in the state.
+func decodeAlarmNames(raw string) []string {
+	var names []string
+	for _, name := range strings.Split(raw, "\n") {
+		if name != "" {
+			names = append(names, name)
 		}
 	}
 
-	return nil
+	return names
 }
@@ -0,0 +1,393 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	log "log/slog"
+	"slices"
+	"strconv"
+	"testing"
+
+	"github.com/michaelprice232/eks-env-scaledown/internal/state"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// fakeCloudwatch serves alarms a page at a time and records the batches of alarm names it is sent.
+type fakeCloudwatch struct {
+	metricAlarms []types.MetricAlarm
+	tags         map[string][]types.Tag
+	pageSize     int
+	failBatch    int // 1-based batch number to fail, 0 for none
+
+	disabled [][]string
+	enabled  [][]string
+	batches  int
+}
+
+func (f *fakeCloudwatch) DescribeAlarms(_ context.Context, in *cloudwatch.DescribeAlarmsInput, _ ...func(*cloudwatch.Options)) (*cloudwatch.DescribeAlarmsOutput, error) {
+	start := 0
+	if in.NextToken != nil {
+		start, _ = strconv.Atoi(*in.NextToken)
+	}
+
+	end := min(start+f.pageSize, len(f.metricAlarms))
+	out := &cloudwatch.DescribeAlarmsOutput{MetricAlarms: f.metricAlarms[start:end]}
+	if end < len(f.metricAlarms) {
+		out.NextToken = aws.String(strconv.Itoa(end))
+	}
+
+	return out, nil
+}
+
+func (f *fakeCloudwatch) ListTagsForResource(_ context.Context, in *cloudwatch.ListTagsForResourceInput, _ ...func(*cloudwatch.Options)) (*cloudwatch.ListTagsForResourceOutput, error) {
+	return &cloudwatch.ListTagsForResourceOutput{Tags: f.tags[aws.ToString(in.ResourceARN)]}, nil
+}
+
+func (f *fakeCloudwatch) DisableAlarmActions(_ context.Context, in *cloudwatch.DisableAlarmActionsInput, _ ...func(*cloudwatch.Options)) (*cloudwatch.DisableAlarmActionsOutput, error) {
+	if err := f.batch(in.AlarmNames); err != nil {
+		return nil, err
+	}
+	f.disabled = append(f.disabled, in.AlarmNames)
+	return &cloudwatch.DisableAlarmActionsOutput{}, nil
+}
+
+func (f *fakeCloudwatch) EnableAlarmActions(_ context.Context, in *cloudwatch.EnableAlarmActionsInput, _ ...func(*cloudwatch.Options)) (*cloudwatch.EnableAlarmActionsOutput, error) {
+	if err := f.batch(in.AlarmNames); err != nil {
+		return nil, err
+	}
+	f.enabled = append(f.enabled, in.AlarmNames)
+	return &cloudwatch.EnableAlarmActionsOutput{}, nil
+}
+
+func (f *fakeCloudwatch) batch(names []string) error {
+	f.batches++
+	if len(names) > cloudwatchMaxAlarmNames {
+		return fmt.Errorf("too many alarm names: %d", len(names))
+	}
+	if f.batches == f.failBatch {
+		return errors.New("throttled")
+	}
+	return nil
+}
+
+// metricAlarms returns n alarms named staging-0..n-1 with their actions enabled.
+func metricAlarms(n int) []types.MetricAlarm {
+	alarms := make([]types.MetricAlarm, 0, n)
+	for i := range n {
+		name := fmt.Sprintf("staging-%d", i)
+		alarms = append(alarms, types.MetricAlarm{
+			AlarmName:      aws.String(name),
+			AlarmArn:       aws.String("arn:aws:cloudwatch:eu-west-1:123456789012:alarm:" + name),
+			ActionsEnabled: aws.Bool(true),
+		})
+	}
+
+	return alarms
+}
+
+func TestNewCloudwatchFilter(t *testing.T) {
+	for _, key := range []string{"CLOUDWATCH_ALARM_PREFIXES", "CLOUDWATCH_ALARM_TAGS", "CLOUDWATCH_ALARM_ALLOW", "CLOUDWATCH_ALARM_DENY"} {
+		t.Setenv(key, "")
+	}
+
+	t.Run("nothing configured matches every alarm", func(t *testing.T) {
+		f, err := NewCloudwatchFilter()
+		require.NoError(t, err)
+		assert.Equal(t, CloudwatchFilter{}, f)
+	})
+
+	t.Run("all filters", func(t *testing.T) {
+		t.Setenv("CLOUDWATCH_ALARM_PREFIXES", "staging-, stg-")
+		t.Setenv("CLOUDWATCH_ALARM_TAGS", "env=staging, team")
+		t.Setenv("CLOUDWATCH_ALARM_ALLOW", "staging-5xx")
+		t.Setenv("CLOUDWATCH_ALARM_DENY", "arn:aws:cloudwatch:eu-west-1:123456789012:alarm:billing")
+
+		f, err := NewCloudwatchFilter()
+		require.NoError(t, err)
+		assert.Equal(t, CloudwatchFilter{
+			Prefixes: []string{"staging-", "stg-"},
+			Tags:     map[string]string{"env": "staging", "team": ""},
+			Allow:    []string{"staging-5xx"},
+			Deny:     []string{"arn:aws:cloudwatch:eu-west-1:123456789012:alarm:billing"},
+		}, f)
+	})
+
+	t.Run("tag without a key", func(t *testing.T) {
+		t.Setenv("CLOUDWATCH_ALARM_TAGS", "=staging")
+
+		_, err := NewCloudwatchFilter()
+		assert.Error(t, err)
+	})
+}
+
+func TestCloudwatchFilterMatchesAlarm(t *testing.T) {
+	const arn = "arn:aws:cloudwatch:eu-west-1:123456789012:alarm:"
+
+	tests := []struct {
+		name    string
+		filter  CloudwatchFilter
+		alarm   string
+		matches bool
+	}{
+		{name: "empty filter", alarm: "billing", matches: true},
+		{name: "matching prefix", filter: CloudwatchFilter{Prefixes: []string{"prod-", "staging-"}}, alarm: "staging-5xx", matches: true},
+		{name: "no matching prefix", filter: CloudwatchFilter{Prefixes: []string{"staging-"}}, alarm: "billing", matches: false},
+		{name: "allowed by name", filter: CloudwatchFilter{Allow: []string{"billing"}}, alarm: "billing", matches: true},
+		{name: "allowed by ARN", filter: CloudwatchFilter{Allow: []string{arn + "billing"}}, alarm: "billing", matches: true},
+		{name: "not allowed", filter: CloudwatchFilter{Allow: []string{"staging-5xx"}}, alarm: "billing", matches: false},
+		{name: "allowed but without the prefix", filter: CloudwatchFilter{Prefixes: []string{"staging-"}, Allow: []string{"billing"}}, alarm: "billing", matches: false},
+		{name: "denied by name", filter: CloudwatchFilter{Prefixes: []string{"staging-"}, Deny: []string{"staging-security"}}, alarm: "staging-security", matches: false},
+		{name: "deny takes precedence over allow", filter: CloudwatchFilter{Allow: []string{"billing"}, Deny: []string{arn + "billing"}}, alarm: "billing", matches: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.matches, tt.filter.matchesAlarm(tt.alarm, arn+tt.alarm))
+		})
+	}
+}
+
+func TestCloudwatchFilterMatchesTags(t *testing.T) {
+	tags := []types.Tag{
+		{Key: aws.String("env"), Value: aws.String("staging")},
+		{Key: aws.String("team"), Value: aws.String("platform")},
+	}
+
+	tests := []struct {
+		name    string
+		filter  map[string]string
+		matches bool
+	}{
+		{name: "no tag filter", matches: true},
+		{name: "matching value", filter: map[string]string{"env": "staging"}, matches: true},
+		{name: "any value", filter: map[string]string{"team": ""}, matches: true},
+		{name: "every tag must match", filter: map[string]string{"env": "staging", "team": "payments"}, matches: false},
+		{name: "missing tag", filter: map[string]string{"cluster": ""}, matches: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.matches, CloudwatchFilter{Tags: tt.filter}.matchesTags(tags))
+		})
+	}
+}
+
+func TestAlarmsToUpdate(t *testing.T) {
+	alarms := []cloudwatchAlarm{
+		{name: "staging-5xx", actionsEnabled: true},
+		{name: "staging-flaky", actionsEnabled: false},
+		{name: "staging-latency", actionsEnabled: true},
+	}
+
+	t.Run("disable skips alarms which are already disabled", func(t *testing.T) {
+		update, skipped := alarmsToUpdate("disable", alarms, nil, false)
+		assert.Equal(t, []string{"staging-5xx", "staging-latency"}, update)
+		assert.Equal(t, []string{"staging-flaky"}, skipped)
+	})
+
+	t.Run("a repeated disable only skips the recorded alarms", func(t *testing.T) {
+		disabled := []cloudwatchAlarm{{name: "staging-5xx"}, {name: "staging-flaky"}, {name: "staging-latency"}}
+		update, skipped := alarmsToUpdate("disable", disabled, decodeAlarmNames("staging-flaky\n"), true)
+		assert.Equal(t, []string{"staging-5xx", "staging-latency"}, update)
+		assert.Equal(t, []string{"staging-flaky"}, skipped)
+	})
+
+	t.Run("enable skips the recorded alarms", func(t *testing.T) {
+		disabled := []cloudwatchAlarm{{name: "staging-5xx"}, {name: "staging-flaky"}, {name: "staging-latency"}}
+		update, skipped := alarmsToUpdate("enable", disabled, decodeAlarmNames("staging-flaky\n"), true)
+		assert.Equal(t, []string{"staging-5xx", "staging-latency"}, update)
+		assert.Equal(t, []string{"staging-flaky"}, skipped)
+	})
+
+	t.Run("enable without a record updates every alarm", func(t *testing.T) {
+		update, skipped := alarmsToUpdate("enable", alarms, decodeAlarmNames(""), false)
+		assert.Len(t, update, 3)
+		assert.Empty(t, skipped)
+	})
+}
+
+func TestUpdateCloudwatchAlarms(t *testing.T) {
+	log.SetDefault(log.New(log.NewJSONHandler(io.Discard, nil)))
+
+	t.Run("nil client is a no-op", func(t *testing.T) {
+		results, err := UpdateCloudwatchAlarms(t.Context(), nil, nil, "disable")
+		require.NoError(t, err)
+		assert.Empty(t, results)
+	})
+
+	t.Run("invalid action", func(t *testing.T) {
+		_, err := UpdateCloudwatchAlarms(t.Context(), &CloudwatchClient{Targets: []CloudwatchTarget{{API: &fakeCloudwatch{}}}}, nil, "pause")
+		assert.Error(t, err)
+	})
+
+	t.Run("requests are batched within the API limit", func(t *testing.T) {
+		api := &fakeCloudwatch{metricAlarms: metricAlarms(250), pageSize: 100}
+
+		results, err := UpdateCloudwatchAlarms(t.Context(), &CloudwatchClient{Targets: []CloudwatchTarget{{API: api}}}, nil, "disable")
+		require.NoError(t, err)
+		assert.Len(t, AlarmsWithStatus(results, AlarmUpdated), 250)
+
+		sizes := make([]int, 0, len(api.disabled))
+		for _, batch := range api.disabled {
+			sizes = append(sizes, len(batch))
+		}
+		assert.Equal(t, []int{100, 100, 50}, sizes)
+	})
+
+	t.Run("a failed batch doesn't stop the others", func(t *testing.T) {
+		api := &fakeCloudwatch{metricAlarms: metricAlarms(150), pageSize: 100, failBatch: 1}
+
+		results, err := UpdateCloudwatchAlarms(t.Context(), &CloudwatchClient{Targets: []CloudwatchTarget{{API: api}}}, nil, "enable")
+		require.NoError(t, err)
+		assert.Len(t, AlarmsWithStatus(results, AlarmFailed), 100)
+		assert.Len(t, AlarmsWithStatus(results, AlarmUpdated), 50)
+		for _, r := range results {
+			if r.Status == AlarmFailed {
+				assert.ErrorContains(t, r.Err, "throttled")
+			}
+		}
+	})
+
+	t.Run("only alarms matching the filter are updated", func(t *testing.T) {
+		alarms := metricAlarms(3)
+		api := &fakeCloudwatch{
+			metricAlarms: alarms,
+			pageSize:     100,
+			tags: map[string][]types.Tag{
+				*alarms[0].AlarmArn: {{Key: aws.String("env"), Value: aws.String("staging")}},
+				*alarms[1].AlarmArn: {{Key: aws.String("env"), Value: aws.String("production")}},
+				*alarms[2].AlarmArn: {{Key: aws.String("env"), Value: aws.String("staging")}},
+			},
+		}
+		filter := CloudwatchFilter{Tags: map[string]string{"env": "staging"}, Deny: []string{"staging-2"}}
+
+		results, err := UpdateCloudwatchAlarms(t.Context(), &CloudwatchClient{Targets: []CloudwatchTarget{{API: api}}, Filter: filter}, nil, "disable")
+		require.NoError(t, err)
+		assert.Equal(t, []AlarmResult{{Name: "staging-0", Status: AlarmUpdated}}, results)
+	})
+
+	t.Run("alarms disabled before the scale down stay disabled", func(t *testing.T) {
+		store := state.New(fake.NewClientset(), "eks-env-scaledown")
+		alarms := metricAlarms(3)
+		alarms[1].ActionsEnabled = aws.Bool(false)
+		api := &fakeCloudwatch{metricAlarms: alarms, pageSize: 100}
+		cw := &CloudwatchClient{Targets: []CloudwatchTarget{{API: api}}}
+
+		results, err := UpdateCloudwatchAlarms(t.Context(), cw, store, "disable")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"staging-1"}, AlarmsWithStatus(results, AlarmSkipped))
+		assert.Equal(t, [][]string{{"staging-0", "staging-2"}}, api.disabled)
+
+		// A repeated scale down sees every alarm disabled, but keeps the original record
+		for i := range alarms {
+			alarms[i].ActionsEnabled = aws.Bool(false)
+		}
+		results, err = UpdateCloudwatchAlarms(t.Context(), cw, store, "disable")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"staging-1"}, AlarmsWithStatus(results, AlarmSkipped), "Expected only the recorded alarm to be reported as disabled before the scale down")
+		assert.Equal(t, []string{"staging-0", "staging-2"}, AlarmsWithStatus(results, AlarmUpdated))
+
+		results, err = UpdateCloudwatchAlarms(t.Context(), cw, store, "enable")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"staging-1"}, AlarmsWithStatus(results, AlarmSkipped))
+		assert.Equal(t, [][]string{{"staging-0", "staging-2"}}, api.enabled)
+
+		_, found, err := store.Get(t.Context(), cloudwatchStateKey)
+		require.NoError(t, err)
+		assert.False(t, found, "Expected the record to be removed once the alarms were re-enabled")
+	})
+
+	t.Run("the record is kept when alarms fail to be re-enabled", func(t *testing.T) {
+		store := state.New(fake.NewClientset(), "eks-env-scaledown")
+		require.NoError(t, store.Set(t.Context(), cloudwatchStateKey, "staging-1"))
+		api := &fakeCloudwatch{metricAlarms: metricAlarms(3), pageSize: 100, failBatch: 1}
+
+		_, err := UpdateCloudwatchAlarms(t.Context(), &CloudwatchClient{Targets: []CloudwatchTarget{{API: api}}}, store, "enable")
+		require.NoError(t, err)
+
+		recorded, found, err := store.Get(t.Context(), cloudwatchStateKey)
+		require.NoError(t, err)
+		assert.True(t, found)
+		assert.True(t, slices.Contains(decodeAlarmNames(recorded), "staging-1"))
+	})
+}
+
+func TestUpdateCloudwatchAlarmsAcrossTargets(t *testing.T) {
+	log.SetDefault(log.New(log.NewJSONHandler(io.Discard, nil)))
+
+	store := state.New(fake.NewClientset(), "eks-env-scaledown")
+	primary := metricAlarms(2)
+	primary[1].ActionsEnabled = aws.Bool(false)
+	regional := &fakeCloudwatch{metricAlarms: primary, pageSize: 100}
+	shared := &fakeCloudwatch{metricAlarms: metricAlarms(1), pageSize: 100, failBatch: 1}
+
+	cw := &CloudwatchClient{Targets: []CloudwatchTarget{
+		{Region: "eu-west-1", API: regional},
+		{Region: "us-east-1", RoleARN: "arn:aws:iam::123456789012:role/scaledown", API: shared},
+	}}
+
+	results, err := UpdateCloudwatchAlarms(t.Context(), cw, store, "disable")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"eu-west-1/staging-0"}, AlarmsWithStatus(results, AlarmUpdated))
+	assert.Equal(t, []string{"eu-west-1/staging-1"}, AlarmsWithStatus(results, AlarmSkipped))
+	assert.Equal(t, []string{"123456789012/us-east-1/staging-0"}, AlarmsWithStatus(results, AlarmFailed))
+
+	recorded, found, err := store.Get(t.Context(), "cloudwatch-disabled-alarms.eu-west-1")
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "staging-1", recorded)
+
+	_, found, err = store.Get(t.Context(), "cloudwatch-disabled-alarms.123456789012.us-east-1")
+	require.NoError(t, err)
+	assert.True(t, found, "Expected each target to keep its own record")
+}
+
+func TestParseCloudwatchTargets(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		want    []CloudwatchTarget
+		wantErr bool
+	}{
+		{name: "empty", raw: ""},
+		{
+			name: "regions and roles",
+			raw:  "eu-west-1; us-east-1=arn:aws:iam::123456789012:role/path/scale=down",
+			want: []CloudwatchTarget{
+				{Region: "eu-west-1"},
+				{Region: "us-east-1", RoleARN: "arn:aws:iam::123456789012:role/path/scale=down"},
+			},
+		},
+		{name: "missing region", raw: "=arn:aws:iam::123456789012:role/scaledown", wantErr: true},
+		{name: "not an ARN", raw: "eu-west-1=scaledown", wantErr: true},
+		{name: "not a role", raw: "eu-west-1=arn:aws:iam::123456789012:user/scaledown", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseCloudwatchTargets(tt.raw)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestCloudwatchTargetName(t *testing.T) {
+	assert.Empty(t, CloudwatchTarget{}.Name())
+	assert.Equal(t, "eu-west-1", CloudwatchTarget{Region: "eu-west-1"}.Name())
+	assert.Equal(t, "123456789012/eu-west-1", CloudwatchTarget{Region: "eu-west-1", RoleARN: "arn:aws:iam::123456789012:role/scaledown"}.Name())
+	assert.Equal(t, "cloudwatch-disabled-alarms", CloudwatchTarget{}.stateKey())
+	assert.Equal(t, "cloudwatch-disabled-alarms.123456789012.eu-west-1", CloudwatchTarget{Region: "eu-west-1", RoleARN: "arn:aws:iam::123456789012:role/scaledown"}.stateKey())
+}
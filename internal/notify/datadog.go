@@ -0,0 +1,263 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	log "log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/michaelprice232/eks-env-scaledown/internal/state"
+)
+
+const (
+	datadogDefaultSite = "datadoghq.com"
+
+	// datadogStateKey is the state key holding the ID of the scheduled downtime.
+	datadogStateKey = "datadog-downtime"
+
+	// defaultDatadogDowntimeDuration covers a weekend. The downtime is cancelled early at scale up, so
+	// this only matters if the scale up never runs.
+	defaultDatadogDowntimeDuration = 72 * time.Hour
+)
+
+// DatadogClient schedules a Datadog downtime whilst the environment is scaled down, muting the
+// monitors matching MonitorTags for the hosts and groups matching Scope.
+type DatadogClient struct {
+	Client      *http.Client
+	BaseURL     string
+	APIKey      string
+	AppKey      string
+	Scope       string
+	MonitorTags []string
+	Duration    time.Duration
+	Environment string
+}
+
+// NewDatadogClient returns DatadogClient, which can be used for scheduling and cancelling Datadog
+// downtimes. nil is returned if DATADOG_API_KEY or DATADOG_APP_KEY are not set.
+func NewDatadogClient() (*DatadogClient, error) {
+	apiKey := os.Getenv("DATADOG_API_KEY")
+	appKey := os.Getenv("DATADOG_APP_KEY")
+	if apiKey == "" || appKey == "" {
+		log.Warn("DATADOG_API_KEY and/or DATADOG_APP_KEY not set. Will not schedule any Datadog downtimes")
+		return nil, nil
+	}
+
+	site := os.Getenv("DATADOG_SITE")
+	if site == "" {
+		site = datadogDefaultSite
+	}
+
+	environment := os.Getenv("ENVIRONMENT")
+
+	// Default to the environment tag, which is how most Datadog setups separate environments
+	scope := os.Getenv("DATADOG_DOWNTIME_SCOPE")
+	if scope == "" && environment != "" {
+		scope = "env:" + environment
+	}
+	if scope == "" {
+		return nil, errors.New("DATADOG_DOWNTIME_SCOPE (or ENVIRONMENT) must be set to scope the Datadog downtime, e.g. env:staging")
+	}
+
+	monitorTags := splitList(os.Getenv("DATADOG_MONITOR_TAGS"))
+	if len(monitorTags) == 0 {
+		monitorTags = []string{"*"}
+	}
+
+	duration := defaultDatadogDowntimeDuration
+	if raw := os.Getenv("DATADOG_DOWNTIME_DURATION"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("unable to parse DATADOG_DOWNTIME_DURATION %q into a positive duration", raw)
+		}
+		duration = d
+	}
+
+	return &DatadogClient{
+		Client:      &http.Client{Timeout: httpTimeout},
+		BaseURL:     "https://api." + site,
+		APIKey:      apiKey,
+		AppKey:      appKey,
+		Scope:       scope,
+		MonitorTags: monitorTags,
+		Duration:    duration,
+		Environment: environment,
+	}, nil
+}
+
+// UpdateDatadogDowntime schedules a downtime at scale down and cancels it at scale up. The downtime
+// ID is kept in store between the runs, so a scale up which fails before reaching this step leaves
+// it recorded for the next scale up to cancel.
+func UpdateDatadogDowntime(ctx context.Context, dd *DatadogClient, store *state.Store, action ScaleAction) error {
+	if dd == nil {
+		return nil
+	}
+
+	if err := action.validateAction(); err != nil {
+		return err
+	}
+
+	existingID, found, err := store.Get(ctx, datadogStateKey)
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case ScaleDown:
+		// A downtime left over from a scale down which was never followed by a scale up is replaced
+		if found {
+			log.Info("Cancelling previous Datadog downtime", "downtimeID", existingID)
+			if err = dd.cancelDowntime(ctx, existingID); err != nil {
+				log.Warn("Unable to cancel previous Datadog downtime. It will end on its own", "downtimeID", existingID, "error", err)
+			}
+		}
+
+		id, err := dd.createDowntime(ctx)
+		if err != nil {
+			return fmt.Errorf("scheduling Datadog downtime: %w", err)
+		}
+		log.Info("Scheduled Datadog downtime", "downtimeID", id, "scope", dd.Scope, "monitorTags", dd.MonitorTags, "duration", dd.Duration)
+
+		if err = store.Set(ctx, datadogStateKey, id); err != nil {
+			return fmt.Errorf("recording Datadog downtime %s, which will end after %s: %w", id, dd.Duration, err)
+		}
+
+	case ScaleUp:
+		if !found {
+			log.Info("No Datadog downtime recorded. Nothing to cancel")
+			return nil
+		}
+
+		log.Info("Cancelling Datadog downtime", "downtimeID", existingID)
+		if err = dd.cancelDowntime(ctx, existingID); err != nil {
+			return fmt.Errorf("cancelling Datadog downtime %s: %w", existingID, err)
+		}
+
+		if err = store.Delete(ctx, datadogStateKey); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type datadogDowntimeSchedule struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+type datadogMonitorIdentifier struct {
+	MonitorTags []string `json:"monitor_tags"`
+}
+
+type datadogDowntimeAttributes struct {
+	Scope             string                   `json:"scope"`
+	Message           string                   `json:"message"`
+	MonitorIdentifier datadogMonitorIdentifier `json:"monitor_identifier"`
+	Schedule          datadogDowntimeSchedule  `json:"schedule"`
+}
+
+type datadogDowntimeData struct {
+	ID         string                    `json:"id,omitempty"`
+	Type       string                    `json:"type"`
+	Attributes datadogDowntimeAttributes `json:"attributes"`
+}
+
+type datadogDowntimeBody struct {
+	Data datadogDowntimeData `json:"data"`
+}
+
+// createDowntime schedules a downtime starting now and returns its ID.
+func (dd *DatadogClient) createDowntime(ctx context.Context) (string, error) {
+	now := time.Now().UTC()
+
+	body, err := json.Marshal(datadogDowntimeBody{Data: datadogDowntimeData{
+		Type: "downtime",
+		Attributes: datadogDowntimeAttributes{
+			Scope:             dd.Scope,
+			Message:           strings.TrimSpace(fmt.Sprintf("eks-env-scaledown: %s scaled down", dd.Environment)),
+			MonitorIdentifier: datadogMonitorIdentifier{MonitorTags: dd.MonitorTags},
+			Schedule:          datadogDowntimeSchedule{Start: now, End: now.Add(dd.Duration)},
+		},
+	}})
+	if err != nil {
+		return "", fmt.Errorf("encoding downtime: %w", err)
+	}
+
+	resp, err := dd.do(ctx, http.MethodPost, "/api/v2/downtime", body)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", datadogError(resp)
+	}
+
+	var created datadogDowntimeBody
+	if err = json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		return "", fmt.Errorf("decoding downtime: %w", err)
+	}
+	if created.Data.ID == "" {
+		return "", errors.New("downtime scheduled without an ID")
+	}
+
+	return created.Data.ID, nil
+}
+
+// cancelDowntime cancels a downtime. A downtime which no longer exists is treated as already cancelled.
+func (dd *DatadogClient) cancelDowntime(ctx context.Context, id string) error {
+	resp, err := dd.do(ctx, http.MethodDelete, "/api/v2/downtime/"+url.PathEscape(id), nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode == http.StatusNotFound {
+		log.Info("Datadog downtime no longer exists", "downtimeID", id)
+		return nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return datadogError(resp)
+	}
+
+	return nil
+}
+
+func (dd *DatadogClient) do(ctx context.Context, method, path string, body []byte) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(dd.BaseURL, "/")+path, reader)
+	if err != nil {
+		return nil, fmt.Errorf("building request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("DD-API-KEY", dd.APIKey)
+	req.Header.Set("DD-APPLICATION-KEY", dd.AppKey)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := dd.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("sending request to Datadog: %w", err)
+	}
+
+	return resp, nil
+}
+
+func datadogError(resp *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("unexpected response from Datadog %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+}
@@ -0,0 +1,150 @@
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	log "log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/michaelprice232/eks-env-scaledown/internal/state"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// fakeDatadog is a stand-in for the Datadog v2 downtime API.
+type fakeDatadog struct {
+	mu        sync.Mutex
+	downtimes map[string]datadogDowntimeAttributes
+	cancelled []string
+	nextID    int
+}
+
+func (f *fakeDatadog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Header.Get("DD-API-KEY") != "dd-api" || r.Header.Get("DD-APPLICATION-KEY") != "dd-app" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/api/v2/downtime":
+		var body datadogDowntimeBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.nextID++
+		body.Data.ID = fmt.Sprintf("downtime-%d", f.nextID)
+		f.downtimes[body.Data.ID] = body.Data.Attributes
+		_ = json.NewEncoder(w).Encode(body)
+
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/api/v2/downtime/"):
+		id := strings.TrimPrefix(r.URL.Path, "/api/v2/downtime/")
+		if _, ok := f.downtimes[id]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(f.downtimes, id)
+		f.cancelled = append(f.cancelled, id)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestUpdateDatadogDowntime(t *testing.T) {
+	log.SetDefault(log.New(log.NewJSONHandler(io.Discard, nil)))
+
+	fakeDD := &fakeDatadog{downtimes: make(map[string]datadogDowntimeAttributes)}
+	srv := httptest.NewServer(fakeDD)
+	t.Cleanup(srv.Close)
+
+	dd := &DatadogClient{
+		Client:      srv.Client(),
+		BaseURL:     srv.URL,
+		APIKey:      "dd-api",
+		AppKey:      "dd-app",
+		Scope:       "env:staging",
+		MonitorTags: []string{"*"},
+		Duration:    12 * time.Hour,
+		Environment: "staging",
+	}
+	store := state.New(fake.NewClientset(), "eks-env-scaledown")
+
+	require.NoError(t, UpdateDatadogDowntime(t.Context(), dd, store, ScaleDown))
+	require.Len(t, fakeDD.downtimes, 1)
+
+	id, found, err := store.Get(t.Context(), datadogStateKey)
+	require.NoError(t, err)
+	require.True(t, found, "Expected the downtime ID to be recorded for the scale up")
+
+	downtime := fakeDD.downtimes[id]
+	assert.Equal(t, "env:staging", downtime.Scope)
+	assert.Equal(t, []string{"*"}, downtime.MonitorIdentifier.MonitorTags)
+	assert.Equal(t, 12*time.Hour, downtime.Schedule.End.Sub(downtime.Schedule.Start))
+
+	// A second scale down replaces the leftover downtime
+	require.NoError(t, UpdateDatadogDowntime(t.Context(), dd, store, ScaleDown))
+	assert.Equal(t, []string{id}, fakeDD.cancelled)
+	require.Len(t, fakeDD.downtimes, 1)
+
+	require.NoError(t, UpdateDatadogDowntime(t.Context(), dd, store, ScaleUp))
+	assert.Empty(t, fakeDD.downtimes)
+
+	_, found, err = store.Get(t.Context(), datadogStateKey)
+	require.NoError(t, err)
+	assert.False(t, found, "Expected the downtime ID to be cleared once cancelled")
+
+	require.NoError(t, UpdateDatadogDowntime(t.Context(), dd, store, ScaleUp), "Expected a scale up without a recorded downtime to be a no-op")
+	assert.NoError(t, UpdateDatadogDowntime(t.Context(), nil, nil, ScaleDown))
+}
+
+func TestNewDatadogClient(t *testing.T) {
+	log.SetDefault(log.New(log.NewJSONHandler(io.Discard, nil)))
+
+	tests := []struct {
+		name      string
+		env       map[string]string
+		wantNil   bool
+		wantErr   bool
+		wantScope string
+		wantURL   string
+	}{
+		{name: "not set", env: map[string]string{}, wantNil: true},
+		{name: "scope defaults to the environment", env: map[string]string{"DATADOG_API_KEY": "a", "DATADOG_APP_KEY": "b", "ENVIRONMENT": "staging"}, wantScope: "env:staging", wantURL: "https://api.datadoghq.com"},
+		{name: "explicit scope and site", env: map[string]string{"DATADOG_API_KEY": "a", "DATADOG_APP_KEY": "b", "DATADOG_DOWNTIME_SCOPE": "env:dev AND team:web", "DATADOG_SITE": "datadoghq.eu"}, wantScope: "env:dev AND team:web", wantURL: "https://api.datadoghq.eu"},
+		{name: "no scope", env: map[string]string{"DATADOG_API_KEY": "a", "DATADOG_APP_KEY": "b"}, wantErr: true},
+		{name: "invalid duration", env: map[string]string{"DATADOG_API_KEY": "a", "DATADOG_APP_KEY": "b", "ENVIRONMENT": "staging", "DATADOG_DOWNTIME_DURATION": "1 week"}, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, key := range []string{"DATADOG_API_KEY", "DATADOG_APP_KEY", "DATADOG_SITE", "DATADOG_DOWNTIME_SCOPE", "DATADOG_DOWNTIME_DURATION", "ENVIRONMENT"} {
+				t.Setenv(key, tc.env[key])
+			}
+
+			client, err := NewDatadogClient()
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.wantNil, client == nil)
+			if client != nil {
+				assert.Equal(t, tc.wantScope, client.Scope)
+				assert.Equal(t, tc.wantURL, client.BaseURL)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	log "log/slog"
+	"net"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/michaelprice232/eks-env-scaledown/internal/report"
+)
+
+// EmailClient sends a plain text email over SMTP once a run has finished.
+type EmailClient struct {
+	Host        string
+	Port        int
+	Username    string
+	Password    string
+	From        string
+	To          []string
+	Environment string
+
+	// NotifySuccess enables a summary of successful runs. Failures are always sent.
+	NotifySuccess bool
+}
+
+// NewEmailClient returns EmailClient, or nil if SMTP_HOST is not set. An error is returned if the
+// sender or recipients are missing, or the port is invalid.
+func NewEmailClient() (*EmailClient, error) {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		log.Debug("SMTP_HOST not set. Disabling email notifications")
+		return nil, nil
+	}
+
+	port := 587
+	if raw := os.Getenv("SMTP_PORT"); raw != "" {
+		p, err := strconv.Atoi(raw)
+		if err != nil || p <= 0 || p > 65535 {
+			return nil, fmt.Errorf("unable to parse SMTP_PORT %q into a port number", raw)
+		}
+		port = p
+	}
+
+	from := os.Getenv("EMAIL_FROM")
+	to := splitList(os.Getenv("EMAIL_TO"))
+	if from == "" || len(to) == 0 {
+		return nil, errors.New("EMAIL_FROM and EMAIL_TO must be set when SMTP_HOST is set")
+	}
+
+	return &EmailClient{
+		Host:          host,
+		Port:          port,
+		Username:      os.Getenv("SMTP_USERNAME"),
+		Password:      os.Getenv("SMTP_PASSWORD"),
+		From:          from,
+		To:            to,
+		Environment:   os.Getenv("ENVIRONMENT"),
+		NotifySuccess: boolEnv("EMAIL_NOTIFY_SUCCESS", false),
+	}, nil
+}
+
+// Name identifies the notifier in logs.
+func (c *EmailClient) Name() string {
+	return "email"
+}
+
+// Started is a no-op for email.
+func (c *EmailClient) Started(context.Context, *report.Report) error {
+	return nil
+}
+
+// GroupCompleted is a no-op for email.
+func (c *EmailClient) GroupCompleted(context.Context, *report.Report, report.Group) error {
+	return nil
+}
+
+// Finished emails the outcome of the run. Successful runs are only sent if NotifySuccess is set.
+// STARTTLS is used whenever the server offers it, and is required by net/smtp before credentials
+// are sent to anything other than localhost.
+func (c *EmailClient) Finished(ctx context.Context, rep *report.Report, runErr error) error {
+	if runErr == nil && !c.NotifySuccess {
+		return nil
+	}
+
+	var auth smtp.Auth
+	if c.Username != "" {
+		auth = smtp.PlainAuth("", c.Username, c.Password, c.Host)
+	}
+
+	addr := net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+
+	// smtp.SendMail does not accept a context, so run it in the background and stop waiting if ctx is cancelled
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(addr, auth, c.From, c.To, c.message(rep, runErr))
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("sending email via %s: %w", addr, err)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// message returns the RFC 5322 message describing the outcome of the run.
+func (c *EmailClient) message(rep *report.Report, runErr error) []byte {
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "From: %s\r\n", c.From)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(c.To, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", title(c.Environment, rep.Action, runErr))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+
+	fmt.Fprintf(&b, "Environment: %s\r\n", c.Environment)
+	fmt.Fprintf(&b, "Scaling Type: %s\r\n", rep.Action)
+	fmt.Fprintf(&b, "Run ID: %s\r\n", rep.RunID)
+	fmt.Fprintf(&b, "Summary: %s\r\n", rep.Summary())
+
+	if runErr != nil {
+		fmt.Fprintf(&b, "\r\nError:\r\n%s\r\n", runErr.Error())
+	}
+
+	if len(rep.Groups) > 0 {
+		fmt.Fprintf(&b, "\r\nGroups:\r\n%s\r\n", strings.Join(groupLines(rep), "\r\n"))
+	}
+
+	if len(rep.Skipped) > 0 {
+		fmt.Fprintf(&b, "\r\nSkipped:\r\n%s\r\n", strings.Join(skippedLines(rep), "\r\n"))
+	}
+
+	if len(rep.Alerting) > 0 {
+		fmt.Fprintf(&b, "\r\nAlerting:\r\n%s\r\n", strings.Join(alertingLines(rep), "\r\n"))
+	}
+
+	if len(rep.Infrastructure) > 0 {
+		fmt.Fprintf(&b, "\r\nInfrastructure:\r\n%s\r\n", strings.Join(infrastructureLines(rep), "\r\n"))
+	}
+
+	if len(rep.Phases) > 0 {
+		fmt.Fprintf(&b, "\r\nPhases: %s\r\n", phaseSummary(rep))
+	}
+
+	return b.Bytes()
+}
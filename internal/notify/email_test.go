@@ -0,0 +1,155 @@
+package notify
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/michaelprice232/eks-env-scaledown/internal/report"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// smtpMessage is a message received by the SMTP stand-in.
+type smtpMessage struct {
+	from string
+	to   []string
+	data string
+}
+
+// startSMTPServer runs a minimal, unauthenticated SMTP server on localhost which delivers each
+// received message to the returned channel.
+func startSMTPServer(t *testing.T) (host string, port int, messages <-chan smtpMessage) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = ln.Close() })
+
+	out := make(chan smtpMessage, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveSMTP(conn, out)
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port, out
+}
+
+func serveSMTP(conn net.Conn, out chan<- smtpMessage) {
+	defer func() { _ = conn.Close() }()
+
+	tp := textproto.NewConn(conn)
+	_ = tp.PrintfLine("220 localhost ESMTP")
+
+	var msg smtpMessage
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch verb {
+		case "EHLO", "HELO":
+			_ = tp.PrintfLine("250 localhost")
+		case "MAIL":
+			msg = smtpMessage{from: strings.Trim(strings.TrimPrefix(line, "MAIL FROM:"), "<>")}
+			_ = tp.PrintfLine("250 OK")
+		case "RCPT":
+			msg.to = append(msg.to, strings.Trim(strings.TrimPrefix(line, "RCPT TO:"), "<>"))
+			_ = tp.PrintfLine("250 OK")
+		case "DATA":
+			_ = tp.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg.data = string(data)
+			out <- msg
+			_ = tp.PrintfLine("250 OK")
+		case "QUIT":
+			_ = tp.PrintfLine("221 Bye")
+			return
+		default:
+			_ = tp.PrintfLine("250 OK")
+		}
+	}
+}
+
+func TestEmailClientFinished(t *testing.T) {
+	host, port, messages := startSMTPServer(t)
+
+	client := &EmailClient{
+		Host:        host,
+		Port:        port,
+		From:        "scaledown@example.com",
+		To:          []string{"ops@example.com", "dev@example.com"},
+		Environment: "staging",
+	}
+	rep := report.New("ScaleDown")
+	rep.AddSkipped(report.Skipped{Kind: "deployment", Namespace: "web", Name: "nginx", Reason: "already scaled to zero"})
+	rep.AddAlerting(report.AlertingAction{Integration: "cloudwatch", Action: "disable", Targets: []string{"staging-5xx", "staging-latency"}})
+
+	require.NoError(t, client.Finished(t.Context(), rep, nil))
+	assert.Empty(t, messages, "Expected only failures to be emailed by default")
+
+	require.NoError(t, client.Finished(t.Context(), rep, errors.New("boom")))
+
+	msg := <-messages
+	assert.Equal(t, "scaledown@example.com", msg.from)
+	assert.Equal(t, []string{"ops@example.com", "dev@example.com"}, msg.to)
+
+	r := textproto.NewReader(bufio.NewReader(strings.NewReader(msg.data)))
+	headers, err := r.ReadMIMEHeader()
+	require.NoError(t, err)
+	assert.Equal(t, "Problem scaling staging (ScaleDown)", headers.Get("Subject"))
+	assert.Equal(t, "ops@example.com, dev@example.com", headers.Get("To"))
+	assert.Contains(t, msg.data, "Run ID: "+rep.RunID)
+	assert.Contains(t, msg.data, "boom")
+	assert.Contains(t, msg.data, "web/nginx: already scaled to zero")
+	assert.Contains(t, msg.data, "cloudwatch disable (2): staging-5xx, staging-latency")
+}
+
+func TestNewEmailClient(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantNil bool
+		wantErr bool
+	}{
+		{name: "not set", env: map[string]string{}, wantNil: true},
+		{name: "valid", env: map[string]string{"SMTP_HOST": "smtp.example.com", "EMAIL_FROM": "a@example.com", "EMAIL_TO": "b@example.com, c@example.com"}},
+		{name: "missing recipients", env: map[string]string{"SMTP_HOST": "smtp.example.com", "EMAIL_FROM": "a@example.com"}, wantErr: true},
+		{name: "invalid port", env: map[string]string{"SMTP_HOST": "smtp.example.com", "SMTP_PORT": "smtp", "EMAIL_FROM": "a@example.com", "EMAIL_TO": "b@example.com"}, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, key := range []string{"SMTP_HOST", "SMTP_PORT", "EMAIL_FROM", "EMAIL_TO"} {
+				t.Setenv(key, tc.env[key])
+			}
+
+			client, err := NewEmailClient()
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.wantNil, client == nil)
+			if client != nil {
+				assert.Equal(t, 587, client.Port)
+				assert.Equal(t, []string{"b@example.com", "c@example.com"}, client.To)
+			}
+		})
+	}
+}
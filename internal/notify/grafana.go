@@ -0,0 +1,59 @@
+package notify
+
+import (
+	"fmt"
+	log "log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// grafanaAlertmanagerPath is where Grafana serves the Alertmanager v2 API for Grafana-managed alerts.
+	grafanaAlertmanagerPath = "/api/alertmanager/grafana"
+
+	// grafanaStateKey is the state key holding the comma-separated IDs of the open Grafana silences.
+	grafanaStateKey = "grafana-silences"
+)
+
+// NewGrafanaClient returns an AlertmanagerClient for Grafana's built-in Alertmanager, which can be used
+// for silencing Grafana-managed alerts. nil is returned if GRAFANA_URL or GRAFANA_API_TOKEN are not set.
+func NewGrafanaClient() (*AlertmanagerClient, error) {
+	grafanaURL := os.Getenv("GRAFANA_URL")
+	token := os.Getenv("GRAFANA_API_TOKEN")
+	if grafanaURL == "" || token == "" {
+		log.Warn("GRAFANA_URL and/or GRAFANA_API_TOKEN not set. Will not create any Grafana silences")
+		return nil, nil
+	}
+
+	if u, err := url.Parse(grafanaURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("GRAFANA_URL %q is not a valid http(s) URL", grafanaURL)
+	}
+
+	silences, err := ParseSilences(os.Getenv("GRAFANA_MATCHERS"))
+	if err != nil {
+		return nil, fmt.Errorf("parsing GRAFANA_MATCHERS: %w", err)
+	}
+
+	duration := defaultSilenceDuration
+	if raw := os.Getenv("GRAFANA_SILENCE_DURATION"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("unable to parse GRAFANA_SILENCE_DURATION %q into a positive duration", raw)
+		}
+		duration = d
+	}
+
+	return &AlertmanagerClient{
+		Client:      &http.Client{Timeout: httpTimeout},
+		BaseURL:     strings.TrimSuffix(grafanaURL, "/") + grafanaAlertmanagerPath,
+		BearerToken: token,
+		Silences:    silences,
+		Duration:    duration,
+		Environment: os.Getenv("ENVIRONMENT"),
+		name:        "Grafana",
+		stateKey:    grafanaStateKey,
+	}, nil
+}
@@ -0,0 +1,57 @@
+package notify
+
+import (
+	"io"
+	log "log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/michaelprice232/eks-env-scaledown/internal/state"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestGrafanaSilences(t *testing.T) {
+	log.SetDefault(log.New(log.NewJSONHandler(io.Discard, nil)))
+
+	fakeAM := &fakeAlertmanager{silences: make(map[string]postableSilence), expired: make(map[string]bool)}
+	srv := httptest.NewServer(http.StripPrefix(grafanaAlertmanagerPath, fakeAM))
+	t.Cleanup(srv.Close)
+
+	t.Setenv("GRAFANA_URL", srv.URL+"/")
+	t.Setenv("GRAFANA_API_TOKEN", "am-token")
+	t.Setenv("GRAFANA_MATCHERS", `grafana_folder="staging"`)
+
+	grafana, err := NewGrafanaClient()
+	require.NoError(t, err)
+	require.NotNil(t, grafana)
+	assert.Equal(t, "Grafana", grafana.Name())
+
+	store := state.New(fake.NewClientset(), "eks-env-scaledown")
+	require.NoError(t, store.Set(t.Context(), alertmanagerStateKey, "prometheus-silence"))
+
+	require.NoError(t, UpdateAlertmanagerSilences(t.Context(), grafana, store, ScaleDown, nil))
+	require.Len(t, fakeAM.active(), 1)
+	assert.Equal(t, []Matcher{{Name: "grafana_folder", Value: "staging", IsEqual: true}}, fakeAM.silences[fakeAM.active()[0]].Matchers)
+
+	require.NoError(t, UpdateAlertmanagerSilences(t.Context(), grafana, store, ScaleUp, nil))
+	assert.Empty(t, fakeAM.active())
+
+	value, found, err := store.Get(t.Context(), alertmanagerStateKey)
+	require.NoError(t, err)
+	assert.True(t, found, "Expected the Grafana silences to be tracked separately from Alertmanager's")
+	assert.Equal(t, "prometheus-silence", value)
+}
+
+func TestNewGrafanaClientNotSet(t *testing.T) {
+	log.SetDefault(log.New(log.NewJSONHandler(io.Discard, nil)))
+	t.Setenv("GRAFANA_URL", "")
+	t.Setenv("GRAFANA_API_TOKEN", "")
+
+	client, err := NewGrafanaClient()
+	require.NoError(t, err)
+	assert.Nil(t, client)
+}
@@ -1,20 +1,95 @@
 package notify
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	log "log/slog"
+	"maps"
 	"os"
+	"path"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/newrelic/newrelic-client-go/v2/newrelic"
 	"github.com/newrelic/newrelic-client-go/v2/pkg/alerts"
+	nrerrors "github.com/newrelic/newrelic-client-go/v2/pkg/errors"
+
+	"github.com/michaelprice232/eks-env-scaledown/internal/state"
+)
+
+// NewRelicMode controls how New Relic alerts are muted whilst the environment is scaled down.
+type NewRelicMode string
+
+const (
+	// NewRelicModeToggle disables every condition in the policies at scale down and enables them all at scale up.
+	NewRelicModeToggle NewRelicMode = "toggle"
+	// NewRelicModePreserve is NewRelicModeToggle, except conditions which were already disabled stay disabled.
+	NewRelicModePreserve NewRelicMode = "preserve"
+	// NewRelicModeMute leaves the conditions untouched and creates a muting rule for the downtime instead.
+	NewRelicModeMute NewRelicMode = "mute"
+)
+
+const (
+	// newRelicConditionsStateKey is the state key holding the conditions which were already disabled
+	// before the scale down, in NewRelicModePreserve.
+	newRelicConditionsStateKey = "newrelic-disabled-conditions"
+
+	// newRelicMutingRuleStateKey is the state key holding the ID of the muting rule, in NewRelicModeMute.
+	newRelicMutingRuleStateKey = "newrelic-muting-rule"
+
+	// defaultNewRelicMutingDuration covers a weekend. The muting rule is deleted early at scale up, so this
+	// only matters if the scale up never runs.
+	defaultNewRelicMutingDuration = 72 * time.Hour
 )
 
-// NewRelicClient wraps the New Relic alerts client and the alert policy IDs to manage.
+// NewRelicAlertsAPI is the subset of the New Relic alerts client used for muting alerts, allowing it to be
+// faked in tests.
+type NewRelicAlertsAPI interface {
+	NerdGraphQueryWithContext(ctx context.Context, query string, vars map[string]any, respBody any) error
+	QueryPolicySearchWithContext(ctx context.Context, accountID int, params alerts.AlertsPoliciesSearchCriteriaInput) ([]*alerts.AlertsPolicy, error)
+
+	ListNrqlConditionsWithContext(ctx context.Context, policyID int) ([]*alerts.NrqlCondition, error)
+	UpdateNrqlConditionWithContext(ctx context.Context, condition alerts.NrqlCondition) (*alerts.NrqlCondition, error)
+	ListConditionsWithContext(ctx context.Context, policyID int) ([]*alerts.Condition, error)
+	UpdateConditionWithContext(ctx context.Context, condition alerts.Condition) (*alerts.Condition, error)
+	ListInfrastructureConditionsWithContext(ctx context.Context, policyID int) ([]alerts.InfrastructureCondition, error)
+	UpdateInfrastructureConditionWithContext(ctx context.Context, condition alerts.InfrastructureCondition) (*alerts.InfrastructureCondition, error)
+	ListSyntheticsConditionsWithContext(ctx context.Context, policyID int) ([]*alerts.SyntheticsCondition, error)
+	UpdateSyntheticsConditionWithContext(ctx context.Context, condition alerts.SyntheticsCondition) (*alerts.SyntheticsCondition, error)
+	ListMultiLocationSyntheticsConditionsWithContext(ctx context.Context, policyID int) ([]*alerts.MultiLocationSyntheticsCondition, error)
+	UpdateMultiLocationSyntheticsConditionWithContext(ctx context.Context, condition alerts.MultiLocationSyntheticsCondition) (*alerts.MultiLocationSyntheticsCondition, error)
+
+	CreateMutingRuleWithContext(ctx context.Context, accountID int, rule alerts.MutingRuleCreateInput) (*alerts.MutingRule, error)
+	DeleteMutingRuleWithContext(ctx context.Context, accountID int, ruleID int) error
+}
+
+// NewRelicClient wraps the New Relic alerts client and the alert policies to manage. Policies are selected by
+// ID, and by name pattern or entity tags when AccountID is set.
 type NewRelicClient struct {
-	Client    *alerts.Alerts
+	Client      NewRelicAlertsAPI
+	PolicyIDs   []int
+	PolicyNames []string
+	PolicyTags  map[string]string
+	Mode        NewRelicMode
+	AccountID   int
+	Environment string
+
+	// SyntheticsTags selects the synthetic monitors which are disabled whilst the environment is scaled down.
+	SyntheticsTags map[string]string
+
+	// The following are only used in NewRelicModeMute. The muting rule only matches the incidents
+	// which belong to one of the policies and whose entity carries every one of MutingTags.
+	MutingTags map[string]string
+	Duration   time.Duration
+}
+
+// NewRelicResult records what UpdateNewRelicAlertPolicy muted or unmuted.
+type NewRelicResult struct {
 	PolicyIDs []int
+	Monitors  []string
 }
 
 // NewNewRelicClient returns NewRelicClient, which can be used for enabling and disabling New Relic alert policies.
@@ -30,17 +105,19 @@ func NewNewRelicClient() (*NewRelicClient, error) {
 		newRelicRegion = "eu"
 	}
 
-	ids := os.Getenv("NEW_RELIC_ALERT_POLICIES")
-	if ids == "" {
-		log.Warn("NEW_RELIC_ALERT_POLICIES envar not set. Will not disable any New Relic alert policies")
-		return nil, nil
+	mode := NewRelicMode(os.Getenv("NEW_RELIC_MODE"))
+	switch mode {
+	case "":
+		mode = NewRelicModeToggle
+	case NewRelicModeToggle, NewRelicModePreserve, NewRelicModeMute:
+	default:
+		return nil, fmt.Errorf("invalid NEW_RELIC_MODE %q: must be %q, %q or %q", mode, NewRelicModeToggle, NewRelicModePreserve, NewRelicModeMute)
 	}
 
-	idsSplit := strings.Split(ids, ",")
+	idsSplit := splitList(os.Getenv("NEW_RELIC_ALERT_POLICIES"))
 	policyIDs := make([]int, 0, len(idsSplit))
 
 	for _, policy := range idsSplit {
-		policy = strings.TrimSpace(policy)
 		policy64, err := strconv.ParseInt(policy, 10, 64)
 		if err != nil {
 			return nil, fmt.Errorf("unable to parse New Relic alert policy ID %q into an int", policy)
@@ -48,15 +125,100 @@ func NewNewRelicClient() (*NewRelicClient, error) {
 		policyIDs = append(policyIDs, int(policy64))
 	}
 
+	nr := &NewRelicClient{
+		PolicyIDs:   policyIDs,
+		PolicyNames: splitList(os.Getenv("NEW_RELIC_POLICY_NAMES")),
+		Mode:        mode,
+		Duration:    defaultNewRelicMutingDuration,
+		Environment: os.Getenv("ENVIRONMENT"),
+	}
+
+	for _, pattern := range nr.PolicyNames {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid NEW_RELIC_POLICY_NAMES pattern %q: %w", pattern, err)
+		}
+	}
+
+	var err error
+	if nr.PolicyTags, err = parseNewRelicTags("NEW_RELIC_POLICY_TAGS"); err != nil {
+		return nil, err
+	}
+	if nr.SyntheticsTags, err = parseNewRelicTags("NEW_RELIC_SYNTHETICS_TAGS"); err != nil {
+		return nil, err
+	}
+
+	if raw := os.Getenv("NEW_RELIC_ACCOUNT_ID"); raw != "" {
+		if nr.AccountID, err = strconv.Atoi(raw); err != nil || nr.AccountID <= 0 {
+			return nil, fmt.Errorf("unable to parse NEW_RELIC_ACCOUNT_ID %q into a New Relic account ID", raw)
+		}
+	}
+	if nr.AccountID == 0 && (len(nr.PolicyNames) > 0 || len(nr.PolicyTags) > 0) {
+		return nil, errors.New("NEW_RELIC_ACCOUNT_ID must be set to select New Relic alert policies by name or tag")
+	}
+
+	if mode == NewRelicModeMute {
+		if err = nr.loadMutingConfig(); err != nil {
+			return nil, err
+		}
+	}
+
+	if !nr.selectsPolicies() && len(nr.MutingTags) == 0 && len(nr.SyntheticsTags) == 0 {
+		log.Warn("NEW_RELIC_ALERT_POLICIES envar not set. Will not disable any New Relic alert policies")
+		return nil, nil
+	}
+
 	client, err := newrelic.New(newrelic.ConfigPersonalAPIKey(apiKey), newrelic.ConfigRegion(newRelicRegion))
 	if err != nil {
 		return nil, fmt.Errorf("creating New Relic client: %w", err)
 	}
+	nr.Client = &client.Alerts
 
-	return &NewRelicClient{
-		Client:    &client.Alerts,
-		PolicyIDs: policyIDs,
-	}, nil
+	return nr, nil
+}
+
+// loadMutingConfig reads the envars used by NewRelicModeMute.
+func (nr *NewRelicClient) loadMutingConfig() error {
+	if nr.AccountID == 0 {
+		return fmt.Errorf("NEW_RELIC_ACCOUNT_ID must be set to a New Relic account ID when NEW_RELIC_MODE is %q", NewRelicModeMute)
+	}
+
+	var err error
+	if nr.MutingTags, err = parseNewRelicTags("NEW_RELIC_MUTING_TAGS"); err != nil {
+		return err
+	}
+
+	if raw := os.Getenv("NEW_RELIC_MUTING_DURATION"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("unable to parse NEW_RELIC_MUTING_DURATION %q into a positive duration", raw)
+		}
+		nr.Duration = d
+	}
+
+	return nil
+}
+
+// parseNewRelicTags parses the comma-separated key=value tags in the envar key.
+func parseNewRelicTags(key string) (map[string]string, error) {
+	var tags map[string]string
+	for _, tag := range splitList(os.Getenv(key)) {
+		k, v, ok := strings.Cut(tag, "=")
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if !ok || k == "" || v == "" {
+			return nil, fmt.Errorf("invalid %s entry %q: must be of the form key=value", key, tag)
+		}
+		if tags == nil {
+			tags = make(map[string]string)
+		}
+		tags[k] = v
+	}
+
+	return tags, nil
+}
+
+// selectsPolicies returns whether any alert policies are selected.
+func (nr *NewRelicClient) selectsPolicies() bool {
+	return len(nr.PolicyIDs) > 0 || len(nr.PolicyNames) > 0 || len(nr.PolicyTags) > 0
 }
 
 // ScaleAction defines whether New Relic alert policies should be enabled or disabled.
@@ -78,17 +240,158 @@ func (sa ScaleAction) validateAction() error {
 	}
 }
 
-// UpdateNewRelicAlertPolicy disables or enables New Relic alert policies.
-func UpdateNewRelicAlertPolicy(nrClient *NewRelicClient, action ScaleAction) error {
+// UpdateNewRelicAlertPolicy mutes or unmutes the New Relic alert policies in the client's mode, and disables or
+// re-enables the selected synthetic monitors. In NewRelicModePreserve the conditions which were already disabled
+// at scale down are recorded in store and left disabled at scale up. In NewRelicModeMute the muting rule ID is
+// kept in store between the runs.
+func UpdateNewRelicAlertPolicy(ctx context.Context, nrClient *NewRelicClient, store *state.Store, action ScaleAction) (NewRelicResult, error) {
+	var result NewRelicResult
 	if nrClient == nil {
-		return nil
+		return result, nil
 	}
 
 	if err := action.validateAction(); err != nil {
+		return result, err
+	}
+
+	policyIDs, err := nrClient.policies(ctx)
+	if err != nil {
+		return result, err
+	}
+	result.PolicyIDs = policyIDs
+
+	switch nrClient.Mode {
+	case NewRelicModeMute:
+		err = nrClient.updateMutingRule(ctx, store, action, policyIDs)
+	case NewRelicModePreserve:
+		err = nrClient.preserveConditions(ctx, store, action, policyIDs)
+	default:
+		err = nrClient.updateConditions(ctx, action, policyIDs, nil)
+	}
+	if err != nil {
+		return result, err
+	}
+
+	result.Monitors, err = nrClient.updateSyntheticMonitors(ctx, store, action)
+	return result, err
+}
+
+// policies returns the IDs of the policies selected by ID, name pattern and tags.
+func (nr *NewRelicClient) policies(ctx context.Context) ([]int, error) {
+	ids := slices.Clone(nr.PolicyIDs)
+	if len(nr.PolicyNames) == 0 && len(nr.PolicyTags) == 0 {
+		return ids, nil
+	}
+
+	policies, err := nr.Client.QueryPolicySearchWithContext(ctx, nr.AccountID, alerts.AlertsPoliciesSearchCriteriaInput{})
+	if err != nil {
+		return nil, fmt.Errorf("listing New Relic alert policies: %w", err)
+	}
+
+	var tagged []string
+	if len(nr.PolicyTags) > 0 {
+		entities, err := searchEntities(ctx, nr.Client, entityQuery("type = 'POLICY'", nr.AccountID, nr.PolicyTags))
+		if err != nil {
+			return nil, fmt.Errorf("searching for New Relic alert policies by tag: %w", err)
+		}
+		for _, e := range entities {
+			tagged = append(tagged, e.GUID)
+		}
+	}
+
+	for _, p := range policies {
+		// Name patterns and tags each select policies, in addition to those listed by ID
+		selected := slices.ContainsFunc(nr.PolicyNames, func(pattern string) bool {
+			matched, _ := path.Match(pattern, p.Name)
+			return matched
+		}) || slices.Contains(tagged, p.EntityGuid)
+		if !selected {
+			continue
+		}
+
+		id, err := strconv.Atoi(p.ID)
+		if err != nil {
+			return nil, fmt.Errorf("parsing New Relic alert policy ID %q: %w", p.ID, err)
+		}
+		if !slices.Contains(ids, id) {
+			log.Debug("Selected New Relic alert policy", "policyID", id, "name", p.Name)
+			ids = append(ids, id)
+		}
+	}
+
+	if len(ids) == 0 {
+		log.Warn("No New Relic alert policies matched", "names", nr.PolicyNames, "tags", nr.PolicyTags)
+	}
+
+	return ids, nil
+}
+
+// preserveConditions records the conditions which are already disabled at scale down, and skips them at scale up.
+// Conditions are recorded as type/id. A bare ID is a NRQL condition, as recorded before the other types were covered.
+func (nr *NewRelicClient) preserveConditions(ctx context.Context, store *state.Store, action ScaleAction, policyIDs []int) error {
+	raw, found, err := store.Get(ctx, newRelicConditionsStateKey)
+	if err != nil {
 		return err
 	}
 
-	for _, policyID := range nrClient.PolicyIDs {
+	var disabled []string
+	for _, key := range splitList(raw) {
+		if !strings.Contains(key, "/") {
+			key = conditionKey(conditionTypeNRQL, key)
+		}
+		disabled = append(disabled, key)
+	}
+
+	switch action {
+	case ScaleDown:
+		// A record left by a scale down which was never followed by a scale up is kept, as by now
+		// it is this app which has disabled the conditions
+		if found {
+			log.Info("Keeping the New Relic conditions recorded as disabled by a previous scale down", "conditions", disabled)
+		} else {
+			if disabled, err = nr.disabledConditions(ctx, policyIDs); err != nil {
+				return err
+			}
+
+			if err = store.Set(ctx, newRelicConditionsStateKey, strings.Join(disabled, ",")); err != nil {
+				return fmt.Errorf("recording the New Relic conditions which are already disabled: %w", err)
+			}
+		}
+
+		return nr.updateConditions(ctx, action, policyIDs, disabled)
+
+	case ScaleUp:
+		if err = nr.updateConditions(ctx, action, policyIDs, disabled); err != nil {
+			return err
+		}
+		return store.Delete(ctx, newRelicConditionsStateKey)
+	}
+
+	return nil
+}
+
+// disabledConditions returns the keys of the conditions in the policies which are disabled.
+func (nr *NewRelicClient) disabledConditions(ctx context.Context, policyIDs []int) ([]string, error) {
+	var disabled []string
+	for _, policyID := range policyIDs {
+		conditions, err := listConditions(ctx, nr.Client, policyID)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range conditions {
+			if !c.enabled {
+				disabled = append(disabled, c.key())
+			}
+		}
+	}
+
+	return disabled, nil
+}
+
+// updateConditions disables or enables every condition in the policies, other than those in skip.
+func (nr *NewRelicClient) updateConditions(ctx context.Context, action ScaleAction, policyIDs []int, skip []string) error {
+	for _, policyID := range policyIDs {
 		if action == ScaleUp {
 			log.Info("Enabling New Relic alert policy", "action", action, "policyID", policyID)
 		}
@@ -96,28 +399,128 @@ func UpdateNewRelicAlertPolicy(nrClient *NewRelicClient, action ScaleAction) err
 			log.Info("Suspending New Relic alert policy", "action", action, "policyID", policyID)
 		}
 
-		alertConditions, err := nrClient.Client.ListNrqlConditions(policyID)
+		alertConditions, err := listConditions(ctx, nr.Client, policyID)
 		if err != nil {
-			return fmt.Errorf("listing nrql conditions in policyID %d: %w", policyID, err)
+			return err
 		}
-		log.Debug("Found NRQL alert conditions", "policyID", policyID, "count", len(alertConditions))
+		log.Debug("Found alert conditions", "policyID", policyID, "count", len(alertConditions))
 
 		for _, c := range alertConditions {
-			switch action {
-			case ScaleUp:
-				log.Debug("Enabling alert condition", "name", c.Name)
-				c.Enabled = true
-			case ScaleDown:
-				log.Debug("Suspending alert condition", "name", c.Name)
-				c.Enabled = false
+			if slices.Contains(skip, c.key()) {
+				log.Info("Skipping alert condition which was disabled before the scale down", "name", c.name, "type", c.kind, "conditionID", c.id)
+				continue
+			}
+
+			enabled := action == ScaleUp
+			if c.enabled == enabled {
+				continue
 			}
 
-			_, err = nrClient.Client.UpdateNrqlCondition(*c)
-			if err != nil {
-				return fmt.Errorf("updating (%s) New Relic alert condition %d in policy %d: %w", action, c.ID, policyID, err)
+			log.Debug("Updating alert condition", "name", c.name, "type", c.kind, "enabled", enabled)
+			if err = c.setEnabled(ctx, enabled); err != nil {
+				return fmt.Errorf("updating (%s) New Relic %s alert condition %d in policy %d: %w", action, c.kind, c.id, policyID, err)
 			}
 		}
 	}
 
 	return nil
 }
+
+// updateMutingRule creates a muting rule at scale down and deletes it at scale up.
+func (nr *NewRelicClient) updateMutingRule(ctx context.Context, store *state.Store, action ScaleAction, policyIDs []int) error {
+	existingID, found, err := store.Get(ctx, newRelicMutingRuleStateKey)
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case ScaleDown:
+		// A muting rule left over from a scale down which was never followed by a scale up is replaced
+		if found {
+			log.Info("Deleting previous New Relic muting rule", "ruleID", existingID)
+			if err = nr.deleteMutingRule(ctx, existingID); err != nil {
+				log.Warn("Unable to delete previous New Relic muting rule. It will end on its own", "ruleID", existingID, "error", err)
+			}
+		}
+
+		if len(policyIDs) == 0 && len(nr.MutingTags) == 0 {
+			log.Warn("No New Relic alert policies or muting tags to mute. Will not create a muting rule")
+			return store.Delete(ctx, newRelicMutingRuleStateKey)
+		}
+
+		now := time.Now().UTC()
+		rule, err := nr.Client.CreateMutingRuleWithContext(ctx, nr.AccountID, alerts.MutingRuleCreateInput{
+			Name:        strings.TrimSpace(fmt.Sprintf("eks-env-scaledown %s", nr.Environment)),
+			Description: strings.TrimSpace(fmt.Sprintf("eks-env-scaledown: %s scaled down", nr.Environment)),
+			Enabled:     true,
+			Condition:   nr.mutingCondition(policyIDs),
+			Schedule: &alerts.MutingRuleScheduleCreateInput{
+				StartTime: &alerts.NaiveDateTime{Time: now},
+				EndTime:   &alerts.NaiveDateTime{Time: now.Add(nr.Duration)},
+				TimeZone:  "UTC",
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("creating New Relic muting rule: %w", err)
+		}
+		id := strconv.Itoa(rule.ID)
+		log.Info("Created New Relic muting rule", "ruleID", id, "policyIDs", policyIDs, "tags", nr.MutingTags, "duration", nr.Duration)
+
+		if err = store.Set(ctx, newRelicMutingRuleStateKey, id); err != nil {
+			return fmt.Errorf("recording New Relic muting rule %s, which will end after %s: %w", id, nr.Duration, err)
+		}
+
+	case ScaleUp:
+		if !found {
+			log.Info("No New Relic muting rule recorded. Nothing to delete")
+			return nil
+		}
+
+		log.Info("Deleting New Relic muting rule", "ruleID", existingID)
+		if err = nr.deleteMutingRule(ctx, existingID); err != nil {
+			return fmt.Errorf("deleting New Relic muting rule %s: %w", existingID, err)
+		}
+
+		if err = store.Delete(ctx, newRelicMutingRuleStateKey); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mutingCondition matches the incidents which belong to one of the policies and whose entity carries every muting tag.
+func (nr *NewRelicClient) mutingCondition(policyIDs []int) alerts.MutingRuleConditionGroup {
+	group := alerts.MutingRuleConditionGroup{Operator: "AND"}
+
+	if len(policyIDs) > 0 {
+		ids := make([]string, 0, len(policyIDs))
+		for _, id := range policyIDs {
+			ids = append(ids, strconv.Itoa(id))
+		}
+		group.Conditions = append(group.Conditions, alerts.MutingRuleCondition{Attribute: "policyId", Operator: "IN", Values: ids})
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(nr.MutingTags)) {
+		group.Conditions = append(group.Conditions, alerts.MutingRuleCondition{Attribute: "tags." + key, Operator: "EQUALS", Values: []string{nr.MutingTags[key]}})
+	}
+
+	return group
+}
+
+// deleteMutingRule deletes a muting rule. A rule which no longer exists is treated as already deleted.
+func (nr *NewRelicClient) deleteMutingRule(ctx context.Context, id string) error {
+	ruleID, err := strconv.Atoi(id)
+	if err != nil {
+		return fmt.Errorf("parsing muting rule ID %q: %w", id, err)
+	}
+
+	err = nr.Client.DeleteMutingRuleWithContext(ctx, nr.AccountID, ruleID)
+	var notFound *nrerrors.NotFound
+	if errors.As(err, &notFound) {
+		log.Info("New Relic muting rule no longer exists", "ruleID", id)
+		return nil
+	}
+
+	return err
+}
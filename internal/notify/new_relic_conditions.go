@@ -0,0 +1,106 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+)
+
+// The New Relic alert condition types, each of which has its own API.
+const (
+	conditionTypeNRQL           = "nrql"
+	conditionTypeAPM            = "apm"
+	conditionTypeInfrastructure = "infrastructure"
+	conditionTypeSynthetics     = "synthetics"
+	conditionTypeMultiLocation  = "multi-location-synthetics"
+)
+
+// newRelicCondition is an alert condition of any type, along with the call which updates it.
+type newRelicCondition struct {
+	kind       string
+	id         int
+	name       string
+	enabled    bool
+	setEnabled func(ctx context.Context, enabled bool) error
+}
+
+// key identifies the condition in the state. IDs are only unique within a condition type.
+func (c newRelicCondition) key() string {
+	return conditionKey(c.kind, strconv.Itoa(c.id))
+}
+
+func conditionKey(kind, id string) string {
+	return kind + "/" + id
+}
+
+// listConditions returns the conditions of every type in a policy.
+func listConditions(ctx context.Context, client NewRelicAlertsAPI, policyID int) ([]newRelicCondition, error) {
+	var conditions []newRelicCondition
+
+	nrql, err := client.ListNrqlConditionsWithContext(ctx, policyID)
+	if err != nil {
+		return nil, fmt.Errorf("listing nrql conditions in policyID %d: %w", policyID, err)
+	}
+	for _, c := range nrql {
+		conditions = append(conditions, newRelicCondition{kind: conditionTypeNRQL, id: c.ID, name: c.Name, enabled: c.Enabled,
+			setEnabled: func(ctx context.Context, enabled bool) error {
+				c.Enabled = enabled
+				_, err := client.UpdateNrqlConditionWithContext(ctx, *c)
+				return err
+			}})
+	}
+
+	apm, err := client.ListConditionsWithContext(ctx, policyID)
+	if err != nil {
+		return nil, fmt.Errorf("listing apm conditions in policyID %d: %w", policyID, err)
+	}
+	for _, c := range apm {
+		conditions = append(conditions, newRelicCondition{kind: conditionTypeAPM, id: c.ID, name: c.Name, enabled: c.Enabled,
+			setEnabled: func(ctx context.Context, enabled bool) error {
+				c.Enabled = enabled
+				_, err := client.UpdateConditionWithContext(ctx, *c)
+				return err
+			}})
+	}
+
+	infra, err := client.ListInfrastructureConditionsWithContext(ctx, policyID)
+	if err != nil {
+		return nil, fmt.Errorf("listing infrastructure conditions in policyID %d: %w", policyID, err)
+	}
+	for _, c := range infra {
+		conditions = append(conditions, newRelicCondition{kind: conditionTypeInfrastructure, id: c.ID, name: c.Name, enabled: c.Enabled,
+			setEnabled: func(ctx context.Context, enabled bool) error {
+				c.Enabled = enabled
+				_, err := client.UpdateInfrastructureConditionWithContext(ctx, c)
+				return err
+			}})
+	}
+
+	synthetics, err := client.ListSyntheticsConditionsWithContext(ctx, policyID)
+	if err != nil {
+		return nil, fmt.Errorf("listing synthetics conditions in policyID %d: %w", policyID, err)
+	}
+	for _, c := range synthetics {
+		conditions = append(conditions, newRelicCondition{kind: conditionTypeSynthetics, id: c.ID, name: c.Name, enabled: c.Enabled,
+			setEnabled: func(ctx context.Context, enabled bool) error {
+				c.Enabled = enabled
+				_, err := client.UpdateSyntheticsConditionWithContext(ctx, *c)
+				return err
+			}})
+	}
+
+	multiLocation, err := client.ListMultiLocationSyntheticsConditionsWithContext(ctx, policyID)
+	if err != nil {
+		return nil, fmt.Errorf("listing multi-location synthetics conditions in policyID %d: %w", policyID, err)
+	}
+	for _, c := range multiLocation {
+		conditions = append(conditions, newRelicCondition{kind: conditionTypeMultiLocation, id: c.ID, name: c.Name, enabled: c.Enabled,
+			setEnabled: func(ctx context.Context, enabled bool) error {
+				c.Enabled = enabled
+				_, err := client.UpdateMultiLocationSyntheticsConditionWithContext(ctx, *c)
+				return err
+			}})
+	}
+
+	return conditions, nil
+}
@@ -0,0 +1,213 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	log "log/slog"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/michaelprice232/eks-env-scaledown/internal/state"
+)
+
+// newRelicMonitorsStateKey is the state key holding the synthetic monitors disabled by the scale down, as
+// type:guid. Monitors which were already disabled are not recorded, so stay disabled at scale up.
+const newRelicMonitorsStateKey = "newrelic-disabled-monitors"
+
+// syntheticsMonitorMutations maps each synthetic monitor type to the suffix of its NerdGraph update mutation.
+var syntheticsMonitorMutations = map[string]string{
+	"SIMPLE":         "SimpleMonitor",
+	"BROWSER":        "SimpleBrowserMonitor",
+	"SCRIPT_API":     "ScriptApiMonitor",
+	"SCRIPT_BROWSER": "ScriptBrowserMonitor",
+	"STEP_MONITOR":   "StepMonitor",
+	"CERT_CHECK":     "CertCheckMonitor",
+	"BROKEN_LINKS":   "BrokenLinksMonitor",
+}
+
+const newRelicEntitySearchQuery = `query($query: String!, $cursor: String) {
+	actor {
+		entitySearch(query: $query) {
+			results(cursor: $cursor) {
+				nextCursor
+				entities {
+					guid
+					name
+					... on SyntheticMonitorEntityOutline {
+						monitorType
+						monitorSummary {
+							status
+						}
+					}
+				}
+			}
+		}
+	}
+}`
+
+// newRelicEntity is an entity returned by NerdGraph's entity search. The monitor fields are only set for
+// synthetic monitors.
+type newRelicEntity struct {
+	GUID           string `json:"guid"`
+	Name           string `json:"name"`
+	MonitorType    string `json:"monitorType"`
+	MonitorSummary struct {
+		Status string `json:"status"`
+	} `json:"monitorSummary"`
+}
+
+type newRelicEntitySearchResponse struct {
+	Actor struct {
+		EntitySearch struct {
+			Results struct {
+				NextCursor *string          `json:"nextCursor"`
+				Entities   []newRelicEntity `json:"entities"`
+			} `json:"results"`
+		} `json:"entitySearch"`
+	} `json:"actor"`
+}
+
+// entityQuery returns an entity search query for the entities matching base with every tag, in the account if set.
+func entityQuery(base string, accountID int, tags map[string]string) string {
+	query := base
+	if accountID != 0 {
+		query += " AND accountId = " + strconv.Itoa(accountID)
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(tags)) {
+		query += fmt.Sprintf(" AND tags.`%s` = '%s'", key, strings.ReplaceAll(tags[key], "'", `\'`))
+	}
+
+	return query
+}
+
+// searchEntities returns every entity matching query.
+func searchEntities(ctx context.Context, client NewRelicAlertsAPI, query string) ([]newRelicEntity, error) {
+	var (
+		entities []newRelicEntity
+		cursor   *string
+	)
+
+	for {
+		var resp newRelicEntitySearchResponse
+		if err := client.NerdGraphQueryWithContext(ctx, newRelicEntitySearchQuery, map[string]any{"query": query, "cursor": cursor}, &resp); err != nil {
+			return nil, err
+		}
+
+		entities = append(entities, resp.Actor.EntitySearch.Results.Entities...)
+		cursor = resp.Actor.EntitySearch.Results.NextCursor
+		if cursor == nil || *cursor == "" {
+			return entities, nil
+		}
+	}
+}
+
+// updateSyntheticMonitors disables the enabled synthetic monitors matching SyntheticsTags at scale down, so they
+// don't fail all night against the sleeping environment, and re-enables those it disabled at scale up.
+// The names of the updated monitors are returned.
+func (nr *NewRelicClient) updateSyntheticMonitors(ctx context.Context, store *state.Store, action ScaleAction) ([]string, error) {
+	if len(nr.SyntheticsTags) == 0 {
+		return nil, nil
+	}
+
+	raw, _, err := store.Get(ctx, newRelicMonitorsStateKey)
+	if err != nil {
+		return nil, err
+	}
+	recorded := splitList(raw)
+
+	monitors, err := searchEntities(ctx, nr.Client, entityQuery("domain = 'SYNTH' AND type = 'MONITOR'", nr.AccountID, nr.SyntheticsTags))
+	if err != nil {
+		return nil, fmt.Errorf("searching for New Relic synthetic monitors: %w", err)
+	}
+
+	var updated []string
+	switch action {
+	case ScaleDown:
+		for _, m := range monitors {
+			if m.MonitorSummary.Status != "ENABLED" {
+				log.Info("Skipping New Relic synthetic monitor which is not enabled", "name", m.Name, "status", m.MonitorSummary.Status)
+				continue
+			}
+
+			// Record the monitor first, so it is re-enabled even if the update times out after succeeding
+			key := m.MonitorType + ":" + m.GUID
+			if !slices.Contains(recorded, key) {
+				recorded = append(recorded, key)
+				if err = store.Set(ctx, newRelicMonitorsStateKey, strings.Join(recorded, ",")); err != nil {
+					return updated, fmt.Errorf("recording New Relic synthetic monitor %s: %w", m.Name, err)
+				}
+			}
+
+			log.Info("Disabling New Relic synthetic monitor", "name", m.Name, "type", m.MonitorType)
+			if err = nr.setMonitorStatus(ctx, m.MonitorType, m.GUID, "DISABLED"); err != nil {
+				return updated, fmt.Errorf("disabling New Relic synthetic monitor %s: %w", m.Name, err)
+			}
+			updated = append(updated, m.Name)
+		}
+
+	case ScaleUp:
+		names := make(map[string]string, len(monitors))
+		for _, m := range monitors {
+			names[m.GUID] = m.Name
+		}
+
+		for _, key := range recorded {
+			monitorType, guid, _ := strings.Cut(key, ":")
+			name := names[guid]
+			if name == "" {
+				// The monitor may have been re-tagged or deleted since the scale down
+				name = guid
+			}
+
+			log.Info("Enabling New Relic synthetic monitor", "name", name, "type", monitorType)
+			if err = nr.setMonitorStatus(ctx, monitorType, guid, "ENABLED"); err != nil {
+				return updated, fmt.Errorf("enabling New Relic synthetic monitor %s: %w", name, err)
+			}
+			updated = append(updated, name)
+		}
+
+		if err = store.Delete(ctx, newRelicMonitorsStateKey); err != nil {
+			return updated, err
+		}
+	}
+
+	return updated, nil
+}
+
+// setMonitorStatus sets the status of a synthetic monitor through the update mutation for its type.
+func (nr *NewRelicClient) setMonitorStatus(ctx context.Context, monitorType, guid, status string) error {
+	suffix, ok := syntheticsMonitorMutations[monitorType]
+	if !ok {
+		return fmt.Errorf("unsupported synthetic monitor type %q", monitorType)
+	}
+
+	mutation := "syntheticsUpdate" + suffix
+	query := fmt.Sprintf(`mutation($guid: EntityGuid!, $monitor: SyntheticsUpdate%sInput!) {
+	%s(guid: $guid, monitor: $monitor) {
+		errors {
+			description
+			type
+		}
+	}
+}`, suffix, mutation)
+
+	var resp map[string]struct {
+		Errors []struct {
+			Description string `json:"description"`
+			Type        string `json:"type"`
+		} `json:"errors"`
+	}
+	vars := map[string]any{"guid": guid, "monitor": map[string]any{"status": status}}
+	if err := nr.Client.NerdGraphQueryWithContext(ctx, query, vars, &resp); err != nil {
+		return err
+	}
+
+	if errs := resp[mutation].Errors; len(errs) > 0 {
+		return fmt.Errorf("%s: %s", errs[0].Type, errs[0].Description)
+	}
+
+	return nil
+}
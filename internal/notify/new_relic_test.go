@@ -1,12 +1,191 @@
 package notify
 
 import (
+	"context"
+	"fmt"
+	"io"
+	log "log/slog"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/michaelprice232/eks-env-scaledown/internal/state"
+
+	"github.com/newrelic/newrelic-client-go/v2/pkg/alerts"
+	nrerrors "github.com/newrelic/newrelic-client-go/v2/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/kubernetes/fake"
 )
 
+// fakeNewRelic holds conditions per policy, the muting rules which have been created and the synthetic monitors.
+type fakeNewRelic struct {
+	nrql        map[int][]*alerts.NrqlCondition
+	apm         map[int][]*alerts.Condition
+	infra       map[int][]alerts.InfrastructureCondition
+	updates     int
+	mutingRules map[int]alerts.MutingRuleCreateInput
+	nextRuleID  int
+
+	policies []*alerts.AlertsPolicy
+	// entities are returned by any entity search, so each test only sets up one kind
+	entities []newRelicEntity
+	queries  []string
+	// monitorStatus records the status set by each monitor update mutation, keyed by GUID
+	monitorStatus map[string]string
+}
+
+func (f *fakeNewRelic) NerdGraphQueryWithContext(_ context.Context, query string, vars map[string]any, respBody any) error {
+	if strings.HasPrefix(query, "mutation") {
+		if f.monitorStatus == nil {
+			f.monitorStatus = make(map[string]string)
+		}
+		f.monitorStatus[vars["guid"].(string)] = vars["monitor"].(map[string]any)["status"].(string)
+		return nil
+	}
+
+	f.queries = append(f.queries, vars["query"].(string))
+	resp := respBody.(*newRelicEntitySearchResponse)
+	resp.Actor.EntitySearch.Results.Entities = f.entities
+	return nil
+}
+
+func (f *fakeNewRelic) QueryPolicySearchWithContext(context.Context, int, alerts.AlertsPoliciesSearchCriteriaInput) ([]*alerts.AlertsPolicy, error) {
+	return f.policies, nil
+}
+
+func (f *fakeNewRelic) ListNrqlConditionsWithContext(_ context.Context, policyID int) ([]*alerts.NrqlCondition, error) {
+	// Return copies, as the real client does
+	var out []*alerts.NrqlCondition
+	for _, c := range f.nrql[policyID] {
+		copied := *c
+		out = append(out, &copied)
+	}
+	return out, nil
+}
+
+func (f *fakeNewRelic) UpdateNrqlConditionWithContext(_ context.Context, condition alerts.NrqlCondition) (*alerts.NrqlCondition, error) {
+	f.updates++
+	for _, conditions := range f.nrql {
+		for _, c := range conditions {
+			if c.ID == condition.ID {
+				*c = condition
+			}
+		}
+	}
+	return &condition, nil
+}
+
+func (f *fakeNewRelic) ListConditionsWithContext(_ context.Context, policyID int) ([]*alerts.Condition, error) {
+	var out []*alerts.Condition
+	for _, c := range f.apm[policyID] {
+		copied := *c
+		out = append(out, &copied)
+	}
+	return out, nil
+}
+
+func (f *fakeNewRelic) UpdateConditionWithContext(_ context.Context, condition alerts.Condition) (*alerts.Condition, error) {
+	f.updates++
+	for _, conditions := range f.apm {
+		for _, c := range conditions {
+			if c.ID == condition.ID {
+				*c = condition
+			}
+		}
+	}
+	return &condition, nil
+}
+
+func (f *fakeNewRelic) ListInfrastructureConditionsWithContext(_ context.Context, policyID int) ([]alerts.InfrastructureCondition, error) {
+	return slices.Clone(f.infra[policyID]), nil
+}
+
+func (f *fakeNewRelic) UpdateInfrastructureConditionWithContext(_ context.Context, condition alerts.InfrastructureCondition) (*alerts.InfrastructureCondition, error) {
+	f.updates++
+	for _, conditions := range f.infra {
+		for i := range conditions {
+			if conditions[i].ID == condition.ID {
+				conditions[i] = condition
+			}
+		}
+	}
+	return &condition, nil
+}
+
+func (f *fakeNewRelic) ListSyntheticsConditionsWithContext(context.Context, int) ([]*alerts.SyntheticsCondition, error) {
+	return nil, nil
+}
+
+func (f *fakeNewRelic) UpdateSyntheticsConditionWithContext(_ context.Context, condition alerts.SyntheticsCondition) (*alerts.SyntheticsCondition, error) {
+	return &condition, nil
+}
+
+func (f *fakeNewRelic) ListMultiLocationSyntheticsConditionsWithContext(context.Context, int) ([]*alerts.MultiLocationSyntheticsCondition, error) {
+	return nil, nil
+}
+
+func (f *fakeNewRelic) UpdateMultiLocationSyntheticsConditionWithContext(_ context.Context, condition alerts.MultiLocationSyntheticsCondition) (*alerts.MultiLocationSyntheticsCondition, error) {
+	return &condition, nil
+}
+
+func (f *fakeNewRelic) CreateMutingRuleWithContext(_ context.Context, _ int, rule alerts.MutingRuleCreateInput) (*alerts.MutingRule, error) {
+	f.nextRuleID++
+	if f.mutingRules == nil {
+		f.mutingRules = make(map[int]alerts.MutingRuleCreateInput)
+	}
+	f.mutingRules[f.nextRuleID] = rule
+	return &alerts.MutingRule{ID: f.nextRuleID}, nil
+}
+
+func (f *fakeNewRelic) DeleteMutingRuleWithContext(_ context.Context, _ int, ruleID int) error {
+	if _, ok := f.mutingRules[ruleID]; !ok {
+		return nrerrors.NewNotFound("muting rule not found")
+	}
+	delete(f.mutingRules, ruleID)
+	return nil
+}
+
+// enabled returns whether each condition is enabled, keyed by type/ID.
+func (f *fakeNewRelic) enabled() map[string]bool {
+	out := make(map[string]bool)
+	for _, conditions := range f.nrql {
+		for _, c := range conditions {
+			out[fmt.Sprintf("nrql/%d", c.ID)] = c.Enabled
+		}
+	}
+	for _, conditions := range f.apm {
+		for _, c := range conditions {
+			out[fmt.Sprintf("apm/%d", c.ID)] = c.Enabled
+		}
+	}
+	for _, conditions := range f.infra {
+		for _, c := range conditions {
+			out[fmt.Sprintf("infrastructure/%d", c.ID)] = c.Enabled
+		}
+	}
+	return out
+}
+
+func newFakeNewRelic() *fakeNewRelic {
+	return &fakeNewRelic{
+		nrql: map[int][]*alerts.NrqlCondition{
+			1: {{ID: 10, Name: "error rate", Enabled: true}, {ID: 11, Name: "flaky", Enabled: false}},
+			2: {{ID: 20, Name: "latency", Enabled: true}},
+		},
+		apm:   map[int][]*alerts.Condition{1: {{ID: 10, Name: "apdex", Enabled: true}}},
+		infra: map[int][]alerts.InfrastructureCondition{2: {{ID: 30, Name: "disk", Enabled: true}}},
+	}
+}
+
+// updateNewRelic calls UpdateNewRelicAlertPolicy, discarding the result.
+func updateNewRelic(t *testing.T, nr *NewRelicClient, store *state.Store, action ScaleAction) error {
+	t.Helper()
+	_, err := UpdateNewRelicAlertPolicy(t.Context(), nr, store, action)
+	return err
+}
+
 func TestNewNewRelicClient(t *testing.T) {
 	t.Run("returns nil when API key is unset", func(t *testing.T) {
 		t.Setenv("NEW_RELIC_API_KEY", "")
@@ -43,16 +222,247 @@ func TestNewNewRelicClient(t *testing.T) {
 		require.NoError(t, err)
 		require.NotNil(t, client)
 		assert.Equal(t, []int{1, 2, 3}, client.PolicyIDs)
+		assert.Equal(t, NewRelicModeToggle, client.Mode)
+	})
+
+	t.Run("errors on an unknown mode", func(t *testing.T) {
+		t.Setenv("NEW_RELIC_API_KEY", "dummy-key")
+		t.Setenv("NEW_RELIC_ALERT_POLICIES", "1")
+		t.Setenv("NEW_RELIC_MODE", "snooze")
+
+		_, err := NewNewRelicClient()
+		assert.Error(t, err)
+	})
+
+	t.Run("mute mode requires an account ID", func(t *testing.T) {
+		t.Setenv("NEW_RELIC_API_KEY", "dummy-key")
+		t.Setenv("NEW_RELIC_ALERT_POLICIES", "1")
+		t.Setenv("NEW_RELIC_MODE", "mute")
+		t.Setenv("NEW_RELIC_ACCOUNT_ID", "")
+
+		_, err := NewNewRelicClient()
+		assert.Error(t, err)
+	})
+
+	t.Run("mute mode can be scoped by tags alone", func(t *testing.T) {
+		t.Setenv("NEW_RELIC_API_KEY", "dummy-key")
+		t.Setenv("NEW_RELIC_ALERT_POLICIES", "")
+		t.Setenv("NEW_RELIC_MODE", "mute")
+		t.Setenv("NEW_RELIC_ACCOUNT_ID", "12345")
+		t.Setenv("NEW_RELIC_MUTING_TAGS", "environment=staging, team = platform")
+		t.Setenv("NEW_RELIC_MUTING_DURATION", "12h")
+
+		client, err := NewNewRelicClient()
+		require.NoError(t, err)
+		require.NotNil(t, client)
+		assert.Equal(t, 12345, client.AccountID)
+		assert.Equal(t, map[string]string{"environment": "staging", "team": "platform"}, client.MutingTags)
+		assert.Equal(t, 12*time.Hour, client.Duration)
+	})
+
+	t.Run("policy names and tags require an account ID", func(t *testing.T) {
+		t.Setenv("NEW_RELIC_API_KEY", "dummy-key")
+		t.Setenv("NEW_RELIC_ALERT_POLICIES", "")
+		t.Setenv("NEW_RELIC_POLICY_NAMES", "staging-*")
+		t.Setenv("NEW_RELIC_ACCOUNT_ID", "")
+
+		_, err := NewNewRelicClient()
+		assert.Error(t, err)
+	})
+
+	t.Run("errors on an invalid policy name pattern", func(t *testing.T) {
+		t.Setenv("NEW_RELIC_API_KEY", "dummy-key")
+		t.Setenv("NEW_RELIC_ALERT_POLICIES", "")
+		t.Setenv("NEW_RELIC_POLICY_NAMES", "staging-[")
+		t.Setenv("NEW_RELIC_ACCOUNT_ID", "12345")
+
+		_, err := NewNewRelicClient()
+		assert.Error(t, err)
+	})
+
+	t.Run("synthetic monitors can be configured alone", func(t *testing.T) {
+		t.Setenv("NEW_RELIC_API_KEY", "dummy-key")
+		t.Setenv("NEW_RELIC_ALERT_POLICIES", "")
+		t.Setenv("NEW_RELIC_SYNTHETICS_TAGS", "environment=staging")
+
+		client, err := NewNewRelicClient()
+		require.NoError(t, err)
+		require.NotNil(t, client)
+		assert.Equal(t, map[string]string{"environment": "staging"}, client.SyntheticsTags)
 	})
 }
 
 func TestUpdateNewRelicAlertPolicy(t *testing.T) {
+	log.SetDefault(log.New(log.NewJSONHandler(io.Discard, nil)))
+
 	t.Run("no-op when client is nil", func(t *testing.T) {
-		assert.NoError(t, UpdateNewRelicAlertPolicy(nil, ScaleDown))
+		assert.NoError(t, updateNewRelic(t, nil, nil, ScaleDown))
 	})
 
 	t.Run("errors on an invalid action", func(t *testing.T) {
 		// Empty PolicyIDs means the API client is never invoked; only the action is validated.
-		assert.Error(t, UpdateNewRelicAlertPolicy(&NewRelicClient{}, "Sideways"))
+		assert.Error(t, updateNewRelic(t, &NewRelicClient{}, nil, "Sideways"))
+	})
+
+	t.Run("toggle mode enables every condition at scale up", func(t *testing.T) {
+		api := newFakeNewRelic()
+		nr := &NewRelicClient{Client: api, PolicyIDs: []int{1, 2}, Mode: NewRelicModeToggle}
+
+		require.NoError(t, updateNewRelic(t, nr, nil, ScaleDown))
+		assert.Equal(t, map[string]bool{"nrql/10": false, "nrql/11": false, "nrql/20": false, "apm/10": false, "infrastructure/30": false}, api.enabled())
+
+		require.NoError(t, updateNewRelic(t, nr, nil, ScaleUp))
+		assert.Equal(t, map[string]bool{"nrql/10": true, "nrql/11": true, "nrql/20": true, "apm/10": true, "infrastructure/30": true}, api.enabled())
+	})
+
+	t.Run("preserve mode leaves conditions which were already disabled", func(t *testing.T) {
+		api := newFakeNewRelic()
+		store := state.New(fake.NewClientset(), "eks-env-scaledown")
+		nr := &NewRelicClient{Client: api, PolicyIDs: []int{1, 2}, Mode: NewRelicModePreserve}
+
+		require.NoError(t, updateNewRelic(t, nr, store, ScaleDown))
+		assert.Equal(t, map[string]bool{"nrql/10": false, "nrql/11": false, "nrql/20": false, "apm/10": false, "infrastructure/30": false}, api.enabled())
+		assert.Equal(t, 4, api.updates, "Expected the already disabled condition not to be updated")
+
+		// A repeated scale down sees every condition disabled, but keeps the original record
+		require.NoError(t, updateNewRelic(t, nr, store, ScaleDown))
+
+		require.NoError(t, updateNewRelic(t, nr, store, ScaleUp))
+		assert.Equal(t, map[string]bool{"nrql/10": true, "nrql/11": false, "nrql/20": true, "apm/10": true, "infrastructure/30": true}, api.enabled())
+
+		_, found, err := store.Get(t.Context(), newRelicConditionsStateKey)
+		require.NoError(t, err)
+		assert.False(t, found)
 	})
+
+	t.Run("mute mode creates and deletes a muting rule", func(t *testing.T) {
+		api := newFakeNewRelic()
+		store := state.New(fake.NewClientset(), "eks-env-scaledown")
+		nr := &NewRelicClient{
+			Client:      api,
+			PolicyIDs:   []int{1, 2},
+			Mode:        NewRelicModeMute,
+			AccountID:   12345,
+			MutingTags:  map[string]string{"environment": "staging"},
+			Duration:    time.Hour,
+			Environment: "staging",
+		}
+
+		require.NoError(t, updateNewRelic(t, nr, store, ScaleDown))
+		require.Len(t, api.mutingRules, 1)
+		rule := api.mutingRules[1]
+		assert.True(t, rule.Enabled)
+		assert.Equal(t, []alerts.MutingRuleCondition{
+			{Attribute: "policyId", Operator: "IN", Values: []string{"1", "2"}},
+			{Attribute: "tags.environment", Operator: "EQUALS", Values: []string{"staging"}},
+		}, rule.Condition.Conditions)
+		assert.Equal(t, time.Hour, rule.Schedule.EndTime.Sub(rule.Schedule.StartTime.Time))
+		assert.Zero(t, api.updates, "Expected the conditions to be left untouched")
+
+		// A repeated scale down replaces the muting rule
+		require.NoError(t, updateNewRelic(t, nr, store, ScaleDown))
+		require.Len(t, api.mutingRules, 1)
+		assert.Contains(t, api.mutingRules, 2)
+
+		require.NoError(t, updateNewRelic(t, nr, store, ScaleUp))
+		assert.Empty(t, api.mutingRules)
+
+		// Nothing recorded is a no-op
+		require.NoError(t, updateNewRelic(t, nr, store, ScaleUp))
+	})
+
+	t.Run("a muting rule which was already deleted is ignored", func(t *testing.T) {
+		store := state.New(fake.NewClientset(), "eks-env-scaledown")
+		require.NoError(t, store.Set(t.Context(), newRelicMutingRuleStateKey, "99"))
+		nr := &NewRelicClient{Client: newFakeNewRelic(), Mode: NewRelicModeMute, AccountID: 12345}
+
+		require.NoError(t, updateNewRelic(t, nr, store, ScaleUp))
+	})
+
+	t.Run("policies are selected by name pattern and tag", func(t *testing.T) {
+		api := newFakeNewRelic()
+		api.policies = []*alerts.AlertsPolicy{
+			{ID: "1", Name: "staging-api", EntityGuid: "guid-1"},
+			{ID: "2", Name: "payments", EntityGuid: "guid-2"},
+			{ID: "3", Name: "production-api", EntityGuid: "guid-3"},
+		}
+		api.entities = []newRelicEntity{{GUID: "guid-2"}}
+		nr := &NewRelicClient{
+			Client:      api,
+			PolicyNames: []string{"staging-*"},
+			PolicyTags:  map[string]string{"environment": "staging"},
+			AccountID:   12345,
+			Mode:        NewRelicModeToggle,
+		}
+
+		result, err := UpdateNewRelicAlertPolicy(t.Context(), nr, nil, ScaleDown)
+		require.NoError(t, err)
+		assert.Equal(t, []int{1, 2}, result.PolicyIDs)
+		assert.Equal(t, []string{"type = 'POLICY' AND accountId = 12345 AND tags.`environment` = 'staging'"}, api.queries)
+	})
+
+	t.Run("preserve mode reads conditions recorded by bare ID as NRQL", func(t *testing.T) {
+		api := newFakeNewRelic()
+		store := state.New(fake.NewClientset(), "eks-env-scaledown")
+		require.NoError(t, store.Set(t.Context(), newRelicConditionsStateKey, "10"))
+		api.nrql[1][0].Enabled = false
+		nr := &NewRelicClient{Client: api, PolicyIDs: []int{1}, Mode: NewRelicModePreserve}
+
+		require.NoError(t, updateNewRelic(t, nr, store, ScaleUp))
+		assert.Equal(t, map[string]bool{"nrql/10": false, "nrql/11": true, "nrql/20": true, "apm/10": true, "infrastructure/30": true}, api.enabled())
+	})
+
+	t.Run("synthetic monitors are disabled and re-enabled", func(t *testing.T) {
+		api := newFakeNewRelic()
+		api.entities = []newRelicEntity{
+			{GUID: "guid-a", Name: "homepage", MonitorType: "BROWSER"},
+			{GUID: "guid-b", Name: "login", MonitorType: "SCRIPT_API"},
+		}
+		api.entities[0].MonitorSummary.Status = "ENABLED"
+		api.entities[1].MonitorSummary.Status = "DISABLED"
+		store := state.New(fake.NewClientset(), "eks-env-scaledown")
+		nr := &NewRelicClient{Client: api, SyntheticsTags: map[string]string{"environment": "staging"}}
+
+		result, err := UpdateNewRelicAlertPolicy(t.Context(), nr, store, ScaleDown)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"homepage"}, result.Monitors)
+		assert.Equal(t, map[string]string{"guid-a": "DISABLED"}, api.monitorStatus)
+
+		raw, _, err := store.Get(t.Context(), newRelicMonitorsStateKey)
+		require.NoError(t, err)
+		assert.Equal(t, "BROWSER:guid-a", raw)
+
+		api.entities[0].MonitorSummary.Status = "DISABLED"
+		result, err = UpdateNewRelicAlertPolicy(t.Context(), nr, store, ScaleUp)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"homepage"}, result.Monitors)
+		assert.Equal(t, map[string]string{"guid-a": "ENABLED"}, api.monitorStatus)
+
+		_, found, err := store.Get(t.Context(), newRelicMonitorsStateKey)
+		require.NoError(t, err)
+		assert.False(t, found)
+	})
+}
+
+func TestEntityQuery(t *testing.T) {
+	tests := []struct {
+		name      string
+		accountID int
+		tags      map[string]string
+		expected  string
+	}{
+		{name: "no account or tags", expected: "type = 'POLICY'"},
+		{name: "account", accountID: 1, expected: "type = 'POLICY' AND accountId = 1"},
+		{
+			name:     "tags are sorted and quoted",
+			tags:     map[string]string{"team": "o'brien", "env": "staging"},
+			expected: `type = 'POLICY' AND tags.` + "`env`" + ` = 'staging' AND tags.` + "`team`" + ` = 'o\'brien'`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, entityQuery("type = 'POLICY'", tc.accountID, tc.tags))
+		})
+	}
 }
@@ -0,0 +1,250 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	log "log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/michaelprice232/eks-env-scaledown/internal/report"
+)
+
+// maxListedItems caps the number of groups or skipped objects listed in a single message, keeping
+// it within the backends' message size limits.
+const maxListedItems = 10
+
+// httpTimeout bounds each webhook request so a slow endpoint cannot hold up the run.
+const httpTimeout = 10 * time.Second
+
+// Notifier is implemented by each notification backend. Backends decide for themselves which
+// events they send, e.g. email only reports the outcome of the run.
+type Notifier interface {
+	// Name identifies the backend in logs.
+	Name() string
+	// Started is called once before any scaling takes place.
+	Started(ctx context.Context, rep *report.Report) error
+	// GroupCompleted is called each time a startup group has been scaled.
+	GroupCompleted(ctx context.Context, rep *report.Report, g report.Group) error
+	// Finished is called once the run has completed. runErr is nil if the run succeeded.
+	Finished(ctx context.Context, rep *report.Report, runErr error) error
+}
+
+// Dispatcher fans each event out to every configured Notifier. A failure to notify is logged
+// rather than returned, so it never affects the outcome of the run.
+type Dispatcher struct {
+	Notifiers []Notifier
+}
+
+// NewDispatcher returns a Dispatcher for every notification backend configured through envars.
+// An error is returned alongside the Dispatcher if any backend is misconfigured; the remaining
+// backends are still included.
+func NewDispatcher() (*Dispatcher, error) {
+	d := &Dispatcher{}
+	var errs []error
+
+	if c := NewSlackClient(); c != nil {
+		d.Notifiers = append(d.Notifiers, c)
+	}
+
+	if c := NewTeamsClient(); c != nil {
+		d.Notifiers = append(d.Notifiers, c)
+	}
+
+	webhook, err := NewWebhookClient()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("configuring webhook notifications: %w", err))
+	} else if webhook != nil {
+		d.Notifiers = append(d.Notifiers, webhook)
+	}
+
+	email, err := NewEmailClient()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("configuring email notifications: %w", err))
+	} else if email != nil {
+		d.Notifiers = append(d.Notifiers, email)
+	}
+
+	return d, errors.Join(errs...)
+}
+
+// Started notifies every backend that the run has started.
+func (d *Dispatcher) Started(ctx context.Context, rep *report.Report) {
+	d.each(func(n Notifier) error { return n.Started(ctx, rep) })
+}
+
+// GroupCompleted notifies every backend that a startup group has been scaled.
+func (d *Dispatcher) GroupCompleted(ctx context.Context, rep *report.Report, g report.Group) {
+	d.each(func(n Notifier) error { return n.GroupCompleted(ctx, rep, g) })
+}
+
+// Finished notifies every backend of the outcome of the run.
+func (d *Dispatcher) Finished(ctx context.Context, rep *report.Report, runErr error) {
+	d.each(func(n Notifier) error { return n.Finished(ctx, rep, runErr) })
+}
+
+func (d *Dispatcher) each(fn func(Notifier) error) {
+	if d == nil {
+		return
+	}
+
+	for _, n := range d.Notifiers {
+		if err := fn(n); err != nil {
+			log.Error("sending notification", "notifier", n.Name(), "error", err)
+		}
+	}
+}
+
+// boolEnv returns the boolean value of the env var key, or def if it is unset or invalid.
+func boolEnv(key string, def bool) bool {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return def
+	}
+
+	v, err := strconv.ParseBool(raw)
+	if err != nil {
+		log.Warn("Invalid boolean envar. Using default", "key", key, "value", raw, "default", def)
+		return def
+	}
+
+	return v
+}
+
+// splitList splits a comma-separated envar value, dropping empty entries.
+func splitList(raw string) []string {
+	var items []string
+	for _, item := range strings.Split(raw, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// postJSON POSTs body to url with the given headers, treating any non-2xx response as an error.
+func postJSON(ctx context.Context, client *http.Client, url string, body []byte, headers map[string]string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("building request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending request: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected response %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return nil
+}
+
+// title returns a one-line description of the outcome of a run for message subjects and headings.
+func title(environment, action string, runErr error) string {
+	if runErr != nil {
+		return fmt.Sprintf("Problem scaling %s (%s)", environment, action)
+	}
+
+	return fmt.Sprintf("%s: %s complete", environment, action)
+}
+
+// groupLines returns a bullet per completed startup group.
+func groupLines(rep *report.Report) []string {
+	lines := make([]string, 0, len(rep.Groups))
+	for _, g := range rep.Groups {
+		lines = append(lines, fmt.Sprintf("• Group %d: %d resource(s) in %s", g.Number, g.Resources, seconds(g.DurationSeconds)))
+	}
+
+	return lines
+}
+
+// skippedLines returns a bullet per skipped object with the reason it was left untouched.
+func skippedLines(rep *report.Report) []string {
+	lines := make([]string, 0, len(rep.Skipped))
+	for _, s := range rep.Skipped {
+		name := s.Name
+		if s.Namespace != "" {
+			name = s.Namespace + "/" + s.Name
+		}
+		lines = append(lines, fmt.Sprintf("• %s %s: %s", s.Kind, name, s.Reason))
+	}
+
+	return lines
+}
+
+// infrastructureLines returns a bullet per cloud resource which was stopped or started.
+func infrastructureLines(rep *report.Report) []string {
+	lines := make([]string, 0, len(rep.Infrastructure))
+	for _, i := range rep.Infrastructure {
+		lines = append(lines, fmt.Sprintf("• %s %s %s", i.Kind, i.Name, i.Change))
+	}
+
+	return lines
+}
+
+// alertingLines returns a bullet per alerting integration with the alarms, policies or silences it updated.
+func alertingLines(rep *report.Report) []string {
+	lines := make([]string, 0, len(rep.Alerting))
+	for _, a := range rep.Alerting {
+		line := fmt.Sprintf("• %s %s", a.Integration, a.Action)
+		if len(a.Targets) > 0 {
+			targets := a.Targets
+			if len(targets) > maxListedItems {
+				targets = append(targets[:maxListedItems:maxListedItems], fmt.Sprintf("…and %d more", len(a.Targets)-maxListedItems))
+			}
+			line += fmt.Sprintf(" (%d): %s", len(a.Targets), strings.Join(targets, ", "))
+		}
+		lines = append(lines, line)
+	}
+
+	return lines
+}
+
+// phaseSummary returns the duration of each phase of the run on a single line.
+func phaseSummary(rep *report.Report) string {
+	phases := make([]string, 0, len(rep.Phases))
+	for _, p := range rep.Phases {
+		phases = append(phases, fmt.Sprintf("%s %s", p.Name, seconds(p.DurationSeconds)))
+	}
+
+	return strings.Join(phases, ", ")
+}
+
+// capLines truncates lines to maxListedItems, noting how many were left out.
+func capLines(lines []string) []string {
+	if len(lines) <= maxListedItems {
+		return lines
+	}
+
+	more := len(lines) - maxListedItems
+	return append(lines[:maxListedItems:maxListedItems], fmt.Sprintf("…and %d more", more))
+}
+
+// seconds formats a duration given in seconds, rounded to the nearest second.
+func seconds(s float64) string {
+	return (time.Duration(s * float64(time.Second))).Round(time.Second).String()
+}
+
+// truncate shortens s to at most n bytes so that it fits within a message field.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+
+	return strings.ToValidUTF8(s[:n], "") + "…"
+}
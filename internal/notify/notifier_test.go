@@ -0,0 +1,117 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"io"
+	log "log/slog"
+	"testing"
+
+	"github.com/michaelprice232/eks-env-scaledown/internal/report"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeNotifier records the events it receives, optionally failing each one.
+type fakeNotifier struct {
+	events []string
+	err    error
+}
+
+func (f *fakeNotifier) Name() string { return "fake" }
+
+func (f *fakeNotifier) Started(context.Context, *report.Report) error {
+	f.events = append(f.events, "started")
+	return f.err
+}
+
+func (f *fakeNotifier) GroupCompleted(context.Context, *report.Report, report.Group) error {
+	f.events = append(f.events, "group")
+	return f.err
+}
+
+func (f *fakeNotifier) Finished(_ context.Context, _ *report.Report, runErr error) error {
+	if runErr != nil {
+		f.events = append(f.events, "failed")
+	} else {
+		f.events = append(f.events, "succeeded")
+	}
+	return f.err
+}
+
+func TestDispatcher(t *testing.T) {
+	log.SetDefault(log.New(log.NewJSONHandler(io.Discard, nil)))
+
+	failing := &fakeNotifier{err: errors.New("unreachable")}
+	healthy := &fakeNotifier{}
+	d := &Dispatcher{Notifiers: []Notifier{failing, healthy}}
+	rep := report.New("ScaleUp")
+
+	d.Started(t.Context(), rep)
+	d.GroupCompleted(t.Context(), rep, report.Group{Number: 0})
+	d.Finished(t.Context(), rep, errors.New("boom"))
+
+	assert.Equal(t, []string{"started", "group", "failed"}, failing.events)
+	assert.Equal(t, []string{"started", "group", "failed"}, healthy.events, "Expected a failing notifier not to stop the others")
+
+	var nilDispatcher *Dispatcher
+	assert.NotPanics(t, func() { nilDispatcher.Finished(t.Context(), rep, nil) })
+}
+
+func TestNewDispatcher(t *testing.T) {
+	log.SetDefault(log.New(log.NewJSONHandler(io.Discard, nil)))
+
+	for _, key := range []string{"SLACK_API_TOKEN", "SLACK_CHANNEL_ID", "ENVIRONMENT", "TEAMS_WEBHOOK_URL", "WEBHOOK_URL", "SMTP_HOST", "EMAIL_FROM", "EMAIL_TO"} {
+		t.Setenv(key, "")
+	}
+
+	t.Run("nothing configured", func(t *testing.T) {
+		d, err := NewDispatcher()
+		require.NoError(t, err)
+		assert.Empty(t, d.Notifiers)
+	})
+
+	t.Run("each backend is configured independently", func(t *testing.T) {
+		t.Setenv("TEAMS_WEBHOOK_URL", "https://example.webhook.office.com/webhook")
+		t.Setenv("WEBHOOK_URL", "https://hooks.example.com/scaledown")
+
+		d, err := NewDispatcher()
+		require.NoError(t, err)
+		require.Len(t, d.Notifiers, 2)
+		assert.Equal(t, "teams", d.Notifiers[0].Name())
+		assert.Equal(t, "webhook", d.Notifiers[1].Name())
+	})
+
+	t.Run("a misconfigured backend is reported and left out", func(t *testing.T) {
+		t.Setenv("TEAMS_WEBHOOK_URL", "https://example.webhook.office.com/webhook")
+		t.Setenv("SMTP_HOST", "smtp.example.com")
+
+		d, err := NewDispatcher()
+		require.Error(t, err)
+		require.Len(t, d.Notifiers, 1)
+		assert.Equal(t, "teams", d.Notifiers[0].Name())
+	})
+}
+
+func TestAlertingLines(t *testing.T) {
+	rep := report.New("ScaleDown")
+	rep.AddAlerting(report.AlertingAction{Integration: "cloudwatch", Action: "disable", Targets: []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j", "k", "l"}})
+	rep.AddAlerting(report.AlertingAction{Integration: "alertmanager", Action: "ScaleDown"})
+
+	assert.Equal(t, []string{
+		"• cloudwatch disable (12): a, b, c, d, e, f, g, h, i, j, …and 2 more",
+		"• alertmanager ScaleDown",
+	}, alertingLines(rep))
+}
+
+func TestInfrastructureLines(t *testing.T) {
+	rep := report.New("ScaleDown")
+	rep.AddInfrastructure("rds-instance", "orders", "stopped")
+	rep.AddInfrastructure("rds-cluster", "users", "stopped")
+
+	assert.Equal(t, []string{
+		"• rds-instance orders stopped",
+		"• rds-cluster users stopped",
+	}, infrastructureLines(rep))
+}
@@ -0,0 +1,249 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	log "log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/michaelprice232/eks-env-scaledown/internal/state"
+)
+
+const (
+	pagerDutyDefaultURL = "https://api.pagerduty.com"
+
+	// pagerDutyStateKey is the state key holding the ID of the open maintenance window.
+	pagerDutyStateKey = "pagerduty-maintenance-window"
+
+	// defaultPagerDutyWindowDuration covers a weekend. The window is ended early at scale up, so this
+	// only matters if the scale up never runs.
+	defaultPagerDutyWindowDuration = 72 * time.Hour
+)
+
+// PagerDutyClient manages a PagerDuty maintenance window covering the configured services whilst
+// the environment is scaled down.
+type PagerDutyClient struct {
+	Client      *http.Client
+	BaseURL     string
+	APIKey      string
+	FromEmail   string
+	ServiceIDs  []string
+	Duration    time.Duration
+	Environment string
+}
+
+// NewPagerDutyClient returns PagerDutyClient, which can be used for opening and closing PagerDuty
+// maintenance windows. nil is returned if PAGERDUTY_API_KEY or PAGERDUTY_SERVICE_IDS are not set.
+func NewPagerDutyClient() (*PagerDutyClient, error) {
+	apiKey := os.Getenv("PAGERDUTY_API_KEY")
+	if apiKey == "" {
+		log.Warn("PAGERDUTY_API_KEY not set. Will not manage PagerDuty maintenance windows")
+		return nil, nil
+	}
+
+	serviceIDs := splitList(os.Getenv("PAGERDUTY_SERVICE_IDS"))
+	if len(serviceIDs) == 0 {
+		log.Warn("PAGERDUTY_SERVICE_IDS envar not set. Will not manage PagerDuty maintenance windows")
+		return nil, nil
+	}
+
+	fromEmail := os.Getenv("PAGERDUTY_FROM_EMAIL")
+	if fromEmail == "" {
+		return nil, errors.New("PAGERDUTY_FROM_EMAIL must be set to the email of a PagerDuty user to create maintenance windows")
+	}
+
+	duration := defaultPagerDutyWindowDuration
+	if raw := os.Getenv("PAGERDUTY_MAINTENANCE_DURATION"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("unable to parse PAGERDUTY_MAINTENANCE_DURATION %q into a positive duration", raw)
+		}
+		duration = d
+	}
+
+	return &PagerDutyClient{
+		Client:      &http.Client{Timeout: httpTimeout},
+		BaseURL:     pagerDutyDefaultURL,
+		APIKey:      apiKey,
+		FromEmail:   fromEmail,
+		ServiceIDs:  serviceIDs,
+		Duration:    duration,
+		Environment: os.Getenv("ENVIRONMENT"),
+	}, nil
+}
+
+// UpdatePagerDutyMaintenanceWindow opens a maintenance window at scale down and ends it at scale up.
+// The window ID is kept in store between the runs, so a scale up which fails before reaching this
+// step leaves it recorded for the next scale up to close.
+func UpdatePagerDutyMaintenanceWindow(ctx context.Context, pd *PagerDutyClient, store *state.Store, action ScaleAction) error {
+	if pd == nil {
+		return nil
+	}
+
+	if err := action.validateAction(); err != nil {
+		return err
+	}
+
+	existingID, found, err := store.Get(ctx, pagerDutyStateKey)
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case ScaleDown:
+		// A window left over from a scale down which was never followed by a scale up is replaced
+		if found {
+			log.Info("Ending previous PagerDuty maintenance window", "windowID", existingID)
+			if err = pd.endMaintenanceWindow(ctx, existingID); err != nil {
+				log.Warn("Unable to end previous PagerDuty maintenance window. It will expire on its own", "windowID", existingID, "error", err)
+			}
+		}
+
+		id, err := pd.createMaintenanceWindow(ctx)
+		if err != nil {
+			return fmt.Errorf("creating PagerDuty maintenance window: %w", err)
+		}
+		log.Info("Created PagerDuty maintenance window", "windowID", id, "services", pd.ServiceIDs, "duration", pd.Duration)
+
+		if err = store.Set(ctx, pagerDutyStateKey, id); err != nil {
+			return fmt.Errorf("recording PagerDuty maintenance window %s, which will expire after %s: %w", id, pd.Duration, err)
+		}
+
+	case ScaleUp:
+		if !found {
+			log.Info("No PagerDuty maintenance window recorded. Nothing to end")
+			return nil
+		}
+
+		log.Info("Ending PagerDuty maintenance window", "windowID", existingID)
+		if err = pd.endMaintenanceWindow(ctx, existingID); err != nil {
+			return fmt.Errorf("ending PagerDuty maintenance window %s: %w", existingID, err)
+		}
+
+		if err = store.Delete(ctx, pagerDutyStateKey); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type pagerDutyReference struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+}
+
+type pagerDutyMaintenanceWindow struct {
+	ID          string               `json:"id,omitempty"`
+	Type        string               `json:"type"`
+	StartTime   time.Time            `json:"start_time"`
+	EndTime     time.Time            `json:"end_time"`
+	Description string               `json:"description"`
+	Services    []pagerDutyReference `json:"services"`
+}
+
+type pagerDutyMaintenanceWindowBody struct {
+	MaintenanceWindow pagerDutyMaintenanceWindow `json:"maintenance_window"`
+}
+
+// createMaintenanceWindow opens a maintenance window starting now and returns its ID.
+func (pd *PagerDutyClient) createMaintenanceWindow(ctx context.Context) (string, error) {
+	now := time.Now().UTC()
+
+	services := make([]pagerDutyReference, 0, len(pd.ServiceIDs))
+	for _, id := range pd.ServiceIDs {
+		services = append(services, pagerDutyReference{ID: id, Type: "service_reference"})
+	}
+
+	body, err := json.Marshal(pagerDutyMaintenanceWindowBody{MaintenanceWindow: pagerDutyMaintenanceWindow{
+		Type:        "maintenance_window",
+		StartTime:   now,
+		EndTime:     now.Add(pd.Duration),
+		Description: strings.TrimSpace(fmt.Sprintf("eks-env-scaledown: %s scaled down", pd.Environment)),
+		Services:    services,
+	}})
+	if err != nil {
+		return "", fmt.Errorf("encoding maintenance window: %w", err)
+	}
+
+	resp, err := pd.do(ctx, http.MethodPost, "/maintenance_windows", body)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return "", pagerDutyError(resp)
+	}
+
+	var created pagerDutyMaintenanceWindowBody
+	if err = json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		return "", fmt.Errorf("decoding maintenance window: %w", err)
+	}
+	if created.MaintenanceWindow.ID == "" {
+		return "", errors.New("maintenance window created without an ID")
+	}
+
+	return created.MaintenanceWindow.ID, nil
+}
+
+// endMaintenanceWindow ends an ongoing maintenance window (or deletes a future one). A window which
+// no longer exists is treated as already ended.
+func (pd *PagerDutyClient) endMaintenanceWindow(ctx context.Context, id string) error {
+	resp, err := pd.do(ctx, http.MethodDelete, "/maintenance_windows/"+id, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		log.Info("PagerDuty maintenance window no longer exists", "windowID", id)
+		return nil
+	case resp.StatusCode == http.StatusMethodNotAllowed:
+		// Returned for windows which have already ended
+		log.Info("PagerDuty maintenance window has already ended", "windowID", id)
+		return nil
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return pagerDutyError(resp)
+	}
+
+	return nil
+}
+
+func (pd *PagerDutyClient) do(ctx context.Context, method, path string, body []byte) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(pd.BaseURL, "/")+path, reader)
+	if err != nil {
+		return nil, fmt.Errorf("building request: %w", err)
+	}
+	req.Header.Set("Accept", "application/vnd.pagerduty+json;version=2")
+	req.Header.Set("Authorization", "Token token="+pd.APIKey)
+	req.Header.Set("From", pd.FromEmail)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := pd.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("sending request to PagerDuty: %w", err)
+	}
+
+	return resp, nil
+}
+
+func pagerDutyError(resp *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("unexpected response from PagerDuty %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+}
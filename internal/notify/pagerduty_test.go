@@ -0,0 +1,187 @@
+package notify
+
+import (
+	"encoding/json"
+	"io"
+	log "log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/michaelprice232/eks-env-scaledown/internal/state"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// fakePagerDuty is a stand-in for the PagerDuty maintenance windows API.
+type fakePagerDuty struct {
+	mu      sync.Mutex
+	windows map[string]pagerDutyMaintenanceWindow
+	ended   []string
+	nextID  int
+}
+
+func (f *fakePagerDuty) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Header.Get("Authorization") != "Token token=pd-key" || r.Header.Get("From") != "oncall@example.com" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/maintenance_windows":
+		var body pagerDutyMaintenanceWindowBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.nextID++
+		body.MaintenanceWindow.ID = "PW" + strings.Repeat("X", f.nextID)
+		f.windows[body.MaintenanceWindow.ID] = body.MaintenanceWindow
+
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(body)
+
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/maintenance_windows/"):
+		id := strings.TrimPrefix(r.URL.Path, "/maintenance_windows/")
+		if _, ok := f.windows[id]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(f.windows, id)
+		f.ended = append(f.ended, id)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newPagerDutyTestClient(t *testing.T) (*PagerDutyClient, *fakePagerDuty) {
+	t.Helper()
+
+	fake := &fakePagerDuty{windows: make(map[string]pagerDutyMaintenanceWindow)}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	return &PagerDutyClient{
+		Client:      srv.Client(),
+		BaseURL:     srv.URL,
+		APIKey:      "pd-key",
+		FromEmail:   "oncall@example.com",
+		ServiceIDs:  []string{"PSVC1", "PSVC2"},
+		Duration:    12 * time.Hour,
+		Environment: "staging",
+	}, fake
+}
+
+func TestUpdatePagerDutyMaintenanceWindow(t *testing.T) {
+	log.SetDefault(log.New(log.NewJSONHandler(io.Discard, nil)))
+
+	t.Run("window is opened at scale down and ended at scale up", func(t *testing.T) {
+		pd, fakePD := newPagerDutyTestClient(t)
+		store := state.New(fake.NewClientset(), "eks-env-scaledown")
+
+		require.NoError(t, UpdatePagerDutyMaintenanceWindow(t.Context(), pd, store, ScaleDown))
+		require.Len(t, fakePD.windows, 1)
+
+		id, found, err := store.Get(t.Context(), pagerDutyStateKey)
+		require.NoError(t, err)
+		require.True(t, found, "Expected the window ID to be recorded for the scale up")
+
+		window := fakePD.windows[id]
+		assert.Equal(t, []pagerDutyReference{{ID: "PSVC1", Type: "service_reference"}, {ID: "PSVC2", Type: "service_reference"}}, window.Services)
+		assert.Equal(t, 12*time.Hour, window.EndTime.Sub(window.StartTime))
+		assert.Equal(t, "eks-env-scaledown: staging scaled down", window.Description)
+
+		require.NoError(t, UpdatePagerDutyMaintenanceWindow(t.Context(), pd, store, ScaleUp))
+		assert.Equal(t, []string{id}, fakePD.ended)
+		assert.Empty(t, fakePD.windows)
+
+		_, found, err = store.Get(t.Context(), pagerDutyStateKey)
+		require.NoError(t, err)
+		assert.False(t, found, "Expected the window ID to be cleared once ended")
+	})
+
+	t.Run("a leftover window is replaced at scale down", func(t *testing.T) {
+		pd, fakePD := newPagerDutyTestClient(t)
+		store := state.New(fake.NewClientset(), "eks-env-scaledown")
+
+		require.NoError(t, UpdatePagerDutyMaintenanceWindow(t.Context(), pd, store, ScaleDown))
+		first, _, _ := store.Get(t.Context(), pagerDutyStateKey)
+
+		require.NoError(t, UpdatePagerDutyMaintenanceWindow(t.Context(), pd, store, ScaleDown))
+		second, _, _ := store.Get(t.Context(), pagerDutyStateKey)
+
+		assert.NotEqual(t, first, second)
+		assert.Equal(t, []string{first}, fakePD.ended)
+		assert.Len(t, fakePD.windows, 1)
+	})
+
+	t.Run("scale up without a recorded window is a no-op", func(t *testing.T) {
+		pd, fakePD := newPagerDutyTestClient(t)
+
+		require.NoError(t, UpdatePagerDutyMaintenanceWindow(t.Context(), pd, state.New(fake.NewClientset(), "eks-env-scaledown"), ScaleUp))
+		assert.Empty(t, fakePD.ended)
+	})
+
+	t.Run("a window which has already gone is treated as ended", func(t *testing.T) {
+		pd, _ := newPagerDutyTestClient(t)
+		store := state.New(fake.NewClientset(), "eks-env-scaledown")
+		require.NoError(t, store.Set(t.Context(), pagerDutyStateKey, "PWGONE"))
+
+		require.NoError(t, UpdatePagerDutyMaintenanceWindow(t.Context(), pd, store, ScaleUp))
+
+		_, found, err := store.Get(t.Context(), pagerDutyStateKey)
+		require.NoError(t, err)
+		assert.False(t, found)
+	})
+
+	t.Run("nil client is a no-op", func(t *testing.T) {
+		assert.NoError(t, UpdatePagerDutyMaintenanceWindow(t.Context(), nil, nil, ScaleDown))
+	})
+}
+
+func TestNewPagerDutyClient(t *testing.T) {
+	log.SetDefault(log.New(log.NewJSONHandler(io.Discard, nil)))
+
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantNil bool
+		wantErr bool
+	}{
+		{name: "not set", env: map[string]string{}, wantNil: true},
+		{name: "no services", env: map[string]string{"PAGERDUTY_API_KEY": "key"}, wantNil: true},
+		{name: "valid", env: map[string]string{"PAGERDUTY_API_KEY": "key", "PAGERDUTY_SERVICE_IDS": "PSVC1, PSVC2", "PAGERDUTY_FROM_EMAIL": "oncall@example.com"}},
+		{name: "missing from email", env: map[string]string{"PAGERDUTY_API_KEY": "key", "PAGERDUTY_SERVICE_IDS": "PSVC1"}, wantErr: true},
+		{name: "invalid duration", env: map[string]string{"PAGERDUTY_API_KEY": "key", "PAGERDUTY_SERVICE_IDS": "PSVC1", "PAGERDUTY_FROM_EMAIL": "oncall@example.com", "PAGERDUTY_MAINTENANCE_DURATION": "weekend"}, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, key := range []string{"PAGERDUTY_API_KEY", "PAGERDUTY_SERVICE_IDS", "PAGERDUTY_FROM_EMAIL", "PAGERDUTY_MAINTENANCE_DURATION"} {
+				t.Setenv(key, tc.env[key])
+			}
+
+			client, err := NewPagerDutyClient()
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.wantNil, client == nil)
+			if client != nil {
+				assert.Equal(t, []string{"PSVC1", "PSVC2"}, client.ServiceIDs)
+				assert.Equal(t, defaultPagerDutyWindowDuration, client.Duration)
+			}
+		})
+	}
+}
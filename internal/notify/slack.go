@@ -1,18 +1,31 @@
 package notify
 
 import (
+	"context"
+	"fmt"
 	log "log/slog"
 	"os"
+	"strings"
+	"time"
+
+	"github.com/michaelprice232/eks-env-scaledown/internal/report"
 
 	"github.com/slack-go/slack"
 )
 
-// SlackClient holds the Slack client and the context used when sending notifications.
+// SlackClient sends Block Kit notifications to a Slack channel, threading each run's progress under its start message.
 type SlackClient struct {
 	Client      *slack.Client
 	ChannelID   string
 	Environment string
-	ScaleAction string
+
+	// NotifySuccess enables the start message, per-group progress and the success summary.
+	NotifySuccess bool
+	// NotifyFailure enables the failure message. Enabled by default.
+	NotifyFailure bool
+
+	// threads maps a run ID to the timestamp of the run's start message, under which progress is posted
+	threads map[string]string
 }
 
 // NewSlackClient returns SlackClient, which can be used for sending messages to Slack channels.
@@ -20,14 +33,14 @@ func NewSlackClient() *SlackClient {
 	slackAPIToken := os.Getenv("SLACK_API_TOKEN")
 	slackChannelID := os.Getenv("SLACK_CHANNEL_ID")
 	environment := os.Getenv("ENVIRONMENT")
-	scaleAction := os.Getenv("SCALE_ACTION")
 
 	if slackAPIToken != "" && slackChannelID != "" && environment != "" {
 		return &SlackClient{
-			Client:      slack.New(slackAPIToken),
-			ChannelID:   slackChannelID,
-			Environment: environment,
-			ScaleAction: scaleAction,
+			Client:        slack.New(slackAPIToken),
+			ChannelID:     slackChannelID,
+			Environment:   environment,
+			NotifySuccess: boolEnv("SLACK_NOTIFY_SUCCESS", false),
+			NotifyFailure: boolEnv("SLACK_NOTIFY_FAILURE", true),
 		}
 	}
 
@@ -35,46 +48,155 @@ func NewSlackClient() *SlackClient {
 	return nil
 }
 
-// PostMessage sends a formatted error notification to the configured Slack channel.
-func PostMessage(slackClient *SlackClient, message string) error {
-	attachment := slack.Attachment{
-		Text: "Details",
-		Fields: []slack.AttachmentField{
-			{
-				Title: "Environment",
-				Value: slackClient.Environment,
-			},
-			{
-				Title: "Scaling Type",
-				Value: slackClient.ScaleAction,
-			},
-			{
-				Title: "Error",
-				Value: message,
-			},
-		},
-	}
-
-	_, _, err := slackClient.Client.PostMessage(
-		slackClient.ChannelID,
-		slack.MsgOptionText("A problem has occurred whilst scaling the environment cloud infrastructure", false),
-		slack.MsgOptionAttachments(attachment),
-	)
+// post sends a Block Kit message. Once a run has a thread, messages for that run are posted as
+// replies within it, optionally also broadcast to the channel. The timestamp of the posted message is returned.
+func (c *SlackClient) post(ctx context.Context, rep *report.Report, fallback string, blocks []slack.Block, broadcast bool) (string, error) {
+	options := []slack.MsgOption{
+		slack.MsgOptionText(fallback, false),
+		slack.MsgOptionBlocks(blocks...),
+	}
+
+	if ts, ok := c.threads[rep.RunID]; ok {
+		options = append(options, slack.MsgOptionTS(ts))
+		if broadcast {
+			options = append(options, slack.MsgOptionBroadcast())
+		}
+	}
+
+	_, ts, err := c.Client.PostMessageContext(ctx, c.ChannelID, options...)
+	if err != nil {
+		return "", err
+	}
+
+	return ts, nil
+}
+
+// detailFields returns the fields identifying the environment and the run.
+func (c *SlackClient) detailFields(rep *report.Report) []*slack.TextBlockObject {
+	fields := []*slack.TextBlockObject{
+		slack.NewTextBlockObject(slack.MarkdownType, "*Environment*\n"+c.Environment, false, false),
+		slack.NewTextBlockObject(slack.MarkdownType, "*Scaling Type*\n"+rep.Action, false, false),
+	}
+	return append(fields, slack.NewTextBlockObject(slack.MarkdownType, "*Run ID*\n"+rep.RunID, false, false))
+}
+
+// Name identifies the notifier in logs.
+func (c *SlackClient) Name() string {
+	return "slack"
+}
+
+// Started announces the start of a run. The message becomes the thread for the run's progress.
+// Only sent when success notifications are enabled.
+func (c *SlackClient) Started(ctx context.Context, rep *report.Report) error {
+	if !c.NotifySuccess {
+		return nil
+	}
+
+	blocks := []slack.Block{
+		slack.NewHeaderBlock(slack.NewTextBlockObject(slack.PlainTextType, fmt.Sprintf("%s: %s started", c.Environment, rep.Action), true, false)),
+		slack.NewSectionBlock(nil, c.detailFields(rep), nil),
+		slack.NewContextBlock("", slack.NewTextBlockObject(slack.MarkdownType, "Progress is posted in this thread", false, false)),
+	}
+
+	ts, err := c.post(ctx, rep, fmt.Sprintf("Scaling %s (%s) has started", c.Environment, rep.Action), blocks, false)
 	if err != nil {
 		return err
 	}
 
+	if c.threads == nil {
+		c.threads = make(map[string]string)
+	}
+	c.threads[rep.RunID] = ts
+
 	return nil
 }
 
-// Slack sends msg to Slack if a SlackClient is configured, logging any send failure.
-func Slack(slackClient *SlackClient, msg string) {
-	if slackClient == nil {
-		return
+// GroupCompleted posts the completion of a startup group as a reply in the run's thread.
+func (c *SlackClient) GroupCompleted(ctx context.Context, rep *report.Report, g report.Group) error {
+	if !c.NotifySuccess {
+		return nil
+	}
+	if _, ok := c.threads[rep.RunID]; !ok {
+		return nil
 	}
 
-	slackErr := PostMessage(slackClient, msg)
-	if slackErr != nil {
-		log.Error("sending Slack message", "error", slackErr)
+	text := fmt.Sprintf(":white_check_mark: Group %d complete: %d resource(s) in %s", g.Number, g.Resources, seconds(g.DurationSeconds))
+	blocks := []slack.Block{
+		slack.NewSectionBlock(slack.NewTextBlockObject(slack.MarkdownType, text, false, false), nil, nil),
 	}
+
+	_, err := c.post(ctx, rep, text, blocks, false)
+	return err
+}
+
+// Finished posts the outcome of a run, broadcast from the run's thread (if any) to the channel. A
+// failure is sent unless failure notifications are disabled, a success only when they are enabled.
+func (c *SlackClient) Finished(ctx context.Context, rep *report.Report, runErr error) error {
+	if runErr != nil {
+		if !c.NotifyFailure {
+			return nil
+		}
+		return c.postFailure(ctx, rep, runErr)
+	}
+
+	if !c.NotifySuccess {
+		return nil
+	}
+	return c.postSuccess(ctx, rep)
+}
+
+// postFailure sends a formatted error notification, with the run report summarised alongside the error.
+func (c *SlackClient) postFailure(ctx context.Context, rep *report.Report, runErr error) error {
+	blocks := []slack.Block{
+		slack.NewHeaderBlock(slack.NewTextBlockObject(slack.PlainTextType, title(c.Environment, rep.Action, runErr), true, false)),
+		slack.NewSectionBlock(nil, c.detailFields(rep), nil),
+		slack.NewSectionBlock(slack.NewTextBlockObject(slack.MarkdownType, "*Error*\n```"+truncate(runErr.Error(), 2800)+"```", false, false), nil, nil),
+		slack.NewContextBlock("", slack.NewTextBlockObject(slack.MarkdownType, rep.Summary(), false, false)),
+	}
+
+	_, err := c.post(ctx, rep, "A problem has occurred whilst scaling the environment cloud infrastructure", blocks, true)
+	return err
+}
+
+// postSuccess sends a summary of a successful run: resources scaled, skipped items and durations.
+func (c *SlackClient) postSuccess(ctx context.Context, rep *report.Report) error {
+	fields := append(c.detailFields(rep),
+		slack.NewTextBlockObject(slack.MarkdownType, fmt.Sprintf("*Resources scaled*\n%d", len(rep.Resources)), false, false),
+		slack.NewTextBlockObject(slack.MarkdownType, fmt.Sprintf("*Skipped*\n%d", len(rep.Skipped)), false, false),
+		slack.NewTextBlockObject(slack.MarkdownType, fmt.Sprintf("*Duration*\n%s", rep.Duration().Round(time.Second)), false, false),
+	)
+
+	blocks := []slack.Block{
+		slack.NewHeaderBlock(slack.NewTextBlockObject(slack.PlainTextType, title(c.Environment, rep.Action, nil), true, false)),
+		slack.NewSectionBlock(nil, fields, nil),
+	}
+
+	if len(rep.Groups) > 0 {
+		blocks = append(blocks, listBlock("Groups", groupLines(rep)))
+	}
+
+	if len(rep.Skipped) > 0 {
+		blocks = append(blocks, listBlock("Skipped", skippedLines(rep)))
+	}
+
+	if len(rep.Alerting) > 0 {
+		blocks = append(blocks, listBlock("Alerting", alertingLines(rep)))
+	}
+
+	if len(rep.Infrastructure) > 0 {
+		blocks = append(blocks, listBlock("Infrastructure", infrastructureLines(rep)))
+	}
+
+	if len(rep.Phases) > 0 {
+		blocks = append(blocks, slack.NewContextBlock("", slack.NewTextBlockObject(slack.MarkdownType, "Phases: "+phaseSummary(rep), false, false)))
+	}
+
+	_, err := c.post(ctx, rep, fmt.Sprintf("Scaling %s (%s) is complete: %s", c.Environment, rep.Action, rep.Summary()), blocks, true)
+	return err
+}
+
+// listBlock returns a section listing lines under heading, truncated to maxListedItems.
+func listBlock(heading string, lines []string) slack.Block {
+	text := fmt.Sprintf("*%s*\n%s", heading, strings.Join(capLines(lines), "\n"))
+	return slack.NewSectionBlock(slack.NewTextBlockObject(slack.MarkdownType, truncate(text, 2900), false, false), nil, nil)
 }
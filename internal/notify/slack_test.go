@@ -1,8 +1,17 @@
 package notify
 
 import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
 	"testing"
 
+	"github.com/michaelprice232/eks-env-scaledown/internal/report"
+
+	"github.com/slack-go/slack"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -12,14 +21,14 @@ func TestNewSlackClient(t *testing.T) {
 		t.Setenv("SLACK_API_TOKEN", "xoxb-token")
 		t.Setenv("SLACK_CHANNEL_ID", "C123")
 		t.Setenv("ENVIRONMENT", "staging")
-		t.Setenv("SCALE_ACTION", "ScaleDown")
 
 		client := NewSlackClient()
 		require.NotNil(t, client)
 		assert.Equal(t, "C123", client.ChannelID)
 		assert.Equal(t, "staging", client.Environment)
-		assert.Equal(t, "ScaleDown", client.ScaleAction)
 		assert.NotNil(t, client.Client)
+		assert.False(t, client.NotifySuccess, "Expected success notifications to be opt-in")
+		assert.True(t, client.NotifyFailure, "Expected failure notifications to be enabled by default")
 	})
 
 	t.Run("returns nil when a required env var is missing", func(t *testing.T) {
@@ -31,9 +40,98 @@ func TestNewSlackClient(t *testing.T) {
 	})
 }
 
-func TestSlackNilClientIsNoOp(t *testing.T) {
-	// Should not panic or attempt to send when no client is configured.
-	assert.NotPanics(t, func() {
-		Slack(nil, "this should be safely ignored")
+// slackRecorder is a stand-in for the Slack API which records each chat.postMessage request.
+type slackRecorder struct {
+	mu       sync.Mutex
+	messages []url.Values
+}
+
+func newSlackTestClient(t *testing.T, notifySuccess, notifyFailure bool) (*SlackClient, *slackRecorder) {
+	t.Helper()
+
+	rec := &slackRecorder{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+
+		rec.mu.Lock()
+		rec.messages = append(rec.messages, r.PostForm)
+		ts := fmt.Sprintf("1700000000.%06d", len(rec.messages))
+		rec.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, `{"ok":true,"channel":"C123","ts":%q}`, ts)
+	}))
+	t.Cleanup(srv.Close)
+
+	return &SlackClient{
+		Client:        slack.New("xoxb-token", slack.OptionAPIURL(srv.URL+"/")),
+		ChannelID:     "C123",
+		Environment:   "staging",
+		NotifySuccess: notifySuccess,
+		NotifyFailure: notifyFailure,
+	}, rec
+}
+
+func TestSlackThreadedRun(t *testing.T) {
+	client, rec := newSlackTestClient(t, true, true)
+	rep := report.New("ScaleDown")
+
+	require.NoError(t, client.Started(t.Context(), rep))
+	require.NoError(t, client.GroupCompleted(t.Context(), rep, report.Group{Number: 100, DurationSeconds: 12, Resources: 3}))
+	rep.AddSkipped(report.Skipped{Kind: "deployment", Namespace: "web", Name: "nginx", Reason: "already scaled to zero"})
+	rep.Finish()
+	require.NoError(t, client.Finished(t.Context(), rep, nil))
+
+	require.Len(t, rec.messages, 3)
+
+	start := rec.messages[0]
+	assert.Empty(t, start.Get("thread_ts"), "Expected the start message to be posted to the channel")
+	assert.Contains(t, start.Get("blocks"), rep.RunID)
+	assert.Contains(t, start.Get("blocks"), "staging: ScaleDown started", "Expected the action to be read from the run's report")
+
+	progress := rec.messages[1]
+	assert.Equal(t, "1700000000.000001", progress.Get("thread_ts"), "Expected progress to be posted in the run's thread")
+	assert.Contains(t, progress.Get("blocks"), "Group 100 complete: 3 resource(s) in 12s")
+	assert.Empty(t, progress.Get("reply_broadcast"))
+
+	finish := rec.messages[2]
+	assert.Equal(t, "1700000000.000001", finish.Get("thread_ts"))
+	assert.Equal(t, "true", finish.Get("reply_broadcast"), "Expected the summary to be broadcast to the channel")
+	assert.Contains(t, finish.Get("blocks"), "web/nginx: already scaled to zero")
+}
+
+func TestSlackNotificationToggles(t *testing.T) {
+	t.Run("success notifications disabled only sends failures", func(t *testing.T) {
+		client, rec := newSlackTestClient(t, false, true)
+		rep := report.New("ScaleDown")
+
+		require.NoError(t, client.Started(t.Context(), rep))
+		require.NoError(t, client.GroupCompleted(t.Context(), rep, report.Group{Number: 1}))
+		require.NoError(t, client.Finished(t.Context(), rep, nil))
+		assert.Empty(t, rec.messages)
+
+		require.NoError(t, client.Finished(t.Context(), rep, errors.New("boom")))
+		require.Len(t, rec.messages, 1)
+		assert.Empty(t, rec.messages[0].Get("thread_ts"), "Expected the failure to be posted to the channel when there is no thread")
+		assert.Contains(t, rec.messages[0].Get("blocks"), "boom")
 	})
+
+	t.Run("failure notifications disabled", func(t *testing.T) {
+		client, rec := newSlackTestClient(t, false, false)
+
+		require.NoError(t, client.Finished(t.Context(), report.New("ScaleDown"), errors.New("boom")))
+		assert.Empty(t, rec.messages)
+	})
+}
+
+func Test_listBlock(t *testing.T) {
+	lines := make([]string, 0, 15)
+	for i := range 15 {
+		lines = append(lines, fmt.Sprintf("line %d", i))
+	}
+
+	text := listBlock("Skipped", lines).(*slack.SectionBlock).Text.Text
+	assert.Contains(t, text, "line 9")
+	assert.NotContains(t, text, "line 10")
+	assert.Contains(t, text, "…and 5 more")
 }
@@ -0,0 +1,150 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	log "log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/michaelprice232/eks-env-scaledown/internal/report"
+)
+
+// TeamsClient posts Adaptive Card notifications to a Microsoft Teams incoming webhook. As incoming
+// webhooks cannot thread replies, only the outcome of the run is posted.
+type TeamsClient struct {
+	Client      *http.Client
+	WebhookURL  string
+	Environment string
+
+	// NotifySuccess enables a summary of successful runs. Failures are always sent.
+	NotifySuccess bool
+}
+
+// NewTeamsClient returns TeamsClient, or nil if TEAMS_WEBHOOK_URL is not set.
+func NewTeamsClient() *TeamsClient {
+	webhookURL := os.Getenv("TEAMS_WEBHOOK_URL")
+	if webhookURL == "" {
+		log.Debug("TEAMS_WEBHOOK_URL not set. Disabling Microsoft Teams notifications")
+		return nil
+	}
+
+	return &TeamsClient{
+		Client:        &http.Client{Timeout: httpTimeout},
+		WebhookURL:    webhookURL,
+		Environment:   os.Getenv("ENVIRONMENT"),
+		NotifySuccess: boolEnv("TEAMS_NOTIFY_SUCCESS", false),
+	}
+}
+
+// Name identifies the notifier in logs.
+func (c *TeamsClient) Name() string {
+	return "teams"
+}
+
+// Started is a no-op for Teams.
+func (c *TeamsClient) Started(context.Context, *report.Report) error {
+	return nil
+}
+
+// GroupCompleted is a no-op for Teams.
+func (c *TeamsClient) GroupCompleted(context.Context, *report.Report, report.Group) error {
+	return nil
+}
+
+// Finished posts the outcome of the run. Successful runs are only posted if NotifySuccess is set.
+func (c *TeamsClient) Finished(ctx context.Context, rep *report.Report, runErr error) error {
+	if runErr == nil && !c.NotifySuccess {
+		return nil
+	}
+
+	body, err := json.Marshal(c.message(rep, runErr))
+	if err != nil {
+		return fmt.Errorf("encoding Teams message: %w", err)
+	}
+
+	return postJSON(ctx, c.Client, c.WebhookURL, body, nil)
+}
+
+// teamsMessage is the incoming webhook envelope for a single Adaptive Card.
+type teamsMessage struct {
+	Type        string            `json:"type"`
+	Attachments []teamsAttachment `json:"attachments"`
+}
+
+type teamsAttachment struct {
+	ContentType string    `json:"contentType"`
+	Content     teamsCard `json:"content"`
+}
+
+type teamsCard struct {
+	Schema  string           `json:"$schema"`
+	Type    string           `json:"type"`
+	Version string           `json:"version"`
+	Body    []map[string]any `json:"body"`
+}
+
+// message builds the Adaptive Card describing the outcome of the run.
+func (c *TeamsClient) message(rep *report.Report, runErr error) teamsMessage {
+	heading := map[string]any{
+		"type":   "TextBlock",
+		"text":   title(c.Environment, rep.Action, runErr),
+		"size":   "Large",
+		"weight": "Bolder",
+		"wrap":   true,
+		"color":  "Good",
+	}
+	if runErr != nil {
+		heading["color"] = "Attention"
+	}
+
+	facts := []map[string]string{
+		{"title": "Environment", "value": c.Environment},
+		{"title": "Scaling Type", "value": rep.Action},
+		{"title": "Run ID", "value": rep.RunID},
+		{"title": "Duration", "value": rep.Duration().Round(time.Second).String()},
+		{"title": "Resources scaled", "value": fmt.Sprint(len(rep.Resources))},
+		{"title": "Skipped", "value": fmt.Sprint(len(rep.Skipped))},
+	}
+
+	body := []map[string]any{
+		heading,
+		{"type": "FactSet", "facts": facts},
+	}
+
+	if runErr != nil {
+		body = append(body, map[string]any{"type": "TextBlock", "text": truncate(runErr.Error(), 2800), "wrap": true, "fontType": "Monospace"})
+	}
+
+	if len(rep.Groups) > 0 {
+		body = append(body, map[string]any{"type": "TextBlock", "text": "**Groups**\n\n" + strings.Join(capLines(groupLines(rep)), "\n\n"), "wrap": true})
+	}
+
+	if len(rep.Skipped) > 0 {
+		body = append(body, map[string]any{"type": "TextBlock", "text": "**Skipped**\n\n" + strings.Join(capLines(skippedLines(rep)), "\n\n"), "wrap": true})
+	}
+
+	if len(rep.Alerting) > 0 {
+		body = append(body, map[string]any{"type": "TextBlock", "text": "**Alerting**\n\n" + strings.Join(alertingLines(rep), "\n\n"), "wrap": true})
+	}
+
+	if len(rep.Infrastructure) > 0 {
+		body = append(body, map[string]any{"type": "TextBlock", "text": "**Infrastructure**\n\n" + strings.Join(capLines(infrastructureLines(rep)), "\n\n"), "wrap": true})
+	}
+
+	return teamsMessage{
+		Type: "message",
+		Attachments: []teamsAttachment{{
+			ContentType: "application/vnd.microsoft.card.adaptive",
+			Content: teamsCard{
+				Schema:  "http://adaptivecards.io/schemas/adaptive-card.json",
+				Type:    "AdaptiveCard",
+				Version: "1.4",
+				Body:    body,
+			},
+		}},
+	}
+}
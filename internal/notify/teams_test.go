@@ -0,0 +1,61 @@
+package notify
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/michaelprice232/eks-env-scaledown/internal/report"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTeamsClientFinished(t *testing.T) {
+	var received []teamsMessage
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg teamsMessage
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&msg))
+		received = append(received, msg)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(srv.Close)
+
+	client := &TeamsClient{Client: srv.Client(), WebhookURL: srv.URL, Environment: "staging"}
+	rep := report.New("ScaleDown")
+	rep.AddGroup(1, 0, 2)
+
+	require.NoError(t, client.Started(t.Context(), rep))
+	require.NoError(t, client.GroupCompleted(t.Context(), rep, rep.Groups[0]))
+	require.NoError(t, client.Finished(t.Context(), rep, nil))
+	assert.Empty(t, received, "Expected only failures to be posted by default")
+
+	require.NoError(t, client.Finished(t.Context(), rep, errors.New("boom")))
+	require.Len(t, received, 1)
+
+	card := received[0].Attachments[0]
+	assert.Equal(t, "application/vnd.microsoft.card.adaptive", card.ContentType)
+	assert.Equal(t, "AdaptiveCard", card.Content.Type)
+	assert.Equal(t, "Problem scaling staging (ScaleDown)", card.Content.Body[0]["text"])
+	assert.Equal(t, "Attention", card.Content.Body[0]["color"])
+	assert.Equal(t, "boom", card.Content.Body[2]["text"])
+
+	client.NotifySuccess = true
+	require.NoError(t, client.Finished(t.Context(), rep, nil))
+	require.Len(t, received, 2)
+	assert.Equal(t, "staging: ScaleDown complete", received[1].Attachments[0].Content.Body[0]["text"])
+}
+
+func TestTeamsClientErrorResponse(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "invalid webhook", http.StatusBadRequest)
+	}))
+	t.Cleanup(srv.Close)
+
+	client := &TeamsClient{Client: srv.Client(), WebhookURL: srv.URL, Environment: "staging"}
+	err := client.Finished(t.Context(), report.New("ScaleUp"), errors.New("boom"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid webhook")
+}
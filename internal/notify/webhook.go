@@ -0,0 +1,144 @@
+package notify
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	log "log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/michaelprice232/eks-env-scaledown/internal/report"
+)
+
+const (
+	// SignatureHeader carries the hex-encoded HMAC-SHA256 of the request body, prefixed with "sha256=".
+	SignatureHeader = "X-Eks-Env-Scaledown-Signature-256"
+	// EventHeader carries the event type so receivers can route without decoding the body.
+	EventHeader = "X-Eks-Env-Scaledown-Event"
+)
+
+// Webhook event types.
+const (
+	EventStarted        = "started"
+	EventGroupCompleted = "group_completed"
+	EventFinished       = "finished"
+)
+
+// WebhookClient POSTs every event as JSON to a generic HTTP endpoint. When a secret is configured
+// each request is signed so the receiver can verify it came from this app.
+type WebhookClient struct {
+	Client      *http.Client
+	URL         string
+	Secret      string
+	Environment string
+}
+
+// WebhookEvent is the JSON payload sent for each event. Report is included with the finished event.
+type WebhookEvent struct {
+	Event       string         `json:"event"`
+	Timestamp   time.Time      `json:"timestamp"`
+	Environment string         `json:"environment"`
+	Action      string         `json:"action"`
+	RunID       string         `json:"runId"`
+	Group       *report.Group  `json:"group,omitempty"`
+	Success     *bool          `json:"success,omitempty"`
+	Error       string         `json:"error,omitempty"`
+	Report      *report.Report `json:"report,omitempty"`
+}
+
+// NewWebhookClient returns WebhookClient, or nil if WEBHOOK_URL is not set. An error is returned if
+// the URL is not a valid http(s) URL.
+func NewWebhookClient() (*WebhookClient, error) {
+	rawURL := os.Getenv("WEBHOOK_URL")
+	if rawURL == "" {
+		log.Debug("WEBHOOK_URL not set. Disabling webhook notifications")
+		return nil, nil
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("WEBHOOK_URL %q is not a valid http(s) URL", rawURL)
+	}
+
+	secret := os.Getenv("WEBHOOK_SECRET")
+	if secret == "" {
+		log.Warn("WEBHOOK_SECRET not set. Webhook requests will not be signed")
+	}
+
+	return &WebhookClient{
+		Client:      &http.Client{Timeout: httpTimeout},
+		URL:         rawURL,
+		Secret:      secret,
+		Environment: os.Getenv("ENVIRONMENT"),
+	}, nil
+}
+
+// Name identifies the notifier in logs.
+func (c *WebhookClient) Name() string {
+	return "webhook"
+}
+
+// Started sends the started event.
+func (c *WebhookClient) Started(ctx context.Context, rep *report.Report) error {
+	return c.send(ctx, c.event(EventStarted, rep))
+}
+
+// GroupCompleted sends the group_completed event.
+func (c *WebhookClient) GroupCompleted(ctx context.Context, rep *report.Report, g report.Group) error {
+	e := c.event(EventGroupCompleted, rep)
+	e.Group = &g
+
+	return c.send(ctx, e)
+}
+
+// Finished sends the finished event along with the full run report.
+func (c *WebhookClient) Finished(ctx context.Context, rep *report.Report, runErr error) error {
+	e := c.event(EventFinished, rep)
+	success := runErr == nil
+	e.Success = &success
+	e.Report = rep
+	if runErr != nil {
+		e.Error = runErr.Error()
+	}
+
+	return c.send(ctx, e)
+}
+
+func (c *WebhookClient) event(name string, rep *report.Report) WebhookEvent {
+	return WebhookEvent{
+		Event:       name,
+		Timestamp:   time.Now().UTC(),
+		Environment: c.Environment,
+		Action:      rep.Action,
+		RunID:       rep.RunID,
+	}
+}
+
+func (c *WebhookClient) send(ctx context.Context, e WebhookEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("encoding webhook event: %w", err)
+	}
+
+	headers := map[string]string{EventHeader: e.Event}
+	if c.Secret != "" {
+		headers[SignatureHeader] = Sign(c.Secret, body)
+	}
+
+	return postJSON(ctx, c.Client, c.URL, body, headers)
+}
+
+// Sign returns the signature header value for body: "sha256=" followed by the hex-encoded
+// HMAC-SHA256 of body keyed with secret. Receivers should recompute it and compare with hmac.Equal.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
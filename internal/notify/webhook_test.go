@@ -0,0 +1,89 @@
+package notify
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/michaelprice232/eks-env-scaledown/internal/report"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookClient(t *testing.T) {
+	var events []WebhookEvent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		assert.True(t, hmac.Equal([]byte(Sign("s3cret", body)), []byte(r.Header.Get(SignatureHeader))), "Expected a valid signature")
+
+		var e WebhookEvent
+		require.NoError(t, json.Unmarshal(body, &e))
+		assert.Equal(t, e.Event, r.Header.Get(EventHeader))
+		events = append(events, e)
+	}))
+	t.Cleanup(srv.Close)
+
+	client := &WebhookClient{Client: srv.Client(), URL: srv.URL, Secret: "s3cret", Environment: "staging"}
+	rep := report.New("ScaleUp")
+
+	require.NoError(t, client.Started(t.Context(), rep))
+	require.NoError(t, client.GroupCompleted(t.Context(), rep, report.Group{Number: 2, Resources: 4}))
+	require.NoError(t, client.Finished(t.Context(), rep, errors.New("boom")))
+
+	require.Len(t, events, 3)
+	assert.Equal(t, EventStarted, events[0].Event)
+	assert.Equal(t, rep.RunID, events[0].RunID)
+	assert.Equal(t, "staging", events[0].Environment)
+
+	assert.Equal(t, EventGroupCompleted, events[1].Event)
+	require.NotNil(t, events[1].Group)
+	assert.Equal(t, 4, events[1].Group.Resources)
+
+	assert.Equal(t, EventFinished, events[2].Event)
+	require.NotNil(t, events[2].Success)
+	assert.False(t, *events[2].Success)
+	assert.Equal(t, "boom", events[2].Error)
+	require.NotNil(t, events[2].Report)
+	assert.Equal(t, rep.RunID, events[2].Report.RunID)
+}
+
+func TestSign(t *testing.T) {
+	// Known value from: printf '{"event":"started"}' | openssl dgst -sha256 -hmac s3cret
+	assert.Equal(t, "sha256=5f164fde238d27bf871022531f3db2eb2e6bffd4f33d2090a3aa17b3746ad016", Sign("s3cret", []byte(`{"event":"started"}`)))
+}
+
+func TestNewWebhookClient(t *testing.T) {
+	tests := []struct {
+		name    string
+		url     string
+		wantNil bool
+		wantErr bool
+	}{
+		{name: "not set", url: "", wantNil: true},
+		{name: "valid", url: "https://hooks.example.com/scaledown"},
+		{name: "missing scheme", url: "hooks.example.com/scaledown", wantErr: true},
+		{name: "unsupported scheme", url: "ftp://hooks.example.com", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("WEBHOOK_URL", tc.url)
+			t.Setenv("WEBHOOK_SECRET", "s3cret")
+
+			client, err := NewWebhookClient()
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.wantNil, client == nil)
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package report
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	log "log/slog"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// HistoryConfigMapName is the ConfigMap which holds the most recent run reports.
+const HistoryConfigMapName = "eks-env-scaledown-history"
+
+const historyTimeout = time.Minute
+
+// historyKey orders the ConfigMap keys by start time so the oldest reports can be pruned first.
+func (r *Report) historyKey() string {
+	return fmt.Sprintf("%s-%s.json", r.StartedAt.UTC().Format("20060102T150405Z"), r.RunID)
+}
+
+// Save stores the report in the history ConfigMap in namespace, creating it if required
+// and pruning the oldest reports so that at most limit are retained.
+func (r *Report) Save(client kubernetes.Interface, namespace string, limit int) error {
+	if r == nil || limit <= 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), historyTimeout)
+	defer cancel()
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("encoding report: %w", err)
+	}
+
+	// RetryOnConflict expects the error to be returned unwrapped
+	// https://pkg.go.dev/k8s.io/client-go/util/retry@v0.33.0#RetryOnConflict
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, getErr := client.CoreV1().ConfigMaps(namespace).Get(ctx, HistoryConfigMapName, metav1.GetOptions{})
+		if k8serrors.IsNotFound(getErr) {
+			cm = &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      HistoryConfigMapName,
+					Namespace: namespace,
+					Labels:    map[string]string{"app": "eks-env-scaledown"},
+				},
+				Data: map[string]string{r.historyKey(): string(data)},
+			}
+			_, createErr := client.CoreV1().ConfigMaps(namespace).Create(ctx, cm, metav1.CreateOptions{})
+			return createErr
+		}
+		if getErr != nil {
+			return getErr
+		}
+
+		if cm.Data == nil {
+			cm.Data = make(map[string]string)
+		}
+		cm.Data[r.historyKey()] = string(data)
+		pruneHistory(cm.Data, limit)
+
+		_, updateErr := client.CoreV1().ConfigMaps(namespace).Update(ctx, cm, metav1.UpdateOptions{})
+		return updateErr
+	})
+}
+
+// History returns the run reports in the history ConfigMap in namespace, oldest first. Reports of runs which are
+// still in progress have a zero FinishedAt.
+func History(ctx context.Context, client kubernetes.Interface, namespace string) ([]*Report, error) {
+	cm, err := client.CoreV1().ConfigMaps(namespace).Get(ctx, HistoryConfigMapName, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("getting the history ConfigMap: %w", err)
+	}
+
+	keys := make([]string, 0, len(cm.Data))
+	for k := range cm.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	reports := make([]*Report, 0, len(keys))
+	for _, k := range keys {
+		var r Report
+		if err = json.Unmarshal([]byte(cm.Data[k]), &r); err != nil {
+			log.Warn("Skipping run report which can't be decoded", "key", k, "error", err)
+			continue
+		}
+		reports = append(reports, &r)
+	}
+
+	return reports, nil
+}
+
+// pruneHistory deletes the oldest entries from data until at most limit remain.
+func pruneHistory(data map[string]string, limit int) {
+	if len(data) <= limit {
+		return
+	}
+
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys[:len(keys)-limit] {
+		log.Debug("Pruning run report from history", "key", k)
+		delete(data, k)
+	}
+}
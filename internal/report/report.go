@@ -0,0 +1,293 @@
+// Package report records what a single scale run changed so it can be emitted as JSON,
+// kept as an in-cluster history and summarised in notifications.
+//
+// Every method is safe to call on a nil *Report, which disables recording.
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Group records how long a single startup group took to scale.
+type Group struct {
+	Number          int     `json:"number"`
+	DurationSeconds float64 `json:"durationSeconds"`
+	Resources       int     `json:"resources"`
+}
+
+// Phase records how long a stage of the run took, such as disabling alerts or scaling the workloads.
+type Phase struct {
+	Name            string  `json:"name"`
+	DurationSeconds float64 `json:"durationSeconds"`
+}
+
+// Resource records a Deployment or StatefulSet whose replica count was changed.
+type Resource struct {
+	Group          int    `json:"group"`
+	Type           string `json:"type"`
+	Namespace      string `json:"namespace"`
+	Name           string `json:"name"`
+	ReplicasBefore int32  `json:"replicasBefore"`
+	ReplicasAfter  int32  `json:"replicasAfter"`
+}
+
+// Skipped records an object which was deliberately left untouched and why.
+type Skipped struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+	Reason    string `json:"reason"`
+}
+
+// ObjectChange records a change to a CronJob, ScaledObject or Pod.
+type ObjectChange struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Change    string `json:"change"`
+}
+
+// AlertingAction records an alerting integration which was enabled or disabled.
+type AlertingAction struct {
+	Integration string   `json:"integration"`
+	Action      string   `json:"action"`
+	Targets     []string `json:"targets,omitempty"`
+}
+
+// InfrastructureChange records a cloud resource, such as a database, which was stopped or started.
+type InfrastructureChange struct {
+	Kind   string `json:"kind"`
+	Name   string `json:"name"`
+	Change string `json:"change"`
+}
+
+// CalendarDecision records whether the calendar of dated overrides let the run go ahead, and why.
+type CalendarDecision struct {
+	Decision string     `json:"decision"`
+	Reason   string     `json:"reason,omitempty"`
+	Until    *time.Time `json:"until,omitempty"`
+}
+
+// Drift records a workload found scaled back up whilst the environment was down, which was scaled down again.
+// OriginalReplicas is the count it is restored to at scale up, updated when its owner changed its desired count
+// overnight. Manager is the field manager which last set its replicas, if known.
+type Drift struct {
+	Type                    string `json:"type"`
+	Namespace               string `json:"namespace"`
+	Name                    string `json:"name"`
+	Replicas                int32  `json:"replicas"`
+	ScaledTo                int32  `json:"scaledTo"`
+	OriginalReplicas        int32  `json:"originalReplicas"`
+	OriginalReplicasChanged bool   `json:"originalReplicasChanged"`
+	Manager                 string `json:"manager,omitempty"`
+}
+
+// Report is the record of a single scale run.
+type Report struct {
+	RunID          string                 `json:"runId"`
+	Action         string                 `json:"action"`
+	StartedAt      time.Time              `json:"startedAt"`
+	FinishedAt     time.Time              `json:"finishedAt"`
+	Success        bool                   `json:"success"`
+	Calendar       *CalendarDecision      `json:"calendar,omitempty"`
+	Phases         []Phase                `json:"phases"`
+	PlannedGroups  []int                  `json:"plannedGroups,omitempty"`
+	Groups         []Group                `json:"groups"`
+	Resources      []Resource             `json:"resources"`
+	Skipped        []Skipped              `json:"skipped"`
+	Drift          []Drift                `json:"drift,omitempty"`
+	CronJobs       []ObjectChange         `json:"cronJobs"`
+	ScaledObjects  []ObjectChange         `json:"scaledObjects"`
+	Pods           []ObjectChange         `json:"pods"`
+	Alerting       []AlertingAction       `json:"alerting"`
+	Infrastructure []InfrastructureChange `json:"infrastructure"`
+	Errors         []string               `json:"errors"`
+
+	groupHooks []func(Group)
+}
+
+// New returns a Report for a run of the given action, stamped with a unique run ID and the current time.
+func New(action string) *Report {
+	return &Report{
+		RunID:     uuid.NewString(),
+		Action:    action,
+		StartedAt: time.Now().UTC(),
+	}
+}
+
+// SetPlannedGroups records the startup groups the run will scale, in order, so its progress can be followed.
+func (r *Report) SetPlannedGroups(groups []int) {
+	if r == nil {
+		return
+	}
+	r.PlannedGroups = groups
+}
+
+// SetCalendar records the calendar's decision for the run. until is when a deferred run can go ahead.
+func (r *Report) SetCalendar(decision, reason string, until time.Time) {
+	if r == nil {
+		return
+	}
+	r.Calendar = &CalendarDecision{Decision: decision, Reason: reason}
+	if !until.IsZero() {
+		r.Calendar.Until = &until
+	}
+}
+
+// AddGroup records a completed startup group.
+func (r *Report) AddGroup(number int, duration time.Duration, resources int) {
+	if r == nil {
+		return
+	}
+	g := Group{Number: number, DurationSeconds: duration.Seconds(), Resources: resources}
+	r.Groups = append(r.Groups, g)
+
+	for _, hook := range r.groupHooks {
+		hook(g)
+	}
+}
+
+// OnGroup registers fn to be called each time a startup group completes, for progress notifications.
+func (r *Report) OnGroup(fn func(Group)) {
+	if r == nil {
+		return
+	}
+	r.groupHooks = append(r.groupHooks, fn)
+}
+
+// AddPhase records a completed stage of the run.
+func (r *Report) AddPhase(name string, duration time.Duration) {
+	if r == nil {
+		return
+	}
+	r.Phases = append(r.Phases, Phase{Name: name, DurationSeconds: duration.Seconds()})
+}
+
+// AddResource records a workload whose replica count was changed.
+func (r *Report) AddResource(res Resource) {
+	if r == nil {
+		return
+	}
+	r.Resources = append(r.Resources, res)
+}
+
+// AddSkipped records an object which was deliberately left untouched.
+func (r *Report) AddSkipped(s Skipped) {
+	if r == nil {
+		return
+	}
+	r.Skipped = append(r.Skipped, s)
+}
+
+// AddDrift records a workload which had drifted back up and was scaled down again.
+func (r *Report) AddDrift(d Drift) {
+	if r == nil {
+		return
+	}
+	r.Drift = append(r.Drift, d)
+}
+
+// AddCronJob records a suspended or resumed CronJob.
+func (r *Report) AddCronJob(namespace, name, change string) {
+	if r == nil {
+		return
+	}
+	r.CronJobs = append(r.CronJobs, ObjectChange{Namespace: namespace, Name: name, Change: change})
+}
+
+// AddScaledObject records a paused or resumed Keda ScaledObject.
+func (r *Report) AddScaledObject(namespace, name, change string) {
+	if r == nil {
+		return
+	}
+	r.ScaledObjects = append(r.ScaledObjects, ObjectChange{Namespace: namespace, Name: name, Change: change})
+}
+
+// AddPod records a terminated standalone pod.
+func (r *Report) AddPod(namespace, name string) {
+	if r == nil {
+		return
+	}
+	r.Pods = append(r.Pods, ObjectChange{Namespace: namespace, Name: name, Change: "terminated"})
+}
+
+// AddAlerting records an alerting integration which was enabled or disabled.
+func (r *Report) AddAlerting(a AlertingAction) {
+	if r == nil {
+		return
+	}
+	r.Alerting = append(r.Alerting, a)
+}
+
+// AddInfrastructure records a cloud resource which was stopped or started.
+func (r *Report) AddInfrastructure(kind, name, change string) {
+	if r == nil {
+		return
+	}
+	r.Infrastructure = append(r.Infrastructure, InfrastructureChange{Kind: kind, Name: name, Change: change})
+}
+
+// AddError records an error encountered during the run.
+func (r *Report) AddError(msg string) {
+	if r == nil {
+		return
+	}
+	r.Errors = append(r.Errors, msg)
+}
+
+// Finish stamps the end time and marks the run as successful if no errors were recorded.
+func (r *Report) Finish() {
+	if r == nil {
+		return
+	}
+	r.FinishedAt = time.Now().UTC()
+	r.Success = len(r.Errors) == 0
+}
+
+// Duration returns how long the run took, or how long it has been running if it has not finished.
+func (r *Report) Duration() time.Duration {
+	if r == nil {
+		return 0
+	}
+	if r.FinishedAt.IsZero() {
+		return time.Since(r.StartedAt)
+	}
+
+	return r.FinishedAt.Sub(r.StartedAt)
+}
+
+// Summary returns a short human-readable description of the run for notifications.
+func (r *Report) Summary() string {
+	if r == nil {
+		return ""
+	}
+	if r.Calendar != nil && r.Calendar.Decision == "skip" {
+		return fmt.Sprintf("skipped by the calendar: %s", r.Calendar.Reason)
+	}
+	if r.Calendar != nil && r.Calendar.Decision == "defer" && r.Calendar.Until != nil {
+		return fmt.Sprintf("deferred by the calendar until %s: %s", r.Calendar.Until.Format(time.RFC3339), r.Calendar.Reason)
+	}
+	if r.Action == "Enforce" {
+		return fmt.Sprintf("%d drifted workload(s) scaled back down, %d skipped in %s", len(r.Drift), len(r.Skipped), r.Duration().Round(time.Second))
+	}
+
+	return fmt.Sprintf("%d resource(s) scaled across %d group(s), %d skipped, %d CronJob(s), %d ScaledObject(s), %d pod(s) terminated in %s",
+		len(r.Resources), len(r.Groups), len(r.Skipped), len(r.CronJobs), len(r.ScaledObjects), len(r.Pods), r.Duration().Round(time.Second))
+}
+
+// WriteJSON writes the report to w as a single line of JSON.
+func (r *Report) WriteJSON(w io.Writer) error {
+	if r == nil {
+		return nil
+	}
+
+	if err := json.NewEncoder(w).Encode(r); err != nil {
+		return fmt.Errorf("encoding report: %w", err)
+	}
+
+	return nil
+}
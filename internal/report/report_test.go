@@ -0,0 +1,161 @@
+package report
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestNilReportIsNoOp(t *testing.T) {
+	var r *Report
+
+	assert.NotPanics(t, func() {
+		r.OnGroup(func(Group) {})
+		r.SetPlannedGroups([]int{1, 100})
+		r.SetCalendar("skip", "Bank holiday", time.Time{})
+		r.AddGroup(1, time.Second, 2)
+		r.AddResource(Resource{Name: "nginx"})
+		r.AddSkipped(Skipped{Name: "nginx"})
+		r.AddDrift(Drift{Name: "nginx"})
+		r.AddCronJob("ns", "job", "suspended")
+		r.AddScaledObject("ns", "so", "paused")
+		r.AddPod("ns", "pod")
+		r.AddAlerting(AlertingAction{Integration: "cloudwatch"})
+		r.AddInfrastructure("rds-instance", "staging-db", "stopped")
+		r.AddError("boom")
+		r.Finish()
+		assert.Empty(t, r.Summary())
+		assert.NoError(t, r.WriteJSON(&bytes.Buffer{}))
+		assert.NoError(t, r.Save(fake.NewClientset(), "eks-env-scaledown", 5))
+	})
+}
+
+func TestFinish(t *testing.T) {
+	t.Run("success when no errors were recorded", func(t *testing.T) {
+		r := New("ScaleUp")
+		r.Finish()
+		assert.True(t, r.Success)
+		assert.False(t, r.FinishedAt.IsZero())
+	})
+
+	t.Run("failure when an error was recorded", func(t *testing.T) {
+		r := New("ScaleUp")
+		r.AddError("boom")
+		r.Finish()
+		assert.False(t, r.Success)
+	})
+}
+
+func TestWriteJSON(t *testing.T) {
+	r := New("ScaleDown")
+	r.AddResource(Resource{Group: 2, Type: "deployment", Namespace: "web", Name: "nginx", ReplicasBefore: 3, ReplicasAfter: 0})
+	r.Finish()
+
+	var buf bytes.Buffer
+	require.NoError(t, r.WriteJSON(&buf))
+
+	var decoded Report
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &decoded))
+	assert.Equal(t, r.RunID, decoded.RunID)
+	assert.Equal(t, "ScaleDown", decoded.Action)
+	assert.Equal(t, r.Resources, decoded.Resources)
+}
+
+func TestSetCalendar(t *testing.T) {
+	r := New("ScaleUp")
+	r.SetCalendar("skip", "Bank holiday", time.Time{})
+	assert.Nil(t, r.Calendar.Until)
+	assert.Equal(t, "skipped by the calendar: Bank holiday", r.Summary())
+
+	until := time.Date(2026, 3, 12, 23, 0, 0, 0, time.UTC)
+	r = New("ScaleDown")
+	r.SetCalendar("defer", "Release rehearsal", until)
+	assert.Equal(t, &until, r.Calendar.Until)
+	assert.Equal(t, "deferred by the calendar until 2026-03-12T23:00:00Z: Release rehearsal", r.Summary())
+}
+
+func TestAddDrift(t *testing.T) {
+	r := New("Enforce")
+	r.AddDrift(Drift{Type: "deployment", Namespace: "web", Name: "nginx", Replicas: 3, OriginalReplicas: 3})
+	r.Finish()
+
+	require.Len(t, r.Drift, 1)
+	assert.Contains(t, r.Summary(), "1 drifted workload(s) scaled back down")
+
+	r = New("ScaleDown")
+	var buf bytes.Buffer
+	require.NoError(t, r.WriteJSON(&buf))
+	assert.NotContains(t, buf.String(), "drift", "Expected the drift to be omitted from the reports of other runs")
+}
+
+func TestSave(t *testing.T) {
+	client := fake.NewClientset()
+	start := time.Date(2026, 1, 1, 19, 0, 0, 0, time.UTC)
+
+	for i := range 4 {
+		r := New("ScaleDown")
+		r.StartedAt = start.Add(time.Duration(i) * time.Hour)
+		r.Finish()
+		require.NoError(t, r.Save(client, "eks-env-scaledown", 3))
+	}
+
+	cm, err := client.CoreV1().ConfigMaps("eks-env-scaledown").Get(context.Background(), HistoryConfigMapName, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Len(t, cm.Data, 3, "Expected the oldest report to be pruned")
+
+	for k := range cm.Data {
+		assert.NotContains(t, k, "20260101T190000Z", "Expected the oldest report to be the one pruned")
+	}
+}
+
+func TestHistory(t *testing.T) {
+	client := fake.NewClientset()
+
+	reports, err := History(t.Context(), client, "eks-env-scaledown")
+	require.NoError(t, err)
+	assert.Empty(t, reports, "Expected no reports before the history ConfigMap exists")
+
+	start := time.Date(2026, 1, 1, 19, 0, 0, 0, time.UTC)
+	for i, action := range []string{"ScaleUp", "ScaleDown"} {
+		r := New(action)
+		r.StartedAt = start.Add(time.Duration(-i) * time.Hour)
+		r.SetPlannedGroups([]int{0, 100})
+		require.NoError(t, r.Save(client, "eks-env-scaledown", 3))
+	}
+
+	reports, err = History(t.Context(), client, "eks-env-scaledown")
+	require.NoError(t, err)
+	require.Len(t, reports, 2)
+	assert.Equal(t, "ScaleDown", reports[0].Action, "Expected the oldest report first")
+	assert.Equal(t, []int{0, 100}, reports[1].PlannedGroups)
+	assert.True(t, reports[1].FinishedAt.IsZero())
+}
+
+func TestSaveDisabled(t *testing.T) {
+	client := fake.NewClientset()
+
+	require.NoError(t, New("ScaleUp").Save(client, "eks-env-scaledown", 0))
+
+	_, err := client.CoreV1().ConfigMaps("eks-env-scaledown").Get(context.Background(), HistoryConfigMapName, metav1.GetOptions{})
+	assert.Error(t, err, "Expected no history ConfigMap when the limit is zero")
+}
+
+func TestOnGroup(t *testing.T) {
+	r := New("ScaleUp")
+
+	var got []Group
+	r.OnGroup(func(g Group) { got = append(got, g) })
+	r.AddGroup(0, 2*time.Second, 3)
+	r.AddGroup(100, time.Second, 1)
+
+	require.Len(t, got, 2)
+	assert.Equal(t, Group{Number: 0, DurationSeconds: 2, Resources: 3}, got[0])
+	assert.Equal(t, 100, got[1].Number)
+}
@@ -7,13 +7,14 @@ import (
 	"time"
 
 	"github.com/michaelprice232/eks-env-scaledown/config"
+	"github.com/michaelprice232/eks-env-scaledown/internal/report"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/util/retry"
 )
 
-func (s *Service) updateCronJobs() error {
-	ctx, cancelCtx := context.WithTimeout(context.Background(), timeout)
+func (s *Service) updateCronJobs(ctx context.Context) error {
+	ctx, cancelCtx := context.WithTimeout(ctx, timeout)
 	defer cancelCtx()
 
 	cjs, err := s.conf.K8sClient.BatchV1().CronJobs("").List(ctx, metav1.ListOptions{})
@@ -22,7 +23,9 @@ func (s *Service) updateCronJobs() error {
 	}
 
 	for _, cj := range cjs.Items {
+		var change string
 		retryErr := retry.RetryOnConflict(s.retryBackoff, func() error {
+			change = ""
 			result, getErr := s.conf.K8sClient.BatchV1().CronJobs(cj.Namespace).Get(ctx, cj.Name, metav1.GetOptions{})
 			if getErr != nil {
 				return getErr
@@ -30,6 +33,12 @@ func (s *Service) updateCronJobs() error {
 
 			if appNameLabel, found := result.Labels["app"]; found && appNameLabel == cronJobAppName {
 				log.Debug("Skipping CronJob as it matches the app label which manages this app", "CronJob", cj.Name, "namespace", cj.Namespace)
+				s.report.AddSkipped(report.Skipped{Kind: "cronjob", Namespace: cj.Namespace, Name: cj.Name, Reason: "manages this app"})
+				return nil
+			}
+
+			if s.conf.Action == config.ScaleDown && s.namespaceKeptAlive(cj.Namespace) {
+				log.Debug("Skipping CronJob as its namespace is kept alive", "CronJob", cj.Name, "namespace", cj.Namespace)
 				return nil
 			}
 
@@ -41,9 +50,11 @@ func (s *Service) updateCronJobs() error {
 			if s.conf.Action == config.ScaleUp {
 				if value, found := result.Annotations[cronJobWasDisabledAnnotationKey]; found && value == cronJobWasDisabledValue {
 					log.Warn("CronJob was previously disabled. Skipping", "CronJob", cj.Name, "namespace", cj.Namespace)
+					s.report.AddSkipped(report.Skipped{Kind: "cronjob", Namespace: cj.Namespace, Name: cj.Name, Reason: "suspended before the scale down"})
 					return nil
 				}
 				result.Spec.Suspend = boolPtr(false)
+				change = "resumed"
 			}
 
 			if s.conf.Action == config.ScaleDown {
@@ -53,6 +64,7 @@ func (s *Service) updateCronJobs() error {
 					result.Annotations[cronJobWasDisabledAnnotationKey] = cronJobWasDisabledValue
 				}
 				result.Spec.Suspend = boolPtr(true)
+				change = "suspended"
 			}
 
 			result.Annotations[updatedAtAnnotationKey] = time.Now().Format(time.RFC3339)
@@ -63,6 +75,9 @@ func (s *Service) updateCronJobs() error {
 		if retryErr != nil {
 			return fmt.Errorf("updating CronJob %s in namespace %s: %w", cj.Name, cj.Namespace, retryErr)
 		}
+		if change != "" {
+			s.report.AddCronJob(cj.Namespace, cj.Name, change)
+		}
 	}
 
 	return nil
@@ -94,7 +94,7 @@ func Test_updateCronJobs(t *testing.T) {
 				})
 			}
 
-			err := s.updateCronJobs()
+			err := s.updateCronJobs(context.Background())
 			if tc.wantErr {
 				assert.Error(t, err)
 			} else {
@@ -0,0 +1,170 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	log "log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/michaelprice232/eks-env-scaledown/config"
+	"github.com/michaelprice232/eks-env-scaledown/internal/report"
+	"github.com/michaelprice232/eks-env-scaledown/internal/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The label Helm sets on the workloads of its releases.
+const (
+	helmManagedByLabelKey = "app.kubernetes.io/managed-by"
+	helmManagedByValue    = "Helm"
+)
+
+// envEnforce scales back down the workloads which have drifted above their scale down replica count whilst the
+// environment is down, such as after a helm upgrade or an operator's reconciliation. Kept alive workloads are left running.
+func (s *Service) envEnforce(ctx context.Context) error {
+	log.Info("Enforcing the environment's scale down")
+
+	if err := tracing.WithSpan(ctx, "load namespace keep-alives", s.loadNamespaceKeepAlives); err != nil {
+		if err = s.handleStepError("loading namespace keep-alives", err); err != nil {
+			return fmt.Errorf("loading namespace keep-alives: %w", err)
+		}
+	}
+
+	if err := tracing.WithSpan(ctx, "build startup order", s.buildStartUpOrder); err != nil {
+		return fmt.Errorf("building startup order: %w", err)
+	}
+	s.startUpOrder = drifted(s.startUpOrder)
+
+	if len(s.startUpOrder) == 0 {
+		log.Info("No workloads have drifted from their scale down")
+		return nil
+	}
+
+	scaleOrder := make([]int, 0, len(s.startUpOrder))
+	for order := range s.startUpOrder {
+		scaleOrder = append(scaleOrder, order)
+	}
+
+	sort.Sort(sort.Reverse(sort.IntSlice(scaleOrder)))
+	log.Debug("Enforce order", "order", scaleOrder)
+	s.report.SetPlannedGroups(scaleOrder)
+
+	for _, order := range scaleOrder {
+		log.Info("Scaling down the drifted workloads in group", "group", order, "resources", len(s.startUpOrder[order]))
+		start := time.Now()
+		err := tracing.WithSpan(ctx, "scale down group", func(ctx context.Context) error {
+			return s.scaleDownGroup(ctx, order)
+		}, attribute.Int("group", order), attribute.Int("resources", len(s.startUpOrder[order])))
+		if err != nil {
+			return fmt.Errorf("scaling down group %d: %w", order, err)
+		}
+		s.report.AddGroup(order, time.Since(start), len(s.startUpOrder[order]))
+	}
+
+	return nil
+}
+
+// drifted returns the workloads in orders running more replicas than they are scaled down to, by startup group.
+func drifted(orders startUpOrder) startUpOrder {
+	result := make(startUpOrder)
+	for group, resources := range orders {
+		for _, r := range resources {
+			if r.ReplicaCount > r.ScaleDownReplicas {
+				result[group] = append(result[group], r)
+			}
+		}
+	}
+
+	return result
+}
+
+// newDrift describes the drift of a workload being scaled back down by an enforce run, or returns nil for other runs.
+// OriginalReplicas, restored at scale up, becomes the count it drifted to only when the change came from its owner,
+// such as a Helm release or an operator, as its desired count has changed. A change by hand, such as a kubectl scale
+// whilst debugging, keeps the count recorded by the scale down.
+func (s *Service) newDrift(r *k8sResource, obj metav1.Object, replicas int32) *report.Drift {
+	if s.conf.Action != config.Enforce {
+		return nil
+	}
+
+	drift := &report.Drift{
+		Type:             r.ResourceType,
+		Namespace:        r.Namespace,
+		Name:             r.Name,
+		Replicas:         replicas,
+		ScaledTo:         r.ScaleDownReplicas,
+		OriginalReplicas: replicas,
+		Manager:          replicasManager(obj),
+	}
+
+	recorded, err := strconv.ParseInt(obj.GetAnnotations()[originalReplicasAnnotationKey], 10, 32)
+	switch {
+	case err != nil:
+		// Nothing was recorded, such as for a workload created whilst the environment is down
+		drift.OriginalReplicasChanged = true
+	case int32(recorded) == replicas:
+	case ownerChangedReplicas(obj, drift.Manager):
+		drift.OriginalReplicasChanged = true
+	default:
+		drift.OriginalReplicas = int32(recorded)
+	}
+
+	return drift
+}
+
+// replicasManager returns the field manager which last set the workload's replicas, or "" if it isn't known.
+func replicasManager(obj metav1.Object) string {
+	var (
+		manager string
+		latest  time.Time
+	)
+	for _, mf := range obj.GetManagedFields() {
+		if mf.FieldsV1 == nil {
+			continue
+		}
+
+		var fields struct {
+			Spec map[string]any `json:"f:spec"`
+		}
+		if err := json.Unmarshal(mf.FieldsV1.Raw, &fields); err != nil {
+			continue
+		}
+		if _, found := fields.Spec["f:replicas"]; !found {
+			continue
+		}
+
+		if manager == "" || (mf.Time != nil && mf.Time.After(latest)) {
+			manager = mf.Manager
+			if mf.Time != nil {
+				latest = mf.Time.Time
+			}
+		}
+	}
+
+	return manager
+}
+
+// ownerChangedReplicas reports whether the workload's replicas were last set by its owner rather than by hand. Without
+// a known field manager, a Helm managed workload is taken to have been changed by its release.
+func ownerChangedReplicas(obj metav1.Object, manager string) bool {
+	if manager != "" {
+		return !strings.HasPrefix(manager, "kubectl")
+	}
+
+	return obj.GetLabels()[helmManagedByLabelKey] == helmManagedByValue
+}
+
+// recordDrift logs and reports a workload which was scaled back down. A nil drift means there was none.
+func (s *Service) recordDrift(drift *report.Drift) {
+	if drift == nil {
+		return
+	}
+
+	log.Warn("Workload had drifted back up whilst the environment is down. Scaled it back down", "type", drift.Type, "resource", drift.Name, "Namespace", drift.Namespace, "replicas", drift.Replicas, "scaledTo", drift.ScaledTo, "originalReplicas", drift.OriginalReplicas, "originalReplicasChanged", drift.OriginalReplicasChanged, "manager", drift.Manager)
+	s.report.AddDrift(*drift)
+}
@@ -0,0 +1,105 @@
+package service
+
+import (
+	"io"
+	log "log/slog"
+	"testing"
+	"time"
+
+	"github.com/michaelprice232/eks-env-scaledown/config"
+	"github.com/michaelprice232/eks-env-scaledown/internal/report"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_envEnforce(t *testing.T) {
+	log.SetDefault(log.New(log.NewJSONHandler(io.Discard, &log.HandlerOptions{Level: log.LevelError})))
+
+	deployment := func(name string, replicas int32, annotations map[string]string) *appsv1.Deployment {
+		return &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "web", Annotations: annotations},
+			Spec:       appsv1.DeploymentSpec{Replicas: int32Ptr(replicas), Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": name}}},
+		}
+	}
+	scaledBy := func(d *appsv1.Deployment, manager string) *appsv1.Deployment {
+		d.ManagedFields = []metav1.ManagedFieldsEntry{
+			{Manager: "helm", Time: &metav1.Time{Time: time.Now().Add(-48 * time.Hour)}, FieldsV1: &metav1.FieldsV1{Raw: []byte(`{"f:spec":{"f:replicas":{},"f:template":{}}}`)}},
+			{Manager: manager, Time: &metav1.Time{Time: time.Now().Add(-time.Hour)}, Subresource: "scale", FieldsV1: &metav1.FieldsV1{Raw: []byte(`{"f:spec":{"f:replicas":{}}}`)}},
+		}
+		return d
+	}
+	helmRelease := func(d *appsv1.Deployment) *appsv1.Deployment {
+		d.Labels = map[string]string{helmManagedByLabelKey: helmManagedByValue}
+		return d
+	}
+
+	client := fake.NewClientset(
+		deployment("nginx", 3, map[string]string{originalReplicasAnnotationKey: "3"}),
+		helmRelease(deployment("api", 5, map[string]string{originalReplicasAnnotationKey: "2", startupOrderAnnotationKey: "1"})),
+		scaledBy(deployment("debug", 1, map[string]string{originalReplicasAnnotationKey: "3"}), "kubectl"),
+		scaledBy(deployment("operated", 4, map[string]string{originalReplicasAnnotationKey: "2"}), "my-operator"),
+		deployment("new", 1, nil),
+		deployment("worker", 0, map[string]string{originalReplicasAnnotationKey: "4"}),
+		deployment("reduced", 1, map[string]string{originalReplicasAnnotationKey: "3", scaleDownReplicasAnnotationKey: "1"}),
+		deployment("cache", 2, map[string]string{keepAliveAnnotationKey: time.Now().Add(time.Hour).UTC().Format(time.RFC3339)}),
+	)
+	rep := report.New(string(config.Enforce))
+	s := &Service{
+		conf:         config.Config{K8sClient: client, Action: config.Enforce, KeepAliveMax: 12 * time.Hour},
+		report:       rep,
+		retryBackoff: wait.Backoff{Duration: 10 * time.Millisecond, Factor: 1.0, Jitter: 0.1, Steps: 1},
+		skipPodWait:  true,
+	}
+
+	require.NoError(t, s.Run(t.Context()))
+
+	get := func(name string) *appsv1.Deployment {
+		d, err := client.AppsV1().Deployments("web").Get(t.Context(), name, metav1.GetOptions{})
+		require.NoError(t, err)
+		return d
+	}
+	for name, expected := range map[string]int32{"nginx": 0, "api": 0, "debug": 0, "operated": 0, "new": 0, "worker": 0, "reduced": 1, "cache": 2} {
+		assert.Equal(t, expected, *get(name).Spec.Replicas, "Unexpected replicas for %s", name)
+	}
+	assert.Equal(t, "5", get("api").Annotations[originalReplicasAnnotationKey], "Expected the changed desired count to be restored at scale up")
+	assert.Equal(t, "3", get("debug").Annotations[originalReplicasAnnotationKey], "Expected a change by hand to keep the recorded count")
+	assert.Equal(t, "4", get("operated").Annotations[originalReplicasAnnotationKey], "Expected a change by the workload's operator to be restored at scale up")
+	assert.Equal(t, "1", get("new").Annotations[originalReplicasAnnotationKey])
+	assert.Equal(t, "4", get("worker").Annotations[originalReplicasAnnotationKey], "Expected a workload which hasn't drifted to be left alone")
+
+	drift := make(map[string]report.Drift)
+	for _, d := range rep.Drift {
+		drift[d.Name] = d
+	}
+	require.Len(t, drift, 5)
+	assert.Equal(t, report.Drift{Type: "deployment", Namespace: "web", Name: "nginx", Replicas: 3, OriginalReplicas: 3}, drift["nginx"])
+	assert.Equal(t, report.Drift{Type: "deployment", Namespace: "web", Name: "api", Replicas: 5, OriginalReplicas: 5, OriginalReplicasChanged: true}, drift["api"])
+	assert.Equal(t, report.Drift{Type: "deployment", Namespace: "web", Name: "debug", Replicas: 1, OriginalReplicas: 3, Manager: "kubectl"}, drift["debug"])
+	assert.True(t, drift["operated"].OriginalReplicasChanged)
+	assert.True(t, drift["new"].OriginalReplicasChanged)
+
+	assert.Equal(t, []int{100, 1}, rep.PlannedGroups, "Expected only the groups with drifted workloads, in scale down order")
+	require.Len(t, rep.Skipped, 1)
+	assert.Equal(t, "cache", rep.Skipped[0].Name)
+}
+
+func Test_envEnforce_noDrift(t *testing.T) {
+	log.SetDefault(log.New(log.NewJSONHandler(io.Discard, &log.HandlerOptions{Level: log.LevelError})))
+
+	client := fake.NewClientset(&appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "nginx", Namespace: "web", Annotations: map[string]string{originalReplicasAnnotationKey: "3"}},
+		Spec:       appsv1.DeploymentSpec{Replicas: int32Ptr(0), Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "nginx"}}},
+	})
+	rep := report.New(string(config.Enforce))
+	s := &Service{conf: config.Config{K8sClient: client, Action: config.Enforce}, report: rep, skipPodWait: true}
+
+	require.NoError(t, s.Run(t.Context()))
+	assert.Empty(t, rep.Drift)
+	assert.Empty(t, rep.Groups)
+	assert.Empty(t, rep.Skipped, "Expected the workloads already scaled down not to be reported as skipped")
+}
@@ -0,0 +1,105 @@
+package service
+
+import (
+	"fmt"
+	log "log/slog"
+	"strings"
+)
+
+// Failure describes a single resource or auxiliary step which could not be scaled
+// whilst running in continue-on-error mode.
+type Failure struct {
+	Step         string `json:"step"`
+	ResourceType string `json:"resourceType,omitempty"`
+	Namespace    string `json:"namespace,omitempty"`
+	Name         string `json:"name,omitempty"`
+	Error        string `json:"error"`
+}
+
+func (f Failure) String() string {
+	if f.Name == "" {
+		return fmt.Sprintf("%s: %s", f.Step, f.Error)
+	}
+
+	return fmt.Sprintf("%s: %s %s/%s: %s", f.Step, f.ResourceType, f.Namespace, f.Name, f.Error)
+}
+
+// FailuresError is returned by Run when one or more failures were collected in
+// continue-on-error mode. Every failure is listed so a single notification covers the whole run.
+type FailuresError struct {
+	Failures []Failure
+}
+
+func (e *FailuresError) Error() string {
+	lines := make([]string, 0, len(e.Failures)+1)
+	lines = append(lines, fmt.Sprintf("%d failure(s) whilst scaling the environment:", len(e.Failures)))
+	for _, f := range e.Failures {
+		lines = append(lines, "- "+f.String())
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func groupStep(groupNumber int) string {
+	return fmt.Sprintf("group %d", groupNumber)
+}
+
+// handleResourceError decides whether a per-resource error aborts the run. The error is returned
+// unchanged unless continue-on-error mode is enabled and the resource is not marked as critical,
+// in which case it is recorded as a failure and the resource is excluded from any further waiting.
+func (s *Service) handleResourceError(groupNumber int, r *k8sResource, err error) error {
+	if !s.conf.ContinueOnError {
+		return err
+	}
+
+	if r.Critical {
+		log.Error("Critical workload failed. Aborting", "type", r.ResourceType, "resource", r.Name, "Namespace", r.Namespace, "error", err)
+		return fmt.Errorf("critical %s %s in Namespace %s: %w", r.ResourceType, r.Name, r.Namespace, err)
+	}
+
+	log.Error("Workload failed. Continuing as continue-on-error is enabled", "type", r.ResourceType, "resource", r.Name, "Namespace", r.Namespace, "error", err)
+	r.failed = true
+	s.recordFailure(Failure{
+		Step:         groupStep(groupNumber),
+		ResourceType: r.ResourceType,
+		Namespace:    r.Namespace,
+		Name:         r.Name,
+		Error:        err.Error(),
+	})
+
+	return nil
+}
+
+// handleWaitError records every resource in the group which did not reach the desired state
+// before the wait failed. done reports whether a resource had already reached it.
+func (s *Service) handleWaitError(groupNumber int, resources []*k8sResource, done func(*k8sResource) bool, err error) error {
+	for _, r := range resources {
+		if r.failed || done(r) {
+			continue
+		}
+
+		if handleErr := s.handleResourceError(groupNumber, r, err); handleErr != nil {
+			return handleErr
+		}
+	}
+
+	return nil
+}
+
+// handleStepError records a failed auxiliary step (CronJobs, Keda etc.) when continue-on-error
+// mode is enabled, otherwise the error is returned unchanged.
+func (s *Service) handleStepError(step string, err error) error {
+	if !s.conf.ContinueOnError {
+		return err
+	}
+
+	log.Error("Step failed. Continuing as continue-on-error is enabled", "step", step, "error", err)
+	s.recordFailure(Failure{Step: step, Error: err.Error()})
+
+	return nil
+}
+
+func (s *Service) recordFailure(f Failure) {
+	s.failures = append(s.failures, f)
+	s.report.AddError(f.String())
+}
@@ -0,0 +1,181 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io"
+	log "log/slog"
+	"testing"
+	"time"
+
+	"github.com/michaelprice232/eks-env-scaledown/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func Test_handleResourceError(t *testing.T) {
+	log.SetDefault(log.New(log.NewJSONHandler(io.Discard, &log.HandlerOptions{Level: log.LevelError})))
+
+	tests := []struct {
+		name            string
+		continueOnError bool
+		critical        bool
+		wantErr         bool
+		wantFailures    int
+	}{
+		{name: "continue-on-error disabled: abort", continueOnError: false, wantErr: true, wantFailures: 0},
+		{name: "continue-on-error enabled: record", continueOnError: true, wantErr: false, wantFailures: 1},
+		{name: "critical workload: abort", continueOnError: true, critical: true, wantErr: true, wantFailures: 0},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &Service{conf: config.Config{ContinueOnError: tc.continueOnError}}
+			r := &k8sResource{Name: "nginx", Namespace: "web", ResourceType: resourceTypeDeployment, Critical: tc.critical}
+
+			err := s.handleResourceError(2, r, errors.New("boom"))
+			if tc.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.True(t, r.failed, "Expected the resource to be excluded from further waiting")
+			}
+			assert.Len(t, s.failures, tc.wantFailures)
+		})
+	}
+}
+
+func Test_runGroupHook(t *testing.T) {
+	log.SetDefault(log.New(log.NewJSONHandler(io.Discard, &log.HandlerOptions{Level: log.LevelError})))
+
+	failing := func(context.Context, int) error { return errors.New("boom") }
+
+	tests := []struct {
+		name            string
+		hook            GroupHook
+		continueOnError bool
+		wantErr         bool
+		wantFailures    int
+	}{
+		{name: "no hook registered", hook: nil, wantErr: false, wantFailures: 0},
+		{name: "continue-on-error disabled: abort", hook: failing, continueOnError: false, wantErr: true, wantFailures: 0},
+		{name: "continue-on-error enabled: record", hook: failing, continueOnError: true, wantErr: false, wantFailures: 1},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &Service{conf: config.Config{ContinueOnError: tc.continueOnError}}
+
+			err := s.runGroupHook(t.Context(), tc.hook, "starting external resources before", 3)
+			if tc.wantErr {
+				assert.ErrorContains(t, err, "starting external resources before group 3")
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Len(t, s.failures, tc.wantFailures)
+		})
+	}
+}
+
+func Test_scaleUpGroup_continueOnError(t *testing.T) {
+	log.SetDefault(log.New(log.NewJSONHandler(io.Discard, &log.HandlerOptions{Level: log.LevelError})))
+
+	newDeployment := func(name string) *appsv1.Deployment {
+		return &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Namespace:   "web",
+				Annotations: map[string]string{originalReplicasAnnotationKey: "2"},
+			},
+			Spec: appsv1.DeploymentSpec{Replicas: int32Ptr(0)},
+		}
+	}
+
+	s := &Service{
+		startUpOrder: startUpOrder{
+			1: []*k8sResource{
+				{Name: "broken", Namespace: "web", ResourceType: resourceTypeDeployment},
+				{Name: "healthy", Namespace: "web", ResourceType: resourceTypeDeployment},
+			},
+		},
+		conf: config.Config{
+			K8sClient:       fake.NewClientset(newDeployment("broken"), newDeployment("healthy")),
+			ContinueOnError: true,
+		},
+		retryBackoff: wait.Backoff{Duration: 10 * time.Millisecond, Factor: 1.0, Jitter: 0.1, Steps: 1},
+		skipPodWait:  true,
+	}
+
+	k8sFakeClient := s.conf.K8sClient.(*fake.Clientset)
+	k8sFakeClient.PrependReactor("update", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.(k8stesting.UpdateAction).GetObject().(*appsv1.Deployment).Name == "broken" {
+			return true, nil, errors.New("server side error")
+		}
+		return false, nil, nil
+	})
+
+	require.NoError(t, s.scaleUpGroup(t.Context(), 1))
+	require.Len(t, s.failures, 1)
+	assert.Equal(t, "broken", s.failures[0].Name)
+	assert.Equal(t, "group 1", s.failures[0].Step)
+
+	healthy, err := s.conf.K8sClient.AppsV1().Deployments("web").Get(t.Context(), "healthy", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), *healthy.Spec.Replicas, "Expected the healthy deployment to be scaled up despite the earlier failure")
+}
+
+func Test_envScaleDown_failuresLeaveExternalResources(t *testing.T) {
+	log.SetDefault(log.New(log.NewJSONHandler(io.Discard, &log.HandlerOptions{Level: log.LevelError})))
+
+	deployment := func(name, group string) *appsv1.Deployment {
+		return &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "web", Annotations: map[string]string{startupOrderAnnotationKey: group}},
+			Spec:       appsv1.DeploymentSpec{Replicas: int32Ptr(2)},
+		}
+	}
+
+	client := fake.NewClientset(deployment("frontend", "10"), deployment("broken", "5"), deployment("api", "1"))
+	client.PrependReactor("update", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.(k8stesting.UpdateAction).GetObject().(*appsv1.Deployment).Name == "broken" {
+			return true, nil, errors.New("server side error")
+		}
+		return false, nil, nil
+	})
+	s := &Service{
+		conf:         config.Config{K8sClient: client, Action: config.ScaleDown, ContinueOnError: true},
+		retryBackoff: wait.Backoff{Duration: 10 * time.Millisecond, Factor: 1.0, Jitter: 0.1, Steps: 1},
+		skipPodWait:  true,
+	}
+	var hookGroups []int
+	s.AfterScaleDownGroup(func(_ context.Context, group int) error {
+		hookGroups = append(hookGroups, group)
+		return nil
+	})
+
+	require.NoError(t, s.envScaleDown(t.Context()))
+	require.Len(t, s.failures, 1)
+	assert.Equal(t, []int{10}, hookGroups, "Expected the external resources to be left running once a workload failed to scale down")
+
+	api, err := client.AppsV1().Deployments("web").Get(t.Context(), "api", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, int32(0), *api.Spec.Replicas, "Expected the lower groups to still be scaled down")
+}
+
+func TestFailuresError(t *testing.T) {
+	err := &FailuresError{Failures: []Failure{
+		{Step: "group 2", ResourceType: resourceTypeDeployment, Namespace: "web", Name: "nginx", Error: "boom"},
+		{Step: "suspending CronJobs", Error: "forbidden"},
+	}}
+
+	assert.Equal(t, "2 failure(s) whilst scaling the environment:\n- group 2: deployment web/nginx: boom\n- suspending CronJobs: forbidden", err.Error())
+
+	var target *FailuresError
+	assert.True(t, errors.As(error(err), &target))
+}
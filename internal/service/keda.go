@@ -21,12 +21,12 @@ const (
 	kedaPausedValue = "true"
 )
 
-func (s *Service) updateKedaScaleObjects(sa config.ScaleAction) error {
+func (s *Service) updateKedaScaleObjects(ctx context.Context, sa config.ScaleAction) error {
 	if sa != config.ScaleDown && sa != config.ScaleUp {
 		return fmt.Errorf("invalid ScaleAction detected. Must be 'ScaleUp' or 'ScaleDown'")
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
 	gvr := schema.GroupVersionResource{
@@ -43,6 +43,10 @@ func (s *Service) updateKedaScaleObjects(sa config.ScaleAction) error {
 	for _, item := range scaledobjects.Items {
 		name := item.GetName()
 		namespace := item.GetNamespace()
+		if sa == config.ScaleDown && s.namespaceKeptAlive(namespace) {
+			log.Debug("Skipping ScaledObject as its namespace is kept alive", "ScaledObject", name, "Namespace", namespace)
+			continue
+		}
 
 		retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
 			// Get the latest version of the ScaledObject
@@ -82,6 +86,11 @@ func (s *Service) updateKedaScaleObjects(sa config.ScaleAction) error {
 		}
 
 		log.Debug("Annotated pod", "namespace", namespace, "name", name)
+		if sa == config.ScaleDown {
+			s.report.AddScaledObject(namespace, name, "paused")
+		} else {
+			s.report.AddScaledObject(namespace, name, "resumed")
+		}
 	}
 
 	return nil
@@ -31,7 +31,7 @@ func TestUpdateKedaScaleObjects_ScaleDown(t *testing.T) {
 		},
 	}
 
-	err := svc.updateKedaScaleObjects(config.ScaleDown)
+	err := svc.updateKedaScaleObjects(context.Background(), config.ScaleDown)
 	assert.NoError(t, err)
 
 	// Check annotation was set during scale down
@@ -59,7 +59,7 @@ func TestUpdateKedaScaleObjects_ScaleUp(t *testing.T) {
 		},
 	}
 
-	err := svc.updateKedaScaleObjects(config.ScaleUp)
+	err := svc.updateKedaScaleObjects(context.Background(), config.ScaleUp)
 	assert.NoError(t, err)
 
 	// Re-fetch the object to get the updated state
@@ -72,6 +72,6 @@ func TestUpdateKedaScaleObjects_ScaleUp(t *testing.T) {
 
 func TestUpdateKedaScaleObjects_InvalidAction(t *testing.T) {
 	svc := &Service{}
-	err := svc.updateKedaScaleObjects("invalid")
+	err := svc.updateKedaScaleObjects(context.Background(), "invalid")
 	assert.Error(t, err, "expected error for invalid action")
 }
@@ -0,0 +1,172 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	log "log/slog"
+	"time"
+
+	"github.com/michaelprice232/eks-env-scaledown/config"
+	"github.com/michaelprice232/eks-env-scaledown/internal/report"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// keepAliveUntil returns when the keep-alive annotation in annotations expires, if it is in force at now. A
+// keep-alive which is invalid or further ahead than KeepAliveMax is logged and ignored, so the resource still goes down.
+func (s *Service) keepAliveUntil(annotations map[string]string, now time.Time, kind, namespace, name string) (time.Time, bool) {
+	value, found := annotations[keepAliveAnnotationKey]
+	if !found {
+		return time.Time{}, false
+	}
+
+	until, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		log.Warn("Unable to parse the RFC3339 time from the keep-alive key. Ignoring", "kind", kind, "resource", name, "Namespace", namespace, "value", value, "key", keepAliveAnnotationKey)
+		return time.Time{}, false
+	}
+	if !until.After(now) {
+		log.Debug("Keep-alive has expired", "kind", kind, "resource", name, "Namespace", namespace, "until", until)
+		return time.Time{}, false
+	}
+	if until.After(now.Add(s.conf.KeepAliveMax)) {
+		log.Warn("Keep-alive is further ahead than the maximum extension. Ignoring", "kind", kind, "resource", name, "Namespace", namespace, "until", until, "max", s.conf.KeepAliveMax)
+		return time.Time{}, false
+	}
+
+	return until, true
+}
+
+// EnvironmentKeptAlive returns when the cluster-wide keep-alive, an annotation on the KeepAliveConfigMap, expires.
+// The zero time is returned if it isn't set or isn't in force, in which case the scale down goes ahead.
+func (s *Service) EnvironmentKeptAlive(ctx context.Context) (time.Time, error) {
+	cm, err := s.conf.K8sClient.CoreV1().ConfigMaps(s.conf.Namespace).Get(ctx, s.conf.KeepAliveConfigMap, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("getting keep-alive ConfigMap %s: %w", s.conf.KeepAliveConfigMap, err)
+	}
+
+	until, found := s.keepAliveUntil(cm.Annotations, time.Now(), "configmap", cm.Namespace, cm.Name)
+	if !found {
+		return time.Time{}, nil
+	}
+	s.report.AddSkipped(report.Skipped{Kind: "environment", Namespace: cm.Namespace, Name: cm.Name, Reason: keptAliveReason(until)})
+	s.noteKeptAlive(until)
+
+	return until, nil
+}
+
+// loadNamespaceKeepAlives records the namespaces whose keep-alive postpones their scale down.
+func (s *Service) loadNamespaceKeepAlives(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	namespaces, err := s.conf.K8sClient.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("listing namespaces: %w", err)
+	}
+
+	now := time.Now()
+	s.keptAliveNamespaces = make(map[string]time.Time)
+	for _, ns := range namespaces.Items {
+		until, found := s.keepAliveUntil(ns.Annotations, now, "namespace", ns.Name, ns.Name)
+		if !found {
+			continue
+		}
+
+		log.Info("Namespace is kept alive. Postponing its scale down", "Namespace", ns.Name, "until", until)
+		s.report.AddSkipped(report.Skipped{Kind: "namespace", Name: ns.Name, Reason: keptAliveReason(until)})
+		s.keptAliveNamespaces[ns.Name] = until
+		s.noteKeptAlive(until)
+	}
+
+	return nil
+}
+
+// namespaceKeptAlive reports whether a keep-alive on namespace postpones its scale down.
+func (s *Service) namespaceKeptAlive(namespace string) bool {
+	_, found := s.keptAliveNamespaces[namespace]
+	return found
+}
+
+// keepAlive reports whether the scale down of the workload in group is postponed by a keep-alive, on the workload
+// or its namespace. A kept alive workload is recorded, so its pods and the group's external resources are left running.
+func (s *Service) keepAlive(res *k8sResource, annotations map[string]string, group int) bool {
+	if s.conf.Action != config.ScaleDown && s.conf.Action != config.Enforce {
+		return false
+	}
+
+	until, found := s.keptAliveNamespaces[res.Namespace]
+	if !found {
+		if until, found = s.keepAliveUntil(annotations, time.Now(), res.ResourceType, res.Namespace, res.Name); !found {
+			return false
+		}
+		s.report.AddSkipped(report.Skipped{Kind: res.ResourceType, Namespace: res.Namespace, Name: res.Name, Reason: keptAliveReason(until)})
+		s.noteKeptAlive(until)
+	}
+
+	log.Info("Workload is kept alive. Postponing its scale down", "type", res.ResourceType, "resource", res.Name, "Namespace", res.Namespace, "until", until)
+	s.keptAliveResources = append(s.keptAliveResources, res)
+	if s.keptAliveGroups == nil {
+		s.keptAliveGroups = make(map[int]bool)
+	}
+	s.keptAliveGroups[group] = true
+
+	return true
+}
+
+// podKeptAlive reports whether the pod is in a kept alive namespace or belongs to a kept alive workload.
+func (s *Service) podKeptAlive(namespace string, podLabels map[string]string) bool {
+	if s.namespaceKeptAlive(namespace) {
+		return true
+	}
+
+	for _, r := range s.keptAliveResources {
+		if selectsPod(r, namespace, podLabels) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// selectsPod reports whether the pod in namespace, with podLabels, belongs to the workload r.
+func selectsPod(r *k8sResource, namespace string, podLabels map[string]string) bool {
+	if r.Namespace != namespace || r.Selector == "" {
+		return false
+	}
+
+	selector, err := labels.Parse(r.Selector)
+	if err != nil {
+		log.Warn("Unable to parse the selector of a workload", "type", r.ResourceType, "resource", r.Name, "Namespace", r.Namespace, "selector", r.Selector, "error", err)
+		return false
+	}
+
+	return selector.Matches(labels.Set(podLabels))
+}
+
+// noteKeptAlive tracks the earliest keep-alive expiry, after which a later scheduled scale down can go ahead.
+func (s *Service) noteKeptAlive(until time.Time) {
+	if s.keptAliveUntil.IsZero() || until.Before(s.keptAliveUntil) {
+		s.keptAliveUntil = until
+	}
+}
+
+// KeptAliveUntil returns the earliest expiry of the keep-alives which postponed part of the scale down, or the zero
+// time if none did.
+func (s *Service) KeptAliveUntil() time.Time {
+	return s.keptAliveUntil
+}
+
+// KeptAliveGroups returns the startup groups with a kept alive workload, whose external resources are left running.
+func (s *Service) KeptAliveGroups() map[int]bool {
+	return s.keptAliveGroups
+}
+
+func keptAliveReason(until time.Time) string {
+	return "kept alive until " + until.Format(time.RFC3339)
+}
@@ -0,0 +1,164 @@
+package service
+
+import (
+	"context"
+	"io"
+	log "log/slog"
+	"maps"
+	"testing"
+	"time"
+
+	"github.com/michaelprice232/eks-env-scaledown/config"
+	"github.com/michaelprice232/eks-env-scaledown/internal/report"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_keepAliveUntil(t *testing.T) {
+	log.SetDefault(log.New(log.NewJSONHandler(io.Discard, &log.HandlerOptions{Level: log.LevelError})))
+
+	now := time.Date(2026, 3, 12, 19, 0, 0, 0, time.UTC)
+	s := &Service{conf: config.Config{KeepAliveMax: 12 * time.Hour}}
+
+	tests := []struct {
+		name      string
+		value     string
+		wantFound bool
+	}{
+		{name: "not set"},
+		{name: "in force", value: "2026-03-12T23:00:00Z", wantFound: true},
+		{name: "in force with an offset", value: "2026-03-12T23:00:00+01:00", wantFound: true},
+		{name: "expired", value: "2026-03-12T18:00:00Z"},
+		{name: "beyond the maximum extension", value: "2026-03-14T23:00:00Z"},
+		{name: "invalid", value: "tonight"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			annotations := map[string]string{}
+			if tc.value != "" {
+				annotations[keepAliveAnnotationKey] = tc.value
+			}
+
+			until, found := s.keepAliveUntil(annotations, now, "deployment", "web", "nginx")
+			assert.Equal(t, tc.wantFound, found)
+			if tc.wantFound {
+				expected, err := time.Parse(time.RFC3339, tc.value)
+				require.NoError(t, err)
+				assert.True(t, expected.Equal(until))
+			}
+		})
+	}
+}
+
+func Test_envScaleDown_keepAlive(t *testing.T) {
+	log.SetDefault(log.New(log.NewJSONHandler(io.Discard, &log.HandlerOptions{Level: log.LevelError})))
+
+	keepAlive := map[string]string{keepAliveAnnotationKey: time.Now().Add(2 * time.Hour).UTC().Format(time.RFC3339)}
+	deployment := func(name, namespace string, annotations map[string]string) *appsv1.Deployment {
+		labels := map[string]string{"app": name}
+		return &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, Annotations: annotations},
+			Spec:       appsv1.DeploymentSpec{Replicas: int32Ptr(2), Selector: &metav1.LabelSelector{MatchLabels: labels}},
+		}
+	}
+	pod := func(name, namespace, app string) *corev1.Pod {
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, Labels: map[string]string{"app": app}}}
+	}
+
+	client := fake.NewClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a", Annotations: keepAlive}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "web"}},
+		deployment("api", "team-a", nil),
+		pod("api-abc", "team-a", "api"),
+		&batchv1.CronJob{ObjectMeta: metav1.ObjectMeta{Name: "report", Namespace: "team-a"}},
+		deployment("nginx", "web", map[string]string{keepAliveAnnotationKey: keepAlive[keepAliveAnnotationKey], startupOrderAnnotationKey: "5"}),
+		pod("nginx-abc", "web", "nginx"),
+		deployment("worker", "web", map[string]string{startupOrderAnnotationKey: "1"}),
+		pod("worker-abc", "web", "worker"),
+	)
+	rep := report.New(string(config.ScaleDown))
+	s := &Service{
+		conf:         config.Config{K8sClient: client, Action: config.ScaleDown, SuspendCronJob: true, KeepAliveMax: 12 * time.Hour},
+		report:       rep,
+		retryBackoff: wait.Backoff{Duration: 10 * time.Millisecond, Factor: 1.0, Jitter: 0.1, Steps: 1},
+		skipPodWait:  true,
+	}
+	hookCalls := make(map[int]map[int]bool)
+	s.AfterScaleDownGroup(func(_ context.Context, group int) error {
+		hookCalls[group] = maps.Clone(s.KeptAliveGroups())
+		return nil
+	})
+
+	require.NoError(t, s.envScaleDown(t.Context()))
+
+	replicas := func(name, namespace string) int32 {
+		d, err := client.AppsV1().Deployments(namespace).Get(t.Context(), name, metav1.GetOptions{})
+		require.NoError(t, err)
+		return *d.Spec.Replicas
+	}
+	assert.Equal(t, int32(2), replicas("api", "team-a"), "Expected the kept alive namespace to be left running")
+	assert.Equal(t, int32(2), replicas("nginx", "web"), "Expected the kept alive workload to be left running")
+	assert.Equal(t, int32(0), replicas("worker", "web"))
+
+	pods, err := client.CoreV1().Pods("").List(t.Context(), metav1.ListOptions{})
+	require.NoError(t, err)
+	var remaining []string
+	for _, p := range pods.Items {
+		remaining = append(remaining, p.Name)
+	}
+	assert.ElementsMatch(t, []string{"api-abc", "nginx-abc"}, remaining)
+
+	cj, err := client.BatchV1().CronJobs("team-a").Get(t.Context(), "report", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Nil(t, cj.Spec.Suspend, "Expected the kept alive namespace's CronJobs not to be suspended")
+
+	// Group 1's hook runs, and is told to leave the external resources of the kept alive groups 100 and 5 running
+	assert.Equal(t, map[int]map[int]bool{1: {defaultStartUpGroup: true, 5: true}}, hookCalls, "Expected the groups' external resources to be left running alongside their kept alive workloads")
+	assert.False(t, s.KeptAliveUntil().IsZero())
+
+	var skipped []string
+	for _, sk := range rep.Skipped {
+		skipped = append(skipped, sk.Kind+"/"+sk.Name)
+	}
+	assert.ElementsMatch(t, []string{"namespace/team-a", "deployment/nginx"}, skipped)
+}
+
+func TestEnvironmentKeptAlive(t *testing.T) {
+	log.SetDefault(log.New(log.NewJSONHandler(io.Discard, &log.HandlerOptions{Level: log.LevelError})))
+
+	conf := config.Config{Namespace: "eks-env-scaledown", KeepAliveConfigMap: "eks-env-scaledown-keep-alive", KeepAliveMax: 12 * time.Hour}
+
+	t.Run("no ConfigMap", func(t *testing.T) {
+		conf.K8sClient = fake.NewClientset()
+		s := &Service{conf: conf}
+
+		until, err := s.EnvironmentKeptAlive(t.Context())
+		require.NoError(t, err)
+		assert.True(t, until.IsZero())
+	})
+
+	t.Run("kept alive", func(t *testing.T) {
+		expected := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+		conf.K8sClient = fake.NewClientset(&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{
+			Name:        conf.KeepAliveConfigMap,
+			Namespace:   conf.Namespace,
+			Annotations: map[string]string{keepAliveAnnotationKey: expected.Format(time.RFC3339)},
+		}})
+		rep := report.New(string(config.ScaleDown))
+		s := &Service{conf: conf, report: rep}
+
+		until, err := s.EnvironmentKeptAlive(t.Context())
+		require.NoError(t, err)
+		assert.True(t, expected.Equal(until))
+		require.Len(t, rep.Skipped, 1)
+		assert.Equal(t, "environment", rep.Skipped[0].Kind)
+	})
+}
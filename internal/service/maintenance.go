@@ -0,0 +1,238 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	log "log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/michaelprice232/eks-env-scaledown/config"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// maintenancePageKey is set to "true" as an annotation on the Ingresses to re-point during the scale down, and as
+	// a label on the maintenance page workload and its pods so they are left running
+	maintenancePageKey = "eks-env-scaledown/maintenance-page"
+
+	// originalBackendsAnnotationKey holds the JSON encoded backends of a re-pointed Ingress, restored at scale up
+	originalBackendsAnnotationKey = "eks-env-scaledown/original-backends"
+
+	// maintenancePageConfigMap is created in each re-pointed Ingress's namespace, holding the page for the
+	// maintenance page workload to serve
+	maintenancePageConfigMap = "eks-env-scaledown-maintenance-page"
+)
+
+// originalBackends are the parts of an Ingress spec which are re-pointed to the maintenance page.
+type originalBackends struct {
+	DefaultBackend *networkingv1.IngressBackend `json:"defaultBackend,omitempty"`
+	Rules          []networkingv1.IngressRule   `json:"rules,omitempty"`
+}
+
+// isMaintenancePage reports whether the labels or annotations mark an object as part of the maintenance page.
+func isMaintenancePage(values map[string]string) bool {
+	value, found := values[maintenancePageKey]
+	if !found {
+		return false
+	}
+
+	enabled, _ := strconv.ParseBool(value)
+	return enabled
+}
+
+// maintenancePageBackend parses the "name:port" MaintenancePageService into an Ingress backend. The port can be a
+// number or a name.
+func maintenancePageBackend(service string) (*networkingv1.IngressBackend, error) {
+	name, port, found := strings.Cut(service, ":")
+	if !found || name == "" || port == "" {
+		return nil, fmt.Errorf("invalid maintenance page service %q: must be in the format name:port", service)
+	}
+
+	var backendPort networkingv1.ServiceBackendPort
+	if p := intstr.Parse(port); p.Type == intstr.Int {
+		backendPort.Number = p.IntVal
+	} else {
+		backendPort.Name = port
+	}
+
+	return &networkingv1.IngressBackend{Service: &networkingv1.IngressServiceBackend{Name: name, Port: backendPort}}, nil
+}
+
+// maintenancePageHTML renders the page served whilst the environment is scaled down.
+func maintenancePageHTML(wakeTime string) string {
+	wake := "It will be woken up by the next scheduled scale up."
+	if wakeTime != "" {
+		wake = fmt.Sprintf("It is scheduled to wake at %s.", html.EscapeString(wakeTime))
+	}
+
+	return fmt.Sprintf(`<!DOCTYPE html>
+<html>
+<head><title>Environment asleep</title></head>
+<body>
+<h1>This environment is asleep</h1>
+<p>%s</p>
+</body>
+</html>
+`, wake)
+}
+
+// updateIngresses re-points the Ingresses annotated with maintenancePageKey to the maintenance page during the
+// scale down, recording their original backends, and restores them during the scale up.
+func (s *Service) updateIngresses(ctx context.Context, sa config.ScaleAction) error {
+	if sa != config.ScaleDown && sa != config.ScaleUp {
+		return fmt.Errorf("invalid ScaleAction detected. Must be 'ScaleUp' or 'ScaleDown'")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	backend, err := maintenancePageBackend(s.conf.MaintenancePageService)
+	if err != nil {
+		return err
+	}
+
+	ingresses, err := s.conf.K8sClient.NetworkingV1().Ingresses("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("listing Ingresses: %w", err)
+	}
+
+	pageWritten := make(map[string]bool)
+	for _, item := range ingresses.Items {
+		if !isMaintenancePage(item.Annotations) {
+			continue
+		}
+		if sa == config.ScaleDown && s.namespaceKeptAlive(item.Namespace) {
+			log.Debug("Skipping Ingress as its namespace is kept alive", "Ingress", item.Name, "Namespace", item.Namespace)
+			continue
+		}
+
+		if sa == config.ScaleDown && !pageWritten[item.Namespace] {
+			if err = s.writeMaintenancePage(ctx, item.Namespace); err != nil {
+				return err
+			}
+			pageWritten[item.Namespace] = true
+		}
+
+		var change string
+		retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			// Get the latest version of the Ingress
+			latest, getErr := s.conf.K8sClient.NetworkingV1().Ingresses(item.Namespace).Get(ctx, item.Name, metav1.GetOptions{})
+			if getErr != nil {
+				return fmt.Errorf("failed to get latest version of Ingress %s/%s: %w", item.Namespace, item.Name, getErr)
+			}
+
+			var changeErr error
+			if sa == config.ScaleDown {
+				change, changeErr = repointIngress(latest, backend)
+			} else {
+				change, changeErr = restoreIngress(latest)
+			}
+			if changeErr != nil || change == "" {
+				return changeErr
+			}
+
+			_, updateErr := s.conf.K8sClient.NetworkingV1().Ingresses(item.Namespace).Update(ctx, latest, metav1.UpdateOptions{})
+			return updateErr
+		})
+		if retryErr != nil {
+			return fmt.Errorf("updating Ingress %s/%s: %w", item.Namespace, item.Name, retryErr)
+		}
+
+		if change == "" {
+			continue
+		}
+		log.Info("Updated Ingress", "Ingress", item.Name, "Namespace", item.Namespace, "change", change)
+		s.report.AddInfrastructure("ingress", item.Namespace+"/"+item.Name, change)
+	}
+
+	return nil
+}
+
+// repointIngress records the backends of ing in an annotation and points them all at backend. An Ingress which an
+// earlier scale down already re-pointed is left alone, so its original backends are kept.
+func repointIngress(ing *networkingv1.Ingress, backend *networkingv1.IngressBackend) (string, error) {
+	if _, found := ing.Annotations[originalBackendsAnnotationKey]; found {
+		log.Debug("Ingress already points to the maintenance page, skipping", "Ingress", ing.Name, "Namespace", ing.Namespace)
+		return "", nil
+	}
+
+	original, err := json.Marshal(originalBackends{DefaultBackend: ing.Spec.DefaultBackend, Rules: ing.Spec.Rules})
+	if err != nil {
+		return "", fmt.Errorf("encoding the original backends: %w", err)
+	}
+	if ing.Annotations == nil {
+		ing.Annotations = make(map[string]string)
+	}
+	ing.Annotations[originalBackendsAnnotationKey] = string(original)
+
+	if ing.Spec.DefaultBackend != nil {
+		ing.Spec.DefaultBackend = backend.DeepCopy()
+	}
+	for i := range ing.Spec.Rules {
+		if ing.Spec.Rules[i].HTTP == nil {
+			continue
+		}
+		for j := range ing.Spec.Rules[i].HTTP.Paths {
+			ing.Spec.Rules[i].HTTP.Paths[j].Backend = *backend.DeepCopy()
+		}
+	}
+
+	return "re-pointed to the maintenance page", nil
+}
+
+// restoreIngress restores the backends recorded by repointIngress. An Ingress without the annotation was not
+// re-pointed, so is left alone.
+func restoreIngress(ing *networkingv1.Ingress) (string, error) {
+	raw, found := ing.Annotations[originalBackendsAnnotationKey]
+	if !found {
+		return "", nil
+	}
+
+	var original originalBackends
+	if err := json.Unmarshal([]byte(raw), &original); err != nil {
+		return "", fmt.Errorf("decoding the %s annotation: %w", originalBackendsAnnotationKey, err)
+	}
+
+	ing.Spec.DefaultBackend = original.DefaultBackend
+	ing.Spec.Rules = original.Rules
+	delete(ing.Annotations, originalBackendsAnnotationKey)
+
+	return "restored", nil
+}
+
+// writeMaintenancePage creates or updates the maintenance page ConfigMap in namespace with the current wake time.
+func (s *Service) writeMaintenancePage(ctx context.Context, namespace string) error {
+	data := map[string]string{
+		"index.html": maintenancePageHTML(s.conf.MaintenancePageWakeTime),
+		"wake-time":  s.conf.MaintenancePageWakeTime,
+	}
+
+	cms := s.conf.K8sClient.CoreV1().ConfigMaps(namespace)
+	cm, err := cms.Get(ctx, maintenancePageConfigMap, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		cm = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: maintenancePageConfigMap, Namespace: namespace}, Data: data}
+		if _, err = cms.Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("creating maintenance page ConfigMap in Namespace %s: %w", namespace, err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("getting maintenance page ConfigMap in Namespace %s: %w", namespace, err)
+	}
+
+	cm.Data = data
+	if _, err = cms.Update(ctx, cm, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("updating maintenance page ConfigMap in Namespace %s: %w", namespace, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,133 @@
+package service
+
+import (
+	"io"
+	log "log/slog"
+	"testing"
+
+	"github.com/michaelprice232/eks-env-scaledown/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_maintenancePageBackend(t *testing.T) {
+	tests := []struct {
+		name     string
+		service  string
+		wantErr  bool
+		expected networkingv1.ServiceBackendPort
+	}{
+		{name: "port number", service: "asleep:80", expected: networkingv1.ServiceBackendPort{Number: 80}},
+		{name: "port name", service: "asleep:http", expected: networkingv1.ServiceBackendPort{Name: "http"}},
+		{name: "missing port", service: "asleep", wantErr: true},
+		{name: "missing name", service: ":80", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			backend, err := maintenancePageBackend(tc.service)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "asleep", backend.Service.Name)
+			assert.Equal(t, tc.expected, backend.Service.Port)
+		})
+	}
+}
+
+func Test_updateIngresses(t *testing.T) {
+	log.SetDefault(log.New(log.NewJSONHandler(io.Discard, &log.HandlerOptions{Level: log.LevelError})))
+
+	pathType := networkingv1.PathTypePrefix
+	original := networkingv1.IngressSpec{
+		DefaultBackend: &networkingv1.IngressBackend{Service: &networkingv1.IngressServiceBackend{Name: "web", Port: networkingv1.ServiceBackendPort{Number: 8080}}},
+		Rules: []networkingv1.IngressRule{{
+			Host: "staging.example.com",
+			IngressRuleValue: networkingv1.IngressRuleValue{HTTP: &networkingv1.HTTPIngressRuleValue{Paths: []networkingv1.HTTPIngressPath{
+				{Path: "/", PathType: &pathType, Backend: networkingv1.IngressBackend{Service: &networkingv1.IngressServiceBackend{Name: "web", Port: networkingv1.ServiceBackendPort{Number: 8080}}}},
+				{Path: "/api", PathType: &pathType, Backend: networkingv1.IngressBackend{Service: &networkingv1.IngressServiceBackend{Name: "api", Port: networkingv1.ServiceBackendPort{Name: "http"}}}},
+			}}},
+		}},
+	}
+	newIngress := func(name string, annotations map[string]string) *networkingv1.Ingress {
+		return &networkingv1.Ingress{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "web", Annotations: annotations},
+			Spec:       *original.DeepCopy(),
+		}
+	}
+
+	client := fake.NewClientset(
+		newIngress("selected", map[string]string{maintenancePageKey: "true"}),
+		newIngress("not-selected", nil),
+	)
+	s := &Service{conf: config.Config{K8sClient: client, MaintenancePageService: "asleep:80", MaintenancePageWakeTime: "07:00 UTC"}}
+	ingresses := client.NetworkingV1().Ingresses("web")
+
+	require.NoError(t, s.updateIngresses(t.Context(), config.ScaleDown))
+
+	selected, err := ingresses.Get(t.Context(), "selected", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Contains(t, selected.Annotations, originalBackendsAnnotationKey)
+	assert.Equal(t, "asleep", selected.Spec.DefaultBackend.Service.Name)
+	for _, p := range selected.Spec.Rules[0].HTTP.Paths {
+		assert.Equal(t, "asleep", p.Backend.Service.Name)
+		assert.Equal(t, int32(80), p.Backend.Service.Port.Number)
+	}
+	assert.Equal(t, "/api", selected.Spec.Rules[0].HTTP.Paths[1].Path, "Expected the paths to be kept")
+
+	notSelected, err := ingresses.Get(t.Context(), "not-selected", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, original, notSelected.Spec)
+
+	page, err := client.CoreV1().ConfigMaps("web").Get(t.Context(), maintenancePageConfigMap, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "07:00 UTC", page.Data["wake-time"])
+	assert.Contains(t, page.Data["index.html"], "scheduled to wake at 07:00 UTC")
+
+	// A repeated scale down keeps the original backends
+	recorded := selected.Annotations[originalBackendsAnnotationKey]
+	s.conf.MaintenancePageWakeTime = "08:00 UTC"
+	require.NoError(t, s.updateIngresses(t.Context(), config.ScaleDown))
+	selected, err = ingresses.Get(t.Context(), "selected", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, recorded, selected.Annotations[originalBackendsAnnotationKey])
+	page, err = client.CoreV1().ConfigMaps("web").Get(t.Context(), maintenancePageConfigMap, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "08:00 UTC", page.Data["wake-time"])
+
+	require.NoError(t, s.updateIngresses(t.Context(), config.ScaleUp))
+
+	selected, err = ingresses.Get(t.Context(), "selected", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.NotContains(t, selected.Annotations, originalBackendsAnnotationKey)
+	assert.Equal(t, original, selected.Spec)
+}
+
+func Test_maintenancePageWorkloadIsLeftRunning(t *testing.T) {
+	log.SetDefault(log.New(log.NewJSONHandler(io.Discard, &log.HandlerOptions{Level: log.LevelError})))
+
+	labels := map[string]string{"app": "asleep", maintenancePageKey: "true"}
+	client := fake.NewClientset(
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "asleep", Namespace: "web", Labels: labels},
+			Spec:       appsv1.DeploymentSpec{Replicas: int32Ptr(1), Selector: &metav1.LabelSelector{MatchLabels: labels}},
+		},
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "asleep-abc", Namespace: "web", Labels: labels}},
+	)
+	s := &Service{conf: config.Config{K8sClient: client}}
+
+	require.NoError(t, s.buildStartUpOrder(t.Context()))
+	assert.Empty(t, s.startUpOrder)
+
+	require.NoError(t, s.terminateStandalonePods(t.Context()))
+	_, err := client.CoreV1().Pods("web").Get(t.Context(), "asleep-abc", metav1.GetOptions{})
+	assert.NoError(t, err)
+}
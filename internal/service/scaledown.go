@@ -4,15 +4,20 @@ import (
 	"context"
 	"fmt"
 	log "log/slog"
+	"slices"
 	"strconv"
 	"time"
 
+	"github.com/michaelprice232/eks-env-scaledown/internal/report"
+	"github.com/michaelprice232/eks-env-scaledown/internal/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/util/retry"
 )
 
-func (s *Service) scaleDownGroup(groupNumber int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+func (s *Service) scaleDownGroup(ctx context.Context, groupNumber int) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
 	var resources []*k8sResource
@@ -25,14 +30,18 @@ func (s *Service) scaleDownGroup(groupNumber int) error {
 		if resource.ResourceType == resourceTypeDeployment {
 			// Use a retry function to handle conflicts on updates from concurrent changes
 			// https://github.com/kubernetes/client-go/tree/master/examples/create-update-delete-deployment
+			var change *report.Resource
+			var drift *report.Drift
 			retryErr := retry.RetryOnConflict(s.retryBackoff, func() error {
+				change, drift = nil, nil
 				result, getErr := s.conf.K8sClient.AppsV1().Deployments(resource.Namespace).Get(ctx, resource.Name, metav1.GetOptions{})
 				if getErr != nil {
 					return getErr
 				}
 
-				if *result.Spec.Replicas == 0 {
-					log.Warn("The workload has already been scaled to zero. Skipping", "type", resource.ResourceType, "resource", result.Name, "Namespace", result.Namespace)
+				if *result.Spec.Replicas <= resource.ScaleDownReplicas {
+					log.Warn("The workload has already been scaled down. Skipping", "type", resource.ResourceType, "resource", result.Name, "Namespace", result.Namespace, "scaleDownReplicas", resource.ScaleDownReplicas)
+					s.report.AddSkipped(report.Skipped{Kind: resource.ResourceType, Namespace: resource.Namespace, Name: resource.Name, Reason: alreadyScaledDownReason(resource.ScaleDownReplicas)})
 					return nil
 				}
 
@@ -40,8 +49,14 @@ func (s *Service) scaleDownGroup(groupNumber int) error {
 					result.Annotations = make(map[string]string)
 				}
 
-				result.Spec.Replicas = int32Ptr(0)
-				result.Annotations[originalReplicasAnnotationKey] = strconv.FormatInt(int64(resource.ReplicaCount), 10)
+				change = newResourceChange(groupNumber, resource, result.Spec.Replicas, resource.ScaleDownReplicas)
+				drift = s.newDrift(resource, result, *result.Spec.Replicas)
+				original := resource.ReplicaCount
+				if drift != nil {
+					original = drift.OriginalReplicas
+				}
+				result.Spec.Replicas = int32Ptr(resource.ScaleDownReplicas)
+				result.Annotations[originalReplicasAnnotationKey] = strconv.FormatInt(int64(original), 10)
 				result.Annotations[updatedAtAnnotationKey] = time.Now().Format(time.RFC3339)
 
 				// RetryOnConflict expects the error to be returned unwrapped
@@ -50,22 +65,31 @@ func (s *Service) scaleDownGroup(groupNumber int) error {
 				return updateErr
 			})
 			if retryErr != nil {
-				return fmt.Errorf("failed to update deployment %s in Namespace %s: %w", resource.Name, resource.Namespace, retryErr)
+				if err := s.handleResourceError(groupNumber, resource, fmt.Errorf("failed to update deployment %s in Namespace %s: %w", resource.Name, resource.Namespace, retryErr)); err != nil {
+					return err
+				}
+				continue
 			}
+			s.recordResourceChange(change)
+			s.recordDrift(drift)
 			log.Debug("Deployment scaled down", resourceTypeDeployment, resource.Name, "Namespace", resource.Namespace)
 		}
 
 		if resource.ResourceType == resourceTypeStatefulSet {
 			// Use a retry function to handle conflicts on updates from concurrent changes
 			// https://github.com/kubernetes/client-go/tree/master/examples/create-update-delete-deployment
+			var change *report.Resource
+			var drift *report.Drift
 			retryErr := retry.RetryOnConflict(s.retryBackoff, func() error {
+				change, drift = nil, nil
 				result, getErr := s.conf.K8sClient.AppsV1().StatefulSets(resource.Namespace).Get(ctx, resource.Name, metav1.GetOptions{})
 				if getErr != nil {
 					return getErr
 				}
 
-				if *result.Spec.Replicas == 0 {
-					log.Warn("The workload has already been scaled to zero. Skipping", "type", resource.ResourceType, "resource", result.Name, "Namespace", result.Namespace)
+				if *result.Spec.Replicas <= resource.ScaleDownReplicas {
+					log.Warn("The workload has already been scaled down. Skipping", "type", resource.ResourceType, "resource", result.Name, "Namespace", result.Namespace, "scaleDownReplicas", resource.ScaleDownReplicas)
+					s.report.AddSkipped(report.Skipped{Kind: resource.ResourceType, Namespace: resource.Namespace, Name: resource.Name, Reason: alreadyScaledDownReason(resource.ScaleDownReplicas)})
 					return nil
 				}
 
@@ -73,8 +97,14 @@ func (s *Service) scaleDownGroup(groupNumber int) error {
 					result.Annotations = make(map[string]string)
 				}
 
-				result.Spec.Replicas = int32Ptr(0)
-				result.Annotations[originalReplicasAnnotationKey] = strconv.FormatInt(int64(resource.ReplicaCount), 10)
+				change = newResourceChange(groupNumber, resource, result.Spec.Replicas, resource.ScaleDownReplicas)
+				drift = s.newDrift(resource, result, *result.Spec.Replicas)
+				original := resource.ReplicaCount
+				if drift != nil {
+					original = drift.OriginalReplicas
+				}
+				result.Spec.Replicas = int32Ptr(resource.ScaleDownReplicas)
+				result.Annotations[originalReplicasAnnotationKey] = strconv.FormatInt(int64(original), 10)
 				result.Annotations[updatedAtAnnotationKey] = time.Now().Format(time.RFC3339)
 
 				// RetryOnConflict expects the error to be returned unwrapped
@@ -83,25 +113,36 @@ func (s *Service) scaleDownGroup(groupNumber int) error {
 				return updateErr
 			})
 			if retryErr != nil {
-				return fmt.Errorf("failed to update %s %s in Namespace %s: %w", resource.ResourceType, resource.Name, resource.Namespace, retryErr)
+				if err := s.handleResourceError(groupNumber, resource, fmt.Errorf("failed to update %s %s in Namespace %s: %w", resource.ResourceType, resource.Name, resource.Namespace, retryErr)); err != nil {
+					return err
+				}
+				continue
 			}
+			s.recordResourceChange(change)
+			s.recordDrift(drift)
 			log.Debug("Statefulset scaled down", resourceTypeStatefulSet, resource.Name, "Namespace", resource.Namespace)
 		}
 	}
 
 	if !s.skipPodWait {
-		if err := s.waitForPodTermination(resources); err != nil {
-			return fmt.Errorf("waiting for pods to terminate: %w", err)
+		if err := s.waitForPodTermination(ctx, resources); err != nil {
+			err = fmt.Errorf("waiting for pods to terminate: %w", err)
+			if err = s.handleWaitError(groupNumber, resources, func(r *k8sResource) bool { return r.podsTerminated }, err); err != nil {
+				return err
+			}
 		}
 	}
 
 	return nil
 }
 
-func (s *Service) waitForPodTermination(resources []*k8sResource) error {
+func (s *Service) waitForPodTermination(ctx context.Context, resources []*k8sResource) (err error) {
+	ctx, span := tracing.Start(ctx, "wait for pod termination", attribute.Int("resources", len(resources)))
+	defer func() { tracing.End(span, err) }()
+
 	ticker := time.NewTicker(timeInterval)
 	defer ticker.Stop()
-	ctx, cancelCtx := context.WithTimeout(context.Background(), timeout)
+	ctx, cancelCtx := context.WithTimeout(ctx, timeout)
 	defer cancelCtx()
 
 	for {
@@ -112,6 +153,10 @@ func (s *Service) waitForPodTermination(resources []*k8sResource) error {
 			}
 
 			for _, r := range resources {
+				if r.failed {
+					continue
+				}
+
 				log.Debug("Finding non-terminated pods", "type", r.ResourceType, "resource", r.Name, "Namespace", r.Namespace, "selector", r.Selector)
 
 				pods, err := s.conf.K8sClient.CoreV1().Pods(r.Namespace).List(ctx, metav1.ListOptions{LabelSelector: r.Selector})
@@ -119,8 +164,8 @@ func (s *Service) waitForPodTermination(resources []*k8sResource) error {
 					return fmt.Errorf("listing pods: %w", err)
 				}
 
-				if len(pods.Items) == 0 {
-					log.Debug("Pods have been terminated", "resource", r.Name, "Namespace", r.Namespace)
+				if len(pods.Items) <= int(r.ScaleDownReplicas) {
+					log.Debug("Pods have been terminated", "resource", r.Name, "Namespace", r.Namespace, "remaining", len(pods.Items))
 					r.podsTerminated = true
 					continue
 				}
@@ -137,7 +182,7 @@ func (s *Service) waitForPodTermination(resources []*k8sResource) error {
 func podsStillRunning(resources []*k8sResource) bool {
 	var runningPods bool
 	for _, r := range resources {
-		if !r.podsTerminated {
+		if !r.podsTerminated && !r.failed {
 			runningPods = true
 		}
 	}
@@ -145,8 +190,31 @@ func podsStillRunning(resources []*k8sResource) bool {
 	return runningPods
 }
 
-func (s *Service) terminateStandalonePods() error {
-	ctx, cancelCtx := context.WithTimeout(context.Background(), timeout)
+// alreadyScaledDownReason is the report's reason for skipping a workload already at its scale down replica count.
+func alreadyScaledDownReason(replicas int32) string {
+	if replicas == 0 {
+		return "already scaled to zero"
+	}
+
+	return fmt.Sprintf("already at or below %d replica(s)", replicas)
+}
+
+// podOfReducedWorkload reports whether the pod belongs to a workload scaled down to a reduced replica count rather
+// than zero, whose remaining pods are left running.
+func (s *Service) podOfReducedWorkload(namespace string, podLabels map[string]string) bool {
+	for _, resources := range s.startUpOrder {
+		for _, r := range resources {
+			if r.ScaleDownReplicas > 0 && selectsPod(r, namespace, podLabels) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (s *Service) terminateStandalonePods(ctx context.Context) error {
+	ctx, cancelCtx := context.WithTimeout(ctx, timeout)
 	defer cancelCtx()
 
 	pods, err := s.conf.K8sClient.CoreV1().Pods("").List(ctx, metav1.ListOptions{})
@@ -159,12 +227,47 @@ func (s *Service) terminateStandalonePods() error {
 			log.Debug("Pod has matching app label and so is likely running this app, skipping", "appLabel", cronJobAppName)
 			continue
 		}
+		if isMaintenancePage(pod.Labels) {
+			log.Debug("Pod is serving the maintenance page, skipping", "pod", pod.Name, "Namespace", pod.Namespace)
+			continue
+		}
+		if s.podKeptAlive(pod.Namespace, pod.Labels) {
+			log.Debug("Pod is kept alive, skipping", "pod", pod.Name, "Namespace", pod.Namespace)
+			continue
+		}
+		if s.podOfReducedWorkload(pod.Namespace, pod.Labels) {
+			log.Debug("Pod belongs to a workload scaled down to a reduced replica count, skipping", "pod", pod.Name, "Namespace", pod.Namespace)
+			continue
+		}
 
 		log.Debug("Terminating remaining pod", "pod", pod.Name, "Namespace", pod.Namespace)
 		if err = s.conf.K8sClient.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{}); err != nil {
 			return fmt.Errorf("deleting pod %s in Namespace %s: %w", pod.Name, pod.Namespace, err)
 		}
+		s.report.AddPod(pod.Namespace, pod.Name)
 	}
 
 	return nil
 }
+
+// NodesInUse returns the nodes running the pods left up by the scale down, those of workloads scaled down to a reduced
+// replica count and those serving the maintenance page, so their node groups aren't scaled to zero underneath them.
+func (s *Service) NodesInUse(ctx context.Context) ([]string, error) {
+	pods, err := s.conf.K8sClient.CoreV1().Pods("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("listing pods: %w", err)
+	}
+
+	var nodes []string
+	for _, pod := range pods.Items {
+		if pod.Spec.NodeName == "" || slices.Contains(nodes, pod.Spec.NodeName) {
+			continue
+		}
+		if isMaintenancePage(pod.Labels) || s.podOfReducedWorkload(pod.Namespace, pod.Labels) {
+			nodes = append(nodes, pod.Spec.NodeName)
+		}
+	}
+	slices.Sort(nodes)
+
+	return nodes, nil
+}
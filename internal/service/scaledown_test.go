@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/michaelprice232/eks-env-scaledown/config"
+	"github.com/michaelprice232/eks-env-scaledown/internal/report"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -85,7 +86,7 @@ func Test_scaleDownGroup_deployments(t *testing.T) {
 				s.startUpOrder = nil
 			}
 
-			err := s.scaleDownGroup(tc.group)
+			err := s.scaleDownGroup(context.Background(), tc.group)
 			if tc.wantErr {
 				assert.Error(t, err)
 			} else {
@@ -178,7 +179,7 @@ func Test_scaleDownGroup_statefulsets(t *testing.T) {
 				s.startUpOrder = nil
 			}
 
-			err := s.scaleDownGroup(tc.group)
+			err := s.scaleDownGroup(context.Background(), tc.group)
 			if tc.wantErr {
 				assert.Error(t, err)
 			} else {
@@ -245,7 +246,7 @@ func Test_terminateStandalonePods(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, 3, len(result.Items), "Expected 3 pods before the termination")
 
-	err = s.terminateStandalonePods()
+	err = s.terminateStandalonePods(context.Background())
 	assert.NoError(t, err)
 
 	result, err = s.conf.K8sClient.CoreV1().Pods("").List(context.Background(), metav1.ListOptions{})
@@ -280,7 +281,7 @@ func Test_terminateStandalonePods_with_ignore_pod(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, 2, len(result.Items), "Expected 2 pods before the termination")
 
-	err = s.terminateStandalonePods()
+	err = s.terminateStandalonePods(context.Background())
 	assert.NoError(t, err)
 
 	result, err = s.conf.K8sClient.CoreV1().Pods("").List(context.Background(), metav1.ListOptions{})
@@ -359,7 +360,7 @@ func Test_waitForPodTermination(t *testing.T) {
 
 	// Start in a separate go routine to allow us to dynamically terminate pods mid-test
 	go func() {
-		err := s.waitForPodTermination([]*k8sResource{{Name: "pod-1", Namespace: "web", ResourceType: "deployment", Selector: "app=nginx"}})
+		err := s.waitForPodTermination(context.Background(), []*k8sResource{{Name: "pod-1", Namespace: "web", ResourceType: "deployment", Selector: "app=nginx"}})
 		done <- err
 	}()
 
@@ -375,3 +376,58 @@ func Test_waitForPodTermination(t *testing.T) {
 		t.Fatal("timeout waiting for waitForPodTermination to finish")
 	}
 }
+
+func Test_scaleDownGroup_reducedReplicas(t *testing.T) {
+	log.SetDefault(log.New(log.NewJSONHandler(io.Discard, &log.HandlerOptions{Level: log.LevelError})))
+	timeInterval = 10 * time.Millisecond
+	timeout = 2 * time.Second
+
+	labels := map[string]string{"app": "auth-stub"}
+	client := fake.NewClientset(
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "auth-stub", Namespace: "auth"},
+			Spec:       appsv1.DeploymentSpec{Replicas: int32Ptr(3)},
+		},
+		&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "auth-stub-abc", Namespace: "auth", Labels: labels}, Spec: v1.PodSpec{NodeName: "shared-1"}},
+		&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "standalone", Namespace: "auth"}, Spec: v1.PodSpec{NodeName: "apps-1"}},
+		&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "asleep-abc", Namespace: "auth", Labels: map[string]string{maintenancePageKey: "true"}}, Spec: v1.PodSpec{NodeName: "apps-2"}},
+	)
+	rep := report.New(string(config.ScaleDown))
+	s := &Service{
+		startUpOrder: startUpOrder{
+			2: []*k8sResource{{Name: "auth-stub", Namespace: "auth", ResourceType: resourceTypeDeployment, ReplicaCount: 3, ScaleDownReplicas: 1, Selector: "app=auth-stub"}},
+		},
+		conf:         config.Config{K8sClient: client},
+		report:       rep,
+		retryBackoff: wait.Backoff{Duration: 10 * time.Millisecond, Factor: 1.0, Jitter: 0.1, Steps: 1},
+	}
+
+	// The remaining pod is within the reduced count, so the wait completes without it terminating
+	require.NoError(t, s.scaleDownGroup(t.Context(), 2))
+
+	d, err := client.AppsV1().Deployments("auth").Get(t.Context(), "auth-stub", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), *d.Spec.Replicas)
+	assert.Equal(t, "3", d.Annotations[originalReplicasAnnotationKey])
+	require.Len(t, rep.Resources, 1)
+	assert.Equal(t, int32(1), rep.Resources[0].ReplicasAfter)
+
+	// A repeated scale down keeps the original replica count
+	require.NoError(t, s.scaleDownGroup(t.Context(), 2))
+	d, err = client.AppsV1().Deployments("auth").Get(t.Context(), "auth-stub", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "3", d.Annotations[originalReplicasAnnotationKey])
+	require.Len(t, rep.Skipped, 1)
+	assert.Equal(t, "already at or below 1 replica(s)", rep.Skipped[0].Reason)
+
+	require.NoError(t, s.terminateStandalonePods(t.Context()))
+	pods, err := client.CoreV1().Pods("auth").List(t.Context(), metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, pods.Items, 2)
+	assert.Equal(t, "asleep-abc", pods.Items[0].Name, "Expected the maintenance page's pod to be left running")
+	assert.Equal(t, "auth-stub-abc", pods.Items[1].Name, "Expected the reduced workload's pod to be left running")
+
+	nodes, err := s.NodesInUse(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"apps-2", "shared-1"}, nodes, "Expected the nodes running the maintenance page's and reduced workload's pods to be kept")
+}
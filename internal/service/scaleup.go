@@ -7,12 +7,16 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/michaelprice232/eks-env-scaledown/internal/report"
+	"github.com/michaelprice232/eks-env-scaledown/internal/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/util/retry"
 )
 
-func (s *Service) scaleUpGroup(groupNumber int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+func (s *Service) scaleUpGroup(ctx context.Context, groupNumber int) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
 	var resources []*k8sResource
@@ -25,7 +29,9 @@ func (s *Service) scaleUpGroup(groupNumber int) error {
 		if resource.ResourceType == resourceTypeDeployment {
 			// Use a retry function to handle conflicts on updates from concurrent changes
 			// https://github.com/kubernetes/client-go/tree/master/examples/create-update-delete-deployment
+			var change *report.Resource
 			retryErr := retry.RetryOnConflict(s.retryBackoff, func() error {
+				change = nil
 				result, getErr := s.conf.K8sClient.AppsV1().Deployments(resource.Namespace).Get(ctx, resource.Name, metav1.GetOptions{})
 				if getErr != nil {
 					return fmt.Errorf("getting deployment %s: %w", result.Name, getErr)
@@ -34,6 +40,7 @@ func (s *Service) scaleUpGroup(groupNumber int) error {
 				replicasRaw, found := result.Annotations[originalReplicasAnnotationKey]
 				if !found {
 					log.Warn("NumReplicas Annotation key not set. The resource might have been created after the scaledown or was already scaled to zero. Skipping", "key", originalReplicasAnnotationKey, "type", resource.ResourceType, "resource", result.Name, "Namespace", result.Namespace)
+					s.report.AddSkipped(report.Skipped{Kind: resource.ResourceType, Namespace: resource.Namespace, Name: resource.Name, Reason: "original replicas annotation not set"})
 					return nil
 				}
 
@@ -43,6 +50,7 @@ func (s *Service) scaleUpGroup(groupNumber int) error {
 				}
 				replicas := int32(replica64)
 
+				change = newResourceChange(groupNumber, resource, result.Spec.Replicas, replicas)
 				result.Spec.Replicas = &replicas
 				delete(result.Annotations, originalReplicasAnnotationKey)
 				result.Annotations[updatedAtAnnotationKey] = time.Now().Format(time.RFC3339)
@@ -53,15 +61,21 @@ func (s *Service) scaleUpGroup(groupNumber int) error {
 				return updateErr
 			})
 			if retryErr != nil {
-				return fmt.Errorf("failed to update deployment %s in Namespace %s: %w", resource.Name, resource.Namespace, retryErr)
+				if err := s.handleResourceError(groupNumber, resource, fmt.Errorf("failed to update deployment %s in Namespace %s: %w", resource.Name, resource.Namespace, retryErr)); err != nil {
+					return err
+				}
+				continue
 			}
+			s.recordResourceChange(change)
 			log.Debug("Deployment scaled up", resourceTypeDeployment, resource.Name, "Namespace", resource.Namespace)
 		}
 
 		if resource.ResourceType == resourceTypeStatefulSet {
 			// Use a retry function to handle conflicts on updates from concurrent changes
 			// https://github.com/kubernetes/client-go/tree/master/examples/create-update-delete-deployment
+			var change *report.Resource
 			retryErr := retry.RetryOnConflict(s.retryBackoff, func() error {
+				change = nil
 				result, getErr := s.conf.K8sClient.AppsV1().StatefulSets(resource.Namespace).Get(ctx, resource.Name, metav1.GetOptions{})
 				if getErr != nil {
 					return fmt.Errorf("getting statefulset %s: %w", result.Name, getErr)
@@ -70,6 +84,7 @@ func (s *Service) scaleUpGroup(groupNumber int) error {
 				replicasRaw, found := result.Annotations[originalReplicasAnnotationKey]
 				if !found {
 					log.Warn("NumReplicas Annotation key not set. The resource might have been created after the scaledown or was already scaled to zero. Skipping", "key", originalReplicasAnnotationKey, "type", resource.ResourceType, "resource", result.Name, "Namespace", result.Namespace)
+					s.report.AddSkipped(report.Skipped{Kind: resource.ResourceType, Namespace: resource.Namespace, Name: resource.Name, Reason: "original replicas annotation not set"})
 					return nil
 				}
 
@@ -79,6 +94,7 @@ func (s *Service) scaleUpGroup(groupNumber int) error {
 				}
 				replicas := int32(replica64)
 
+				change = newResourceChange(groupNumber, resource, result.Spec.Replicas, replicas)
 				result.Spec.Replicas = &replicas
 				delete(result.Annotations, originalReplicasAnnotationKey)
 				result.Annotations[updatedAtAnnotationKey] = time.Now().Format(time.RFC3339)
@@ -89,25 +105,35 @@ func (s *Service) scaleUpGroup(groupNumber int) error {
 				return updateErr
 			})
 			if retryErr != nil {
-				return fmt.Errorf("failed to update %s %s in Namespace %s: %w", resource.ResourceType, resource.Name, resource.Namespace, retryErr)
+				if err := s.handleResourceError(groupNumber, resource, fmt.Errorf("failed to update %s %s in Namespace %s: %w", resource.ResourceType, resource.Name, resource.Namespace, retryErr)); err != nil {
+					return err
+				}
+				continue
 			}
+			s.recordResourceChange(change)
 			log.Debug("Statefulset scaled up", resourceTypeStatefulSet, resource.Name, "Namespace", resource.Namespace)
 		}
 	}
 
 	if !s.skipPodWait {
-		if err := s.waitForPodsReady(resources); err != nil {
-			return fmt.Errorf("waiting for pods to be ready: %w", err)
+		if err := s.waitForPodsReady(ctx, resources); err != nil {
+			err = fmt.Errorf("waiting for pods to be ready: %w", err)
+			if err = s.handleWaitError(groupNumber, resources, func(r *k8sResource) bool { return r.podsUpdatedAndReady }, err); err != nil {
+				return err
+			}
 		}
 	}
 
 	return nil
 }
 
-func (s *Service) waitForPodsReady(resources []*k8sResource) error {
+func (s *Service) waitForPodsReady(ctx context.Context, resources []*k8sResource) (err error) {
+	ctx, span := tracing.Start(ctx, "wait for pods ready", attribute.Int("resources", len(resources)))
+	defer func() { tracing.End(span, err) }()
+
 	ticker := time.NewTicker(timeInterval)
 	defer ticker.Stop()
-	ctx, cancelCtx := context.WithTimeout(context.Background(), timeout)
+	ctx, cancelCtx := context.WithTimeout(ctx, timeout)
 	defer cancelCtx()
 
 	for {
@@ -124,7 +150,7 @@ func (s *Service) waitForPodsReady(resources []*k8sResource) error {
 				// resources become ready the per-tick call count shrinks toward zero,
 				// keeping the rate limiter's backlog bounded rather than growing until
 				// it exceeds the context deadline.
-				if r.podsUpdatedAndReady {
+				if r.podsUpdatedAndReady || r.failed {
 					continue
 				}
 				if r.ResourceType == resourceTypeDeployment {
@@ -180,7 +206,7 @@ func (s *Service) waitForPodsReady(resources []*k8sResource) error {
 func podsUpdatedAndReady(resources []*k8sResource) bool {
 	podsReady := true
 	for _, r := range resources {
-		if !r.podsUpdatedAndReady {
+		if !r.podsUpdatedAndReady && !r.failed {
 			podsReady = false
 		}
 	}
@@ -94,7 +94,7 @@ func Test_scaleUpGroup_deployments(t *testing.T) {
 				s.startUpOrder = nil
 			}
 
-			err := s.scaleUpGroup(tc.group)
+			err := s.scaleUpGroup(context.Background(), tc.group)
 			if tc.wantErr {
 				assert.Error(t, err)
 			} else {
@@ -199,7 +199,7 @@ func Test_scaleUpGroup_statefulsets(t *testing.T) {
 				s.startUpOrder = nil
 			}
 
-			err := s.scaleUpGroup(tc.group)
+			err := s.scaleUpGroup(context.Background(), tc.group)
 			if tc.wantErr {
 				assert.Error(t, err)
 			} else {
@@ -3,13 +3,17 @@
 package service
 
 import (
+	"context"
 	"fmt"
 	log "log/slog"
 	"sort"
 	"time"
 
 	"github.com/michaelprice232/eks-env-scaledown/config"
+	"github.com/michaelprice232/eks-env-scaledown/internal/report"
+	"github.com/michaelprice232/eks-env-scaledown/internal/tracing"
 
+	"go.opentelemetry.io/otel/attribute"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/util/retry"
 )
@@ -20,6 +24,9 @@ const (
 	updatedAtAnnotationKey              = "eks-env-scaledown/updated-at"
 	cronJobWasDisabledAnnotationKey     = "eks-env-scaledown/cronjob-was-disabled"
 	cronJobWasDisabledValue             = "yes"
+	criticalAnnotationKey               = "eks-env-scaledown/critical"
+	keepAliveAnnotationKey              = "eks-env-scaledown/keep-alive-until"
+	scaleDownReplicasAnnotationKey      = "eks-env-scaledown/scaledown-replicas"
 	kedaPausedKey                       = "autoscaling.keda.sh/paused"
 	defaultStartUpGroup             int = 100
 	cronJobAppName                      = "eks-env-scaledown"
@@ -38,9 +45,12 @@ type k8sResource struct {
 	ResourceType        string
 	Namespace           string
 	ReplicaCount        int32
+	ScaleDownReplicas   int32
 	Selector            string
+	Critical            bool
 	podsTerminated      bool
 	podsUpdatedAndReady bool
+	failed              bool
 }
 
 type startUpOrder map[int][]*k8sResource
@@ -51,38 +61,97 @@ type Service struct {
 	startUpOrder startUpOrder
 	retryBackoff wait.Backoff
 	skipPodWait  bool
+
+	// report records what the run changed. A nil report disables recording
+	report *report.Report
+
+	// failures collects per-resource and per-step errors when running in continue-on-error mode
+	failures []Failure
+
+	// beforeScaleUpGroup and afterScaleDownGroup are called around each startup group, so resources outside the
+	// cluster can be started and stopped at their point in the run. Nil hooks are skipped
+	beforeScaleUpGroup  GroupHook
+	afterScaleDownGroup GroupHook
+
+	// keptAliveNamespaces, keptAliveResources and keptAliveGroups are what a keep-alive postponed the scale down of,
+	// and keptAliveUntil the earliest expiry among them
+	keptAliveNamespaces map[string]time.Time
+	keptAliveResources  []*k8sResource
+	keptAliveGroups     map[int]bool
+	keptAliveUntil      time.Time
+}
+
+// GroupHook is called with the number of a startup group as it is scaled.
+type GroupHook func(ctx context.Context, group int) error
+
+// BeforeScaleUpGroup registers fn to be called before each startup group is scaled up.
+func (s *Service) BeforeScaleUpGroup(fn GroupHook) {
+	s.beforeScaleUpGroup = fn
+}
+
+// AfterScaleDownGroup registers fn to be called once each startup group has been scaled down.
+func (s *Service) AfterScaleDownGroup(fn GroupHook) {
+	s.afterScaleDownGroup = fn
 }
 
-// NewService returns a Service configured with the supplied config.
-func NewService(c config.Config) (*Service, error) {
+// runGroupHook calls hook for group, treating a failure as a failed step in continue-on-error mode.
+func (s *Service) runGroupHook(ctx context.Context, hook GroupHook, step string, group int) error {
+	if hook == nil {
+		return nil
+	}
+
+	if err := hook(ctx, group); err != nil {
+		step = fmt.Sprintf("%s group %d", step, group)
+		if err = s.handleStepError(step, err); err != nil {
+			return fmt.Errorf("%s: %w", step, err)
+		}
+	}
+
+	return nil
+}
+
+// NewService returns a Service configured with the supplied config, recording its changes in rep.
+func NewService(c config.Config, rep *report.Report) (*Service, error) {
 	return &Service{
 		conf:         c,
 		retryBackoff: retry.DefaultRetry,
+		report:       rep,
 	}, nil
 }
 
-// Run scales the environment up or down depending on the configured ScaleAction.
-func (s *Service) Run() error {
+// Run scales the environment up or down, or enforces its scale down, depending on the configured ScaleAction.
+func (s *Service) Run(ctx context.Context) (err error) {
+	ctx, span := tracing.Start(ctx, "Service.Run", attribute.String("action", string(s.conf.Action)))
+	defer func() { tracing.End(span, err) }()
+
 	switch s.conf.Action {
 	case config.ScaleUp:
-		if err := s.envScaleUp(); err != nil {
+		if err := s.envScaleUp(ctx); err != nil {
 			return fmt.Errorf("scaling environment up: %w", err)
 		}
 	case config.ScaleDown:
-		if err := s.envScaleDown(); err != nil {
+		if err := s.envScaleDown(ctx); err != nil {
 			return fmt.Errorf("scaling environment down: %w", err)
 		}
+	case config.Enforce:
+		if err := s.envEnforce(ctx); err != nil {
+			return fmt.Errorf("enforcing environment scale down: %w", err)
+		}
 	default:
-		return fmt.Errorf("invalid ScaleAction detected. Must be 'ScaleUp' or 'ScaleDown'")
+		return fmt.Errorf("invalid ScaleAction detected. Must be 'ScaleUp', 'ScaleDown' or 'Enforce'")
+	}
+
+	if len(s.failures) > 0 {
+		return &FailuresError{Failures: s.failures}
 	}
 
 	return nil
 }
 
-func (s *Service) envScaleUp() error {
+func (s *Service) envScaleUp(ctx context.Context) error {
 	log.Info("Scaling environment up")
 
-	if err := s.buildStartUpOrder(); err != nil {
+	if err := tracing.WithSpan(ctx, "build startup order", s.buildStartUpOrder); err != nil {
 		return fmt.Errorf("building startup order: %w", err)
 	}
 
@@ -93,49 +162,104 @@ func (s *Service) envScaleUp() error {
 
 	sort.Ints(scaleOrder)
 	log.Debug("Scale up order", "order", scaleOrder)
+	s.report.SetPlannedGroups(scaleOrder)
 
 	for _, order := range scaleOrder {
+		if err := s.runGroupHook(ctx, s.beforeScaleUpGroup, "starting external resources before", order); err != nil {
+			return err
+		}
+
 		log.Info("Scaling up group", "group", order)
-		if err := s.scaleUpGroup(order); err != nil {
+		start := time.Now()
+		err := tracing.WithSpan(ctx, "scale up group", func(ctx context.Context) error {
+			return s.scaleUpGroup(ctx, order)
+		}, attribute.Int("group", order), attribute.Int("resources", len(s.startUpOrder[order])))
+		if err != nil {
 			return fmt.Errorf("scaling up group %d: %w", order, err)
 		}
+		s.report.AddGroup(order, time.Since(start), len(s.startUpOrder[order]))
+	}
+
+	if s.conf.MaintenancePageService != "" {
+		log.Info("Restoring the Ingresses pointed to the maintenance page")
+		err := tracing.WithSpan(ctx, "restore Ingresses", func(ctx context.Context) error {
+			return s.updateIngresses(ctx, config.ScaleUp)
+		})
+		if err != nil {
+			if err = s.handleStepError("restoring Ingresses", err); err != nil {
+				return fmt.Errorf("restoring Ingresses: %w", err)
+			}
+		}
 	}
 
 	if s.conf.SuspendCronJob {
 		log.Info("Enabling all CronJobs except for the ones which manage this app or were previously disabled", "AppLabel", cronJobAppName)
-		if err := s.updateCronJobs(); err != nil {
-			return fmt.Errorf("re-enabling CronJobs: %w", err)
+		if err := tracing.WithSpan(ctx, "re-enable CronJobs", s.updateCronJobs); err != nil {
+			if err = s.handleStepError("re-enabling CronJobs", err); err != nil {
+				return fmt.Errorf("re-enabling CronJobs: %w", err)
+			}
 		}
 	}
 
 	if s.conf.SuspendKeda {
 		log.Info("Unpausing Keda ScaledObjects")
-		if err := s.updateKedaScaleObjects(config.ScaleUp); err != nil {
-			return fmt.Errorf("unpausing Keda ScaledObjects: %w", err)
+		err := tracing.WithSpan(ctx, "unpause Keda ScaledObjects", func(ctx context.Context) error {
+			return s.updateKedaScaleObjects(ctx, config.ScaleUp)
+		})
+		if err != nil {
+			if err = s.handleStepError("unpausing Keda ScaledObjects", err); err != nil {
+				return fmt.Errorf("unpausing Keda ScaledObjects: %w", err)
+			}
 		}
 	}
 
 	return nil
 }
 
-func (s *Service) envScaleDown() error {
+func (s *Service) envScaleDown(ctx context.Context) error {
 	log.Info("Scaling environment down")
 
+	if err := tracing.WithSpan(ctx, "load namespace keep-alives", s.loadNamespaceKeepAlives); err != nil {
+		if err = s.handleStepError("loading namespace keep-alives", err); err != nil {
+			return fmt.Errorf("loading namespace keep-alives: %w", err)
+		}
+	}
+
+	// Re-point the Ingresses first, so testers see the maintenance page rather than errors as the workloads go down
+	if s.conf.MaintenancePageService != "" {
+		log.Info("Pointing Ingresses to the maintenance page", "service", s.conf.MaintenancePageService)
+		err := tracing.WithSpan(ctx, "re-point Ingresses", func(ctx context.Context) error {
+			return s.updateIngresses(ctx, config.ScaleDown)
+		})
+		if err != nil {
+			if err = s.handleStepError("re-pointing Ingresses", err); err != nil {
+				return fmt.Errorf("re-pointing Ingresses: %w", err)
+			}
+		}
+	}
+
 	if s.conf.SuspendKeda {
 		log.Info("Pausing Keda ScaledObjects")
-		if err := s.updateKedaScaleObjects(config.ScaleDown); err != nil {
-			return fmt.Errorf("pausing Keda ScaledObjects: %w", err)
+		err := tracing.WithSpan(ctx, "pause Keda ScaledObjects", func(ctx context.Context) error {
+			return s.updateKedaScaleObjects(ctx, config.ScaleDown)
+		})
+		if err != nil {
+			if err = s.handleStepError("pausing Keda ScaledObjects", err); err != nil {
+				return fmt.Errorf("pausing Keda ScaledObjects: %w", err)
+			}
 		}
 	}
 
 	if s.conf.SuspendCronJob {
 		log.Info("Suspending all CronJobs except for the ones which manage this app", "AppLabel", cronJobAppName)
-		if err := s.updateCronJobs(); err != nil {
-			return fmt.Errorf("suspending CronJobs: %w", err)
+		if err := tracing.WithSpan(ctx, "suspend CronJobs", s.updateCronJobs); err != nil {
+			if err = s.handleStepError("suspending CronJobs", err); err != nil {
+				return fmt.Errorf("suspending CronJobs: %w", err)
+			}
 		}
 	}
 
-	if err := s.buildStartUpOrder(); err != nil {
+	if err := tracing.WithSpan(ctx, "build startup order", s.buildStartUpOrder); err != nil {
 		return fmt.Errorf("building startup order: %w", err)
 	}
 
@@ -146,21 +270,70 @@ func (s *Service) envScaleDown() error {
 
 	sort.Sort(sort.Reverse(sort.IntSlice(scaleOrder)))
 	log.Debug("Scale down order", "order", scaleOrder)
+	s.report.SetPlannedGroups(scaleOrder)
 
 	for _, order := range scaleOrder {
 		log.Info("Scaling down group", "group", order)
-		if err := s.scaleDownGroup(order); err != nil {
+		start := time.Now()
+		err := tracing.WithSpan(ctx, "scale down group", func(ctx context.Context) error {
+			return s.scaleDownGroup(ctx, order)
+		}, attribute.Int("group", order), attribute.Int("resources", len(s.startUpOrder[order])))
+		if err != nil {
 			return fmt.Errorf("scaling down group %d: %w", order, err)
 		}
+		s.report.AddGroup(order, time.Since(start), len(s.startUpOrder[order]))
+
+		// Workloads which failed to scale down may still be using the external resources of this and the lower groups
+		if len(s.failures) > 0 {
+			log.Warn("Leaving the group's external resources running as not every workload was scaled down", "group", order)
+			continue
+		}
+		// The group's external resources may still be in use by its kept alive workloads
+		if s.keptAliveGroups[order] {
+			log.Info("Leaving the group's external resources running as some of its workloads are kept alive", "group", order)
+			continue
+		}
+		if err = s.runGroupHook(ctx, s.afterScaleDownGroup, "stopping external resources after", order); err != nil {
+			return err
+		}
 	}
 
 	log.Info("Terminating standalone pods")
-	if err := s.terminateStandalonePods(); err != nil {
-		return fmt.Errorf("terminating standalone pods: %w", err)
+	if err := tracing.WithSpan(ctx, "terminate standalone pods", s.terminateStandalonePods); err != nil {
+		if err = s.handleStepError("terminating standalone pods", err); err != nil {
+			return fmt.Errorf("terminating standalone pods: %w", err)
+		}
 	}
 
 	return nil
 }
 
+// newResourceChange describes a pending replica change for the run report. current is the
+// workload's Spec.Replicas, which the API server defaults to 1 when unset.
+func newResourceChange(groupNumber int, r *k8sResource, current *int32, replicas int32) *report.Resource {
+	before := int32(1)
+	if current != nil {
+		before = *current
+	}
+
+	return &report.Resource{
+		Group:          groupNumber,
+		Type:           r.ResourceType,
+		Namespace:      r.Namespace,
+		Name:           r.Name,
+		ReplicasBefore: before,
+		ReplicasAfter:  replicas,
+	}
+}
+
+// recordResourceChange adds a completed replica change to the run report. A nil change means
+// the resource was skipped.
+func (s *Service) recordResourceChange(change *report.Resource) {
+	if change == nil {
+		return
+	}
+	s.report.AddResource(*change)
+}
+
 func int32Ptr(i int32) *int32 { return &i }
 func boolPtr(b bool) *bool    { return &b }
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	log "log/slog"
+	"sort"
 	"strconv"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -18,8 +19,61 @@ func convertLabelSelectorToString(ls *metav1.LabelSelector) (string, error) {
 	return selector.String(), nil
 }
 
-func (s *Service) buildStartUpOrder() error {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+// isCritical reports whether the workload is marked as critical, meaning a failure to scale it
+// aborts the run even when continue-on-error mode is enabled.
+func isCritical(annotations map[string]string, resourceType, name, namespace string) bool {
+	value, found := annotations[criticalAnnotationKey]
+	if !found {
+		return false
+	}
+
+	critical, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Warn("Unable to parse the bool from the critical key. Treating as non-critical", resourceType, name, "Namespace", namespace, "value", value, "key", criticalAnnotationKey)
+		return false
+	}
+
+	return critical
+}
+
+// scaleDownReplicas returns the replica count the workload is scaled down to: its annotation if set and valid, otherwise
+// its namespace's default from SCALEDOWN_REPLICAS, otherwise zero.
+func (s *Service) scaleDownReplicas(annotations map[string]string, resourceType, name, namespace string) int32 {
+	if value, found := annotations[scaleDownReplicasAnnotationKey]; found {
+		replicas, err := strconv.ParseInt(value, 10, 32)
+		if err == nil && replicas >= 0 {
+			return int32(replicas)
+		}
+		log.Warn("Unable to parse a replica count of 0 or more from the scale down replicas key. Using the namespace default", resourceType, name, "Namespace", namespace, "value", value, "key", scaleDownReplicasAnnotationKey)
+	}
+
+	return s.conf.ScaleDownReplicas[namespace]
+}
+
+// startUpGroup returns the workload's startup group from its annotation. The default group, which starts up last, is
+// returned if it isn't set or isn't valid.
+func startUpGroup(annotations map[string]string, resourceType, name, namespace string) int {
+	orderKey, found := annotations[startupOrderAnnotationKey]
+	if !found {
+		return defaultStartUpGroup
+	}
+
+	so, err := strconv.Atoi(orderKey)
+	if err != nil {
+		log.Warn("Unable to parse the int from the startup order key. Assigning to default group", resourceType, name, "Namespace", namespace, "originalOrder", orderKey, "key", startupOrderAnnotationKey)
+		return defaultStartUpGroup
+	}
+
+	if so < 0 || so >= defaultStartUpGroup {
+		log.Warn("startUpOrder number can only be from 0 to 99. Assigning to default group", resourceType, name, "Namespace", namespace, "originalOrder", so, "defaultGroup", defaultStartUpGroup)
+		return defaultStartUpGroup
+	}
+
+	return so
+}
+
+func (s *Service) buildStartUpOrder(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
 	orders := make(startUpOrder)
@@ -31,6 +85,15 @@ func (s *Service) buildStartUpOrder() error {
 	}
 
 	for _, d := range deployments.Items {
+		if d.Labels["app"] == cronJobAppName {
+			log.Debug("Skipping workload which runs this app, such as the controller", resourceTypeDeployment, d.Name, "Namespace", d.Namespace)
+			continue
+		}
+		if isMaintenancePage(d.Labels) {
+			log.Debug("Skipping the maintenance page workload, which serves the Ingresses whilst scaled down", resourceTypeDeployment, d.Name, "Namespace", d.Namespace)
+			continue
+		}
+
 		selector, err := convertLabelSelectorToString(d.Spec.Selector)
 		if err != nil {
 			return err
@@ -43,32 +106,20 @@ func (s *Service) buildStartUpOrder() error {
 		}
 
 		res := &k8sResource{
-			Name:         d.Name,
-			ResourceType: resourceTypeDeployment,
-			Namespace:    d.Namespace,
-			ReplicaCount: replicaCount,
-			Selector:     selector,
+			Name:              d.Name,
+			ResourceType:      resourceTypeDeployment,
+			Namespace:         d.Namespace,
+			ReplicaCount:      replicaCount,
+			ScaleDownReplicas: s.scaleDownReplicas(d.Annotations, resourceTypeDeployment, d.Name, d.Namespace),
+			Selector:          selector,
+			Critical:          isCritical(d.Annotations, resourceTypeDeployment, d.Name, d.Namespace),
 		}
 
-		if orderKey, found := d.Annotations[startupOrderAnnotationKey]; found {
-			so, err := strconv.Atoi(orderKey)
-			if err != nil {
-				log.Warn("Unable to parse the int from the startup order key. Assigning to default group", resourceTypeDeployment, d.Name, "Namespace", d.Namespace, "originalOrder", orderKey, "key", startupOrderAnnotationKey)
-				orders[defaultStartUpGroup] = append(orders[defaultStartUpGroup], res)
-				continue
-			}
-
-			if so < 0 || so >= defaultStartUpGroup {
-				log.Warn("startUpOrder number can only be from 0 to 99. Assigning to default group", resourceTypeDeployment, d.Name, "Namespace", d.Namespace, "originalOrder", so, "defaultGroup", defaultStartUpGroup)
-				orders[defaultStartUpGroup] = append(orders[defaultStartUpGroup], res)
-				continue
-			}
-
-			orders[so] = append(orders[so], res)
+		group := startUpGroup(d.Annotations, resourceTypeDeployment, d.Name, d.Namespace)
+		if s.keepAlive(res, d.Annotations, group) {
 			continue
 		}
-		// Assign to the default group which starts up last if not set
-		orders[defaultStartUpGroup] = append(orders[defaultStartUpGroup], res)
+		orders[group] = append(orders[group], res)
 	}
 
 	// Statefulsets
@@ -77,6 +128,15 @@ func (s *Service) buildStartUpOrder() error {
 		return fmt.Errorf("listing K8s statefulsets: %w", err)
 	}
 	for _, ss := range statefulset.Items {
+		if ss.Labels["app"] == cronJobAppName {
+			log.Debug("Skipping workload which runs this app, such as the controller", resourceTypeStatefulSet, ss.Name, "Namespace", ss.Namespace)
+			continue
+		}
+		if isMaintenancePage(ss.Labels) {
+			log.Debug("Skipping the maintenance page workload, which serves the Ingresses whilst scaled down", resourceTypeStatefulSet, ss.Name, "Namespace", ss.Namespace)
+			continue
+		}
+
 		selector, err := convertLabelSelectorToString(ss.Spec.Selector)
 		if err != nil {
 			return err
@@ -89,32 +149,20 @@ func (s *Service) buildStartUpOrder() error {
 		}
 
 		res := &k8sResource{
-			Name:         ss.Name,
-			ResourceType: resourceTypeStatefulSet,
-			Namespace:    ss.Namespace,
-			ReplicaCount: replicaCount,
-			Selector:     selector,
+			Name:              ss.Name,
+			ResourceType:      resourceTypeStatefulSet,
+			Namespace:         ss.Namespace,
+			ReplicaCount:      replicaCount,
+			ScaleDownReplicas: s.scaleDownReplicas(ss.Annotations, resourceTypeStatefulSet, ss.Name, ss.Namespace),
+			Selector:          selector,
+			Critical:          isCritical(ss.Annotations, resourceTypeStatefulSet, ss.Name, ss.Namespace),
 		}
 
-		if orderKey, found := ss.Annotations[startupOrderAnnotationKey]; found {
-			so, err := strconv.Atoi(orderKey)
-			if err != nil {
-				log.Warn("Unable to parse the int from the startup order key. Assigning to default group", resourceTypeStatefulSet, ss.Name, "Namespace", ss.Namespace, "originalOrder", orderKey, "key", startupOrderAnnotationKey)
-				orders[defaultStartUpGroup] = append(orders[defaultStartUpGroup], res)
-				continue
-			}
-
-			if so < 0 || so >= defaultStartUpGroup {
-				log.Warn("startUpOrder number can only be from 0 to 99. Assigning to default group", resourceTypeStatefulSet, ss.Name, "Namespace", ss.Namespace, "originalOrder", so, "defaultGroup", defaultStartUpGroup)
-				orders[defaultStartUpGroup] = append(orders[defaultStartUpGroup], res)
-				continue
-			}
-
-			orders[so] = append(orders[so], res)
+		group := startUpGroup(ss.Annotations, resourceTypeStatefulSet, ss.Name, ss.Namespace)
+		if s.keepAlive(res, ss.Annotations, group) {
 			continue
 		}
-		// Assign to the default group which starts up last if not set
-		orders[defaultStartUpGroup] = append(orders[defaultStartUpGroup], res)
+		orders[group] = append(orders[group], res)
 	}
 
 	log.Debug("Completed building startUpOrder", "orders", orders)
@@ -122,3 +170,36 @@ func (s *Service) buildStartUpOrder() error {
 
 	return nil
 }
+
+// TargetNamespaces returns the sorted namespaces which contain Deployments or StatefulSets, i.e. the
+// namespaces a run scales. Used to scope alert silences before the scaling starts.
+func (s *Service) TargetNamespaces(ctx context.Context) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	seen := make(map[string]struct{})
+
+	deployments, err := s.conf.K8sClient.AppsV1().Deployments("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("listing K8s deployments: %w", err)
+	}
+	for _, d := range deployments.Items {
+		seen[d.Namespace] = struct{}{}
+	}
+
+	statefulSets, err := s.conf.K8sClient.AppsV1().StatefulSets("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("listing K8s statefulsets: %w", err)
+	}
+	for _, ss := range statefulSets.Items {
+		seen[ss.Namespace] = struct{}{}
+	}
+
+	namespaces := make([]string, 0, len(seen))
+	for ns := range seen {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+
+	return namespaces, nil
+}
@@ -1,6 +1,7 @@
 package service
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -10,7 +11,9 @@ import (
 	"github.com/michaelprice232/eks-env-scaledown/config"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes/fake"
@@ -120,7 +123,7 @@ func Test_BuildStartUpOrder_Deployments(t *testing.T) {
 				})
 			}
 
-			err := s.buildStartUpOrder()
+			err := s.buildStartUpOrder(context.Background())
 			if tc.wantErr {
 				assert.Error(t, err, "Expected error in test case: %s", tc.name)
 			} else {
@@ -244,7 +247,7 @@ func Test_BuildStartUpOrder_Statefulsets(t *testing.T) {
 				})
 			}
 
-			err := s.buildStartUpOrder()
+			err := s.buildStartUpOrder(context.Background())
 			if tc.wantErr {
 				assert.Error(t, err, "Expected error in test case: %s", tc.name)
 			} else {
@@ -301,7 +304,7 @@ func Test_BuildStartUpOrder_MultipleGroups(t *testing.T) {
 		},
 	}
 
-	err := s.buildStartUpOrder()
+	err := s.buildStartUpOrder(context.Background())
 
 	assert.NoError(t, err)
 	assert.NotNil(t, s.startUpOrder, "Expected the startup order to be initialised")
@@ -312,3 +315,70 @@ func Test_BuildStartUpOrder_MultipleGroups(t *testing.T) {
 		assert.Equal(t, len(s.startUpOrder), 2, "Expected there to be two startup groups")
 	}
 }
+
+func Test_BuildStartUpOrder_skipsThisApp(t *testing.T) {
+	log.SetDefault(log.New(log.NewJSONHandler(io.Discard, &log.HandlerOptions{Level: log.LevelError})))
+
+	controllerLabels := map[string]string{"app": cronJobAppName}
+	client := fake.NewClientset(
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "eks-env-scaledown-controller", Namespace: "eks-env-scaledown", Labels: controllerLabels},
+			Spec:       appsv1.DeploymentSpec{Replicas: int32Ptr(2), Selector: &metav1.LabelSelector{MatchLabels: controllerLabels}},
+		},
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "eks-env-scaledown-controller-abc", Namespace: "eks-env-scaledown", Labels: controllerLabels}},
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "nginx", Namespace: "web"},
+			Spec:       appsv1.DeploymentSpec{Replicas: int32Ptr(2), Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "nginx"}}},
+		},
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "nginx-abc", Namespace: "web", Labels: map[string]string{"app": "nginx"}}},
+	)
+	s := &Service{conf: config.Config{K8sClient: client}}
+
+	require.NoError(t, s.buildStartUpOrder(t.Context()))
+	require.Len(t, s.startUpOrder[defaultStartUpGroup], 1, "Expected the controller's Deployment to be left out of the startup order")
+	assert.Equal(t, "nginx", s.startUpOrder[defaultStartUpGroup][0].Name)
+
+	require.NoError(t, s.terminateStandalonePods(t.Context()))
+	pods, err := client.CoreV1().Pods("").List(t.Context(), metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, pods.Items, 1, "Expected only the controller's pod to survive")
+	assert.Equal(t, "eks-env-scaledown-controller-abc", pods.Items[0].Name)
+}
+
+func Test_scaleDownReplicas(t *testing.T) {
+	log.SetDefault(log.New(log.NewJSONHandler(io.Discard, &log.HandlerOptions{Level: log.LevelError})))
+
+	s := &Service{conf: config.Config{ScaleDownReplicas: map[string]int32{"auth": 2}}}
+
+	tests := []struct {
+		name        string
+		namespace   string
+		annotations map[string]string
+		expected    int32
+	}{
+		{name: "no annotation or namespace default", namespace: "web", expected: 0},
+		{name: "namespace default", namespace: "auth", expected: 2},
+		{name: "annotation takes precedence", namespace: "auth", annotations: map[string]string{scaleDownReplicasAnnotationKey: "1"}, expected: 1},
+		{name: "annotation of zero", namespace: "auth", annotations: map[string]string{scaleDownReplicasAnnotationKey: "0"}, expected: 0},
+		{name: "invalid annotation uses the namespace default", namespace: "auth", annotations: map[string]string{scaleDownReplicasAnnotationKey: "one"}, expected: 2},
+		{name: "negative annotation uses the namespace default", namespace: "web", annotations: map[string]string{scaleDownReplicasAnnotationKey: "-1"}, expected: 0},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, s.scaleDownReplicas(tc.annotations, resourceTypeDeployment, "stub", tc.namespace))
+		})
+	}
+}
+
+func TestTargetNamespaces(t *testing.T) {
+	s := &Service{conf: config.Config{K8sClient: fake.NewClientset(
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "nginx", Namespace: "web"}},
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "web"}},
+		&appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "postgres", Namespace: "data"}},
+	)}}
+
+	namespaces, err := s.TargetNamespaces(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"data", "web"}, namespaces)
+}
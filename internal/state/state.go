@@ -0,0 +1,107 @@
+// Package state persists small pieces of state between runs, such as the IDs of maintenance windows
+// opened at scale down which must be closed at scale up, in a ConfigMap alongside the app.
+package state
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// ConfigMapName is the ConfigMap which holds the state carried between runs.
+const ConfigMapName = "eks-env-scaledown-state"
+
+const stateTimeout = 30 * time.Second
+
+// Store reads and writes keys in the state ConfigMap. A nil Store holds nothing and discards writes.
+type Store struct {
+	client    kubernetes.Interface
+	namespace string
+}
+
+// New returns a Store backed by the state ConfigMap in namespace.
+func New(client kubernetes.Interface, namespace string) *Store {
+	return &Store{client: client, namespace: namespace}
+}
+
+// Get returns the value of key and whether it was set.
+func (s *Store) Get(ctx context.Context, key string) (string, bool, error) {
+	if s == nil {
+		return "", false, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, stateTimeout)
+	defer cancel()
+
+	cm, err := s.client.CoreV1().ConfigMaps(s.namespace).Get(ctx, ConfigMapName, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("getting state ConfigMap %s/%s: %w", s.namespace, ConfigMapName, err)
+	}
+
+	value, ok := cm.Data[key]
+	return value, ok, nil
+}
+
+// Set stores value under key, creating the state ConfigMap if required.
+func (s *Store) Set(ctx context.Context, key, value string) error {
+	return s.update(ctx, func(data map[string]string) { data[key] = value })
+}
+
+// Delete removes key. Deleting a key which is not set is not an error.
+func (s *Store) Delete(ctx context.Context, key string) error {
+	return s.update(ctx, func(data map[string]string) { delete(data, key) })
+}
+
+// update applies fn to the ConfigMap's data, creating the ConfigMap first if it does not exist.
+func (s *Store) update(ctx context.Context, fn func(map[string]string)) error {
+	if s == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, stateTimeout)
+	defer cancel()
+
+	// RetryOnConflict expects the error to be returned unwrapped
+	// https://pkg.go.dev/k8s.io/client-go/util/retry@v0.33.0#RetryOnConflict
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, getErr := s.client.CoreV1().ConfigMaps(s.namespace).Get(ctx, ConfigMapName, metav1.GetOptions{})
+		if k8serrors.IsNotFound(getErr) {
+			cm = &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      ConfigMapName,
+					Namespace: s.namespace,
+					Labels:    map[string]string{"app": "eks-env-scaledown"},
+				},
+				Data: make(map[string]string),
+			}
+			fn(cm.Data)
+			_, createErr := s.client.CoreV1().ConfigMaps(s.namespace).Create(ctx, cm, metav1.CreateOptions{})
+			return createErr
+		}
+		if getErr != nil {
+			return getErr
+		}
+
+		if cm.Data == nil {
+			cm.Data = make(map[string]string)
+		}
+		fn(cm.Data)
+
+		_, updateErr := s.client.CoreV1().ConfigMaps(s.namespace).Update(ctx, cm, metav1.UpdateOptions{})
+		return updateErr
+	})
+	if err != nil {
+		return fmt.Errorf("updating state ConfigMap %s/%s: %w", s.namespace, ConfigMapName, err)
+	}
+
+	return nil
+}
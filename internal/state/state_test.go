@@ -0,0 +1,47 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestStore(t *testing.T) {
+	s := New(fake.NewClientset(), "eks-env-scaledown")
+
+	_, ok, err := s.Get(t.Context(), "pagerduty")
+	require.NoError(t, err)
+	assert.False(t, ok, "Expected nothing to be set before the ConfigMap exists")
+
+	require.NoError(t, s.Set(t.Context(), "pagerduty", "PW123"))
+	require.NoError(t, s.Set(t.Context(), "alertmanager", "abc"))
+
+	value, ok, err := s.Get(t.Context(), "pagerduty")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "PW123", value)
+
+	require.NoError(t, s.Delete(t.Context(), "pagerduty"))
+	require.NoError(t, s.Delete(t.Context(), "pagerduty"), "Expected deleting an unset key to succeed")
+
+	_, ok, err = s.Get(t.Context(), "pagerduty")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	value, _, err = s.Get(t.Context(), "alertmanager")
+	require.NoError(t, err)
+	assert.Equal(t, "abc", value, "Expected other keys to be untouched")
+}
+
+func TestNilStoreIsNoOp(t *testing.T) {
+	var s *Store
+
+	require.NoError(t, s.Set(t.Context(), "key", "value"))
+	require.NoError(t, s.Delete(t.Context(), "key"))
+
+	_, ok, err := s.Get(t.Context(), "key")
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
@@ -0,0 +1,34 @@
+package tracing
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+// rateLimiter wraps a client-go rate limiter so that time spent waiting for a token is
+// visible as its own span, separate from the API request itself.
+type rateLimiter struct {
+	flowcontrol.RateLimiter
+}
+
+// NewRateLimiter returns a token bucket rate limiter with the given QPS and burst which records
+// a span for every wait made within a traced operation.
+func NewRateLimiter(qps float32, burst int) flowcontrol.RateLimiter {
+	return &rateLimiter{RateLimiter: flowcontrol.NewTokenBucketRateLimiter(qps, burst)}
+}
+
+// Wait blocks until a token is available. A span is only recorded when the caller is already
+// being traced, to avoid a root span per Kubernetes request.
+func (r *rateLimiter) Wait(ctx context.Context) error {
+	if !trace.SpanFromContext(ctx).IsRecording() {
+		return r.RateLimiter.Wait(ctx)
+	}
+
+	_, span := Start(ctx, "k8s.client.rate_limiter.wait")
+	err := r.RateLimiter.Wait(ctx)
+	End(span, err)
+
+	return err
+}
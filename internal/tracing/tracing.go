@@ -0,0 +1,105 @@
+// Package tracing configures OpenTelemetry tracing for the scale workflow. Spans are exported over
+// OTLP/HTTP when the standard OTEL_* environment variables enable it, otherwise tracing is a no-op.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	log "log/slog"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.40.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	instrumentationName = "github.com/michaelprice232/eks-env-scaledown"
+	defaultServiceName  = "eks-env-scaledown"
+)
+
+// ShutdownFunc flushes any buffered spans and stops the exporter.
+type ShutdownFunc func(context.Context) error
+
+// enabled reports whether the standard OTEL environment variables ask for traces to be exported.
+// An OTLP endpoint must be configured (or OTEL_TRACES_EXPORTER=otlp set explicitly), and neither
+// OTEL_SDK_DISABLED=true nor OTEL_TRACES_EXPORTER=none may be set.
+func enabled() bool {
+	if strings.EqualFold(os.Getenv("OTEL_SDK_DISABLED"), "true") {
+		return false
+	}
+
+	switch strings.ToLower(os.Getenv("OTEL_TRACES_EXPORTER")) {
+	case "none":
+		return false
+	case "otlp":
+		return true
+	}
+
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+// Setup installs the global tracer provider. The exporter, sampler and resource attributes are
+// configured through the standard OTEL_* environment variables. When tracing is not enabled the
+// default no-op provider is left in place and the returned ShutdownFunc does nothing.
+func Setup(ctx context.Context) (ShutdownFunc, error) {
+	if !enabled() {
+		log.Debug("OTLP endpoint not set. Tracing disabled")
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("creating OTLP trace exporter: %w", err)
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES take precedence over the default service name
+	res, err := resource.Merge(
+		resource.NewSchemaless(semconv.ServiceName(defaultServiceName)),
+		resource.Environment(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("building trace resource: %w", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	log.Info("Tracing enabled")
+
+	return tp.Shutdown, nil
+}
+
+// Start begins a span named name as a child of any span in ctx.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End records err (if any) against span and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// WithSpan runs fn within a span named name, recording any error it returns.
+func WithSpan(ctx context.Context, name string, fn func(context.Context) error, attrs ...attribute.KeyValue) error {
+	ctx, span := Start(ctx, name, attrs...)
+	err := fn(ctx)
+	End(span, err)
+
+	return err
+}
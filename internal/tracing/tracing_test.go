@@ -0,0 +1,68 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestEnabled(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      map[string]string
+		expected bool
+	}{
+		{name: "nothing set is disabled", env: map[string]string{}, expected: false},
+		{name: "endpoint set is enabled", env: map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318"}, expected: true},
+		{name: "traces endpoint set is enabled", env: map[string]string{"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT": "http://collector:4318/v1/traces"}, expected: true},
+		{name: "otlp exporter set is enabled", env: map[string]string{"OTEL_TRACES_EXPORTER": "otlp"}, expected: true},
+		{name: "none exporter overrides the endpoint", env: map[string]string{"OTEL_TRACES_EXPORTER": "none", "OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318"}, expected: false},
+		{name: "sdk disabled overrides the endpoint", env: map[string]string{"OTEL_SDK_DISABLED": "true", "OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318"}, expected: false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, key := range []string{"OTEL_SDK_DISABLED", "OTEL_TRACES_EXPORTER", "OTEL_EXPORTER_OTLP_ENDPOINT", "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"} {
+				t.Setenv(key, tc.env[key])
+			}
+
+			assert.Equal(t, tc.expected, enabled())
+		})
+	}
+}
+
+func TestSetupDisabledIsNoOp(t *testing.T) {
+	t.Setenv("OTEL_TRACES_EXPORTER", "none")
+
+	shutdown, err := Setup(context.Background())
+	require.NoError(t, err)
+	assert.NoError(t, shutdown(context.Background()))
+}
+
+func TestWithSpan(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	err := WithSpan(context.Background(), "outer", func(ctx context.Context) error {
+		return WithSpan(ctx, "inner", func(context.Context) error {
+			return errors.New("boom")
+		})
+	})
+	require.Error(t, err)
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 2)
+	assert.Equal(t, "inner", spans[0].Name())
+	assert.Equal(t, codes.Error, spans[0].Status().Code)
+	assert.Equal(t, "outer", spans[1].Name())
+	assert.Equal(t, spans[1].SpanContext().SpanID(), spans[0].Parent().SpanID(), "Expected the inner span to be a child of the outer span")
+}
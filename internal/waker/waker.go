@@ -0,0 +1,503 @@
+// Package waker implements the long-running waker, which serves the environment asleep page and lets developers wake
+// the environment outside of its schedule by triggering a ScaleUp run, following its progress until it is ready.
+package waker
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	log "log/slog"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/michaelprice232/eks-env-scaledown/internal/report"
+
+	"golang.org/x/time/rate"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	defaultAddr      = ":8080"
+	defaultCronJob   = "eks-env-scaledown-up"
+	defaultNamespace = "eks-env-scaledown"
+
+	// jobLabelKey marks the Jobs created by the waker, so an in progress wake up can be found again
+	jobLabelKey = "eks-env-scaledown/waker"
+
+	// resultTTL is how long the outcome of a wake up is shown, before the page reverts to the environment being asleep
+	resultTTL = 30 * time.Minute
+
+	// refreshSeconds is how often the page reloads whilst the environment is waking up
+	refreshSeconds = 10
+
+	requestTimeout = 30 * time.Second
+
+	// sessionCookie is set after a wake up from the page's form, so the page shows the run's errors to the visitor
+	// who supplied the token. It holds its expiry, signed with the token
+	sessionCookie = "eks-env-scaledown-waker"
+	sessionTTL    = 12 * time.Hour
+
+	// wakeInterval and wakeBurst limit the requests to wake the environment, across every visitor, so the token
+	// can't be guessed by brute force
+	wakeInterval = 6 * time.Second
+	wakeBurst    = 5
+)
+
+// The states of the environment shown by the waker.
+const (
+	StateAsleep = "asleep"
+	StateWaking = "waking"
+	StateReady  = "ready"
+	StateFailed = "failed"
+)
+
+// Config holds the waker's settings.
+type Config struct {
+	// Addr is the address the HTTP server listens on
+	Addr string
+
+	// Token must be supplied to wake the environment, either in the page's form or as a bearer token
+	Token string
+
+	// Hosts are the hosts the asleep page is served for. Empty serves every host
+	Hosts []string
+
+	// CronJob is the ScaleUp CronJob which a wake up creates its Job from
+	CronJob string
+
+	// Namespace is where this app runs, holding the CronJob and the run report history
+	Namespace string
+
+	// WakeTime is when the environment is next scheduled to wake, shown on the page
+	WakeTime string
+}
+
+// NewConfig builds the waker's Config from environment variables.
+func NewConfig() (Config, error) {
+	conf := Config{
+		Addr:      os.Getenv("WAKER_ADDR"),
+		Token:     os.Getenv("WAKER_TOKEN"),
+		CronJob:   os.Getenv("WAKER_CRONJOB"),
+		Namespace: os.Getenv("POD_NAMESPACE"),
+		WakeTime:  os.Getenv("MAINTENANCE_PAGE_WAKE_TIME"),
+	}
+	if conf.Token == "" {
+		return conf, fmt.Errorf("WAKER_TOKEN is required")
+	}
+	if conf.Addr == "" {
+		conf.Addr = defaultAddr
+	}
+	if conf.CronJob == "" {
+		conf.CronJob = defaultCronJob
+	}
+	if conf.Namespace == "" {
+		conf.Namespace = defaultNamespace
+	}
+	for _, host := range strings.Split(os.Getenv("WAKER_HOSTS"), ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			conf.Hosts = append(conf.Hosts, strings.ToLower(host))
+		}
+	}
+
+	return conf, nil
+}
+
+// Status is the state of the environment as shown by the waker, with the progress of the latest wake up.
+type Status struct {
+	State           string   `json:"state"`
+	Job             string   `json:"job,omitempty"`
+	PlannedGroups   []int    `json:"plannedGroups,omitempty"`
+	CompletedGroups []int    `json:"completedGroups,omitempty"`
+	Errors          []string `json:"errors,omitempty"`
+	WakeTime        string   `json:"wakeTime,omitempty"`
+}
+
+// public returns the status without the run's errors, which can name the environment's resources, for visitors
+// without the token.
+func (st Status) public() Status {
+	st.Errors = nil
+	return st
+}
+
+// Server serves the asleep page and wakes the environment on an authenticated request.
+type Server struct {
+	conf    Config
+	client  kubernetes.Interface
+	now     func() time.Time
+	limiter *rate.Limiter
+}
+
+// New returns a Server using client to create the ScaleUp Jobs and read their progress.
+func New(conf Config, client kubernetes.Interface) *Server {
+	return &Server{conf: conf, client: client, now: time.Now, limiter: rate.NewLimiter(rate.Every(wakeInterval), wakeBurst)}
+}
+
+// ListenAndServe serves HTTP until ctx is cancelled, then shuts down gracefully.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	srv := &http.Server{Addr: s.conf.Addr, Handler: s.Handler(), ReadHeaderTimeout: requestTimeout}
+
+	errCh := make(chan error, 1)
+	go func() {
+		log.Info("Waker listening", "addr", s.conf.Addr, "hosts", s.conf.Hosts, "cronJob", s.conf.CronJob)
+		errCh <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		return fmt.Errorf("serving HTTP: %w", err)
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("shutting down HTTP server: %w", err)
+	}
+
+	return nil
+}
+
+// Handler returns the waker's HTTP handler.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.Handle("GET /status", s.forHosts(http.HandlerFunc(s.handleStatus)))
+	mux.Handle("POST /wake", s.forHosts(http.HandlerFunc(s.handleWake)))
+	mux.Handle("GET /", s.forHosts(http.HandlerFunc(s.handlePage)))
+
+	return mux
+}
+
+// forHosts only serves the requests for the configured hosts.
+func (s *Server) forHosts(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+
+		if len(s.conf.Hosts) > 0 && !slices.Contains(s.conf.Hosts, strings.ToLower(host)) {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := s.Status(r.Context())
+	if err != nil {
+		log.Error("Getting the environment status", "error", err)
+		http.Error(w, "unable to get the environment status", http.StatusInternalServerError)
+		return
+	}
+	if !s.showsErrors(r) {
+		status = status.public()
+	}
+
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (s *Server) handleWake(w http.ResponseWriter, r *http.Request) {
+	if !s.limiter.Allow() {
+		log.Warn("Rejected wake up request as too many have been made", "remoteAddr", r.RemoteAddr)
+		w.Header().Set("Retry-After", strconv.Itoa(int(wakeInterval.Seconds())))
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+		return
+	}
+
+	bearer := strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !s.authorized(r) {
+		log.Warn("Rejected wake up request with an invalid token", "remoteAddr", r.RemoteAddr)
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	status, err := s.Wake(r.Context())
+	if err != nil {
+		log.Error("Waking the environment", "error", err)
+		http.Error(w, "unable to wake the environment", http.StatusInternalServerError)
+		return
+	}
+
+	// API clients get the status, whilst the page's form is sent back to the page to follow the progress
+	if bearer {
+		writeJSON(w, http.StatusAccepted, status)
+		return
+	}
+	expires := s.now().Add(sessionTTL)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    s.sessionValue(expires),
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteStrictMode,
+	})
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (s *Server) handlePage(w http.ResponseWriter, r *http.Request) {
+	status, err := s.Status(r.Context())
+	if err != nil {
+		log.Error("Getting the environment status", "error", err)
+		http.Error(w, "unable to get the environment status", http.StatusInternalServerError)
+		return
+	}
+
+	if !s.showsErrors(r) {
+		status = status.public()
+	}
+
+	// The asleep page replaces the environment's own pages, which aren't available
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if status.State != StateReady {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err = pageTemplate.Execute(w, pageData{Status: status, Refresh: refreshSeconds}); err != nil {
+		log.Error("Rendering the asleep page", "error", err)
+	}
+}
+
+// authorized reports whether r carries the token, as a bearer token or in the page's form.
+func (s *Server) authorized(r *http.Request) bool {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found {
+		token = r.PostFormValue("token")
+	}
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.conf.Token)) == 1
+}
+
+// showsErrors reports whether r is from a holder of the token, who is shown the errors of a failed wake up.
+func (s *Server) showsErrors(r *http.Request) bool {
+	return s.authorized(r) || s.validSession(r)
+}
+
+// sessionValue returns the session cookie's value expiring at expires, as the expiry in Unix seconds and its HMAC.
+func (s *Server) sessionValue(expires time.Time) string {
+	unix := strconv.FormatInt(expires.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(s.conf.Token))
+	mac.Write([]byte(unix))
+
+	return unix + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// validSession reports whether r carries an unexpired session cookie, set after a wake up from the page's form.
+func (s *Server) validSession(r *http.Request) bool {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return false
+	}
+
+	unix, _, _ := strings.Cut(cookie.Value, ".")
+	expiry, err := strconv.ParseInt(unix, 10, 64)
+	if err != nil || s.now().Unix() >= expiry {
+		return false
+	}
+
+	return hmac.Equal([]byte(cookie.Value), []byte(s.sessionValue(time.Unix(expiry, 0))))
+}
+
+// Wake creates a Job from the ScaleUp CronJob, unless a wake up is already in progress.
+func (s *Server) Wake(ctx context.Context) (Status, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	status, err := s.Status(ctx)
+	if err != nil {
+		return status, err
+	}
+	if status.State == StateWaking {
+		log.Info("Environment is already waking up", "job", status.Job)
+		return status, nil
+	}
+
+	cronJob, err := s.client.BatchV1().CronJobs(s.conf.Namespace).Get(ctx, s.conf.CronJob, metav1.GetOptions{})
+	if err != nil {
+		return status, fmt.Errorf("getting CronJob %s: %w", s.conf.CronJob, err)
+	}
+
+	job, err := s.client.BatchV1().Jobs(s.conf.Namespace).Create(ctx, jobFromCronJob(cronJob, s.now()), metav1.CreateOptions{})
+	if err != nil {
+		return status, fmt.Errorf("creating Job from CronJob %s: %w", s.conf.CronJob, err)
+	}
+	log.Info("Waking the environment", "job", job.Name)
+
+	return Status{State: StateWaking, Job: job.Name, WakeTime: s.conf.WakeTime}, nil
+}
+
+// jobFromCronJob builds a Job from the CronJob's template, as `kubectl create job --from=cronjob` does.
+func jobFromCronJob(cronJob *batchv1.CronJob, now time.Time) *batchv1.Job {
+	labels := make(map[string]string, len(cronJob.Spec.JobTemplate.Labels)+1)
+	for k, v := range cronJob.Spec.JobTemplate.Labels {
+		labels[k] = v
+	}
+	labels[jobLabelKey] = "true"
+
+	annotations := make(map[string]string, len(cronJob.Spec.JobTemplate.Annotations)+1)
+	for k, v := range cronJob.Spec.JobTemplate.Annotations {
+		annotations[k] = v
+	}
+	annotations["cronjob.kubernetes.io/instantiate"] = "manual"
+
+	// A wake up on request goes ahead whatever the calendar of dated overrides says
+	spec := cronJob.Spec.JobTemplate.Spec.DeepCopy()
+	for i := range spec.Template.Spec.Containers {
+		spec.Template.Spec.Containers[i].Env = append(spec.Template.Spec.Containers[i].Env, corev1.EnvVar{Name: "IGNORE_CALENDAR", Value: "true"})
+	}
+
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            fmt.Sprintf("%s-wake-%d", cronJob.Name, now.Unix()),
+			Namespace:       cronJob.Namespace,
+			Labels:          labels,
+			Annotations:     annotations,
+			OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(cronJob, batchv1.SchemeGroupVersion.WithKind("CronJob"))},
+		},
+		Spec: *spec,
+	}
+}
+
+// Status returns the state of the environment, from the latest Job created by the waker and the report of its run.
+func (s *Server) Status(ctx context.Context) (Status, error) {
+	status := Status{State: StateAsleep, WakeTime: s.conf.WakeTime}
+
+	jobs, err := s.client.BatchV1().Jobs(s.conf.Namespace).List(ctx, metav1.ListOptions{LabelSelector: jobLabelKey + "=true"})
+	if err != nil {
+		return status, fmt.Errorf("listing waker Jobs: %w", err)
+	}
+	if len(jobs.Items) == 0 {
+		return status, nil
+	}
+
+	latest := slices.MaxFunc(jobs.Items, func(a, b batchv1.Job) int {
+		return a.CreationTimestamp.Compare(b.CreationTimestamp.Time)
+	})
+
+	state, finishedAt := jobState(&latest)
+	if state != StateWaking && s.now().Sub(finishedAt) > resultTTL {
+		return status, nil
+	}
+	status.State = state
+	status.Job = latest.Name
+
+	reports, err := report.History(ctx, s.client, s.conf.Namespace)
+	if err != nil {
+		return status, err
+	}
+	for _, r := range slices.Backward(reports) {
+		if r.Action != "ScaleUp" || r.StartedAt.Before(latest.CreationTimestamp.Time) {
+			continue
+		}
+
+		status.PlannedGroups = r.PlannedGroups
+		for _, g := range r.Groups {
+			status.CompletedGroups = append(status.CompletedGroups, g.Number)
+		}
+		status.Errors = r.Errors
+		break
+	}
+
+	return status, nil
+}
+
+// jobState maps the conditions of a Job to the state of the environment, along with when the Job finished.
+func jobState(job *batchv1.Job) (string, time.Time) {
+	for _, c := range job.Status.Conditions {
+		if c.Status != corev1.ConditionTrue {
+			continue
+		}
+
+		switch c.Type {
+		case batchv1.JobComplete:
+			return StateReady, c.LastTransitionTime.Time
+		case batchv1.JobFailed:
+			return StateFailed, c.LastTransitionTime.Time
+		}
+	}
+
+	return StateWaking, time.Time{}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error("Writing JSON response", "error", err)
+	}
+}
+
+type pageData struct {
+	Status
+	Refresh int
+}
+
+var pageTemplate = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>Environment asleep</title>
+{{- if or (eq .State "waking") (eq .State "ready") }}
+<meta http-equiv="refresh" content="{{ .Refresh }}">
+{{- end }}
+</head>
+<body>
+{{- if eq .State "waking" }}
+<h1>The environment is waking up</h1>
+{{- if .PlannedGroups }}
+<p>Scaled up {{ len .CompletedGroups }} of {{ len .PlannedGroups }} startup group(s).</p>
+<ul>
+{{- range .CompletedGroups }}
+<li>Group {{ . }} ready</li>
+{{- end }}
+</ul>
+{{- else }}
+<p>Preparing the environment.</p>
+{{- end }}
+<p>This page refreshes every {{ .Refresh }} seconds.</p>
+{{- else if eq .State "ready" }}
+<h1>The environment is awake</h1>
+<p>This page will be replaced by the environment shortly.</p>
+{{- else }}
+{{- if eq .State "failed" }}
+<h1>The environment failed to wake up</h1>
+{{- if .Errors }}
+<ul>
+{{- range .Errors }}
+<li>{{ . }}</li>
+{{- end }}
+</ul>
+{{- else }}
+<p>Try again, or contact the environment's owners.</p>
+{{- end }}
+{{- else }}
+<h1>This environment is asleep</h1>
+{{- if .WakeTime }}
+<p>It is scheduled to wake at {{ .WakeTime }}.</p>
+{{- end }}
+{{- end }}
+<form method="post" action="/wake">
+<label>Token <input type="password" name="token"></label>
+<button type="submit">Wake up now</button>
+</form>
+{{- end }}
+</body>
+</html>
+`))
@@ -0,0 +1,290 @@
+package waker
+
+import (
+	"encoding/json"
+	"io"
+	log "log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/michaelprice232/eks-env-scaledown/internal/report"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const testToken = "s3cret"
+
+func newTestServer(t *testing.T, hosts ...string) (*Server, *fake.Clientset) {
+	t.Helper()
+	log.SetDefault(log.New(log.NewJSONHandler(io.Discard, nil)))
+
+	client := fake.NewClientset(&batchv1.CronJob{
+		ObjectMeta: metav1.ObjectMeta{Name: defaultCronJob, Namespace: defaultNamespace},
+		Spec: batchv1.CronJobSpec{JobTemplate: batchv1.JobTemplateSpec{
+			ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "eks-env-scaledown"}},
+			Spec: batchv1.JobSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "app", Env: []corev1.EnvVar{{Name: "SCALE_ACTION", Value: "ScaleUp"}}}},
+			}}},
+		}},
+	})
+	conf := Config{Token: testToken, Hosts: hosts, CronJob: defaultCronJob, Namespace: defaultNamespace, WakeTime: "07:00 UTC"}
+
+	return New(conf, client), client
+}
+
+func wakeRequest(form url.Values, bearer string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/wake", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	return req
+}
+
+func TestNewConfig(t *testing.T) {
+	t.Run("token is required", func(t *testing.T) {
+		t.Setenv("WAKER_TOKEN", "")
+
+		_, err := NewConfig()
+		assert.Error(t, err)
+	})
+
+	t.Run("defaults", func(t *testing.T) {
+		t.Setenv("WAKER_TOKEN", testToken)
+		t.Setenv("WAKER_HOSTS", "Staging.example.com, api.staging.example.com")
+		t.Setenv("POD_NAMESPACE", "")
+
+		conf, err := NewConfig()
+		require.NoError(t, err)
+		assert.Equal(t, defaultAddr, conf.Addr)
+		assert.Equal(t, defaultCronJob, conf.CronJob)
+		assert.Equal(t, defaultNamespace, conf.Namespace)
+		assert.Equal(t, []string{"staging.example.com", "api.staging.example.com"}, conf.Hosts)
+	})
+}
+
+func TestWake(t *testing.T) {
+	tests := []struct {
+		name       string
+		form       url.Values
+		bearer     string
+		wantCode   int
+		wantJob    bool
+		wantCookie bool
+	}{
+		{name: "no token", form: url.Values{}, wantCode: http.StatusUnauthorized},
+		{name: "wrong token", form: url.Values{"token": {"wrong"}}, wantCode: http.StatusUnauthorized},
+		{name: "form token", form: url.Values{"token": {testToken}}, wantCode: http.StatusSeeOther, wantJob: true, wantCookie: true},
+		{name: "bearer token", bearer: testToken, wantCode: http.StatusAccepted, wantJob: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s, client := newTestServer(t)
+
+			rec := httptest.NewRecorder()
+			s.Handler().ServeHTTP(rec, wakeRequest(tc.form, tc.bearer))
+			assert.Equal(t, tc.wantCode, rec.Code)
+
+			cookies := rec.Result().Cookies()
+			if tc.wantCookie {
+				require.Len(t, cookies, 1)
+				assert.Equal(t, sessionCookie, cookies[0].Name)
+				assert.True(t, cookies[0].HttpOnly)
+				assert.Equal(t, http.SameSiteStrictMode, cookies[0].SameSite)
+			} else {
+				assert.Empty(t, cookies)
+			}
+
+			jobs, err := client.BatchV1().Jobs(defaultNamespace).List(t.Context(), metav1.ListOptions{})
+			require.NoError(t, err)
+			if !tc.wantJob {
+				assert.Empty(t, jobs.Items)
+				return
+			}
+
+			require.Len(t, jobs.Items, 1)
+			job := jobs.Items[0]
+			assert.Equal(t, "true", job.Labels[jobLabelKey])
+			assert.Equal(t, "eks-env-scaledown", job.Labels["app"])
+			assert.Equal(t, "ScaleUp", job.Spec.Template.Spec.Containers[0].Env[0].Value)
+			assert.Contains(t, job.Spec.Template.Spec.Containers[0].Env, corev1.EnvVar{Name: "IGNORE_CALENDAR", Value: "true"})
+			assert.Equal(t, defaultCronJob, job.OwnerReferences[0].Name)
+		})
+	}
+
+	t.Run("a wake up in progress is reused", func(t *testing.T) {
+		s, client := newTestServer(t)
+
+		first, err := s.Wake(t.Context())
+		require.NoError(t, err)
+		second, err := s.Wake(t.Context())
+		require.NoError(t, err)
+		assert.Equal(t, first.Job, second.Job)
+
+		jobs, err := client.BatchV1().Jobs(defaultNamespace).List(t.Context(), metav1.ListOptions{})
+		require.NoError(t, err)
+		assert.Len(t, jobs.Items, 1)
+	})
+}
+
+func TestWakeRateLimit(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	for range wakeBurst {
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, wakeRequest(url.Values{"token": {"guess"}}, ""))
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	}
+
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, wakeRequest(url.Values{"token": {testToken}}, ""))
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code, "Expected the requests beyond the limit to be rejected, even with the token")
+	assert.NotEmpty(t, rec.Header().Get("Retry-After"))
+}
+
+func TestStatus(t *testing.T) {
+	s, client := newTestServer(t)
+	now := time.Date(2026, 1, 1, 22, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	status, err := s.Status(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, StateAsleep, status.State)
+
+	woken, err := s.Wake(t.Context())
+	require.NoError(t, err)
+
+	// The fake clientset doesn't set the creation time, so set it to when the Job was created
+	job, err := client.BatchV1().Jobs(defaultNamespace).Get(t.Context(), woken.Job, metav1.GetOptions{})
+	require.NoError(t, err)
+	job.CreationTimestamp = metav1.NewTime(now)
+	job, err = client.BatchV1().Jobs(defaultNamespace).Update(t.Context(), job, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	// An earlier run isn't mistaken for the progress of this one
+	earlier := report.New("ScaleUp")
+	earlier.StartedAt = now.Add(-24 * time.Hour)
+	earlier.SetPlannedGroups([]int{5})
+	require.NoError(t, earlier.Save(client, defaultNamespace, 5))
+
+	running := report.New("ScaleUp")
+	running.StartedAt = now.Add(time.Minute)
+	running.SetPlannedGroups([]int{0, 1, 100})
+	running.AddGroup(0, time.Minute, 2)
+	require.NoError(t, running.Save(client, defaultNamespace, 5))
+
+	status, err = s.Status(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, Status{State: StateWaking, Job: woken.Job, PlannedGroups: []int{0, 1, 100}, CompletedGroups: []int{0}, WakeTime: "07:00 UTC"}, status)
+
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Contains(t, rec.Body.String(), "Scaled up 1 of 3 startup group(s)")
+
+	// Once the Job has completed the environment is ready, until the result expires
+	job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: corev1.ConditionTrue, LastTransitionTime: metav1.NewTime(now)}}
+	_, err = client.BatchV1().Jobs(defaultNamespace).UpdateStatus(t.Context(), job, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	rec = httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+	assert.Equal(t, StateReady, status.State)
+
+	now = now.Add(resultTTL + time.Minute)
+	status, err = s.Status(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, StateAsleep, status.State)
+}
+
+func TestStatusHidesErrors(t *testing.T) {
+	s, client := newTestServer(t)
+	now := time.Date(2026, 1, 1, 22, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	woken, err := s.Wake(t.Context())
+	require.NoError(t, err)
+	job, err := client.BatchV1().Jobs(defaultNamespace).Get(t.Context(), woken.Job, metav1.GetOptions{})
+	require.NoError(t, err)
+	job.CreationTimestamp = metav1.NewTime(now)
+	job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobFailed, Status: corev1.ConditionTrue, LastTransitionTime: metav1.NewTime(now)}}
+	_, err = client.BatchV1().Jobs(defaultNamespace).Update(t.Context(), job, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	const runErr = "starting databases: arn:aws:rds:eu-west-1:123456789012:db:orders: access denied"
+	failed := report.New("ScaleUp")
+	failed.StartedAt = now.Add(time.Minute)
+	failed.AddError(runErr)
+	require.NoError(t, failed.Save(client, defaultNamespace, 5))
+
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Contains(t, rec.Body.String(), "The environment failed to wake up")
+	assert.NotContains(t, rec.Body.String(), "arn:aws:rds", "Expected the errors to be hidden from the public page")
+
+	var status Status
+	rec = httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+	assert.Equal(t, StateFailed, status.State)
+	assert.Empty(t, status.Errors, "Expected the errors to be hidden without the token")
+
+	req := httptest.NewRequest(http.MethodGet, "/status", nil)
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	rec = httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+	assert.Equal(t, []string{runErr}, status.Errors)
+
+	// The session cookie set by a wake up from the page's form shows the errors on the page
+	page := func(value string) string {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(&http.Cookie{Name: sessionCookie, Value: value})
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, req)
+		return rec.Body.String()
+	}
+	assert.Contains(t, page(s.sessionValue(now.Add(time.Hour))), "arn:aws:rds")
+	assert.NotContains(t, page(s.sessionValue(now.Add(-time.Minute))), "arn:aws:rds", "Expected an expired session to be rejected")
+	forged, _, _ := strings.Cut(s.sessionValue(now.Add(time.Hour)), ".")
+	assert.NotContains(t, page(forged+".00"), "arn:aws:rds", "Expected a session without a valid signature to be rejected")
+}
+
+func TestHosts(t *testing.T) {
+	s, _ := newTestServer(t, "staging.example.com")
+
+	tests := []struct {
+		name     string
+		host     string
+		path     string
+		wantCode int
+	}{
+		{name: "configured host", host: "staging.example.com", path: "/", wantCode: http.StatusServiceUnavailable},
+		{name: "configured host with a port", host: "Staging.example.com:8080", path: "/", wantCode: http.StatusServiceUnavailable},
+		{name: "other host", host: "prod.example.com", path: "/", wantCode: http.StatusNotFound},
+		{name: "health check from any host", host: "10.0.0.1:8080", path: "/healthz", wantCode: http.StatusOK},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			req.Host = tc.host
+
+			rec := httptest.NewRecorder()
+			s.Handler().ServeHTTP(rec, req)
+			assert.Equal(t, tc.wantCode, rec.Code)
+		})
+	}
+}